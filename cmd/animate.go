@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/kiesman99/stitch/pkg/stitch"
+	"github.com/kiesman99/stitch/pkg/tile"
+)
+
+// runAnimation writes an animated GIF of the centered area zooming from
+// --zoom-from to --zoom-to
+func runAnimation(ctx context.Context, urls []string, lat, lon float64, width, height int) error {
+	fps := viper.GetFloat64("fps")
+	if fps <= 0 {
+		return fmt.Errorf("--fps must be positive")
+	}
+	zoomFrom, zoomTo := viper.GetInt("zoom-from"), viper.GetInt("zoom-to")
+	if zoomFrom < 0 || zoomTo < 0 {
+		return fmt.Errorf("zoom levels must not be negative")
+	}
+
+	legacy, err := stitchOptions(true, tile.OUTFMT_PNG)
+	if err != nil {
+		return err
+	}
+	resampling, err := stitch.ParseResampling(viper.GetString("resampling"))
+	if err != nil {
+		return fmt.Errorf("--resampling: %v", err)
+	}
+	if legacy.Output == "" && !legacy.Force {
+		if stat, err := os.Stdout.Stat(); err == nil && stat.Mode()&os.ModeCharDevice != 0 {
+			return fmt.Errorf("didn't specify output file and standard output is a terminal (use --force to write anyway)")
+		}
+	}
+
+	opts := libraryOptions(legacy, urls)
+	opts.Mode = stitch.ModeCentered
+	opts.CenterLat, opts.CenterLon = lat, lon
+	opts.Width, opts.Height = width, height
+	opts.Resampling = resampling
+
+	fmt.Fprintf(tile.Log, "==Animating zoom %d to %d at %g fps\n", zoomFrom, zoomTo, fps)
+	data, err := stitch.New().AnimateCentered(ctx, opts, stitch.AnimationOptions{
+		ZoomFrom:   zoomFrom,
+		ZoomTo:     zoomTo,
+		FrameDelay: time.Duration(float64(time.Second) / fps),
+	})
+	if err != nil {
+		return err
+	}
+
+	if legacy.Output == "" {
+		fmt.Fprintf(tile.Log, "Output GIF: stdout\n")
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	fmt.Fprintf(tile.Log, "Output GIF: %s\n", legacy.Output)
+	return os.WriteFile(legacy.Output, data, 0644)
+}
+
+// libraryOptions returns the options of the stitch library for the tile
+// source and image settings of the command line
+func libraryOptions(legacy *tile.StitchOptions, urls []string) *stitch.Options {
+	opts := &stitch.Options{
+		TileURLs:        urls,
+		TileSize:        legacy.TileSize,
+		Headers:         legacy.Headers,
+		BearerToken:     legacy.BearerToken,
+		UserAgent:       legacy.UserAgent,
+		Referer:         legacy.Referer,
+		Origin:          legacy.Origin,
+		RequestMethod:   legacy.Method,
+		RequestBody:     legacy.Body,
+		BackgroundColor: legacy.Background,
+		DrawTileGrid:    legacy.Grid,
+		GridColor:       legacy.GridColor,
+		GridLabels:      legacy.GridLabels,
+		MaxPixels:       legacy.MaxPixels,
+		MaxFailureRatio: legacy.MaxFailureRatio,
+		MaxFailedTiles:  legacy.MaxFailedTiles,
+		Logger:          legacy.Logger,
+	}
+	if legacy.Proxy != nil {
+		opts.ProxyURL = legacy.Proxy.String()
+	}
+	opts.InsecureSkipVerify = legacy.Insecure
+	if legacy.BasicAuth != "" {
+		username, password, _ := strings.Cut(legacy.BasicAuth, ":")
+		opts.BasicAuth = &stitch.BasicAuth{Username: username, Password: password}
+	}
+	return opts
+}
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/kiesman99/stitch/pkg/stitch"
+	"github.com/kiesman99/stitch/pkg/tile"
+)
+
+// runContactSheet writes the tiles of the bounding box, or of the centered
+// area when bbox is nil, as a labeled grid instead of stitching them
+func runContactSheet(ctx context.Context, urls []string, zoom int, bbox *tile.BoundingBox, centered *tile.CenteredRequest) error {
+	legacy, err := stitchOptions(centered != nil, tile.OUTFMT_PNG)
+	if err != nil {
+		return err
+	}
+	if legacy.Output == "" && !legacy.Force {
+		if stat, err := os.Stdout.Stat(); err == nil && stat.Mode()&os.ModeCharDevice != 0 {
+			return fmt.Errorf("didn't specify output file and standard output is a terminal (use --force to write anyway)")
+		}
+	}
+
+	opts := libraryOptions(legacy, urls)
+	if bbox != nil {
+		opts.Mode = stitch.ModeBBox
+		opts.MinLat, opts.MinLon, opts.MaxLat, opts.MaxLon = bbox.MinLat, bbox.MinLon, bbox.MaxLat, bbox.MaxLon
+	} else {
+		opts.Mode = stitch.ModeCentered
+		opts.CenterLat, opts.CenterLon = centered.Lat, centered.Lon
+		opts.Width, opts.Height = centered.Width, centered.Height
+	}
+	opts.Zoom = zoom
+
+	fmt.Fprintf(tile.Log, "==Contact sheet of zoom %d\n", zoom)
+	result, err := stitch.New().ContactSheet(ctx, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(tile.Log, "Contact sheet: %d of %d tiles downloaded, %dx%d pixels\n", result.SuccessfulTiles, result.TotalTiles, result.Width, result.Height)
+
+	if legacy.Output == "" {
+		fmt.Fprintf(tile.Log, "Output PNG: stdout\n")
+		_, err = os.Stdout.Write(result.ImageData)
+		return err
+	}
+	fmt.Fprintf(tile.Log, "Output PNG: %s\n", legacy.Output)
+	return os.WriteFile(legacy.Output, result.ImageData, 0644)
+}
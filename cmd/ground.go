@@ -0,0 +1,12 @@
+package cmd
+
+import (
+	"github.com/kiesman99/stitch/pkg/stitch"
+)
+
+// groundSize converts --width-meters and --height-meters around lat to the
+// image size in pixels of Web Mercator tiles of tileSize pixels at zoom
+func groundSize(widthMeters, heightMeters, lat float64, zoom, tileSize int) (int, int) {
+	width, height := stitch.MetersToPixels(widthMeters, heightMeters, lat, zoom, tileSize, stitch.CRSWebMercator)
+	return max(width, 1), max(height, 1)
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/kiesman99/stitch/internal/stitch"
+	"github.com/spf13/viper"
+)
+
+// newLogger returns a logger writing to w at level (debug, info, warn or
+// error) in format (text or json)
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("--log-level must be debug, info, warn or error")
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("--log-format must be text or json")
+	}
+}
+
+// logFormatChanged reports whether --log-format was given; init sets it, as
+// rootCmd can't be referenced from code rootCmd itself reaches
+var logFormatChanged func() bool
+
+// cliLogger returns the logger of a stitch run on stderr. With JSON progress
+// the logs are JSON too, unless --log-format says otherwise, so every line on
+// stderr stays parseable.
+func cliLogger() (*slog.Logger, error) {
+	format := viper.GetString("log-format")
+	if viper.GetString("progress") == stitch.ProgressJSON && !logFormatChanged() {
+		format = "json"
+	}
+	return newLogger(os.Stderr, logLevel(), format)
+}
+
+// logLevel returns the level of the stitch logs: --quiet lets only errors
+// through and --verbose adds the debug records with the stitch geometry
+func logLevel() string {
+	switch {
+	case viper.GetBool("quiet"):
+		return "error"
+	case viper.GetBool("verbose"):
+		return "debug"
+	}
+	return viper.GetString("log-level")
+}
+
+// progressMode returns the --progress mode, which --quiet turns off
+func progressMode() string {
+	if viper.GetBool("quiet") {
+		return stitch.ProgressNone
+	}
+	return viper.GetString("progress")
+}
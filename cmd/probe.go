@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/kiesman99/stitch/pkg/tile"
+)
+
+var probeCmd = &cobra.Command{
+	Use:   "probe",
+	Short: "Fetch a single tile to check a URL template",
+	Long: `Fetch the tile containing a point and report the HTTP status, content
+type and decoded image size, to diagnose authentication problems or a wrong
+tile size before starting a large stitch.
+
+Examples:
+  # Check a tile source at zoom 10
+  stitch probe --url http://a.tile.openstreetmap.org/{z}/{x}/{y}.png --zoom 10 --lat 37.77 --lon -122.42
+
+  # Check a retina source
+  stitch probe --url https://tiles.example.com/{z}/{x}/{y}@2x.png --zoom 10 --tilesize 512`,
+	RunE: runProbe,
+}
+
+func init() {
+	rootCmd.AddCommand(probeCmd)
+
+	probeCmd.Flags().StringP("url", "u", "", "tile URL template with {z}, {x}, {y} placeholders (required)")
+	probeCmd.Flags().IntP("zoom", "z", 0, "zoom level")
+	probeCmd.Flags().Float64("lat", 0, "latitude of the point whose tile is fetched")
+	probeCmd.Flags().Float64("lon", 0, "longitude of the point whose tile is fetched")
+	probeCmd.Flags().IntP("tilesize", "t", 256, "expected tile size in pixels")
+	probeCmd.Flags().String("user-agent", tile.DefaultUserAgent, "HTTP User-Agent header")
+
+	viper.BindPFlag("probe.url", probeCmd.Flags().Lookup("url"))
+	viper.BindPFlag("probe.zoom", probeCmd.Flags().Lookup("zoom"))
+	viper.BindPFlag("probe.lat", probeCmd.Flags().Lookup("lat"))
+	viper.BindPFlag("probe.lon", probeCmd.Flags().Lookup("lon"))
+	viper.BindPFlag("probe.tilesize", probeCmd.Flags().Lookup("tilesize"))
+	viper.BindPFlag("probe.user-agent", probeCmd.Flags().Lookup("user-agent"))
+}
+
+func runProbe(cmd *cobra.Command, args []string) error {
+	template := viper.GetString("probe.url")
+	if template == "" {
+		return fmt.Errorf("a tile URL is required (use --url)")
+	}
+	if err := tile.ValidateTemplate(template); err != nil {
+		return err
+	}
+
+	return probeTile(cmd.Context(), cmd.OutOrStdout(), tile.NewProcessor(viper.GetString("probe.user-agent")),
+		template, viper.GetInt("probe.zoom"), viper.GetFloat64("probe.lat"), viper.GetFloat64("probe.lon"),
+		viper.GetInt("probe.tilesize"))
+}
+
+// probeTile fetches the tile containing lat/lon and writes a report to out.
+// It fails if the tile can't be used for stitching.
+func probeTile(ctx context.Context, out io.Writer, processor *tile.Processor, template string, zoom int, lat, lon float64, tileSize int) error {
+	if zoom < 0 || zoom > 32 {
+		return fmt.Errorf("zoom %d out of range", zoom)
+	}
+
+	x, y := tile.LatLonToTile(lat, lon, zoom)
+	url := tile.BuildURL(template, zoom, x, y)
+
+	result, err := processor.Probe(ctx, url)
+	if err != nil {
+		return fmt.Errorf("can't retrieve %s: %v", url, err)
+	}
+
+	fmt.Fprintf(out, "URL:          %s\n", result.URL)
+	fmt.Fprintf(out, "Status:       %s\n", result.StatusText)
+	fmt.Fprintf(out, "Content-Type: %s\n", result.ContentType)
+	fmt.Fprintf(out, "Bytes:        %d\n", result.Bytes)
+
+	if result.Status != http.StatusOK {
+		return fmt.Errorf("tile request failed: %s", result.StatusText)
+	}
+	if result.DecodeError != nil {
+		fmt.Fprintf(out, "Image:        can't decode: %v\n", result.DecodeError)
+		return fmt.Errorf("tile isn't in a supported image format")
+	}
+
+	img := result.Image
+	fmt.Fprintf(out, "Image:        %dx%d, %d channels\n", img.Width, img.Height, img.Depth)
+	if img.Width != tileSize || img.Height != tileSize {
+		fmt.Fprintf(out, "Tile size:    mismatch, expected %dx%d\n", tileSize, tileSize)
+		return fmt.Errorf("got %dx%d tile, not %d (see --tilesize)", img.Width, img.Height, tileSize)
+	}
+	fmt.Fprintf(out, "Tile size:    OK\n")
+	return nil
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kiesman99/stitch/pkg/tile"
+)
+
+func TestProbeTile(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 256, 256))); err != nil {
+		t.Fatalf("Failed to encode tile: %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(encoded.Bytes())
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		name      string
+		tileSize  int
+		expected  []string
+		expectErr bool
+	}{
+		{
+			name:     "Matching tile size",
+			tileSize: 256,
+			expected: []string{
+				"URL:          " + server.URL + "/10/163/395.png",
+				"Status:       200 OK",
+				"Content-Type: image/png",
+				"Image:        256x256, 4 channels",
+				"Tile size:    OK",
+			},
+		},
+		{
+			name:      "Retina tile size expected",
+			tileSize:  512,
+			expected:  []string{"Tile size:    mismatch, expected 512x512"},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := probeTile(context.Background(), &out, tile.NewProcessor("stitch-test/1.0"),
+				server.URL+"/{z}/{x}/{y}.png", 10, 37.77, -122.42, tc.tileSize)
+			if tc.expectErr && err == nil {
+				t.Error("Expected an error")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+			for _, line := range tc.expected {
+				if !strings.Contains(out.String(), line+"\n") {
+					t.Errorf("Expected output to contain %q, got:\n%s", line, out.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/viper"
+
+	"github.com/kiesman99/stitch/pkg/stitch"
+	"github.com/kiesman99/stitch/pkg/tile"
+)
+
+// runPyramid writes the tiles of the bounding box at every zoom level from
+// --zoom-from to --zoom-to to the --pyramid directory as z/x/y files
+func runPyramid(ctx context.Context, urls []string, minLat, minLon, maxLat, maxLon float64, zoomFrom, zoomTo int) error {
+	dir := viper.GetString("pyramid")
+	if zoomFrom < 0 || zoomTo < 0 {
+		return fmt.Errorf("zoom levels must not be negative")
+	}
+	concurrency := viper.GetInt("pyramid-concurrency")
+	if concurrency < 1 {
+		return fmt.Errorf("--pyramid-concurrency must be at least 1")
+	}
+	maxTiles := viper.GetInt("pyramid-max-tiles")
+	if maxTiles < 0 {
+		return fmt.Errorf("--pyramid-max-tiles must not be negative")
+	}
+
+	legacy, err := stitchOptions(false, tile.OUTFMT_PNG)
+	if err != nil {
+		return err
+	}
+
+	opts := libraryOptions(legacy, urls)
+	opts.Mode = stitch.ModeBBox
+	opts.MinLat, opts.MinLon, opts.MaxLat, opts.MaxLon = minLat, minLon, maxLat, maxLon
+	opts.Concurrency = concurrency
+	opts.MaxTiles = maxTiles
+
+	fmt.Fprintf(tile.Log, "==Exporting zoom %d to %d to '%s'\n", zoomFrom, zoomTo, dir)
+	result, err := stitch.New().ExportPyramid(ctx, opts, stitch.PyramidOptions{
+		ZoomFrom: zoomFrom,
+		ZoomTo:   zoomTo,
+		Dir:      dir,
+		Reencode: viper.GetBool("pyramid-png"),
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(tile.Log, "Pyramid: %d of %d tiles downloaded\n", result.SuccessfulTiles, result.TotalTiles)
+	return nil
+}
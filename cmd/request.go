@@ -0,0 +1,244 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+
+	"github.com/kiesman99/stitch/internal/api"
+)
+
+// coordinateKeys are the settings that select the area; a request file's area
+// is ignored when any of them is given on the command line
+var coordinateKeys = []string{"bbox", "min-lat", "min-lon", "max-lat", "max-lon", "lat", "lon", "width", "height", "tile-range"}
+
+// requestFile is a stitch request in the JSON shape of the server's
+// StitchRequest
+type requestFile struct {
+	api.StitchRequest
+
+	// The API types hold coordinates as float32, which would shift the area
+	// by up to a meter; the file's coordinates are kept at full precision
+	area struct {
+		Bbox *struct {
+			MinLat float64 `json:"min_lat"`
+			MinLon float64 `json:"min_lon"`
+			MaxLat float64 `json:"max_lat"`
+			MaxLon float64 `json:"max_lon"`
+		} `json:"bbox"`
+		Center *struct {
+			Lat float64 `json:"lat"`
+			Lon float64 `json:"lon"`
+		} `json:"center"`
+	}
+}
+
+// readRequestFile reads a stitch request from a JSON or YAML file
+func readRequestFile(path string) (*requestFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// YAML is a superset of JSON, so both go through the YAML decoder and are
+	// converted to JSON for the generated types
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("can't parse request file %s: %v", path, err)
+	}
+	data, err = json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse request file %s: %v", path, err)
+	}
+
+	var req requestFile
+	if err := json.Unmarshal(data, &req.StitchRequest); err != nil {
+		return nil, fmt.Errorf("invalid request file %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &req.area); err != nil {
+		return nil, fmt.Errorf("invalid request file %s: %v", path, err)
+	}
+	return &req, nil
+}
+
+// requestSettings converts a stitch request to the settings of the
+// corresponding command line flags
+func requestSettings(req *requestFile) (map[string]interface{}, error) {
+	settings := map[string]interface{}{}
+
+	switch req.Mode {
+	case api.Bbox:
+		bbox := req.area.Bbox
+		if bbox == nil {
+			return nil, fmt.Errorf("mode bbox requires a bbox")
+		}
+		settings["bbox"] = fmt.Sprintf("%s,%s,%s,%s", formatCoordinate(bbox.MinLat), formatCoordinate(bbox.MinLon),
+			formatCoordinate(bbox.MaxLat), formatCoordinate(bbox.MaxLon))
+		settings["bbox-order"] = bboxOrderLatLon
+	case api.Centered:
+		if req.area.Center == nil || req.Center == nil {
+			return nil, fmt.Errorf("mode centered requires a center")
+		}
+		settings["lat"] = req.area.Center.Lat
+		settings["lon"] = req.area.Center.Lon
+		if req.Center.Width != nil {
+			settings["width"] = *req.Center.Width
+		}
+		if req.Center.Height != nil {
+			settings["height"] = *req.Center.Height
+		}
+		if req.Center.WidthMeters != nil {
+			settings["width-meters"] = *req.Center.WidthMeters
+		}
+		if req.Center.HeightMeters != nil {
+			settings["height-meters"] = *req.Center.HeightMeters
+		}
+	case api.Tilerange:
+		r := req.TileRange
+		if r == nil {
+			return nil, fmt.Errorf("mode tilerange requires a tile_range")
+		}
+		settings["tile-range"] = fmt.Sprintf("%d,%d,%d,%d,%d", req.Zoom, r.MinX, r.MinY, r.MaxX, r.MaxY)
+	case "":
+	default:
+		return nil, fmt.Errorf("unknown mode %q", req.Mode)
+	}
+
+	if req.Zoom != 0 {
+		settings["zoom"] = req.Zoom
+	}
+
+	// Layers are stitched as additional URLs on top of the tile source
+	var urls []string
+	if req.TileSource.Url != "" {
+		urls = append(urls, req.TileSource.Url)
+	}
+	if req.Layers != nil {
+		for _, layer := range *req.Layers {
+			urls = append(urls, layer.Url)
+		}
+	}
+	if len(urls) > 0 {
+		settings["url"] = urls
+	}
+
+	if req.TileSource.Headers != nil {
+		headers := make([]string, 0, len(*req.TileSource.Headers))
+		for name, value := range *req.TileSource.Headers {
+			headers = append(headers, name+": "+value)
+		}
+		sort.Strings(headers)
+		settings["header"] = headers
+	}
+	if auth := req.TileSource.BasicAuth; auth != nil {
+		settings["basic-auth"] = auth.Username + ":" + auth.Password
+	}
+	if req.TileSource.BearerToken != nil {
+		settings["bearer"] = *req.TileSource.BearerToken
+	}
+	if req.TileSource.UserAgent != nil {
+		settings["user-agent"] = *req.TileSource.UserAgent
+	}
+	if req.TileSource.Referer != nil {
+		settings["referer"] = *req.TileSource.Referer
+	}
+	if req.TileSource.Origin != nil {
+		settings["origin"] = *req.TileSource.Origin
+	}
+	if req.TileSource.ProxyUrl != nil {
+		settings["proxy"] = *req.TileSource.ProxyUrl
+	}
+	if req.TileSource.Method != nil {
+		settings["method"] = string(*req.TileSource.Method)
+	}
+	if req.TileSource.Body != nil {
+		settings["body"] = *req.TileSource.Body
+	}
+
+	if out := req.Output; out != nil {
+		if out.Format != nil {
+			settings["format"] = string(*out.Format)
+		}
+		if out.TileSize != nil {
+			settings["tilesize"] = int(*out.TileSize)
+		}
+		if out.GenerateWorldfile != nil {
+			settings["worldfile"] = *out.GenerateWorldfile
+		}
+		if out.Background != nil {
+			settings["background"] = *out.Background
+		}
+		if out.Crop != nil {
+			settings["crop"] = string(*out.Crop)
+		}
+		if out.MaxFailureRatio != nil {
+			settings["max-failure-ratio"] = float64(*out.MaxFailureRatio)
+		}
+		if out.MaxFailedTiles != nil {
+			settings["max-tile-failures"] = *out.MaxFailedTiles
+		}
+	}
+
+	return settings, nil
+}
+
+// applyRequestFile loads a request file into viper. Flags given on the
+// command line take precedence over the file.
+func applyRequestFile(cmd *cobra.Command, path string) error {
+	req, err := readRequestFile(path)
+	if err != nil {
+		return err
+	}
+	settings, err := requestSettings(req)
+	if err != nil {
+		return fmt.Errorf("invalid request file %s: %v", path, err)
+	}
+
+	// Coordinates on the command line replace the file's area as a whole,
+	// rather than mixing e.g. a bbox from the file with --lat from the flags
+	for _, key := range coordinateKeys {
+		if cmd.Flags().Changed(key) {
+			for _, key := range coordinateKeys {
+				delete(settings, key)
+			}
+			delete(settings, "bbox-order")
+			break
+		}
+	}
+
+	for key, value := range settings {
+		if !cmd.Flags().Changed(key) {
+			viper.Set(key, value)
+		}
+	}
+	return nil
+}
+
+// parseHeaders parses "Name: Value" header flags
+func parseHeaders(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	headers := make(map[string]string, len(values))
+	for _, value := range values {
+		name, val, ok := strings.Cut(value, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid header %q (use 'Name: Value')", value)
+		}
+		headers[name] = strings.TrimSpace(val)
+	}
+	return headers, nil
+}
+
+// formatCoordinate formats a coordinate with the digits it was given with
+func formatCoordinate(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/kiesman99/stitch/pkg/tile"
+)
+
+func TestApplyRequestFile(t *testing.T) {
+	job := `mode: bbox
+bbox:
+  min_lat: 37.371794
+  min_lon: -122.917099
+  max_lat: 38.226853
+  max_lon: -121.564407
+zoom: 10
+tile_source:
+  url: https://tile.test/{z}/{x}/{y}.png
+  headers:
+    X-Api-Key: secret
+layers:
+  - url: https://overlay.test/{z}/{x}/{y}.png
+output:
+  format: png
+  tile_size: 512
+  generate_worldfile: true
+`
+	path := filepath.Join(t.TempDir(), "job.yaml")
+	if err := os.WriteFile(path, []byte(job), 0644); err != nil {
+		t.Fatalf("Failed to write request file: %v", err)
+	}
+
+	for _, key := range []string{"bbox", "bbox-order", "zoom", "url", "header", "format", "tilesize", "worldfile"} {
+		t.Cleanup(func() { viper.Set(key, nil) })
+	}
+
+	// --zoom on the command line overrides the file
+	cmd := &cobra.Command{}
+	cmd.Flags().Int("zoom", 0, "")
+	if err := cmd.Flags().Set("zoom", "12"); err != nil {
+		t.Fatalf("Failed to set flag: %v", err)
+	}
+	viper.Set("zoom", 12)
+
+	if err := applyRequestFile(cmd, path); err != nil {
+		t.Fatalf("Failed to apply request file: %v", err)
+	}
+
+	if bbox := viper.GetString("bbox"); bbox != "37.371794,-122.917099,38.226853,-121.564407" {
+		t.Errorf("Expected bbox from the file, got %q", bbox)
+	}
+	if zoom := viper.GetInt("zoom"); zoom != 12 {
+		t.Errorf("Expected zoom 12 from the flag, got %d", zoom)
+	}
+	expectedURLs := []string{"https://tile.test/{z}/{x}/{y}.png", "https://overlay.test/{z}/{x}/{y}.png"}
+	if urls := viper.GetStringSlice("url"); !reflect.DeepEqual(urls, expectedURLs) {
+		t.Errorf("Expected URLs %v, got %v", expectedURLs, urls)
+	}
+
+	opts, err := stitchOptions(false, tile.OUTFMT_PNG)
+	if err != nil {
+		t.Fatalf("Failed to build stitch options: %v", err)
+	}
+	if opts.TileSize != 512 {
+		t.Errorf("Expected tile size 512, got %d", opts.TileSize)
+	}
+	if !opts.WriteWorldFile {
+		t.Error("Expected WriteWorldFile to be set")
+	}
+	if !reflect.DeepEqual(opts.Headers, map[string]string{"X-Api-Key": "secret"}) {
+		t.Errorf("Expected the file's headers, got %v", opts.Headers)
+	}
+}
+
+func TestRequestSettings_Invalid(t *testing.T) {
+	testCases := []struct {
+		name string
+		job  string
+	}{
+		{
+			name: "bbox mode without bbox",
+			job:  `{"mode": "bbox", "zoom": 10, "tile_source": {"url": "https://tile.test/{z}/{x}/{y}.png"}}`,
+		},
+		{
+			name: "unknown mode",
+			job:  `{"mode": "tiles", "zoom": 10, "tile_source": {"url": "https://tile.test/{z}/{x}/{y}.png"}}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "job.json")
+			if err := os.WriteFile(path, []byte(tc.job), 0644); err != nil {
+				t.Fatalf("Failed to write request file: %v", err)
+			}
+
+			if err := applyRequestFile(&cobra.Command{}, path); err == nil {
+				t.Error("Expected an error for an invalid request file")
+			}
+		})
+	}
+}
@@ -1,10 +1,20 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"image/color"
+	"io"
+	"io/fs"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/kiesman99/stitch/internal/stitch"
 	"github.com/kiesman99/stitch/pkg/tile"
@@ -34,15 +44,30 @@ Examples:
   # Get centered image around Tokyo
   stitch --lat 35.6824 --lon 139.7531 --width 640 --height 480 --zoom 10 --url http://b.tile.stamen.com/watercolor/{z}/{x}/{y}.jpg -o tokyo.png
 
+  # Zoom-in animation from zoom 6 to 12 around Tokyo, 4 frames per second
+  stitch --lat 35.6824 --lon 139.7531 --width 640 --height 480 --zoom-from 6 --zoom-to 12 --fps 4 --url http://a.tile.openstreetmap.org/{z}/{x}/{y}.png -o tokyo.gif
+
+  # Tile pyramid of San Francisco for zoom 10 to 14, as z/x/y.png under tiles/
+  stitch --bbox 37.70,-122.52,37.82,-122.35 --zoom-from 10 --zoom-to 14 --url http://a.tile.openstreetmap.org/{z}/{x}/{y}.png --pyramid tiles
+
+  # Contact sheet of the tiles around San Francisco, captioned with z/x/y, to spot missing ones
+  stitch --bbox 37.70,-122.52,37.82,-122.35 --zoom 12 --url http://a.tile.openstreetmap.org/{z}/{x}/{y}.png --contact-sheet -o sheet.png
+
   # Multiple tile sources
   stitch --bbox 37.37,-122.92,38.23,-121.56 --zoom 10 --url http://a.tile.openstreetmap.org/{z}/{x}/{y}.png --url http://b.tile.openstreetmap.org/{z}/{x}/{y}.png -o map.png
 
+  # Exactly the 4x3 tiles from 655,1582 to 658,1584 at zoom 12, with a world file
+  stitch --tile-range 12,655,1582,658,1584 --url http://a.tile.openstreetmap.org/{z}/{x}/{y}.png -w -o tiles.png
+
+  # Run a job saved in the server's request format, overriding the zoom
+  stitch --request-file job.yaml --zoom 12 -o map.png
+
   # Start HTTP server
   stitch serve --port 8080`,
 	// If no subcommand is specified and we have args, run the stitch command
 	RunE: func(cmd *cobra.Command, args []string) error {
-		// If no args, show help
-		if len(args) == 0 {
+		// If no args or flags, show help
+		if len(args) == 0 && cmd.Flags().NFlag() == 0 {
 			return cmd.Help()
 		}
 		// Otherwise, delegate to stitch command
@@ -64,51 +89,171 @@ func init() {
 
 	// Global flags
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.stitch.yaml)")
+	rootCmd.PersistentFlags().String("log-level", "info", "log level: debug, info, warn or error")
+	rootCmd.PersistentFlags().String("log-format", "text", "log format on stderr: text or json")
+	viper.BindPFlag("log-level", rootCmd.PersistentFlags().Lookup("log-level"))
+	viper.BindPFlag("log-format", rootCmd.PersistentFlags().Lookup("log-format"))
+	logFormatChanged = func() bool { return rootCmd.PersistentFlags().Changed("log-format") }
 
 	// Add stitch command flags to root for default behavior
 	// Output options
 	rootCmd.Flags().StringP("output", "o", "", "output file (default: stdout)")
 	rootCmd.Flags().StringP("format", "f", "png", "output format (png|geotiff)")
 	rootCmd.Flags().BoolP("worldfile", "w", false, "write world file")
+	rootCmd.Flags().Bool("vrt", false, "write a GDAL VRT referencing the output next to it")
+	rootCmd.Flags().Bool("force", false, "write to standard output even if it is a terminal")
+	rootCmd.Flags().Bool("mkdir", false, "create missing directories of the output files")
+	rootCmd.Flags().Bool("stats-histogram", false, "write per-channel statistics and histograms of the result as JSON")
+	rootCmd.Flags().Bool("alpha-mask", false, "write the alpha channel as a grayscale PNG mask next to the output")
+	rootCmd.Flags().String("background", "", "fill color for transparent areas as #RRGGBB or #RRGGBBAA")
+	rootCmd.Flags().Bool("verify-output", false, "re-decode the encoded image and check its size before writing it")
+	rootCmd.Flags().String("resampling", "bilinear", "interpolation for scaled zoom animation frames: nearest, bilinear or bicubic")
+	rootCmd.Flags().Int("dpi", 0, "declare this print resolution in the PNG (pHYs chunk); 0 leaves it out")
+	rootCmd.Flags().Bool("grid", false, "draw tile boundaries over the image to debug seams")
+	rootCmd.Flags().String("grid-color", "#ff0000", "color of --grid lines as #RRGGBB or #RRGGBBAA")
+	rootCmd.Flags().Bool("grid-labels", false, "label every tile of --grid with z/x/y")
+	rootCmd.Flags().Bool("scale-bar", false, "draw a scale bar for the center latitude in the bottom-left corner")
+	rootCmd.Flags().Bool("north-arrow", false, "draw a north arrow in the top-right corner")
+	rootCmd.Flags().String("crop", "exact", "crop to the exact area, or keep whole 'tiles' for tile-aligned mosaics")
 	
 	// Coordinate options - Bounding box mode
 	rootCmd.Flags().Float64("min-lat", 0, "minimum latitude (south boundary)")
 	rootCmd.Flags().Float64("min-lon", 0, "minimum longitude (west boundary)")
 	rootCmd.Flags().Float64("max-lat", 0, "maximum latitude (north boundary)")
 	rootCmd.Flags().Float64("max-lon", 0, "maximum longitude (east boundary)")
-	rootCmd.Flags().String("bbox", "", "bounding box as 'min-lat,min-lon,max-lat,max-lon'")
+	rootCmd.Flags().String("bbox", "", "bounding box as 'min-lat,min-lon,max-lat,max-lon', optionally prefixed with 'EPSG:4326:'")
+	rootCmd.Flags().String("bbox-order", bboxOrderLatLon, "coordinate order of --bbox: latlon (min-lat,min-lon,max-lat,max-lon) or lonlat (min-lon,min-lat,max-lon,max-lat as in GIS tools)")
+	
+	// Coordinate options - Tile range mode
+	rootCmd.Flags().String("tile-range", "", "stitch exactly the tiles 'z,xmin,ymin,xmax,ymax' (inclusive) instead of an area given in degrees")
 	
 	// Coordinate options - Centered mode
 	rootCmd.Flags().Float64("lat", 0, "center latitude")
 	rootCmd.Flags().Float64("lon", 0, "center longitude")
 	rootCmd.Flags().Int("width", 0, "image width in pixels (centered mode)")
 	rootCmd.Flags().Int("height", 0, "image height in pixels (centered mode)")
+	rootCmd.Flags().Float64("width-meters", 0, "image width on the ground in meters, instead of --width (centered mode)")
+	rootCmd.Flags().Float64("height-meters", 0, "image height on the ground in meters, instead of --height (centered mode)")
 	
 	// Tile options
 	rootCmd.Flags().Int("zoom", 0, "zoom level (required)")
 	rootCmd.Flags().StringSliceP("url", "u", []string{}, "tile URL template(s) with {z}, {x}, {y} placeholders (required)")
+	rootCmd.Flags().String("url-file", "", "file with one tile URL template per line, added after the --url ones (blank lines and # comments are skipped)")
 	rootCmd.Flags().IntP("tilesize", "t", 256, "tile size in pixels")
+	rootCmd.Flags().Int64("max-pixels", 10000*10000, "maximum output image size in pixels")
+	rootCmd.Flags().Float64("max-failure-ratio", 0, "fail when more than this share of tiles (0 to 1) fail; 0 allows none (unset: never for images, half for animations)")
+	rootCmd.Flags().Int("max-tile-failures", 0, "fail when more tiles than this fail; 0 allows none (unset: unlimited)")
 	
 	// HTTP options
-	rootCmd.Flags().String("user-agent", "stitch/2.0.0", "HTTP User-Agent header")
+	rootCmd.Flags().String("user-agent", tile.DefaultUserAgent, "HTTP User-Agent header")
+	rootCmd.Flags().Bool("debug-dump", false, "print request and response headers of the first tile (secrets redacted)")
+	rootCmd.Flags().String("metadata", "", "write JSON metadata (bbox, zoom, CRS, size, tile counts) next to the output, or to the given path")
+	rootCmd.Flags().Lookup("metadata").NoOptDefVal = tile.MetadataAuto
+	rootCmd.Flags().String("geojson", "", "write the footprint of the image as a GeoJSON polygon to this path")
+	rootCmd.Flags().String("method", "GET", "HTTP method for tile requests (GET or POST)")
+	rootCmd.Flags().String("body", "", "request body template for POST tile requests, with {z}, {x}, {y} placeholders")
+	rootCmd.Flags().String("progress", "text", "progress output on stderr: text, json (newline-delimited events) or none")
+	rootCmd.Flags().BoolP("quiet", "q", false, "print nothing but errors on stderr")
+	rootCmd.Flags().Bool("verbose", false, "log the full stitch geometry (bounds, projection, tiles, pixel size) on stderr")
+	rootCmd.Flags().Bool("dry-run", false, "print the tile URLs that would be fetched, one per line, without downloading anything")
+	rootCmd.Flags().String("cache-dir", "", "directory to cache downloaded tiles in; re-running an interrupted stitch only fetches the missing tiles")
+	rootCmd.Flags().Duration("cache-ttl", 0, "revalidate cached tiles older than this with the tile server (ETag/Last-Modified); 0 never does")
+	rootCmd.Flags().Bool("no-keepalive", false, "use a new connection for every tile request (slow; for debugging)")
+	rootCmd.Flags().Duration("tile-timeout", tile.DefaultTimeout, "time limit of a single tile request (0 disables it)")
+	rootCmd.Flags().Int("retries", 0, "retry tiles that failed with a network error, timeout, 429 or 5xx this often, with exponential backoff")
+	rootCmd.Flags().String("basic-auth", "", "HTTP Basic credentials for tile requests as 'user:password'")
+	rootCmd.Flags().String("bearer", "", "bearer token for tile requests")
+	rootCmd.Flags().String("referer", "", "HTTP Referer header, for tile providers that only serve requests from their customers' sites")
+	rootCmd.Flags().String("origin", "", "HTTP Origin header for tile requests")
+	rootCmd.Flags().String("proxy", "", "proxy for tile requests as http://, https:// or socks5:// URL (default: HTTP_PROXY/HTTPS_PROXY)")
+	rootCmd.Flags().Bool("insecure", false, "accept any TLS certificate from tile servers, e.g. self-signed ones (only on trusted networks)")
+	rootCmd.Flags().StringArrayP("header", "H", []string{}, "additional HTTP header for tile requests as 'Name: Value' (repeatable)")
+	
+	// Animation options
+	rootCmd.Flags().Int("zoom-from", 0, "first zoom level of an animated GIF (centered mode) or tile pyramid")
+	rootCmd.Flags().Int("zoom-to", 0, "last zoom level of an animated GIF (centered mode) or tile pyramid")
+	rootCmd.Flags().Float64("fps", 2, "frames per second of an animated GIF")
+	
+	// Pyramid options
+	rootCmd.Flags().String("pyramid", "", "write the tiles of the bounding box as a z/x/y tree to this directory instead of stitching them")
+	rootCmd.Flags().Int("pyramid-concurrency", 4, "parallel tile downloads of --pyramid")
+	rootCmd.Flags().Bool("pyramid-png", false, "re-encode the tiles of --pyramid as PNG")
+	rootCmd.Flags().Int("pyramid-max-tiles", 100000, "maximum number of tiles of --pyramid over all zoom levels (0 is unlimited)")
+	rootCmd.Flags().Bool("contact-sheet", false, "lay the tiles out in a grid captioned with z/x/y instead of stitching them, to check a tile source")
+	
+	// Job options
+	rootCmd.Flags().String("request-file", "", "read the stitch parameters from a JSON or YAML file in the server's request format; flags override it")
 	
 	// Bind flags to viper for root command
 	viper.BindPFlag("output", rootCmd.Flags().Lookup("output"))
 	viper.BindPFlag("format", rootCmd.Flags().Lookup("format"))
 	viper.BindPFlag("worldfile", rootCmd.Flags().Lookup("worldfile"))
+	viper.BindPFlag("vrt", rootCmd.Flags().Lookup("vrt"))
+	viper.BindPFlag("force", rootCmd.Flags().Lookup("force"))
+	viper.BindPFlag("mkdir", rootCmd.Flags().Lookup("mkdir"))
+	viper.BindPFlag("stats-histogram", rootCmd.Flags().Lookup("stats-histogram"))
+	viper.BindPFlag("alpha-mask", rootCmd.Flags().Lookup("alpha-mask"))
+	viper.BindPFlag("background", rootCmd.Flags().Lookup("background"))
+	viper.BindPFlag("verify-output", rootCmd.Flags().Lookup("verify-output"))
+	viper.BindPFlag("resampling", rootCmd.Flags().Lookup("resampling"))
+	viper.BindPFlag("dpi", rootCmd.Flags().Lookup("dpi"))
+	viper.BindPFlag("crop", rootCmd.Flags().Lookup("crop"))
+	viper.BindPFlag("grid", rootCmd.Flags().Lookup("grid"))
+	viper.BindPFlag("grid-color", rootCmd.Flags().Lookup("grid-color"))
+	viper.BindPFlag("grid-labels", rootCmd.Flags().Lookup("grid-labels"))
+	viper.BindPFlag("scale-bar", rootCmd.Flags().Lookup("scale-bar"))
+	viper.BindPFlag("north-arrow", rootCmd.Flags().Lookup("north-arrow"))
 	viper.BindPFlag("min-lat", rootCmd.Flags().Lookup("min-lat"))
 	viper.BindPFlag("min-lon", rootCmd.Flags().Lookup("min-lon"))
 	viper.BindPFlag("max-lat", rootCmd.Flags().Lookup("max-lat"))
 	viper.BindPFlag("max-lon", rootCmd.Flags().Lookup("max-lon"))
 	viper.BindPFlag("bbox", rootCmd.Flags().Lookup("bbox"))
+	viper.BindPFlag("bbox-order", rootCmd.Flags().Lookup("bbox-order"))
+	viper.BindPFlag("tile-range", rootCmd.Flags().Lookup("tile-range"))
 	viper.BindPFlag("lat", rootCmd.Flags().Lookup("lat"))
 	viper.BindPFlag("lon", rootCmd.Flags().Lookup("lon"))
 	viper.BindPFlag("width", rootCmd.Flags().Lookup("width"))
 	viper.BindPFlag("height", rootCmd.Flags().Lookup("height"))
+	viper.BindPFlag("width-meters", rootCmd.Flags().Lookup("width-meters"))
+	viper.BindPFlag("height-meters", rootCmd.Flags().Lookup("height-meters"))
 	viper.BindPFlag("zoom", rootCmd.Flags().Lookup("zoom"))
 	viper.BindPFlag("url", rootCmd.Flags().Lookup("url"))
+	viper.BindPFlag("url-file", rootCmd.Flags().Lookup("url-file"))
 	viper.BindPFlag("tilesize", rootCmd.Flags().Lookup("tilesize"))
+	viper.BindPFlag("max-pixels", rootCmd.Flags().Lookup("max-pixels"))
+	viper.BindPFlag("max-failure-ratio", rootCmd.Flags().Lookup("max-failure-ratio"))
+	viper.BindPFlag("max-tile-failures", rootCmd.Flags().Lookup("max-tile-failures"))
 	viper.BindPFlag("user-agent", rootCmd.Flags().Lookup("user-agent"))
+	viper.BindPFlag("debug-dump", rootCmd.Flags().Lookup("debug-dump"))
+	viper.BindPFlag("metadata", rootCmd.Flags().Lookup("metadata"))
+	viper.BindPFlag("geojson", rootCmd.Flags().Lookup("geojson"))
+	viper.BindPFlag("method", rootCmd.Flags().Lookup("method"))
+	viper.BindPFlag("body", rootCmd.Flags().Lookup("body"))
+	viper.BindPFlag("progress", rootCmd.Flags().Lookup("progress"))
+	viper.BindPFlag("quiet", rootCmd.Flags().Lookup("quiet"))
+	viper.BindPFlag("verbose", rootCmd.Flags().Lookup("verbose"))
+	viper.BindPFlag("dry-run", rootCmd.Flags().Lookup("dry-run"))
+	viper.BindPFlag("cache-dir", rootCmd.Flags().Lookup("cache-dir"))
+	viper.BindPFlag("cache-ttl", rootCmd.Flags().Lookup("cache-ttl"))
+	viper.BindPFlag("no-keepalive", rootCmd.Flags().Lookup("no-keepalive"))
+	viper.BindPFlag("tile-timeout", rootCmd.Flags().Lookup("tile-timeout"))
+	viper.BindPFlag("retries", rootCmd.Flags().Lookup("retries"))
+	viper.BindPFlag("basic-auth", rootCmd.Flags().Lookup("basic-auth"))
+	viper.BindPFlag("bearer", rootCmd.Flags().Lookup("bearer"))
+	viper.BindPFlag("referer", rootCmd.Flags().Lookup("referer"))
+	viper.BindPFlag("origin", rootCmd.Flags().Lookup("origin"))
+	viper.BindPFlag("proxy", rootCmd.Flags().Lookup("proxy"))
+	viper.BindPFlag("insecure", rootCmd.Flags().Lookup("insecure"))
+	viper.BindPFlag("header", rootCmd.Flags().Lookup("header"))
+	viper.BindPFlag("zoom-from", rootCmd.Flags().Lookup("zoom-from"))
+	viper.BindPFlag("zoom-to", rootCmd.Flags().Lookup("zoom-to"))
+	viper.BindPFlag("fps", rootCmd.Flags().Lookup("fps"))
+	viper.BindPFlag("pyramid", rootCmd.Flags().Lookup("pyramid"))
+	viper.BindPFlag("pyramid-concurrency", rootCmd.Flags().Lookup("pyramid-concurrency"))
+	viper.BindPFlag("pyramid-png", rootCmd.Flags().Lookup("pyramid-png"))
+	viper.BindPFlag("pyramid-max-tiles", rootCmd.Flags().Lookup("pyramid-max-tiles"))
+	viper.BindPFlag("contact-sheet", rootCmd.Flags().Lookup("contact-sheet"))
+	viper.BindPFlag("request-file", rootCmd.Flags().Lookup("request-file"))
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -136,16 +281,55 @@ func initConfig() {
 }
 
 func runStitch(cmd *cobra.Command, args []string) error {
+	// Cancel in-flight downloads on Ctrl-C
+	ctx, stop := signal.NotifyContext(cmd.Context(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	
+	if path := viper.GetString("request-file"); path != "" {
+		if err := applyRequestFile(cmd, path); err != nil {
+			return err
+		}
+	}
+	
 	// Validate required parameters
 	zoom := viper.GetInt("zoom")
-	urls := viper.GetStringSlice("url")
+	urls, err := tileURLs()
+	if err != nil {
+		return err
+	}
 	
-	if zoom == 0 {
+	// A zoom range makes an animation, or a pyramid with --pyramid
+	zoomRange := viper.GetInt("zoom-from") != 0 || viper.GetInt("zoom-to") != 0
+	pyramid := viper.GetString("pyramid") != ""
+	animate := zoomRange && !pyramid
+	tileRange := viper.GetString("tile-range") // brings its own zoom
+	if zoom == 0 && !zoomRange && tileRange == "" {
 		return fmt.Errorf("zoom level is required (use --zoom)")
 	}
+	zoomFrom, zoomTo := zoom, zoom
+	if zoomRange {
+		zoomFrom, zoomTo = viper.GetInt("zoom-from"), viper.GetInt("zoom-to")
+	}
 	
 	if len(urls) == 0 {
-		return fmt.Errorf("at least one tile URL is required (use --url)")
+		return fmt.Errorf("at least one tile URL is required (use --url or --url-file)")
+	}
+	quiet := viper.GetBool("quiet")
+	if quiet && viper.GetBool("verbose") {
+		return fmt.Errorf("--quiet and --verbose can't be combined")
+	}
+	for _, url := range urls {
+		if err := tile.ValidateTemplate(url); err != nil {
+			return err
+		}
+		if warning := tile.UserAgentWarning(url, viper.GetString("user-agent")); warning != "" && !quiet {
+			fmt.Fprintf(cmd.ErrOrStderr(), "Warning: %s (use --user-agent)\n", warning)
+		}
+	}
+
+	// Keep stderr machine-readable: only progress events in JSON mode
+	if quiet || viper.GetString("progress") == stitch.ProgressJSON {
+		tile.Log = io.Discard
 	}
 
 	// Parse format
@@ -156,7 +340,9 @@ func runStitch(cmd *cobra.Command, args []string) error {
 		format = tile.OUTFMT_PNG
 	case "geotiff":
 		format = tile.OUTFMT_GEOTIFF
-		fmt.Fprintf(cmd.ErrOrStderr(), "Warning: GeoTIFF output not yet implemented, using PNG\n")
+		if !quiet {
+			fmt.Fprintf(cmd.ErrOrStderr(), "Warning: GeoTIFF output not yet implemented, using PNG\n")
+		}
 		format = tile.OUTFMT_PNG
 	default:
 		return fmt.Errorf("unknown format: %s", formatStr)
@@ -173,43 +359,195 @@ func runStitch(cmd *cobra.Command, args []string) error {
 	lon := viper.GetFloat64("lon")
 	width := viper.GetInt("width")
 	height := viper.GetInt("height")
+	widthMeters := viper.GetFloat64("width-meters")
+	heightMeters := viper.GetFloat64("height-meters")
+
+	// Zero is a valid coordinate, so modes follow which flags were given
+	bboxFlags := anyGiven(cmd, "min-lat", "min-lon", "max-lat", "max-lon")
+	meterFlags := anyGiven(cmd, "width-meters", "height-meters")
+	centerFlags := anyGiven(cmd, "lat", "lon", "width", "height") || meterFlags
+
+	// Refuse ambiguous coordinates rather than silently preferring one form
+	if bbox != "" && bboxFlags {
+		return fmt.Errorf("--bbox conflicts with --min-lat, --min-lon, --max-lat, --max-lon; specify the bounding box only once")
+	}
+	if centerFlags && (bbox != "" || bboxFlags) {
+		return fmt.Errorf("centered coordinates (--lat, --lon, --width, --height) conflict with the bounding box; use one mode")
+	}
+
+	if pyramid && centerFlags {
+		return fmt.Errorf("--pyramid requires a bounding box (--bbox or --min-lat, --min-lon, --max-lat, --max-lon)")
+	}
+	contactSheet := viper.GetBool("contact-sheet")
+	if contactSheet && zoomRange {
+		return fmt.Errorf("--contact-sheet requires a single zoom level (--zoom)")
+	}
+
+	// Check for tile range mode
+	if tileRange != "" {
+		if centerFlags || bbox != "" || bboxFlags {
+			return fmt.Errorf("--tile-range conflicts with the bounding box and centered coordinates; use one mode")
+		}
+		if zoomRange || pyramid || contactSheet {
+			return fmt.Errorf("--tile-range can't be combined with --zoom-from, --zoom-to, --pyramid or --contact-sheet")
+		}
+		r, err := parseTileRange(tileRange)
+		if err != nil {
+			return err
+		}
+		if given(cmd, "zoom") && zoom != r.Zoom {
+			return fmt.Errorf("--zoom %d differs from zoom %d of --tile-range; leave out --zoom", zoom, r.Zoom)
+		}
+		return runTileRangeMode(ctx, r, urls, format)
+	}
 
 	// Check for centered mode
-	if lat != 0 || lon != 0 || width != 0 || height != 0 {
-		if lat == 0 || lon == 0 || width == 0 || height == 0 {
+	if centerFlags {
+		// A size on the ground becomes the pixel size at the stitch's zoom
+		if meterFlags {
+			if anyGiven(cmd, "width", "height") {
+				return fmt.Errorf("--width-meters and --height-meters conflict with --width and --height; give the size only once")
+			}
+			if widthMeters <= 0 || heightMeters <= 0 {
+				return fmt.Errorf("--width-meters and --height-meters must both be positive")
+			}
+			if animate {
+				return fmt.Errorf("zoom animations need the size in pixels (--width, --height)")
+			}
+			width, height = groundSize(widthMeters, heightMeters, lat, zoom, viper.GetInt("tilesize"))
+		}
+		if !allGiven(cmd, "lat", "lon") || width <= 0 || height <= 0 {
 			return fmt.Errorf("centered mode requires all of: --lat, --lon, --width, --height")
 		}
-		return runCenteredMode(zoom, urls, lat, lon, width, height, format)
+		if animate {
+			return runAnimation(ctx, urls, lat, lon, width, height)
+		}
+		if contactSheet {
+			return runContactSheet(ctx, urls, zoom, nil, &tile.CenteredRequest{Lat: lat, Lon: lon, Width: width, Height: height})
+		}
+		return runCenteredMode(ctx, zoom, urls, lat, lon, width, height, format)
+	}
+	if animate {
+		return fmt.Errorf("zoom animations (--zoom-from, --zoom-to) require centered mode")
 	}
 
 	// Check for bounding box mode
 	if bbox != "" {
-		return runBboxStringMode(bbox, zoom, urls, format)
+		if pyramid || contactSheet {
+			minLat, minLon, maxLat, maxLon, err := parseBBox(bbox, viper.GetString("bbox-order"))
+			if err != nil {
+				return err
+			}
+			if contactSheet {
+				return runContactSheet(ctx, urls, zoom, &tile.BoundingBox{MinLat: minLat, MinLon: minLon, MaxLat: maxLat, MaxLon: maxLon}, nil)
+			}
+			return runPyramid(ctx, urls, minLat, minLon, maxLat, maxLon, zoomFrom, zoomTo)
+		}
+		return runBboxStringMode(ctx, bbox, viper.GetString("bbox-order"), zoom, urls, format)
 	}
 	
-	if minLat != 0 || maxLat != 0 || minLon != 0 || maxLon != 0 {
-		if minLat == 0 || maxLat == 0 || minLon == 0 || maxLon == 0 {
+	if bboxFlags {
+		if !allGiven(cmd, "min-lat", "min-lon", "max-lat", "max-lon") {
 			return fmt.Errorf("bounding box mode requires all of: --min-lat, --min-lon, --max-lat, --max-lon")
 		}
-		return runBboxMode(minLat, minLon, maxLat, maxLon, zoom, urls, format)
+		if pyramid {
+			return runPyramid(ctx, urls, minLat, minLon, maxLat, maxLon, zoomFrom, zoomTo)
+		}
+		if contactSheet {
+			return runContactSheet(ctx, urls, zoom, &tile.BoundingBox{MinLat: minLat, MinLon: minLon, MaxLat: maxLat, MaxLon: maxLon}, nil)
+		}
+		return runBboxMode(ctx, minLat, minLon, maxLat, maxLon, zoom, urls, format)
 	}
 
-	return fmt.Errorf("either specify bounding box coordinates (--min-lat, --min-lon, --max-lat, --max-lon or --bbox) or centered coordinates (--lat, --lon, --width, --height)")
+	return fmt.Errorf("either specify bounding box coordinates (--min-lat, --min-lon, --max-lat, --max-lon or --bbox), centered coordinates (--lat, --lon, --width, --height) or --tile-range")
 }
 
-func runBboxMode(minLat, minLon, maxLat, maxLon float64, zoom int, urls []string, format int) error {
-	// Create stitch options
-	opts := &tile.StitchOptions{
-		Output:         viper.GetString("output"),
-		TileSize:       viper.GetInt("tilesize"),
-		Centered:       false,
-		Format:         format,
-		WriteWorldFile: viper.GetBool("worldfile"),
-		UserAgent:      viper.GetString("user-agent"),
+// tileURLs returns the --url templates followed by those in --url-file
+func tileURLs() ([]string, error) {
+	urls := viper.GetStringSlice("url")
+	path := viper.GetString("url-file")
+	if path == "" {
+		return urls, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read URL file: %v", err)
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.Contains(line, "{z}") || !strings.Contains(line, "{x}") || !tile.HasYPlaceholder(line) {
+			return nil, fmt.Errorf("%s:%d: URL template must contain {z}, {x} and {y} placeholders", path, i+1)
+		}
+		urls = append(urls, line)
+	}
+	return urls, nil
+}
+
+// outputDir checks that the directory a file is written to exists, or
+// creates it when mkdir is set. An empty path is standard output.
+func outputDir(path string, mkdir bool) error {
+	if path == "" {
+		return nil
+	}
+	dir := filepath.Dir(path)
+	info, err := os.Stat(dir)
+	switch {
+	case errors.Is(err, fs.ErrNotExist) && mkdir:
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create output directory: %v", err)
+		}
+		return nil
+	case errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("output directory does not exist: %s (use --mkdir to create it)", dir)
+	case err != nil:
+		return err
+	case !info.IsDir():
+		return fmt.Errorf("output directory is not a directory: %s", dir)
+	}
+	return nil
+}
+
+// given reports whether key was set on the command line, in the config file or
+// by a request file, as opposed to holding its default
+func given(cmd *cobra.Command, key string) bool {
+	return cmd.Flags().Changed(key) || viper.IsSet(key)
+}
+
+// anyGiven reports whether at least one of keys was given
+func anyGiven(cmd *cobra.Command, keys ...string) bool {
+	for _, key := range keys {
+		if given(cmd, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// allGiven reports whether every one of keys was given
+func allGiven(cmd *cobra.Command, keys ...string) bool {
+	for _, key := range keys {
+		if !given(cmd, key) {
+			return false
+		}
+	}
+	return true
+}
+
+func runBboxMode(ctx context.Context, minLat, minLon, maxLat, maxLon float64, zoom int, urls []string, format int) error {
+	opts, err := stitchOptions(false, format)
+	if err != nil {
+		return err
 	}
 
 	// Create stitcher
-	stitcher := stitch.NewStitcher(opts)
+	stitcher, err := stitch.NewStitcher(opts)
+	if err != nil {
+		return err
+	}
 
 	bbox := &tile.BoundingBox{
 		MinLat: minLat,
@@ -218,59 +556,286 @@ func runBboxMode(minLat, minLon, maxLat, maxLon float64, zoom int, urls []string
 		MaxLon: maxLon,
 	}
 
-	return stitcher.StitchBoundingBox(bbox, zoom, urls)
+	return stitcher.StitchBoundingBox(ctx, bbox, zoom, urls)
+}
+
+// Coordinate orders of --bbox
+const (
+	bboxOrderLatLon = "latlon" // min-lat,min-lon,max-lat,max-lon
+	bboxOrderLonLat = "lonlat" // min-lon,min-lat,max-lon,max-lat, as GIS tools write it
+)
+
+func runBboxStringMode(ctx context.Context, bboxStr, order string, zoom int, urls []string, format int) error {
+	minLat, minLon, maxLat, maxLon, err := parseBBox(bboxStr, order)
+	if err != nil {
+		return err
+	}
+	return runBboxMode(ctx, minLat, minLon, maxLat, maxLon, zoom, urls, format)
 }
 
-func runBboxStringMode(bboxStr string, zoom int, urls []string, format int) error {
-	// Parse bbox string: "min-lat,min-lon,max-lat,max-lon"
+// parseBBox parses a --bbox value in order. A leading "EPSG:4326:" is
+// accepted, as GIS tools copy it along; other reference systems aren't in
+// degrees and are rejected. Swapped axes usually show up as a minimum above
+// its maximum or a latitude beyond ±90°, so those are errors too.
+func parseBBox(bboxStr, order string) (minLat, minLon, maxLat, maxLon float64, err error) {
+	names := []string{"min-lat", "min-lon", "max-lat", "max-lon"}
+	switch order {
+	case bboxOrderLatLon:
+	case bboxOrderLonLat:
+		names = []string{"min-lon", "min-lat", "max-lon", "max-lat"}
+	default:
+		return 0, 0, 0, 0, fmt.Errorf("--bbox-order must be %s or %s", bboxOrderLatLon, bboxOrderLonLat)
+	}
+
+	if len(bboxStr) > 5 && strings.EqualFold(bboxStr[:5], "EPSG:") {
+		code, rest, ok := strings.Cut(bboxStr[5:], ":")
+		if !ok {
+			return 0, 0, 0, 0, fmt.Errorf("bbox prefix must be 'EPSG:4326:'")
+		}
+		if code != "4326" {
+			return 0, 0, 0, 0, fmt.Errorf("bbox in EPSG:%s is not supported, only EPSG:4326 (degrees)", code)
+		}
+		bboxStr = rest
+	}
+
 	parts := strings.Split(bboxStr, ",")
 	if len(parts) != 4 {
-		return fmt.Errorf("bbox must be in format 'min-lat,min-lon,max-lat,max-lon'")
+		return 0, 0, 0, 0, fmt.Errorf("bbox must be in format '%s'", strings.Join(names, ","))
+	}
+
+	values := make(map[string]float64, 4)
+	for i, name := range names {
+		v, err := strconv.ParseFloat(strings.TrimSpace(parts[i]), 64)
+		if err != nil {
+			return 0, 0, 0, 0, fmt.Errorf("invalid %s in bbox: %v", name, err)
+		}
+		values[name] = v
+	}
+	minLat, minLon, maxLat, maxLon = values["min-lat"], values["min-lon"], values["max-lat"], values["max-lon"]
+
+	if minLat < -90 || maxLat > 90 {
+		return 0, 0, 0, 0, fmt.Errorf("bbox latitudes must be between -90 and 90 (is --bbox-order %s right?)", order)
 	}
+	if minLon < -180 || maxLon > 180 {
+		return 0, 0, 0, 0, fmt.Errorf("bbox longitudes must be between -180 and 180")
+	}
+	if minLat >= maxLat {
+		return 0, 0, 0, 0, fmt.Errorf("bbox min-lat %g must be below max-lat %g", minLat, maxLat)
+	}
+	if minLon >= maxLon {
+		return 0, 0, 0, 0, fmt.Errorf("bbox min-lon %g must be below max-lon %g", minLon, maxLon)
+	}
+	return minLat, minLon, maxLat, maxLon, nil
+}
 
-	minLat, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+func runTileRangeMode(ctx context.Context, r *tile.TileRange, urls []string, format int) error {
+	opts, err := stitchOptions(false, format)
 	if err != nil {
-		return fmt.Errorf("invalid min-lat in bbox: %v", err)
+		return err
 	}
 
-	minLon, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	stitcher, err := stitch.NewStitcher(opts)
 	if err != nil {
-		return fmt.Errorf("invalid min-lon in bbox: %v", err)
+		return err
+	}
+	return stitcher.StitchTileRange(ctx, r, urls)
+}
+
+// parseTileRange parses a --tile-range value 'z,xmin,ymin,xmax,ymax' and
+// checks the tiles exist at that zoom
+func parseTileRange(value string) (*tile.TileRange, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("tile range must be in format 'z,xmin,ymin,xmax,ymax'")
+	}
+	var values [5]uint64
+	for i, name := range []string{"z", "xmin", "ymin", "xmax", "ymax"} {
+		v, err := strconv.ParseUint(strings.TrimSpace(parts[i]), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s in tile range: %v", name, err)
+		}
+		values[i] = v
 	}
 
-	maxLat, err := strconv.ParseFloat(strings.TrimSpace(parts[2]), 64)
+	if values[0] > 30 {
+		return nil, fmt.Errorf("tile range zoom %d must be at most 30", values[0])
+	}
+	r := &tile.TileRange{Zoom: int(values[0]), MinX: uint32(values[1]), MinY: uint32(values[2]), MaxX: uint32(values[3]), MaxY: uint32(values[4])}
+	if r.MinX > r.MaxX || r.MinY > r.MaxY {
+		return nil, fmt.Errorf("tile range xmin,ymin %d,%d must not exceed xmax,ymax %d,%d", r.MinX, r.MinY, r.MaxX, r.MaxY)
+	}
+	if n := uint32(1) << r.Zoom; r.MaxX >= n || r.MaxY >= n {
+		return nil, fmt.Errorf("tile range exceeds zoom %d, which has tiles 0 to %d", r.Zoom, n-1)
+	}
+	return r, nil
+}
+
+func runCenteredMode(ctx context.Context, zoom int, urls []string, lat, lon float64, width, height int, format int) error {
+	opts, err := stitchOptions(true, format)
 	if err != nil {
-		return fmt.Errorf("invalid max-lat in bbox: %v", err)
+		return err
 	}
 
-	maxLon, err := strconv.ParseFloat(strings.TrimSpace(parts[3]), 64)
+	// Create stitcher
+	stitcher, err := stitch.NewStitcher(opts)
 	if err != nil {
-		return fmt.Errorf("invalid max-lon in bbox: %v", err)
+		return err
+	}
+
+	req := &tile.CenteredRequest{
+		Lat:    lat,
+		Lon:    lon,
+		Width:  width,
+		Height: height,
 	}
 
-	return runBboxMode(minLat, minLon, maxLat, maxLon, zoom, urls, format)
+	return stitcher.StitchCentered(ctx, req, zoom, urls)
 }
 
-func runCenteredMode(zoom int, urls []string, lat, lon float64, width, height int, format int) error {
-	// Create stitch options
+// stitchOptions builds the stitch options shared by both modes from the flags
+func stitchOptions(centered bool, format int) (*tile.StitchOptions, error) {
+	background, err := backgroundFlag()
+	if err != nil {
+		return nil, err
+	}
+	headers, err := parseHeaders(viper.GetStringSlice("header"))
+	if err != nil {
+		return nil, err
+	}
+	if viper.GetInt("tilesize") <= 0 {
+		return nil, fmt.Errorf("--tilesize must be positive")
+	}
+	if viper.GetInt("dpi") < 0 {
+		return nil, fmt.Errorf("--dpi must not be negative")
+	}
+	if viper.GetInt("retries") < 0 {
+		return nil, fmt.Errorf("--retries must not be negative")
+	}
+	if viper.GetDuration("tile-timeout") < 0 {
+		return nil, fmt.Errorf("--tile-timeout must not be negative")
+	}
+	// Unset limits are nil, as 0 allows no failed tile
+	var maxFailureRatio *float64
+	if viper.IsSet("max-failure-ratio") {
+		ratio := viper.GetFloat64("max-failure-ratio")
+		if ratio < 0 || ratio > 1 {
+			return nil, fmt.Errorf("--max-failure-ratio must be between 0 and 1")
+		}
+		maxFailureRatio = &ratio
+	}
+	var maxFailedTiles *int
+	if viper.IsSet("max-tile-failures") {
+		limit := viper.GetInt("max-tile-failures")
+		if limit < 0 {
+			return nil, fmt.Errorf("--max-tile-failures must not be negative")
+		}
+		maxFailedTiles = &limit
+	}
+	crop := viper.GetString("crop")
+	if crop != "exact" && crop != "tiles" {
+		return nil, fmt.Errorf("--crop must be exact or tiles")
+	}
+	var gridColor color.RGBA
+	if viper.GetBool("grid") {
+		if gridColor, err = tile.ParseColor(viper.GetString("grid-color")); err != nil {
+			return nil, fmt.Errorf("--grid-color: %v", err)
+		}
+	}
+	basicAuth, bearer := viper.GetString("basic-auth"), viper.GetString("bearer")
+	if basicAuth != "" && bearer != "" {
+		return nil, fmt.Errorf("--basic-auth and --bearer can't be combined")
+	}
+	if basicAuth != "" && !strings.Contains(basicAuth, ":") {
+		return nil, fmt.Errorf("--basic-auth must be 'user:password'")
+	}
+	if viper.GetBool("vrt") && viper.GetString("output") == "" {
+		return nil, fmt.Errorf("--vrt requires --output, as the VRT references the image file")
+	}
+	// Find a missing directory before downloading anything, not when writing
+	if !viper.GetBool("dry-run") {
+		paths := []string{viper.GetString("output"), viper.GetString("geojson")}
+		if metadata := viper.GetString("metadata"); metadata != tile.MetadataAuto {
+			paths = append(paths, metadata)
+		}
+		for _, path := range paths {
+			if err := outputDir(path, viper.GetBool("mkdir")); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var proxy *url.URL
+	if raw := viper.GetString("proxy"); raw != "" {
+		if proxy, err = tile.ParseProxy(raw); err != nil {
+			return nil, fmt.Errorf("--proxy: %v", err)
+		}
+	}
+	logger, err := cliLogger()
+	if err != nil {
+		return nil, err
+	}
+
 	opts := &tile.StitchOptions{
 		Output:         viper.GetString("output"),
 		TileSize:       viper.GetInt("tilesize"),
-		Centered:       true,
+		Centered:       centered,
 		Format:         format,
 		WriteWorldFile: viper.GetBool("worldfile"),
+		WriteVRT:       viper.GetBool("vrt"),
 		UserAgent:      viper.GetString("user-agent"),
+		DebugDump:      viper.GetBool("debug-dump"),
+		NoKeepAlive:    viper.GetBool("no-keepalive"),
+		Timeout:        tileTimeout(),
+		Retries:        viper.GetInt("retries"),
+		Force:          viper.GetBool("force"),
+		MaxPixels:      viper.GetInt64("max-pixels"),
+		Stats:          viper.GetBool("stats-histogram"),
+		AlphaMask:      viper.GetBool("alpha-mask"),
+		Background:     background,
+		VerifyOutput:   viper.GetBool("verify-output"),
+		CacheDir:       viper.GetString("cache-dir"),
+		CacheTTL:       viper.GetDuration("cache-ttl"),
+		DryRun:         viper.GetBool("dry-run"),
+		Progress:       progressMode(),
+		Method:         viper.GetString("method"),
+		Body:           viper.GetString("body"),
+		Metadata:       viper.GetString("metadata"),
+		GeoJSON:        viper.GetString("geojson"),
+		DPI:            viper.GetInt("dpi"),
+		CropToTiles:    crop == "tiles",
+		Logger:         logger,
+		Grid:           viper.GetBool("grid"),
+		GridColor:      gridColor,
+		GridLabels:     viper.GetBool("grid-labels"),
+		ScaleBar:       viper.GetBool("scale-bar"),
+		NorthArrow:     viper.GetBool("north-arrow"),
+		Headers:        headers,
+		BasicAuth:      basicAuth,
+		BearerToken:    bearer,
+		Referer:        viper.GetString("referer"),
+		Origin:         viper.GetString("origin"),
+		Proxy:          proxy,
+		Insecure:       viper.GetBool("insecure"),
+
+		MaxFailureRatio: maxFailureRatio,
+		MaxFailedTiles:  maxFailedTiles,
 	}
 
-	// Create stitcher
-	stitcher := stitch.NewStitcher(opts)
+	return opts, nil
+}
 
-	req := &tile.CenteredRequest{
-		Lat:    lat,
-		Lon:    lon,
-		Width:  width,
-		Height: height,
+// backgroundFlag parses --background; unset means transparent
+func backgroundFlag() (color.RGBA, error) {
+	value := viper.GetString("background")
+	if value == "" {
+		return color.RGBA{}, nil
 	}
+	return tile.ParseColor(value)
+}
 
-	return stitcher.StitchCentered(req, zoom, urls)
+// tileTimeout reads --tile-timeout, where 0 disables the limit
+func tileTimeout() time.Duration {
+	if timeout := viper.GetDuration("tile-timeout"); timeout > 0 {
+		return timeout
+	}
+	return -1
 }
@@ -0,0 +1,643 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kiesman99/stitch/pkg/tile"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func TestRunStitch_ConflictingCoordinateFlags(t *testing.T) {
+	testCases := []struct {
+		name     string
+		flags    map[string]interface{}
+		expected string
+	}{
+		{
+			name: "bbox and individual bounds",
+			flags: map[string]interface{}{
+				"bbox":    "37.37,-122.92,38.23,-121.56",
+				"min-lat": 37.0,
+				"min-lon": -123.0,
+				"max-lat": 38.0,
+				"max-lon": -122.0,
+			},
+			expected: "--bbox conflicts with --min-lat",
+		},
+		{
+			name: "bbox and centered",
+			flags: map[string]interface{}{
+				"bbox":   "37.37,-122.92,38.23,-121.56",
+				"lat":    37.8,
+				"lon":    -122.4,
+				"width":  640,
+				"height": 480,
+			},
+			expected: "conflict with the bounding box",
+		},
+		{
+			name: "individual bounds and centered",
+			flags: map[string]interface{}{
+				"min-lat": 37.0,
+				"lat":     37.8,
+			},
+			expected: "conflict with the bounding box",
+		},
+		{
+			name: "bbox and centered at 0,0",
+			flags: map[string]interface{}{
+				"bbox": "-1,-1,1,1",
+				"lat":  0.0,
+				"lon":  0.0,
+			},
+			expected: "conflict with the bounding box",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			set := func(key string, value interface{}) {
+				viper.Set(key, value)
+				t.Cleanup(func() { viper.Set(key, nil) })
+			}
+			set("zoom", 10)
+			set("url", []string{"https://tile.test/{z}/{x}/{y}.png"})
+			for key, value := range tc.flags {
+				set(key, value)
+			}
+
+			cmd := &cobra.Command{}
+			cmd.SetContext(context.Background())
+			err := runStitch(cmd, nil)
+			if err == nil {
+				t.Fatal("Expected an error for conflicting coordinates")
+			}
+			if !strings.Contains(err.Error(), tc.expected) {
+				t.Errorf("Expected error containing %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestRunStitch_CenteredAtZero(t *testing.T) {
+	set := func(key string, value interface{}) {
+		viper.Set(key, value)
+		t.Cleanup(func() { viper.Set(key, nil) })
+	}
+	set("zoom", 10)
+	set("url", []string{"https://tile.test/{z}/{x}/{y}.png"})
+	set("lat", 0.0)
+	set("lon", 0.0)
+	set("width", 256)
+	set("height", 256)
+	set("dry-run", true)
+
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.Background())
+	if err := runStitch(cmd, nil); err != nil {
+		t.Fatalf("Expected centered mode at 0,0 to be accepted, got %v", err)
+	}
+}
+
+func TestRunStitch_Quiet(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		t.Fatalf("Failed to encode tile: %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(encoded.Bytes())
+	}))
+	defer server.Close()
+
+	oldLog := tile.Log
+	t.Cleanup(func() { tile.Log = oldLog })
+
+	set := func(key string, value interface{}) {
+		viper.Set(key, value)
+		t.Cleanup(func() { viper.Set(key, nil) })
+	}
+	set("zoom", 10)
+	set("url", []string{server.URL + "/{z}/{x}/{y}.png"})
+	set("lat", 37.8)
+	set("lon", -122.4)
+	set("width", 300)
+	set("height", 200)
+	set("output", filepath.Join(t.TempDir(), "out.png"))
+	set("worldfile", true)
+	set("quiet", true)
+
+	// Everything on stderr goes through os.Stderr
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	oldStderr := os.Stderr
+	os.Stderr = w
+	defer func() { os.Stderr = oldStderr }()
+
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.Background())
+	cmd.SetErr(w)
+	runErr := runStitch(cmd, nil)
+	w.Close()
+	os.Stderr = oldStderr
+
+	stderr, _ := io.ReadAll(r)
+	if runErr != nil {
+		t.Fatalf("Stitch failed: %v", runErr)
+	}
+	if len(stderr) != 0 {
+		t.Errorf("Expected nothing on stderr with --quiet, got %q", stderr)
+	}
+}
+
+func TestRunStitch_Pyramid(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		t.Fatalf("Failed to encode tile: %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(encoded.Bytes())
+	}))
+	defer server.Close()
+
+	oldLog := tile.Log
+	t.Cleanup(func() { tile.Log = oldLog })
+
+	set := func(key string, value interface{}) {
+		viper.Set(key, value)
+		t.Cleanup(func() { viper.Set(key, nil) })
+	}
+	dir := t.TempDir()
+	set("url", []string{server.URL + "/{z}/{x}/{y}.png"})
+	set("bbox", "10,10,20,20")
+	set("zoom-from", 3)
+	set("zoom-to", 4)
+	set("pyramid", dir)
+	set("quiet", true)
+
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.Background())
+	if err := runStitch(cmd, nil); err != nil {
+		t.Fatalf("Pyramid export failed: %v", err)
+	}
+
+	for _, name := range []string{"3/4/3.png", "4/8/7.png"} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			t.Errorf("Expected tile %s: %v", name, err)
+		}
+	}
+
+	// The tile limit covers both levels together
+	set("pyramid-max-tiles", 1)
+	if err := runStitch(cmd, nil); err == nil || !strings.Contains(err.Error(), "needs 2 tiles") {
+		t.Errorf("Expected the tile limit to refuse 2 tiles, got %v", err)
+	}
+}
+
+func TestRunStitch_ContactSheet(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		t.Fatalf("Failed to encode tile: %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(encoded.Bytes())
+	}))
+	defer server.Close()
+
+	oldLog := tile.Log
+	t.Cleanup(func() { tile.Log = oldLog })
+
+	set := func(key string, value interface{}) {
+		viper.Set(key, value)
+		t.Cleanup(func() { viper.Set(key, nil) })
+	}
+	output := filepath.Join(t.TempDir(), "sheet.png")
+	set("url", []string{server.URL + "/{z}/{x}/{y}.png"})
+	set("bbox", "-10,40,10,50")
+	set("zoom", 3)
+	set("contact-sheet", true)
+	set("output", output)
+	set("quiet", true)
+
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.Background())
+	if err := runStitch(cmd, nil); err != nil {
+		t.Fatalf("Contact sheet failed: %v", err)
+	}
+
+	f, err := os.Open(output)
+	if err != nil {
+		t.Fatalf("Expected the contact sheet: %v", err)
+	}
+	defer f.Close()
+	config, err := png.DecodeConfig(f)
+	if err != nil {
+		t.Fatalf("Failed to decode contact sheet: %v", err)
+	}
+	// 2x2 tiles, each with a margin and a caption
+	if config.Width <= 512 || config.Height <= 512 {
+		t.Errorf("Expected a sheet larger than the 512x512 pixels of its tiles, got %dx%d", config.Width, config.Height)
+	}
+
+	// Contact sheets show the tiles of one zoom level
+	set("zoom-from", 3)
+	set("zoom-to", 4)
+	if err := runStitch(cmd, nil); err == nil || !strings.Contains(err.Error(), "--contact-sheet") {
+		t.Errorf("Expected a --contact-sheet error for a zoom range, got %v", err)
+	}
+}
+
+func TestRunStitch_TileRange(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		t.Fatalf("Failed to encode tile: %v", err)
+	}
+	var mu sync.Mutex
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(encoded.Bytes())
+	}))
+	defer server.Close()
+
+	oldLog := tile.Log
+	t.Cleanup(func() { tile.Log = oldLog })
+
+	set := func(key string, value interface{}) {
+		viper.Set(key, value)
+		t.Cleanup(func() { viper.Set(key, nil) })
+	}
+	output := filepath.Join(t.TempDir(), "tiles.png")
+	set("url", []string{server.URL + "/{z}/{x}/{y}.png"})
+	set("tile-range", "3,4,3,5,4")
+	set("output", output)
+	set("quiet", true)
+
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.Background())
+	if err := runStitch(cmd, nil); err != nil {
+		t.Fatalf("Tile range stitch failed: %v", err)
+	}
+
+	slices.Sort(paths)
+	want := []string{"/3/4/3.png", "/3/4/4.png", "/3/5/3.png", "/3/5/4.png"}
+	if !slices.Equal(paths, want) {
+		t.Errorf("Expected requests for %v, got %v", want, paths)
+	}
+
+	f, err := os.Open(output)
+	if err != nil {
+		t.Fatalf("Expected the stitched image: %v", err)
+	}
+	defer f.Close()
+	config, err := png.DecodeConfig(f)
+	if err != nil {
+		t.Fatalf("Failed to decode image: %v", err)
+	}
+	if config.Width != 512 || config.Height != 512 {
+		t.Errorf("Expected exactly the 512x512 pixels of the tiles, got %dx%d", config.Width, config.Height)
+	}
+
+	// A tile range is its own mode
+	set("bbox", "-10,40,10,50")
+	if err := runStitch(cmd, nil); err == nil || !strings.Contains(err.Error(), "--tile-range") {
+		t.Errorf("Expected a --tile-range error with a bounding box, got %v", err)
+	}
+}
+
+func TestRunStitch_GeoJSONCroppedToTiles(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		t.Fatalf("Failed to encode tile: %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(encoded.Bytes())
+	}))
+	defer server.Close()
+
+	oldLog := tile.Log
+	t.Cleanup(func() { tile.Log = oldLog })
+
+	set := func(key string, value interface{}) {
+		viper.Set(key, value)
+		t.Cleanup(func() { viper.Set(key, nil) })
+	}
+	dir := t.TempDir()
+	footprint := filepath.Join(dir, "footprint.geojson")
+	set("url", []string{server.URL + "/{z}/{x}/{y}.png"})
+	set("bbox", "10,10,20,20")
+	set("zoom", 3)
+	set("crop", "tiles")
+	set("output", filepath.Join(dir, "out.png"))
+	set("geojson", footprint)
+	set("quiet", true)
+
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.Background())
+	if err := runStitch(cmd, nil); err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+
+	data, err := os.ReadFile(footprint)
+	if err != nil {
+		t.Fatalf("Expected the footprint: %v", err)
+	}
+	var polygon struct {
+		Coordinates [][][2]float64 `json:"coordinates"`
+	}
+	if err := json.Unmarshal(data, &polygon); err != nil {
+		t.Fatalf("Failed to decode footprint: %v", err)
+	}
+
+	// The footprint is the rendered tile 4,3, not the requested area
+	maxLat, minLon := tile.TileToLatLon(4, 3, 3)
+	minLat, maxLon := tile.TileToLatLon(5, 4, 3)
+	southWest, northEast := polygon.Coordinates[0][0], polygon.Coordinates[0][2]
+	for _, c := range []struct{ got, want float64 }{
+		{southWest[0], minLon}, {southWest[1], minLat}, {northEast[0], maxLon}, {northEast[1], maxLat},
+	} {
+		if math.Abs(c.got-c.want) > 1e-6 {
+			t.Errorf("Expected the footprint of the tile, %g,%g to %g,%g, got %v", minLon, minLat, maxLon, maxLat, polygon.Coordinates[0])
+			break
+		}
+	}
+}
+
+func TestParseTileRange(t *testing.T) {
+	r, err := parseTileRange("12, 655,1582,658,1584")
+	if err != nil {
+		t.Fatalf("parseTileRange failed: %v", err)
+	}
+	if *r != (tile.TileRange{Zoom: 12, MinX: 655, MinY: 1582, MaxX: 658, MaxY: 1584}) {
+		t.Errorf("Unexpected tile range %+v", *r)
+	}
+
+	for _, value := range []string{
+		"12,655,1582,658",      // missing ymax
+		"12,658,1582,655,1584", // xmin after xmax
+		"3,0,0,8,0",            // zoom 3 has tiles 0 to 7
+		"12,-1,0,1,1",
+		"31,0,0,1,1",
+	} {
+		if _, err := parseTileRange(value); err == nil {
+			t.Errorf("Expected an error for %q", value)
+		}
+	}
+}
+
+func TestRunStitch_OutputDirectory(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		t.Fatalf("Failed to encode tile: %v", err)
+	}
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(encoded.Bytes())
+	}))
+	defer server.Close()
+
+	oldLog := tile.Log
+	t.Cleanup(func() { tile.Log = oldLog })
+
+	set := func(key string, value interface{}) {
+		viper.Set(key, value)
+		t.Cleanup(func() { viper.Set(key, nil) })
+	}
+	output := filepath.Join(t.TempDir(), "maps", "bay", "out.png")
+	set("url", []string{server.URL + "/{z}/{x}/{y}.png"})
+	set("bbox", "10,10,20,20")
+	set("zoom", 3)
+	set("output", output)
+	set("worldfile", true)
+	set("quiet", true)
+
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.Background())
+
+	// A missing directory fails before any download
+	err := runStitch(cmd, nil)
+	if err == nil || !strings.Contains(err.Error(), "output directory does not exist") {
+		t.Fatalf("Expected a missing directory error, got %v", err)
+	}
+	if requests != 0 {
+		t.Errorf("Expected no tile requests, got %d", requests)
+	}
+
+	set("mkdir", true)
+	if err := runStitch(cmd, nil); err != nil {
+		t.Fatalf("Stitch with --mkdir failed: %v", err)
+	}
+	for _, name := range []string{output, strings.TrimSuffix(output, ".png") + ".pnw"} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("Expected %s to be written: %v", name, err)
+		}
+	}
+}
+
+func TestParseBBox(t *testing.T) {
+	testCases := []struct {
+		name     string
+		bbox     string
+		order    string
+		expected [4]float64 // min-lat, min-lon, max-lat, max-lon
+		errorMsg string
+	}{
+		{
+			name:     "lat-first order",
+			bbox:     "37.37,-122.92,38.23,-121.56",
+			order:    bboxOrderLatLon,
+			expected: [4]float64{37.37, -122.92, 38.23, -121.56},
+		},
+		{
+			name:     "GIS order",
+			bbox:     "-122.92,37.37,-121.56,38.23",
+			order:    bboxOrderLonLat,
+			expected: [4]float64{37.37, -122.92, 38.23, -121.56},
+		},
+		{
+			name:     "EPSG:4326 prefix",
+			bbox:     "EPSG:4326:-122.92,37.37,-121.56,38.23",
+			order:    bboxOrderLonLat,
+			expected: [4]float64{37.37, -122.92, 38.23, -121.56},
+		},
+		{
+			name:     "GIS order read lat-first",
+			bbox:     "-122.92,37.37,-121.56,38.23",
+			order:    bboxOrderLatLon,
+			errorMsg: "latitudes must be between -90 and 90",
+		},
+		{
+			name:     "minimum above maximum",
+			bbox:     "38.23,-122.92,37.37,-121.56",
+			order:    bboxOrderLatLon,
+			errorMsg: "min-lat 38.23 must be below max-lat 37.37",
+		},
+		{
+			name:     "projected prefix",
+			bbox:     "EPSG:3857:-13683580,4492000,-13531000,4612000",
+			order:    bboxOrderLonLat,
+			errorMsg: "EPSG:3857 is not supported",
+		},
+		{
+			name:     "prefix without code",
+			bbox:     "EPSG:-122.92,37.37,-121.56,38.23",
+			order:    bboxOrderLonLat,
+			errorMsg: "prefix must be 'EPSG:4326:'",
+		},
+		{
+			name:     "unknown order",
+			bbox:     "37.37,-122.92,38.23,-121.56",
+			order:    "xy",
+			errorMsg: "--bbox-order must be",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			minLat, minLon, maxLat, maxLon, err := parseBBox(tc.bbox, tc.order)
+			if tc.errorMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.errorMsg) {
+					t.Errorf("Expected error containing %q, got %v", tc.errorMsg, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to parse bbox: %v", err)
+			}
+			if got := [4]float64{minLat, minLon, maxLat, maxLon}; got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestTileURLs_URLFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.txt")
+	content := `# mirrors, tried in order
+https://a.tile.test/{z}/{x}/{y}.png
+
+https://b.tile.test/{z}/{x}/{y}.png
+  https://c.tile.test/{z}/{x}/{-y}.png  
+`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write URL file: %v", err)
+	}
+
+	set := func(key string, value interface{}) {
+		viper.Set(key, value)
+		t.Cleanup(func() { viper.Set(key, nil) })
+	}
+	set("url", []string{"https://main.tile.test/{z}/{x}/{y}.png"})
+	set("url-file", path)
+
+	urls, err := tileURLs()
+	if err != nil {
+		t.Fatalf("Failed to read URLs: %v", err)
+	}
+	expected := []string{
+		"https://main.tile.test/{z}/{x}/{y}.png",
+		"https://a.tile.test/{z}/{x}/{y}.png",
+		"https://b.tile.test/{z}/{x}/{y}.png",
+		"https://c.tile.test/{z}/{x}/{-y}.png",
+	}
+	if strings.Join(urls, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected %v, got %v", expected, urls)
+	}
+
+	if err := os.WriteFile(path, []byte("https://a.tile.test/{z}/{x}.png\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write URL file: %v", err)
+	}
+	if _, err := tileURLs(); err == nil || !strings.Contains(err.Error(), "urls.txt:1") {
+		t.Errorf("Expected an error for the template without {y}, got %v", err)
+	}
+}
+
+func TestTileTimeout(t *testing.T) {
+	t.Cleanup(func() { viper.Set("tile-timeout", nil) })
+
+	viper.Set("tile-timeout", 5*time.Second)
+	if got := tileTimeout(); got != 5*time.Second {
+		t.Errorf("Expected 5s, got %v", got)
+	}
+
+	// 0 disables the limit rather than falling back to the default
+	viper.Set("tile-timeout", time.Duration(0))
+	if got := tileTimeout(); got >= 0 {
+		t.Errorf("Expected a negative timeout that disables the limit, got %v", got)
+	}
+}
+
+func TestStitchOptions_FailureLimits(t *testing.T) {
+	for _, key := range []string{"max-failure-ratio", "max-tile-failures"} {
+		t.Cleanup(func() { viper.Set(key, nil) })
+	}
+
+	// Unset limits stay nil, so the stitcher applies its defaults
+	opts, err := stitchOptions(false, tile.OUTFMT_PNG)
+	if err != nil {
+		t.Fatalf("Failed to build stitch options: %v", err)
+	}
+	if opts.MaxFailureRatio != nil || opts.MaxFailedTiles != nil {
+		t.Errorf("Expected no failure limits, got ratio %v and count %v", opts.MaxFailureRatio, opts.MaxFailedTiles)
+	}
+
+	// 0 allows no failed tile rather than lifting the limit
+	viper.Set("max-failure-ratio", 0.0)
+	viper.Set("max-tile-failures", 0)
+	opts, err = stitchOptions(false, tile.OUTFMT_PNG)
+	if err != nil {
+		t.Fatalf("Failed to build stitch options: %v", err)
+	}
+	if opts.MaxFailureRatio == nil || *opts.MaxFailureRatio != 0 {
+		t.Errorf("Expected a failure ratio of 0, got %v", opts.MaxFailureRatio)
+	}
+	if opts.MaxFailedTiles == nil || *opts.MaxFailedTiles != 0 {
+		t.Errorf("Expected a failed tile limit of 0, got %v", opts.MaxFailedTiles)
+	}
+
+	viper.Set("max-tile-failures", -1)
+	if _, err := stitchOptions(false, tile.OUTFMT_PNG); err == nil || !strings.Contains(err.Error(), "--max-tile-failures") {
+		t.Errorf("Expected an error for a negative failed tile limit, got %v", err)
+	}
+}
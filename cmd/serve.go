@@ -3,20 +3,24 @@ package cmd
 import (
 	"context"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
 	"github.com/kiesman99/stitch/internal/api"
 	"github.com/kiesman99/stitch/internal/server"
+	"github.com/kiesman99/stitch/pkg/stitch"
+	"github.com/kiesman99/stitch/pkg/tile"
 )
 
 var serveCmd = &cobra.Command{
@@ -34,7 +38,10 @@ Examples:
   stitch serve --port 3000
 
   # Start server with custom bind address
-  stitch serve --bind 0.0.0.0 --port 8080`,
+  stitch serve --bind 0.0.0.0 --port 8080
+
+  # Allow uploads to S3-compatible storage (credentials from AWS_ACCESS_KEY_ID etc.)
+  stitch serve --s3-endpoint https://s3.eu-central-1.amazonaws.com --s3-region eu-central-1 --s3-destinations maps/exports`,
 	RunE: runServe,
 }
 
@@ -45,11 +52,68 @@ func init() {
 	serveCmd.Flags().StringP("bind", "b", "localhost", "bind address")
 	serveCmd.Flags().IntP("port", "p", 8080, "port to listen on")
 	serveCmd.Flags().Duration("timeout", 30*time.Second, "request timeout")
+	serveCmd.Flags().Duration("read-timeout", 30*time.Second, "maximum time to read a request, including its body")
+	serveCmd.Flags().Duration("write-timeout", 5*time.Minute, "maximum time from reading a request to having written the response; leave room beyond --timeout for sending large images")
+	serveCmd.Flags().Duration("idle-timeout", 2*time.Minute, "close idle keep-alive client connections after this long")
+	serveCmd.Flags().Duration("stitch-timeout", 0, "maximum time for one stitch before answering 504 TILE_SERVER_TIMEOUT (0 leaves only --timeout)")
+	serveCmd.Flags().Duration("tile-timeout", 0, "maximum time for one tile request (0 uses 30s); stitches failing mostly by it answer 504 TILE_SERVER_TIMEOUT")
+
+	// Tile download configuration
+	serveCmd.Flags().Int("concurrency", 1, "parallel tile downloads per stitch")
+	serveCmd.Flags().Duration("ramp-up", 0, "spread download worker start-up over this period (0 disables slow start)")
+	serveCmd.Flags().Int64("max-pixels", stitch.DefaultMaxPixels, "maximum output image size in pixels")
+	serveCmd.Flags().Int("max-tiles", 0, "maximum number of tiles per stitch (0 is unlimited)")
+	serveCmd.Flags().Bool("metrics", false, "expose Prometheus metrics at /metrics")
+	serveCmd.Flags().Int("flush-bytes", 0, "flush image responses to the client every this many bytes (0 disables)")
+	serveCmd.Flags().Int("max-idle-conns-per-host", 0, "idle connections kept open per tile host (0 keeps at least --concurrency)")
+	serveCmd.Flags().Int("max-conns-per-host", 0, "maximum connections per tile host (0 is unlimited)")
+	serveCmd.Flags().Duration("idle-conn-timeout", 0, "close idle tile connections after this long (0 uses 90s)")
+	serveCmd.Flags().Int("rate-limit-retries", 0, "retry tiles the tile server rate limits (HTTP 429) this many times, waiting out Retry-After")
+	serveCmd.Flags().Bool("clamp-latitude", false, "clamp latitudes beyond the Web Mercator limit of ±85.0511° (with a Warning header) instead of rejecting the request")
+	serveCmd.Flags().Bool("geo-headers", false, "send the georeferencing of stitched images in X-Min-X, X-Max-Y, X-Pixel-Size-X, X-Pixel-Size-Y and X-CRS headers")
+	serveCmd.Flags().Bool("verify-output", false, "re-decode every encoded image and check its size before sending it")
+
+	// Keep a public server from being used to reach internal services
+	serveCmd.Flags().StringSlice("allowed-hosts", nil, "only fetch tiles from these hosts (*.example.com allows subdomains; empty allows all)")
+	serveCmd.Flags().Bool("allow-private-hosts", false, "allow tile URLs on loopback, private and link-local addresses")
+
+	serveCmd.Flags().String("sources", "", "YAML file of named tile sources that requests can use by name (listed at /api/v1/sources)")
+	serveCmd.Flags().String("health-probe-url", "", "tile URL fetched by /api/v1/health?deep=true ({z}/{x}/{y} become 0/0/0)")
+
+	// Upload configuration; credentials come from the environment
+	serveCmd.Flags().String("s3-endpoint", "", "S3-compatible endpoint for output.destination uploads (empty disables them)")
+	serveCmd.Flags().String("s3-region", "us-east-1", "S3 signing region")
+	serveCmd.Flags().StringSlice("s3-destinations", nil, "buckets ('bucket') and folders ('bucket/prefix') uploads may write to; required with --s3-endpoint")
 
 	// Bind flags to viper
 	viper.BindPFlag("server.bind", serveCmd.Flags().Lookup("bind"))
 	viper.BindPFlag("server.port", serveCmd.Flags().Lookup("port"))
 	viper.BindPFlag("server.timeout", serveCmd.Flags().Lookup("timeout"))
+	viper.BindPFlag("server.read-timeout", serveCmd.Flags().Lookup("read-timeout"))
+	viper.BindPFlag("server.write-timeout", serveCmd.Flags().Lookup("write-timeout"))
+	viper.BindPFlag("server.idle-timeout", serveCmd.Flags().Lookup("idle-timeout"))
+	viper.BindPFlag("server.stitch-timeout", serveCmd.Flags().Lookup("stitch-timeout"))
+	viper.BindPFlag("server.tile-timeout", serveCmd.Flags().Lookup("tile-timeout"))
+	viper.BindPFlag("server.concurrency", serveCmd.Flags().Lookup("concurrency"))
+	viper.BindPFlag("server.ramp-up", serveCmd.Flags().Lookup("ramp-up"))
+	viper.BindPFlag("server.max-pixels", serveCmd.Flags().Lookup("max-pixels"))
+	viper.BindPFlag("server.max-tiles", serveCmd.Flags().Lookup("max-tiles"))
+	viper.BindPFlag("server.metrics", serveCmd.Flags().Lookup("metrics"))
+	viper.BindPFlag("server.flush-bytes", serveCmd.Flags().Lookup("flush-bytes"))
+	viper.BindPFlag("server.max-idle-conns-per-host", serveCmd.Flags().Lookup("max-idle-conns-per-host"))
+	viper.BindPFlag("server.max-conns-per-host", serveCmd.Flags().Lookup("max-conns-per-host"))
+	viper.BindPFlag("server.idle-conn-timeout", serveCmd.Flags().Lookup("idle-conn-timeout"))
+	viper.BindPFlag("server.rate-limit-retries", serveCmd.Flags().Lookup("rate-limit-retries"))
+	viper.BindPFlag("server.clamp-latitude", serveCmd.Flags().Lookup("clamp-latitude"))
+	viper.BindPFlag("server.geo-headers", serveCmd.Flags().Lookup("geo-headers"))
+	viper.BindPFlag("server.verify-output", serveCmd.Flags().Lookup("verify-output"))
+	viper.BindPFlag("server.allowed-hosts", serveCmd.Flags().Lookup("allowed-hosts"))
+	viper.BindPFlag("server.allow-private-hosts", serveCmd.Flags().Lookup("allow-private-hosts"))
+	viper.BindPFlag("server.sources", serveCmd.Flags().Lookup("sources"))
+	viper.BindPFlag("server.health-probe-url", serveCmd.Flags().Lookup("health-probe-url"))
+	viper.BindPFlag("server.s3-endpoint", serveCmd.Flags().Lookup("s3-endpoint"))
+	viper.BindPFlag("server.s3-region", serveCmd.Flags().Lookup("s3-region"))
+	viper.BindPFlag("server.s3-destinations", serveCmd.Flags().Lookup("s3-destinations"))
 }
 
 func runServe(cmd *cobra.Command, args []string) error {
@@ -59,22 +123,30 @@ func runServe(cmd *cobra.Command, args []string) error {
 
 	addr := fmt.Sprintf("%s:%d", bind, port)
 
+	logger, err := newLogger(cmd.ErrOrStderr(), viper.GetString("log-level"), viper.GetString("log-format"))
+	if err != nil {
+		return err
+	}
+
 	// Create Chi router
 	r := chi.NewRouter()
 
 	// Add middleware
-	r.Use(middleware.Logger)
-	r.Use(middleware.Recoverer)
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
+	r.Use(server.RequestLogger(logger))
+	r.Use(middleware.Recoverer)
+	// Compress JSON and text responses only; images are already compressed
+	r.Use(middleware.Compress(5, "application/json", "text/plain"))
 	r.Use(middleware.Timeout(timeout))
 
 	// CORS middleware for API access
 	r.Use(func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, OPTIONS")
 			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key")
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(server.GeoHeaderNames, ", "))
 
 			if r.Method == "OPTIONS" {
 				w.WriteHeader(http.StatusOK)
@@ -85,8 +157,76 @@ func runServe(cmd *cobra.Command, args []string) error {
 		})
 	})
 
+	config := server.Config{
+		Concurrency:  viper.GetInt("server.concurrency"),
+		RampUp:       viper.GetDuration("server.ramp-up"),
+		FlushBytes:   viper.GetInt("server.flush-bytes"),
+		MaxPixels:    viper.GetInt64("server.max-pixels"),
+		MaxTiles:     viper.GetInt("server.max-tiles"),
+		VerifyOutput: viper.GetBool("server.verify-output"),
+
+		StitchTimeout: viper.GetDuration("server.stitch-timeout"),
+		TileTimeout:   viper.GetDuration("server.tile-timeout"),
+
+		RateLimitRetries: viper.GetInt("server.rate-limit-retries"),
+		ClampLatitude:    viper.GetBool("server.clamp-latitude"),
+		GeoHeaders:       viper.GetBool("server.geo-headers"),
+
+		AllowedHosts:      viper.GetStringSlice("server.allowed-hosts"),
+		BlockPrivateHosts: !viper.GetBool("server.allow-private-hosts"),
+
+		HealthProbeURL: viper.GetString("server.health-probe-url"),
+		Logger:         logger,
+		Transport: tile.TransportOptions{
+			MaxIdleConnsPerHost: viper.GetInt("server.max-idle-conns-per-host"),
+			MaxConnsPerHost:     viper.GetInt("server.max-conns-per-host"),
+			IdleConnTimeout:     viper.GetDuration("server.idle-conn-timeout"),
+		},
+	}
+
+	if config.StitchTimeout > 0 && config.StitchTimeout >= timeout {
+		logger.Warn("--stitch-timeout isn't shorter than --timeout, which cuts stitches off first", "stitch_timeout", config.StitchTimeout, "timeout", timeout)
+	}
+	if writeTimeout := viper.GetDuration("server.write-timeout"); writeTimeout > 0 && writeTimeout <= timeout {
+		logger.Warn("--write-timeout isn't longer than --timeout, which truncates images that finish stitching late", "write_timeout", writeTimeout, "timeout", timeout)
+	}
+
+	// Named tile sources
+	if path := viper.GetString("server.sources"); path != "" {
+		if config.Sources, err = server.LoadSources(path); err != nil {
+			return err
+		}
+	}
+
+	// Object storage for output.destination, with the AWS SDK's environment variables
+	if endpoint := viper.GetString("server.s3-endpoint"); endpoint != "" {
+		config.S3 = &server.S3Config{
+			Endpoint:        endpoint,
+			Region:          viper.GetString("server.s3-region"),
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+			Destinations:    viper.GetStringSlice("server.s3-destinations"),
+		}
+		if config.S3.AccessKeyID == "" || config.S3.SecretAccessKey == "" {
+			return fmt.Errorf("--s3-endpoint requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+		if len(config.S3.Destinations) == 0 {
+			return fmt.Errorf("--s3-endpoint requires --s3-destinations")
+		}
+	}
+
+	// Prometheus metrics on the default registry
+	if viper.GetBool("server.metrics") {
+		config.Metrics = server.NewMetrics()
+		if err := config.Metrics.Register(prometheus.DefaultRegisterer); err != nil {
+			return fmt.Errorf("failed to register metrics: %v", err)
+		}
+		r.Handle("/metrics", promhttp.Handler())
+	}
+
 	// Create server implementation
-	apiServer := server.NewServer("2.0.0")
+	apiServer := server.NewServerWithConfig("2.0.0", config)
 
 	// Mount API routes at /api/v1
 	r.Route("/api/v1", func(r chi.Router) {
@@ -94,6 +234,7 @@ func runServe(cmd *cobra.Command, args []string) error {
 		handler := api.HandlerWithOptions(apiServer, api.ChiServerOptions{
 			BaseRouter: r,
 		})
+		apiServer.RegisterStitchMethods(r)
 		r.Mount("/", handler)
 	})
 
@@ -103,12 +244,7 @@ func runServe(cmd *cobra.Command, args []string) error {
 		http.Redirect(w, r, "/api/v1/health", http.StatusMovedPermanently)
 	})
 
-	httpServer := &http.Server{
-		Addr:         addr,
-		Handler:      r,
-		ReadTimeout:  timeout,
-		WriteTimeout: timeout,
-	}
+	httpServer := newHTTPServer(addr, r)
 
 	// Graceful shutdown
 	go func() {
@@ -116,19 +252,25 @@ func runServe(cmd *cobra.Command, args []string) error {
 		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 		<-sigChan
 
-		fmt.Fprintf(cmd.ErrOrStderr(), "\nShutting down server...\n")
+		logger.Info("shutting down server")
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 
 		if err := httpServer.Shutdown(ctx); err != nil {
-			log.Printf("Server shutdown error: %v", err)
+			logger.Error("server shutdown failed", "error", err)
 		}
 	}()
 
-	fmt.Fprintf(cmd.ErrOrStderr(), "Starting stitch server on %s\n", addr)
-	fmt.Fprintf(cmd.ErrOrStderr(), "API documentation: http://%s/\n", addr)
-	fmt.Fprintf(cmd.ErrOrStderr(), "Health check: http://%s/api/v1/health\n", addr)
-	fmt.Fprintf(cmd.ErrOrStderr(), "Stitch endpoint: http://%s/api/v1/stitch\n", addr)
+	endpoints := []any{
+		"addr", addr,
+		"docs", "http://" + addr + "/",
+		"health", "http://" + addr + "/api/v1/health",
+		"stitch", "http://" + addr + "/api/v1/stitch",
+	}
+	if config.Metrics != nil {
+		endpoints = append(endpoints, "metrics", "http://"+addr+"/metrics")
+	}
+	logger.Info("starting stitch server", endpoints...)
 
 	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
 		return fmt.Errorf("server error: %v", err)
@@ -136,3 +278,17 @@ func runServe(cmd *cobra.Command, args []string) error {
 
 	return nil
 }
+
+// newHTTPServer returns the server for handler with the connection timeouts
+// of the flags. The write timeout runs from reading the request to the end of
+// the response, so it covers both stitching and sending the image; unlike
+// --timeout it cuts a response off mid-body when it runs out.
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  viper.GetDuration("server.read-timeout"),
+		WriteTimeout: viper.GetDuration("server.write-timeout"),
+		IdleTimeout:  viper.GetDuration("server.idle-timeout"),
+	}
+}
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestNewHTTPServer_LargeResponse(t *testing.T) {
+	set := func(key string, value interface{}) {
+		viper.Set(key, value)
+		t.Cleanup(func() { viper.Set(key, nil) })
+	}
+
+	// A large image sent slowly, taking longer than the read timeout
+	const chunks, chunkSize = 16, 256 << 10
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		chunk := make([]byte, chunkSize)
+		for i := 0; i < chunks; i++ {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+	download := func() (int, error) {
+		server := httptest.NewUnstartedServer(handler)
+		server.Config = newHTTPServer("", handler)
+		server.Start()
+		defer server.Close()
+
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return len(body), err
+	}
+
+	set("server.read-timeout", 100*time.Millisecond)
+
+	// The default write timeout leaves the response time to finish
+	if n, err := download(); err != nil || n != chunks*chunkSize {
+		t.Errorf("Expected all %d bytes with the default write timeout, got %d (%v)", chunks*chunkSize, n, err)
+	}
+
+	// A write timeout as short as the old default of --timeout cuts it off
+	set("server.write-timeout", 100*time.Millisecond)
+	if n, err := download(); err == nil && n == chunks*chunkSize {
+		t.Error("Expected a write timeout of 100ms to truncate the response")
+	}
+}
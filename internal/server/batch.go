@@ -0,0 +1,163 @@
+package server
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/kiesman99/stitch/internal/api"
+	"github.com/kiesman99/stitch/pkg/stitch"
+)
+
+const (
+	// maxBatchSize is the most stitch requests one batch may contain
+	maxBatchSize = 50
+
+	// batchConcurrency is how many requests of a batch are stitched at once;
+	// each of them downloads with Config.Concurrency
+	batchConcurrency = 4
+)
+
+// batchOutcome is the result of one request of a batch
+type batchOutcome struct {
+	result *stitch.Result
+	item   api.BatchItem
+}
+
+// CreateStitchBatch stitches several requests and answers with a ZIP archive
+// of the images and a manifest. Failed requests don't abort the batch; the
+// manifest carries the error response /stitch would have sent for them.
+func (s *Server) CreateStitchBatch(w http.ResponseWriter, r *http.Request) {
+	requestID := generateRequestID()
+
+	var reqs []api.StitchRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		s.writeErrorResponse(w, http.StatusBadRequest, "INVALID_JSON",
+			"Invalid JSON in request body, expected an array of stitch requests", &requestID, nil)
+		return
+	}
+	if len(reqs) == 0 || len(reqs) > maxBatchSize {
+		s.writeErrorResponse(w, http.StatusBadRequest, "VALIDATION_ERROR",
+			fmt.Sprintf("a batch must contain 1 to %d stitch requests, got %d", maxBatchSize, len(reqs)), &requestID, nil)
+		return
+	}
+
+	// Stitch a few requests at a time, keeping the outcomes in request order
+	outcomes := make([]batchOutcome, len(reqs))
+	sem := make(chan struct{}, batchConcurrency)
+	var wg sync.WaitGroup
+	for i := range reqs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			outcomes[i] = s.stitchBatchItem(r.Context(), &reqs[i], i, fmt.Sprintf("%s_%d", requestID, i))
+		}(i)
+	}
+	wg.Wait()
+
+	manifest := api.BatchManifest{Items: make([]api.BatchItem, len(outcomes))}
+	for i, outcome := range outcomes {
+		manifest.Items[i] = outcome.item
+		if outcome.result != nil {
+			manifest.Succeeded++
+		} else {
+			manifest.Failed++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="stitch_batch.zip"`)
+	w.Header().Set("X-Request-ID", requestID)
+	w.WriteHeader(http.StatusOK)
+
+	if err := writeBatchZip(w, outcomes, manifest); err != nil {
+		s.log.Warn("writing batch response failed", "request_id", requestID, "error", err)
+	}
+}
+
+// stitchBatchItem stitches the request at index of a batch. Its error
+// response is recorded instead of sent, for the manifest.
+func (s *Server) stitchBatchItem(ctx context.Context, req *api.StitchRequest, index int, requestID string) batchOutcome {
+	rec := httptest.NewRecorder()
+	outcome := batchOutcome{item: api.BatchItem{Index: index}}
+
+	var result *stitch.Result
+	ok := false
+	if req.Output != nil && req.Output.Destination != nil {
+		s.writeValidationErrorResponse(rec, "output.destination isn't available in batches", &requestID)
+	} else {
+		result, _, ok = s.stitchRequest(ctx, rec, req, requestID)
+	}
+
+	if !ok {
+		outcome.item.Status = rec.Code
+		var errorResponse map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &errorResponse); err == nil {
+			outcome.item.Error = &errorResponse
+		}
+		return outcome
+	}
+
+	ext := "png"
+	if req.Output != nil && req.Output.Format != nil && *req.Output.Format == api.Geotiff {
+		ext = "tif"
+	}
+	file := fmt.Sprintf("%03d.%s", index+1, ext)
+	outcome.result = result
+	failedTiles := len(result.FailedTiles)
+	outcome.item.Status = http.StatusOK
+	outcome.item.File = &file
+	outcome.item.Width = &result.Width
+	outcome.item.Height = &result.Height
+	outcome.item.FailedTiles = &failedTiles
+	return outcome
+}
+
+// writeBatchZip writes the images of the successful outcomes and
+// manifest.json as a ZIP archive to w. The images are stored as they are, as
+// they're compressed already.
+func writeBatchZip(w io.Writer, outcomes []batchOutcome, manifest api.BatchManifest) error {
+	archive := zip.NewWriter(w)
+	modified := time.Now()
+
+	for _, outcome := range outcomes {
+		if outcome.result == nil {
+			continue
+		}
+		entry, err := archive.CreateHeader(&zip.FileHeader{
+			Name:     *outcome.item.File,
+			Method:   zip.Store,
+			Modified: modified,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := entry.Write(outcome.result.ImageData); err != nil {
+			return err
+		}
+	}
+
+	entry, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     "manifest.json",
+		Method:   zip.Deflate,
+		Modified: modified,
+	})
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(entry)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"image/png"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/kiesman99/stitch/internal/api"
+)
+
+func TestStitchBatchEndpoint(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+	tiles := pngTileServer(t)
+
+	request := func(url string) api.StitchRequest {
+		return api.StitchRequest{
+			Mode: api.Bbox,
+			Bbox: &api.BoundingBox{
+				MinLat: 37.7,
+				MinLon: -122.5,
+				MaxLat: 37.8,
+				MaxLon: -122.4,
+			},
+			Zoom: 10,
+			TileSource: api.TileSource{
+				Url: url,
+			},
+		}
+	}
+	batch := []api.StitchRequest{
+		request(tiles.URL + "/{z}/{x}/{y}.png"),
+		request("http://127.0.0.1:1/{z}/{x}/{y}.png"), // nothing listens there
+	}
+
+	jsonData, err := json.Marshal(batch)
+	if err != nil {
+		t.Fatalf("Failed to marshal request: %v", err)
+	}
+	resp, err := http.Post(server.URL+"/api/v1/stitch/batch", "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "application/zip" {
+		t.Errorf("Expected content type application/zip, got %s", contentType)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("Failed to open ZIP: %v", err)
+	}
+
+	files := make(map[string]*zip.File)
+	for _, file := range archive.File {
+		files[file.Name] = file
+	}
+	if len(files) != 2 || files["001.png"] == nil || files["manifest.json"] == nil {
+		t.Fatalf("Expected 001.png and manifest.json, got %v", files)
+	}
+
+	image, err := files["001.png"].Open()
+	if err != nil {
+		t.Fatalf("Failed to open image: %v", err)
+	}
+	defer image.Close()
+	config, err := png.DecodeConfig(image)
+	if err != nil {
+		t.Fatalf("Failed to decode image: %v", err)
+	}
+
+	manifestFile, err := files["manifest.json"].Open()
+	if err != nil {
+		t.Fatalf("Failed to open manifest: %v", err)
+	}
+	defer manifestFile.Close()
+	var manifest api.BatchManifest
+	if err := json.NewDecoder(manifestFile).Decode(&manifest); err != nil {
+		t.Fatalf("Failed to decode manifest: %v", err)
+	}
+
+	if manifest.Succeeded != 1 || manifest.Failed != 1 || len(manifest.Items) != 2 {
+		t.Fatalf("Expected 1 success and 1 failure, got %+v", manifest)
+	}
+
+	ok := manifest.Items[0]
+	if ok.Index != 0 || ok.Status != http.StatusOK || ok.File == nil || *ok.File != "001.png" {
+		t.Errorf("Expected item 0 to be 001.png with status 200, got %+v", ok)
+	}
+	if ok.Width == nil || ok.Height == nil || *ok.Width != config.Width || *ok.Height != config.Height {
+		t.Errorf("Expected the manifest to give the image size %dx%d, got %+v", config.Width, config.Height, ok)
+	}
+
+	failed := manifest.Items[1]
+	if failed.Index != 1 || failed.Status != http.StatusBadGateway || failed.File != nil {
+		t.Errorf("Expected item 1 to fail with status 502 and no file, got %+v", failed)
+	}
+	if failed.Error == nil || (*failed.Error)["error"] != "TILE_SERVER_ERROR" {
+		t.Errorf("Expected a TILE_SERVER_ERROR response for item 1, got %v", failed.Error)
+	}
+
+	t.Run("Empty batch", func(t *testing.T) {
+		resp, err := http.Post(server.URL+"/api/v1/stitch/batch", "application/json", bytes.NewBufferString("[]"))
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", resp.StatusCode)
+		}
+	})
+}
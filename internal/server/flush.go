@@ -0,0 +1,51 @@
+package server
+
+import (
+	"io"
+	"net/http"
+)
+
+// flushWriter writes to an http.ResponseWriter in chunks, flushing after each
+// one so bytes reach the client progressively instead of sitting in the
+// server's buffers. Writers that don't implement http.Flusher are written to
+// directly.
+type flushWriter struct {
+	w         io.Writer
+	flusher   http.Flusher
+	chunkSize int
+}
+
+// newFlushWriter returns a writer flushing every chunkSize bytes, or w itself
+// when chunkSize is not positive or w can't flush
+func newFlushWriter(w http.ResponseWriter, chunkSize int) io.Writer {
+	flusher, ok := w.(http.Flusher)
+	if !ok || chunkSize <= 0 {
+		return w
+	}
+
+	return &flushWriter{
+		w:         w,
+		flusher:   flusher,
+		chunkSize: chunkSize,
+	}
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > fw.chunkSize {
+			chunk = chunk[:fw.chunkSize]
+		}
+
+		n, err := fw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		fw.flusher.Flush()
+
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// flushRecorder records how many bytes had been written at each flush
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushedAt []int
+}
+
+func (r *flushRecorder) Flush() {
+	r.flushedAt = append(r.flushedAt, r.Body.Len())
+	r.ResponseRecorder.Flush()
+}
+
+// plainWriter is a ResponseWriter without http.Flusher
+type plainWriter struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *plainWriter) Header() http.Header         { return w.header }
+func (w *plainWriter) Write(p []byte) (int, error) { return w.body.Write(p) }
+func (w *plainWriter) WriteHeader(int)             {}
+
+func TestFlushWriter_IncrementalWrites(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 2500)
+
+	rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	n, err := newFlushWriter(rec, 1000).Write(data)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if n != len(data) {
+		t.Errorf("Expected %d bytes written, got %d", len(data), n)
+	}
+
+	expected := []int{1000, 2000, 2500}
+	if len(rec.flushedAt) != len(expected) {
+		t.Fatalf("Expected flushes at %v, got %v", expected, rec.flushedAt)
+	}
+	for i := range expected {
+		if rec.flushedAt[i] != expected[i] {
+			t.Errorf("Expected flushes at %v, got %v", expected, rec.flushedAt)
+			break
+		}
+	}
+	if !bytes.Equal(rec.Body.Bytes(), data) {
+		t.Error("Expected body to match written data")
+	}
+}
+
+func TestFlushWriter_WithoutFlusher(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 2500)
+
+	w := &plainWriter{header: http.Header{}}
+	if _, err := newFlushWriter(w, 1000).Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if !bytes.Equal(w.body.Bytes(), data) {
+		t.Error("Expected body to match written data")
+	}
+}
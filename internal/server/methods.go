@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/kiesman99/stitch/internal/api"
+)
+
+// stitchAllow lists the methods of the stitch endpoint for the Allow header
+var stitchAllow = []string{http.MethodPost, http.MethodHead, http.MethodOptions}
+
+// RegisterStitchMethods adds the methods of the stitch endpoint that aren't in
+// the API spec to r, which must be the router the generated handler uses:
+// HEAD and a JSON 405 for every other method.
+func (s *Server) RegisterStitchMethods(r chi.Router) {
+	r.Head("/stitch", s.HeadStitch)
+	for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		r.MethodFunc(method, "/stitch", s.stitchMethodNotAllowed)
+	}
+}
+
+// HeadStitch answers with the headers a POST of the same request would get,
+// from the bounds alone: nothing is downloaded, so there's no Content-Length.
+func (s *Server) HeadStitch(w http.ResponseWriter, r *http.Request) {
+	requestID := generateRequestID()
+
+	var req api.StitchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeErrorResponse(w, http.StatusBadRequest, "INVALID_JSON",
+			"Invalid JSON in request body", &requestID, nil)
+		return
+	}
+
+	// Hash the request as sent, like POST does, before a named source is
+	// resolved into it
+	answerJSON := wantsJSON(r, queryFormat(r))
+	etag := s.stitchETag(&req, answerJSON)
+	opts, bounds, ok := s.validateRequest(w, &req, requestID)
+	if !ok {
+		return
+	}
+
+	contentType := "image/png"
+	if answerJSON {
+		contentType = "application/json"
+	} else if req.Output != nil && req.Output.Format != nil && *req.Output.Format == api.Geotiff {
+		contentType = "image/tiff"
+	}
+
+	w.Header().Set("Vary", "Accept")
+	w.Header().Set("X-Request-ID", requestID)
+	w.Header().Set("X-Stitch-Dimensions", strconv.Itoa(bounds.Width)+"x"+strconv.Itoa(bounds.Height))
+	w.Header().Set("X-Stitch-Tile-Count", strconv.FormatInt(bounds.TileCount()*int64(opts.SourcesPerTile()), 10))
+	if req.Output == nil || req.Output.Destination == nil {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", cacheControlFor(&req))
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+}
+
+// queryFormat returns the format query parameter of r, which the generated
+// HEAD handler doesn't parse
+func queryFormat(r *http.Request) *api.CreateStitchedImageParamsFormat {
+	if !r.URL.Query().Has("format") {
+		return nil
+	}
+	format := api.CreateStitchedImageParamsFormat(r.URL.Query().Get("format"))
+	return &format
+}
+
+// stitchMethodNotAllowed rejects methods the stitch endpoint doesn't support
+func (s *Server) stitchMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	requestID := generateRequestID()
+	w.Header().Set("Allow", strings.Join(stitchAllow, ", "))
+	s.writeErrorResponse(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED",
+		r.Method+" is not supported; send the stitch request with POST", &requestID, nil)
+}
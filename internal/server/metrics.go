@@ -0,0 +1,92 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics holds the Prometheus collectors for the stitch service
+type Metrics struct {
+	StitchRequests  *prometheus.CounterVec
+	TilesDownloaded prometheus.Counter
+	TileFailures    prometheus.Counter
+	StitchDuration  prometheus.Histogram
+	OutputBytes     prometheus.Counter
+}
+
+// NewMetrics creates the stitch collectors; they still need to be registered
+func NewMetrics() *Metrics {
+	return &Metrics{
+		StitchRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "stitch_requests_total",
+			Help: "Total number of stitch requests by HTTP status code.",
+		}, []string{"code"}),
+		TilesDownloaded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "stitch_tiles_downloaded_total",
+			Help: "Total number of tiles downloaded successfully.",
+		}),
+		TileFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "stitch_tile_failures_total",
+			Help: "Total number of failed tile downloads.",
+		}),
+		StitchDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "stitch_duration_seconds",
+			Help:    "Time spent downloading and stitching tiles.",
+			Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+		}),
+		OutputBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "stitch_output_bytes_total",
+			Help: "Total number of image bytes returned to clients.",
+		}),
+	}
+}
+
+// Register registers all collectors with the given registerer
+func (m *Metrics) Register(reg prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{
+		m.StitchRequests,
+		m.TilesDownloaded,
+		m.TileFailures,
+		m.StitchDuration,
+		m.OutputBytes,
+	} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// observeTile records the outcome of a single tile download
+func (m *Metrics) observeTile(url string, ok bool) {
+	if ok {
+		m.TilesDownloaded.Inc()
+	} else {
+		m.TileFailures.Inc()
+	}
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush keeps streaming working through the recorder
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// code returns the recorded status code as a label value
+func (r *statusRecorder) code() string {
+	return strconv.Itoa(r.status)
+}
@@ -2,34 +2,114 @@ package server
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/kiesman99/stitch/internal/api"
-	"github.com/kiesman99/stitch/internal/stitcher"
+	"github.com/kiesman99/stitch/pkg/stitch"
+	"github.com/kiesman99/stitch/pkg/tile"
 )
 
 // Server implements the ServerInterface from the generated API
 type Server struct {
 	startTime time.Time
 	version   string
+	config    Config
+	stitcher  *stitch.Stitcher // shared so tile connections are reused across requests
+	log       *slog.Logger
+}
+
+// Config holds server-wide stitching settings that clients can't override
+type Config struct {
+	Concurrency  int           // parallel tile downloads per stitch
+	RampUp       time.Duration // slow-start period before all download workers run
+	Metrics      *Metrics      // optional Prometheus instrumentation
+	FlushBytes   int           // flush the image response every this many bytes; 0 writes it in one piece
+	MaxPixels    int64         // output size limit; 0 uses the stitcher default
+	MaxTiles     int           // tile count limit per stitch; 0 is unlimited
+	VerifyOutput bool          // re-decode every encoded image before sending it
+
+	// StitchTimeout caps the total time of one stitch; when it runs out the
+	// request fails with TILE_SERVER_TIMEOUT. 0 leaves only the request timeout.
+	StitchTimeout time.Duration
+
+	// TileTimeout caps each tile request; stitches whose failed tiles mostly
+	// timed out fail with TILE_SERVER_TIMEOUT instead of TILE_SERVER_ERROR.
+	// 0 uses the stitcher's 30 seconds.
+	TileTimeout time.Duration
+
+	RateLimitRetries int  // retries of tiles the tile server rate limits (429)
+	ClampLatitude    bool // clamp latitudes beyond ±85.0511° with a warning instead of rejecting them
+	GeoHeaders       bool // send the georeferencing of stitched images as X-Min-X, X-Max-Y, ... headers
+
+	// S3 is the storage for output.destination uploads; nil rejects them
+	S3 *S3Config
+
+	// AllowedHosts limits tile and layer URLs to these hosts; "*.example.com"
+	// also allows its subdomains. Empty allows every host.
+	AllowedHosts []string
+
+	// BlockPrivateHosts rejects tile URLs on loopback, private and link-local
+	// addresses and refuses connections to host names that resolve to them
+	BlockPrivateHosts bool
+
+	// Sources are the named tile sources requests can use by name instead
+	// of a URL
+	Sources map[string]NamedSource
+
+	// HealthProbeURL is a tile URL (template) fetched by deep health checks
+	HealthProbeURL string
+
+	// Transport tunes the connection pool shared by all stitches. An unset
+	// MaxIdleConnsPerHost keeps at least Concurrency connections per host.
+	Transport tile.TransportOptions
+
+	// Logger receives request problems and tile failures; nil uses slog.Default
+	Logger *slog.Logger
 }
 
 // NewServer creates a new server instance
 func NewServer(version string) *Server {
+	return NewServerWithConfig(version, Config{})
+}
+
+// NewServerWithConfig creates a new server instance with the given settings
+func NewServerWithConfig(version string, config Config) *Server {
+	transport := config.Transport
+	if transport.MaxIdleConnsPerHost == 0 {
+		transport.MaxIdleConnsPerHost = max(config.Concurrency, tile.DefaultMaxIdleConnsPerHost)
+	}
+	transport.BlockPrivateAddresses = config.BlockPrivateHosts
+
+	logger := config.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
 	return &Server{
 		startTime: time.Now(),
 		version:   version,
+		config:    config,
+		stitcher:  stitch.NewWithTransport(transport),
+		log:       logger,
 	}
 }
 
+// healthProbeTimeout bounds the tile fetch of a deep health check
+const healthProbeTimeout = 5 * time.Second
+
 // GetHealth implements the health check endpoint
-func (s *Server) GetHealth(w http.ResponseWriter, r *http.Request) {
+func (s *Server) GetHealth(w http.ResponseWriter, r *http.Request, params api.GetHealthParams) {
 	uptime := int(time.Since(s.startTime).Seconds())
 
 	response := api.HealthResponse{
@@ -39,19 +119,71 @@ func (s *Server) GetHealth(w http.ResponseWriter, r *http.Request) {
 		Version:   &s.version,
 	}
 
+	// Deep checks find out whether stitching can work at all; the plain
+	// check stays cheap for liveness probes
+	status := http.StatusOK
+	if params.Deep != nil && *params.Deep && s.config.HealthProbeURL != "" {
+		check := s.probeTileSource(r.Context())
+		response.Checks = &[]api.HealthCheck{check}
+		if check.Status != api.Ok {
+			response.Status = api.Degraded
+			status = http.StatusServiceUnavailable
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(status)
 
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Error encoding health response: %v", err)
+		s.log.Error("encoding health response failed", "error", err)
 	}
 }
 
+// probeTileSource fetches the tile at HealthProbeURL and checks that it
+// decodes
+func (s *Server) probeTileSource(ctx context.Context) api.HealthCheck {
+	ctx, cancel := context.WithTimeout(ctx, healthProbeTimeout)
+	defer cancel()
+
+	start := time.Now()
+	url := tile.BuildURL(s.config.HealthProbeURL, 0, 0, 0)
+	result, err := tile.NewProcessor(tile.DefaultUserAgent).Probe(ctx, url)
+	check := api.HealthCheck{
+		Name:       "tile_source",
+		Status:     api.Ok,
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+
+	switch {
+	case err != nil:
+		err = fmt.Errorf("can't reach tile source: %v", err)
+	case result.Status != http.StatusOK:
+		err = fmt.Errorf("HTTP %d: %s", result.Status, result.StatusText)
+	case result.DecodeError != nil:
+		err = fmt.Errorf("tile doesn't decode: %v", result.DecodeError)
+	}
+	if err != nil {
+		message := err.Error()
+		check.Status = api.Failed
+		check.Error = &message
+	}
+	return check
+}
+
 // CreateStitchedImage implements the main stitching endpoint
-func (s *Server) CreateStitchedImage(w http.ResponseWriter, r *http.Request) {
+func (s *Server) CreateStitchedImage(w http.ResponseWriter, r *http.Request, params api.CreateStitchedImageParams) {
 	// Generate request ID for tracking
 	requestID := generateRequestID()
 
+	// Record the response status for metrics
+	if s.config.Metrics != nil {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		w = rec
+		defer func() {
+			s.config.Metrics.StitchRequests.WithLabelValues(rec.code()).Inc()
+		}()
+	}
+
 	// Parse request body
 	var req api.StitchRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -60,52 +192,443 @@ func (s *Server) CreateStitchedImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate request
-	if err := s.validateStitchRequest(&req); err != nil {
-		s.writeValidationErrorResponse(w, err.Error(), &requestID)
+	// The same request gives the same image, so a client holding it
+	// doesn't need it stitched again. Uploads are never skipped. The JSON
+	// answer is another representation, so it has its own entity tag.
+	upload := req.Output != nil && req.Output.Destination != nil
+	answerJSON := wantsJSON(r, params.Format)
+	etag := s.stitchETag(&req, answerJSON)
+	w.Header().Set("Vary", "Accept")
+
+	// Invalid requests fail even for a client claiming to hold the image
+	opts, _, ok := s.validateRequest(w, &req, requestID)
+	if !ok {
 		return
 	}
-
-	// Convert API request to stitcher options
-	opts, err := s.convertToStitcherOptions(&req)
-	if err != nil {
-		s.writeErrorResponse(w, http.StatusBadRequest, "INVALID_REQUEST",
-			err.Error(), &requestID, nil)
+	if !upload && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", cacheControlFor(&req))
+		w.Header().Set("X-Request-ID", requestID)
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
-	// Create stitcher instance
-	st := stitcher.New()
-
-	// Perform stitching
-	result, err := st.Stitch(r.Context(), opts)
-	if err != nil {
-		s.handleStitchingError(w, err, &requestID)
+	result, ok := s.stitchValidated(r.Context(), w, opts, requestID)
+	if !ok {
 		return
 	}
 
+	// Failed tiles may load next time, so partial images aren't cached
+	// and get no entity tag that would answer later requests with 304
+	cacheControl := cacheControlFor(&req)
+	if len(result.FailedTiles) > 0 {
+		etag, cacheControl = "", "no-store"
+	}
+
 	// Set appropriate content type based on output format
 	format := api.Png // default
 	if req.Output != nil && req.Output.Format != nil {
 		format = *req.Output.Format
 	}
 
-	switch format {
-	case api.Png:
-		w.Header().Set("Content-Type", "image/png")
-	case api.Geotiff:
-		w.Header().Set("Content-Type", "image/tiff")
+	contentType := "image/png"
+	if format == api.Geotiff {
+		contentType = "image/tiff"
+	}
+
+	// Upload to object storage and answer with its location instead of the image
+	if upload {
+		url, err := s.config.S3.upload(r.Context(), *req.Output.Destination, contentType, result.ImageData)
+		if err != nil {
+			s.log.Error("upload failed", "request_id", requestID, "destination", *req.Output.Destination, "error", err)
+			s.writeErrorResponse(w, http.StatusBadGateway, "UPLOAD_FAILED",
+				"Failed to upload the image to "+*req.Output.Destination, &requestID, nil)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Request-ID", requestID)
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(api.UploadResponse{
+			Url:    url,
+			Bytes:  int64(len(result.ImageData)),
+			Width:  result.Width,
+			Height: result.Height,
+		}); err != nil {
+			s.log.Error("encoding upload response failed", "request_id", requestID, "error", err)
+		}
+		return
+	}
+
+	// Answer with the image and every tile that failed in one JSON object,
+	// for clients that can't read the headers of a partial stitch
+	if answerJSON {
+		w.Header().Set("Content-Type", "application/json")
+		setCacheHeaders(w.Header(), etag, cacheControl)
+		w.Header().Set("X-Request-ID", requestID)
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(api.StitchJSONResponse{
+			Image:           result.ImageData,
+			ContentType:     contentType,
+			Width:           result.Width,
+			Height:          result.Height,
+			FailedTiles:     apiFailedTiles(result.FailedTiles),
+			SuccessfulTiles: result.SuccessfulTiles,
+			TotalTiles:      result.TotalTiles,
+		}); err != nil {
+			s.log.Error("encoding JSON response failed", "request_id", requestID, "error", err)
+		}
+		return
 	}
 
+	w.Header().Set("Content-Type", contentType)
+	setCacheHeaders(w.Header(), etag, cacheControl)
+
 	// Set additional headers
 	w.Header().Set("X-Request-ID", requestID)
+	if result.Empty {
+		w.Header().Set("X-Empty", "true")
+	}
+	// Report how much of the area the source declares data for
+	if opts.Coverage != nil {
+		w.Header().Set("X-Coverage", strconv.FormatFloat(result.CoveragePercent, 'f', 1, 64))
+		if result.CoveragePercent < 100 {
+			s.log.Info("tile source covers only part of the area", "request_id", requestID, "coverage_percent", result.CoveragePercent)
+		}
+	}
+	// Warn when the area was cut off at the Web Mercator latitude limit
+	if result.LatitudeClamped {
+		w.Header().Set("Warning", `199 - "latitude clamped to the Web Mercator range of ±85.0511°"`)
+		s.log.Info("latitude clamped", "request_id", requestID, "max_lat", stitch.MaxMercatorLat)
+	}
+	if result.FallbackTiles > 0 {
+		w.Header().Set("X-Tiles-Fallback", strconv.Itoa(result.FallbackTiles))
+	}
+	// Tell clients about holes left by failed tiles
+	if len(result.FailedTiles) > 0 {
+		w.Header().Set("X-Tiles-Failed", strconv.Itoa(len(result.FailedTiles)))
+		w.Header().Set("X-Tiles-Total", strconv.Itoa(result.TotalTiles))
+	}
+	if s.config.GeoHeaders {
+		setGeoHeaders(w.Header(), result)
+	}
 	w.Header().Set("Content-Length", strconv.Itoa(len(result.ImageData)))
 
 	// Write image data
 	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write(result.ImageData); err != nil {
-		log.Printf("Error writing response: %v", err)
+	if _, err := newFlushWriter(w, s.config.FlushBytes).Write(result.ImageData); err != nil {
+		s.log.Warn("writing response failed", "request_id", requestID, "error", err)
 	}
+	if s.config.Metrics != nil {
+		s.config.Metrics.OutputBytes.Add(float64(len(result.ImageData)))
+	}
+}
+
+// wantsJSON reports whether r asks for the JSON answer instead of the image,
+// with ?format=json or an Accept header preferring JSON to images
+func wantsJSON(r *http.Request, format *api.CreateStitchedImageParamsFormat) bool {
+	if format != nil {
+		return *format == api.Json
+	}
+	return prefersJSON(r.Header.Get("Accept"))
+}
+
+// prefersJSON reports whether an Accept header rates application/json
+// strictly higher than images. Clients sending */* or image/* along with
+// application/json at the same quality still get the image, and q=0 refuses
+// a type.
+func prefersJSON(accept string) bool {
+	jsonQuality := acceptQuality(accept, "application/json")
+	return jsonQuality > 0 && jsonQuality > acceptQuality(accept, "image/png")
+}
+
+// acceptQuality returns the q value an Accept header gives mediaType, from its
+// most specific matching media range: 1 when the header is empty and 0 when no
+// range matches
+func acceptQuality(accept, mediaType string) float64 {
+	if strings.TrimSpace(accept) == "" {
+		return 1
+	}
+	typ, _, _ := strings.Cut(mediaType, "/")
+	quality, specificity := 0.0, 0
+	for _, part := range strings.Split(accept, ",") {
+		rangeType, params, _ := strings.Cut(part, ";")
+		rangeType = strings.ToLower(strings.TrimSpace(rangeType))
+		var matches int
+		switch rangeType {
+		case mediaType:
+			matches = 3
+		case typ + "/*":
+			matches = 2
+		case "*/*":
+			matches = 1
+		default:
+			continue
+		}
+		if matches <= specificity {
+			continue
+		}
+		specificity = matches
+		quality = 1
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(param, "=")
+			if strings.EqualFold(strings.TrimSpace(name), "q") {
+				if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					quality = q
+				}
+			}
+		}
+	}
+	return quality
+}
+
+// GeoHeaderNames are the response headers with the georeferencing of a
+// stitched image; browsers only let scripts read them when they're exposed
+var GeoHeaderNames = []string{"X-Min-X", "X-Max-Y", "X-Pixel-Size-X", "X-Pixel-Size-Y", "X-CRS"}
+
+// setGeoHeaders sets the upper-left corner, pixel size and CRS of result, the
+// geotransform of a world file, so clients can georeference the image
+func setGeoHeaders(h http.Header, result *stitch.Result) {
+	format := func(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
+	h.Set("X-Min-X", format(result.MinX))
+	h.Set("X-Max-Y", format(result.MaxY))
+	h.Set("X-Pixel-Size-X", format(result.PixelSizeX))
+	h.Set("X-Pixel-Size-Y", format(result.PixelSizeY))
+	h.Set("X-CRS", fmt.Sprintf("EPSG:%d", result.CRS))
+}
+
+// stitchRequest validates req and stitches it, or writes the error response to w
+// and returns false
+func (s *Server) stitchRequest(ctx context.Context, w http.ResponseWriter, req *api.StitchRequest, requestID string) (*stitch.Result, *stitch.Options, bool) {
+	opts, _, ok := s.validateRequest(w, req, requestID)
+	if !ok {
+		return nil, nil, false
+	}
+	result, ok := s.stitchValidated(ctx, w, opts, requestID)
+	return result, opts, ok
+}
+
+// validateRequest is previewRequest that also rejects requests that would
+// need too many tiles or pixels, before allocating or downloading anything
+func (s *Server) validateRequest(w http.ResponseWriter, req *api.StitchRequest, requestID string) (*stitch.Options, *stitch.Bounds, bool) {
+	opts, bounds, ok := s.previewRequest(w, req, requestID)
+	if !ok {
+		return nil, nil, false
+	}
+	if err := stitch.CheckLimits(opts, bounds); err != nil {
+		s.handleStitchingError(w, err, &requestID)
+		return nil, nil, false
+	}
+	return opts, bounds, true
+}
+
+// stitchValidated stitches the options of a request validateRequest
+// accepted, or writes the error response to w and returns false
+func (s *Server) stitchValidated(ctx context.Context, w http.ResponseWriter, opts *stitch.Options, requestID string) (*stitch.Result, bool) {
+	// Sources like tile.openstreetmap.org block the default User-Agent
+	userAgent := opts.UserAgent
+	for name, value := range opts.Headers {
+		if userAgent == "" && strings.EqualFold(name, "User-Agent") {
+			userAgent = value
+		}
+	}
+	for _, url := range opts.TileURLs {
+		if warning := tile.UserAgentWarning(url, userAgent); warning != "" {
+			s.log.Warn(warning, "request_id", requestID, "url", url)
+		}
+	}
+	opts.Logger = s.log.With("request_id", requestID)
+
+	// Perform stitching
+	if s.config.StitchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.config.StitchTimeout)
+		defer cancel()
+	}
+	stitchStart := time.Now()
+	result, err := s.stitcher.Stitch(ctx, opts)
+	if s.config.Metrics != nil {
+		s.config.Metrics.StitchDuration.Observe(time.Since(stitchStart).Seconds())
+	}
+	if err != nil {
+		// Tiles cut off by the deadline show up as failed tiles; report the
+		// deadline itself
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = context.DeadlineExceeded
+		}
+		s.handleStitchingError(w, err, &requestID)
+		return nil, false
+	}
+
+	return result, true
+}
+
+// PreviewStitch reports the tile count and image size of a stitch request
+// without downloading anything
+func (s *Server) PreviewStitch(w http.ResponseWriter, r *http.Request) {
+	requestID := generateRequestID()
+
+	var req api.StitchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeErrorResponse(w, http.StatusBadRequest, "INVALID_JSON",
+			"Invalid JSON in request body", &requestID, nil)
+		return
+	}
+
+	opts, bounds, ok := s.previewRequest(w, &req, requestID)
+	if !ok {
+		return
+	}
+
+	response := api.PreviewResponse{
+		TileCount:      bounds.TileCount() * int64(opts.SourcesPerTile()),
+		OutputWidth:    bounds.Width,
+		OutputHeight:   bounds.Height,
+		EstimatedBytes: int64(bounds.Width) * int64(bounds.Height) * 4,
+		TileRange: api.TileRange{
+			MinX: int64(bounds.MinTileX),
+			MinY: int64(bounds.MinTileY),
+			MaxX: int64(bounds.MaxTileX),
+			MaxY: int64(bounds.MaxTileY),
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Request-ID", requestID)
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		s.log.Error("encoding preview response failed", "request_id", requestID, "error", err)
+	}
+}
+
+// previewRequest validates req and computes its bounds without downloading
+// anything, or writes the error response to w and returns false
+func (s *Server) previewRequest(w http.ResponseWriter, req *api.StitchRequest, requestID string) (*stitch.Options, *stitch.Bounds, bool) {
+	if err := s.resolveSource(req); err != nil {
+		s.writeValidationErrorResponse(w, err.Error(), &requestID)
+		return nil, nil, false
+	}
+	if err := s.validateStitchRequest(req); err != nil {
+		s.writeValidationErrorResponse(w, err.Error(), &requestID)
+		return nil, nil, false
+	}
+	if err := s.checkHosts(req); err != nil {
+		s.writeHostNotAllowed(w, err, &requestID)
+		return nil, nil, false
+	}
+
+	opts, err := s.convertToStitcherOptions(req)
+	if err != nil {
+		s.writeErrorResponse(w, http.StatusBadRequest, "INVALID_REQUEST",
+			err.Error(), &requestID, nil)
+		return nil, nil, false
+	}
+	if err := stitch.CheckHosts(opts); err != nil {
+		s.writeHostNotAllowed(w, fmt.Errorf("tile URL: %v", err), &requestID)
+		return nil, nil, false
+	}
+
+	bounds, err := stitch.ComputeBounds(opts)
+	if err != nil {
+		s.writeErrorResponse(w, http.StatusBadRequest, "INVALID_REQUEST",
+			err.Error(), &requestID, nil)
+		return nil, nil, false
+	}
+
+	return opts, bounds, true
+}
+
+// GetTile proxies a single tile through the stitcher's download path
+func (s *Server) GetTile(w http.ResponseWriter, r *http.Request, params api.GetTileParams) {
+	requestID := generateRequestID()
+
+	if err := validateTileTemplate("url", params.Url); err != nil {
+		s.writeValidationErrorResponse(w, err.Error(), &requestID)
+		return
+	}
+	if err := s.hostPolicy().Check(params.Url); err != nil {
+		s.writeHostNotAllowed(w, fmt.Errorf("url: %v", err), &requestID)
+		return
+	}
+	if params.Z < 0 || params.Z > 20 {
+		s.writeValidationErrorResponse(w, "z must be between 0 and 20", &requestID)
+		return
+	}
+	if n := int64(1) << params.Z; params.X < 0 || params.X >= n || params.Y < 0 || params.Y >= n {
+		s.writeValidationErrorResponse(w, fmt.Sprintf("x and y must be between 0 and %d at zoom %d", n-1, params.Z), &requestID)
+		return
+	}
+
+	opts := &stitch.Options{
+		TileURLs:         []string{params.Url},
+		RateLimitRetries: s.config.RateLimitRetries,
+		HostPolicy:       s.hostPolicy(),
+		Logger:           s.log.With("request_id", requestID),
+	}
+	if s.config.Metrics != nil {
+		opts.OnTile = s.config.Metrics.observeTile
+	}
+
+	ctx := r.Context()
+	if s.config.StitchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.config.StitchTimeout)
+		defer cancel()
+	}
+	t, err := s.stitcher.FetchTile(ctx, opts, params.Z, uint32(params.X), uint32(params.Y))
+	if err != nil {
+		var rateErr *stitch.RateLimitError
+		var hostErr *tile.HostError
+		switch {
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			s.handleStitchingError(w, context.DeadlineExceeded, &requestID)
+		case errors.As(err, &hostErr):
+			s.writeHostNotAllowed(w, fmt.Errorf("url: %v", err), &requestID)
+		case errors.As(err, &rateErr):
+			w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(rateErr.RetryAfter.Seconds())), 1)))
+			s.writeErrorResponse(w, http.StatusServiceUnavailable, "TILE_SERVER_RATE_LIMITED",
+				err.Error(), &requestID, nil)
+		default:
+			s.writeErrorResponse(w, http.StatusBadGateway, "TILE_SERVER_ERROR",
+				err.Error(), &requestID, nil)
+		}
+		return
+	}
+
+	w.Header().Set("X-Request-ID", requestID)
+	if len(t.Data) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", t.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(t.Data)))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(t.Data); err != nil {
+		s.log.Warn("writing response failed", "request_id", requestID, "error", err)
+	}
+}
+
+// checkTileRange checks that the tile range of a tilerange request is
+// ordered and exists at its zoom in the tile scheme of its output CRS
+func checkTileRange(req *api.StitchRequest) error {
+	r := req.TileRange
+	if r.MinX < 0 || r.MinY < 0 {
+		return fmt.Errorf("tile_range coordinates must not be negative")
+	}
+	if r.MinX > r.MaxX || r.MinY > r.MaxY {
+		return fmt.Errorf("tile_range min_x and min_y must not exceed max_x and max_y")
+	}
+
+	// The WGS84 scheme is two tiles wide at zoom 0
+	columns, rows := int64(1)<<req.Zoom, int64(1)<<req.Zoom
+	if req.Output != nil && req.Output.Crs != nil && int(*req.Output.Crs) == stitch.CRSWGS84 {
+		columns *= 2
+	}
+	if r.MaxX >= columns || r.MaxY >= rows {
+		return fmt.Errorf("tile_range exceeds the %dx%d tiles of zoom %d", columns, rows, req.Zoom)
+	}
+	return nil
 }
 
 // validateStitchRequest validates the incoming stitch request
@@ -116,55 +639,281 @@ func (s *Server) validateStitchRequest(req *api.StitchRequest) error {
 		if req.Bbox == nil {
 			return fmt.Errorf("bbox is required when mode is 'bbox'")
 		}
-		if req.Center != nil {
-			return fmt.Errorf("center should not be provided when mode is 'bbox'")
+		if req.Center != nil || req.TileRange != nil {
+			return fmt.Errorf("center or tile_range should not be provided when mode is 'bbox'")
 		}
 		// Validate bbox bounds
 		if req.Bbox.MinLat >= req.Bbox.MaxLat {
 			return fmt.Errorf("min_lat must be less than max_lat")
 		}
-		if req.Bbox.MinLon >= req.Bbox.MaxLon {
+		if req.Bbox.MinLon > req.Bbox.MaxLon {
+			return stitch.ErrAntimeridian
+		}
+		if req.Bbox.MinLon == req.Bbox.MaxLon {
 			return fmt.Errorf("min_lon must be less than max_lon")
 		}
 	case api.Centered:
 		if req.Center == nil {
 			return fmt.Errorf("center is required when mode is 'centered'")
 		}
-		if req.Bbox != nil {
-			return fmt.Errorf("bbox should not be provided when mode is 'centered'")
+		if req.Bbox != nil || req.TileRange != nil {
+			return fmt.Errorf("bbox or tile_range should not be provided when mode is 'centered'")
 		}
-		// Validate center dimensions
-		if req.Center.Width <= 0 || req.Center.Height <= 0 {
+		// Validate center dimensions, given either in pixels or in meters
+		center := req.Center
+		if center.WidthMeters != nil || center.HeightMeters != nil {
+			if center.Width != nil || center.Height != nil {
+				return fmt.Errorf("width and height can't be combined with width_meters and height_meters")
+			}
+			if center.WidthMeters == nil || center.HeightMeters == nil {
+				return fmt.Errorf("width_meters and height_meters must be given together")
+			}
+			if *center.WidthMeters <= 0 || *center.HeightMeters <= 0 {
+				return fmt.Errorf("width_meters and height_meters must be positive")
+			}
+		} else if center.Width == nil || center.Height == nil || *center.Width <= 0 || *center.Height <= 0 {
 			return fmt.Errorf("width and height must be positive")
 		}
+	case api.Tilerange:
+		if req.TileRange == nil {
+			return fmt.Errorf("tile_range is required when mode is 'tilerange'")
+		}
+		if req.Bbox != nil || req.Center != nil {
+			return fmt.Errorf("bbox or center should not be provided when mode is 'tilerange'")
+		}
 	default:
 		return fmt.Errorf("invalid mode: %s", req.Mode)
 	}
 
+	// Web Mercator can't represent the poles; reject such latitudes unless
+	// the server clamps them
+	if !s.config.ClampLatitude && (req.Output == nil || req.Output.Crs == nil || int(*req.Output.Crs) == stitch.CRSWebMercator) {
+		lats := []float32{}
+		if req.Bbox != nil {
+			lats = append(lats, req.Bbox.MinLat, req.Bbox.MaxLat)
+		}
+		if req.Center != nil {
+			lats = append(lats, req.Center.Lat)
+		}
+		for _, lat := range lats {
+			if math.Abs(float64(lat)) > stitch.MaxMercatorLat {
+				return fmt.Errorf("latitude %g is outside the Web Mercator range of ±85.0511°", lat)
+			}
+		}
+	}
+
 	// Validate zoom level
 	if req.Zoom < 0 || req.Zoom > 20 {
 		return fmt.Errorf("zoom must be between 0 and 20")
 	}
+	if req.TileRange != nil {
+		if err := checkTileRange(req); err != nil {
+			return err
+		}
+	}
 
 	// Validate tile source URL
 	if req.TileSource.Url == "" {
-		return fmt.Errorf("tile_source.url is required")
+		return fmt.Errorf("tile_source.url or the name of a configured source is required")
+	}
+	if err := validateTileTemplate("tile_source.url", req.TileSource.Url); err != nil {
+		return err
+	}
+
+	// Validate custom placeholder names
+	if req.TileSource.Params != nil {
+		for name := range *req.TileSource.Params {
+			if name == "" {
+				return fmt.Errorf("tile_source.params can't have an empty name")
+			}
+			if slices.Contains(stitch.ReservedPlaceholders(), name) {
+				return fmt.Errorf("tile_source.params can't override the {%s} placeholder", name)
+			}
+		}
+	}
+
+	// Validate the tile request method
+	if req.TileSource.Method != nil {
+		switch *req.TileSource.Method {
+		case api.GET, api.POST:
+		default:
+			return fmt.Errorf("tile_source.method must be GET or POST")
+		}
+	}
+	if req.TileSource.Body != nil && (req.TileSource.Method == nil || *req.TileSource.Method != api.POST) {
+		return fmt.Errorf("tile_source.body requires method POST")
+	}
+
+	// Validate credentials
+	if req.TileSource.BasicAuth != nil && req.TileSource.BearerToken != nil {
+		return fmt.Errorf("tile_source.basic_auth and tile_source.bearer_token can't be combined")
+	}
+
+	// Validate the proxy
+	if req.TileSource.ProxyUrl != nil {
+		if _, err := tile.ParseProxy(*req.TileSource.ProxyUrl); err != nil {
+			return fmt.Errorf("tile_source.proxy_url: %v", err)
+		}
+	}
+
+	// Validate declared source coverage
+	if b := req.TileSource.Bounds; b != nil {
+		if len(*b) != 4 {
+			return fmt.Errorf("tile_source.bounds must be [min_lon, min_lat, max_lon, max_lat]")
+		}
+		if (*b)[0] >= (*b)[2] || (*b)[1] >= (*b)[3] {
+			return fmt.Errorf("tile_source.bounds minimums must be less than maximums")
+		}
+	}
+	if req.TileSource.Minzoom != nil && req.TileSource.Maxzoom != nil && *req.TileSource.Minzoom > *req.TileSource.Maxzoom {
+		return fmt.Errorf("tile_source.minzoom must not be greater than maxzoom")
+	}
+	if err := checkZoomRange(req); err != nil {
+		return err
+	}
+
+	// Validate failure thresholds
+	if req.Output != nil && req.Output.MaxFailureRatio != nil {
+		if ratio := *req.Output.MaxFailureRatio; ratio < 0 || ratio > 1 {
+			return fmt.Errorf("output.max_failure_ratio must be between 0 and 1")
+		}
+	}
+	if req.Output != nil && req.Output.MaxFailedTiles != nil && *req.Output.MaxFailedTiles < 0 {
+		return fmt.Errorf("output.max_failed_tiles must not be negative")
+	}
+
+	// Validate the upload destination
+	if req.Output != nil && req.Output.Destination != nil {
+		if s.config.S3 == nil {
+			return fmt.Errorf("output.destination requires the server to be configured with S3 storage")
+		}
+		bucket, key, err := parseS3Destination(*req.Output.Destination)
+		if err != nil {
+			return fmt.Errorf("output.%v", err)
+		}
+		if err := s.config.S3.checkDestination(bucket, key); err != nil {
+			return fmt.Errorf("output.%v", err)
+		}
+	}
+
+	// Validate overlay layers
+	if req.Layers != nil {
+		if len(*req.Layers) > maxLayers {
+			return fmt.Errorf("layers must not have more than %d entries", maxLayers)
+		}
+		for i, layer := range *req.Layers {
+			if err := validateTileTemplate(fmt.Sprintf("layers[%d].url", i), layer.Url); err != nil {
+				return err
+			}
+			if layer.Opacity != nil && (*layer.Opacity < 0 || *layer.Opacity > 1) {
+				return fmt.Errorf("layers[%d].opacity must be between 0 and 1", i)
+			}
+		}
+	}
+
+	return nil
+}
+
+// maxLayers is the maxItems of layers in openapi.yaml, which the generated
+// types don't enforce
+const maxLayers = 5
+
+// validateTileTemplate checks that the tile URL template in field has the
+// {z}, {x} and {y} placeholders, or a {bbox} one for WMS-like sources
+func validateTileTemplate(field, url string) error {
+	tiled := strings.Contains(url, "{z}") &&
+		strings.Contains(url, "{x}") &&
+		tile.HasYPlaceholder(url)
+	if !tiled && !strings.Contains(url, "{bbox}") {
+		return fmt.Errorf("%s must contain {z}, {x}, and {y} or {bbox} placeholders", field)
 	}
-	if !strings.Contains(req.TileSource.Url, "{z}") ||
-		!strings.Contains(req.TileSource.Url, "{x}") ||
-		!strings.Contains(req.TileSource.Url, "{y}") {
-		return fmt.Errorf("tile_source.url must contain {z}, {x}, and {y} placeholders")
+	if err := tile.ValidateTemplate(url); err != nil {
+		return fmt.Errorf("%s is invalid: %v", field, err)
+	}
+	return nil
+}
+
+// hostPolicy returns the hosts tile URLs may point at
+func (s *Server) hostPolicy() tile.HostPolicy {
+	return tile.HostPolicy{
+		Allowed:      s.config.AllowedHosts,
+		BlockPrivate: s.config.BlockPrivateHosts,
 	}
+}
 
+// checkHosts returns an error when a tile source, layer or proxy URL of req
+// points at a host the server doesn't allow. The expanded URLs are checked
+// by stitch.CheckHosts once the placeholders are known.
+func (s *Server) checkHosts(req *api.StitchRequest) error {
+	policy := s.hostPolicy()
+	if err := policy.Check(req.TileSource.Url); err != nil {
+		return fmt.Errorf("tile_source.url: %v", err)
+	}
+	if req.TileSource.ProxyUrl != nil {
+		if err := policy.CheckURL(*req.TileSource.ProxyUrl); err != nil {
+			return fmt.Errorf("tile_source.proxy_url: %v", err)
+		}
+	}
+	if req.Layers != nil {
+		for i, layer := range *req.Layers {
+			if err := policy.Check(layer.Url); err != nil {
+				return fmt.Errorf("layers[%d].url: %v", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkZoomRange rejects a zoom level outside the range the tile source
+// declares, where every tile would fail to download. With fallback_zoom,
+// levels up to DefaultMaxFallbackLevels above maxzoom are allowed, as they
+// are filled from the highest one.
+func checkZoomRange(req *api.StitchRequest) error {
+	src := req.TileSource
+	if src.Minzoom == nil && src.Maxzoom == nil {
+		return nil
+	}
+
+	minZoom, maxZoom := 0, 30
+	if src.Minzoom != nil {
+		minZoom = *src.Minzoom
+	}
+	if src.Maxzoom != nil {
+		maxZoom = *src.Maxzoom
+	}
+	if src.FallbackZoom != nil && *src.FallbackZoom {
+		maxZoom += stitch.DefaultMaxFallbackLevels
+	}
+
+	if req.Zoom < minZoom || req.Zoom > maxZoom {
+		return fmt.Errorf("zoom %d is outside the range of the tile source, %d to %d", req.Zoom, minZoom, maxZoom)
+	}
 	return nil
 }
 
 // convertToStitcherOptions converts API request to internal stitcher options
-func (s *Server) convertToStitcherOptions(req *api.StitchRequest) (*stitcher.Options, error) {
-	opts := &stitcher.Options{
+func (s *Server) convertToStitcherOptions(req *api.StitchRequest) (*stitch.Options, error) {
+	opts := &stitch.Options{
 		Zoom:     req.Zoom,
 		TileURLs: []string{req.TileSource.Url},
 		TileSize: 256, // default
+		// Server-wide download settings
+		Concurrency:  s.config.Concurrency,
+		RampUp:       s.config.RampUp,
+		MaxPixels:    s.config.MaxPixels,
+		MaxTiles:     s.config.MaxTiles,
+		VerifyOutput: s.config.VerifyOutput,
+
+		RateLimitRetries: s.config.RateLimitRetries,
+		TileTimeout:      s.config.TileTimeout,
+		ClampLatitude:    s.config.ClampLatitude,
+		Subdomains:       s.sourceSubdomains(req.TileSource),
+		HostPolicy:       s.hostPolicy(),
+	}
+
+	// Instrument the download path
+	if s.config.Metrics != nil {
+		opts.OnTile = s.config.Metrics.observeTile
 	}
 
 	// Set tile size if specified
@@ -176,12 +925,17 @@ func (s *Server) convertToStitcherOptions(req *api.StitchRequest) (*stitcher.Opt
 	if req.Output != nil && req.Output.Format != nil {
 		switch *req.Output.Format {
 		case api.Png:
-			opts.OutputFormat = stitcher.FormatPNG
+			opts.OutputFormat = stitch.FormatPNG
 		case api.Geotiff:
-			opts.OutputFormat = stitcher.FormatGeoTIFF
+			opts.OutputFormat = stitch.FormatGeoTIFF
 		}
 	} else {
-		opts.OutputFormat = stitcher.FormatPNG
+		opts.OutputFormat = stitch.FormatPNG
+	}
+
+	// Set output projection
+	if req.Output != nil && req.Output.Crs != nil {
+		opts.OutputCRS = int(*req.Output.Crs)
 	}
 
 	// Set world file generation
@@ -189,73 +943,280 @@ func (s *Server) convertToStitcherOptions(req *api.StitchRequest) (*stitcher.Opt
 		opts.GenerateWorldFile = *req.Output.GenerateWorldfile
 	}
 
+	// Set custom placeholder values if provided
+	if req.TileSource.Params != nil {
+		opts.URLParams = *req.TileSource.Params
+	}
+	if req.TileSource.Token != nil {
+		opts.Token = *req.TileSource.Token
+	}
+
+	// Allow fully transparent results
+	if req.Output != nil && req.Output.AllowEmpty != nil {
+		opts.AllowEmpty = *req.Output.AllowEmpty
+	}
+
+	// Set failure thresholds; unset ones keep the library defaults
+	if req.Output != nil && req.Output.MaxFailureRatio != nil {
+		ratio := float64(*req.Output.MaxFailureRatio)
+		opts.MaxFailureRatio = &ratio
+	}
+	if req.Output != nil {
+		opts.MaxFailedTiles = req.Output.MaxFailedTiles
+	}
+
+	// Fill transparent areas with a background color
+	if req.Output != nil && req.Output.Background != nil {
+		background, err := tile.ParseColor(*req.Output.Background)
+		if err != nil {
+			return nil, err
+		}
+		opts.BackgroundColor = background
+	}
+
+	// Select the interpolation for scaled tiles
+	if req.Output != nil && req.Output.Resampling != nil {
+		resampling, err := stitch.ParseResampling(string(*req.Output.Resampling))
+		if err != nil {
+			return nil, err
+		}
+		opts.Resampling = resampling
+	}
+
+	// Keep whole tiles instead of cropping to the area
+	if req.Output != nil && req.Output.Crop != nil && *req.Output.Crop == api.Tiles {
+		opts.CropMode = stitch.CropTiles
+	}
+
 	// Set headers if provided
 	if req.TileSource.Headers != nil {
 		opts.Headers = *req.TileSource.Headers
 	}
 
+	// Fill failed tiles from lower zoom levels
+	if req.TileSource.FallbackZoom != nil {
+		opts.FallbackZoom = *req.TileSource.FallbackZoom
+	}
+
+	// Set credentials; they replace an Authorization header
+	if auth := req.TileSource.BasicAuth; auth != nil {
+		opts.BasicAuth = &stitch.BasicAuth{Username: auth.Username, Password: auth.Password}
+	}
+	if req.TileSource.BearerToken != nil {
+		opts.BearerToken = *req.TileSource.BearerToken
+	}
+	if req.TileSource.UserAgent != nil {
+		opts.UserAgent = *req.TileSource.UserAgent
+	}
+	if req.TileSource.Referer != nil {
+		opts.Referer = *req.TileSource.Referer
+	}
+	if req.TileSource.Origin != nil {
+		opts.Origin = *req.TileSource.Origin
+	}
+	if req.TileSource.ProxyUrl != nil {
+		opts.ProxyURL = *req.TileSource.ProxyUrl
+	}
+
+	// Set the tile request method and body
+	if req.TileSource.Method != nil {
+		opts.RequestMethod = string(*req.TileSource.Method)
+	}
+	if req.TileSource.Body != nil {
+		opts.RequestBody = *req.TileSource.Body
+	}
+
+	// Check the request against the source's declared coverage
+	if src := req.TileSource; src.Bounds != nil || src.Minzoom != nil || src.Maxzoom != nil {
+		coverage := &stitch.SourceCoverage{
+			MinLon: -180, MinLat: -90, MaxLon: 180, MaxLat: 90,
+			MinZoom: 0, MaxZoom: 30,
+		}
+		if src.Bounds != nil {
+			b := *src.Bounds
+			coverage.MinLon, coverage.MinLat, coverage.MaxLon, coverage.MaxLat = b[0], b[1], b[2], b[3]
+		}
+		if src.Minzoom != nil {
+			coverage.MinZoom = *src.Minzoom
+		}
+		if src.Maxzoom != nil {
+			coverage.MaxZoom = *src.Maxzoom
+		}
+		opts.Coverage = coverage
+		if src.StrictCoverage != nil {
+			opts.StrictCoverage = *src.StrictCoverage
+		}
+	}
+
+	// Credit the tile source in the image
+	if req.TileSource.Attribution != nil {
+		opts.Attribution = *req.TileSource.Attribution
+	}
+
+	// Composite overlay layers on top of the tile source
+	if req.Layers != nil && len(*req.Layers) > 0 {
+		opts.LayerMode = stitch.LayerModeOverlay
+		base := stitch.Layer{URL: req.TileSource.Url, Opacity: 1, Attribution: opts.Attribution}
+		if req.TileSource.Minzoom != nil {
+			base.MinZoom = *req.TileSource.Minzoom
+		}
+		if req.TileSource.Maxzoom != nil {
+			base.MaxZoom = *req.TileSource.Maxzoom
+		}
+		opts.Layers = []stitch.Layer{base}
+		for _, layer := range *req.Layers {
+			opacity := 1.0
+			if layer.Opacity != nil {
+				opacity = float64(*layer.Opacity)
+			}
+			attribution := ""
+			if layer.Attribution != nil {
+				attribution = *layer.Attribution
+			}
+			opts.Layers = append(opts.Layers, stitch.Layer{URL: layer.Url, Opacity: opacity, Attribution: attribution})
+		}
+	}
+
 	// Set coordinates based on mode
 	switch req.Mode {
 	case api.Bbox:
-		opts.Mode = stitcher.ModeBBox
+		opts.Mode = stitch.ModeBBox
 		opts.MinLat = float64(req.Bbox.MinLat)
 		opts.MinLon = float64(req.Bbox.MinLon)
 		opts.MaxLat = float64(req.Bbox.MaxLat)
 		opts.MaxLon = float64(req.Bbox.MaxLon)
 	case api.Centered:
-		opts.Mode = stitcher.ModeCentered
+		opts.Mode = stitch.ModeCentered
 		opts.CenterLat = float64(req.Center.Lat)
 		opts.CenterLon = float64(req.Center.Lon)
-		opts.Width = req.Center.Width
-		opts.Height = req.Center.Height
+		if req.Center.Width != nil && req.Center.Height != nil {
+			opts.Width = *req.Center.Width
+			opts.Height = *req.Center.Height
+		}
+		if req.Center.WidthMeters != nil && req.Center.HeightMeters != nil {
+			opts.WidthMeters = float64(*req.Center.WidthMeters)
+			opts.HeightMeters = float64(*req.Center.HeightMeters)
+		}
+	case api.Tilerange:
+		opts.Mode = stitch.ModeTileRange
+		opts.MinTileX = uint32(req.TileRange.MinX)
+		opts.MinTileY = uint32(req.TileRange.MinY)
+		opts.MaxTileX = uint32(req.TileRange.MaxX)
+		opts.MaxTileY = uint32(req.TileRange.MaxY)
 	}
 
 	return opts, nil
 }
 
+// apiFailedTiles converts failed tile downloads to their API representation
+func apiFailedTiles(failed []stitch.FailedTile) []api.FailedTile {
+	failedTiles := make([]api.FailedTile, len(failed))
+	for i, ft := range failed {
+		failedTiles[i].Error = ft.Error
+		failedTiles[i].StatusCode = ft.StatusCode
+		failedTiles[i].Url = ft.URL
+		if ft.Cause != "" {
+			cause := api.FailedTileCause(ft.Cause)
+			failedTiles[i].Cause = &cause
+		}
+	}
+	return failedTiles
+}
+
 // handleStitchingError handles errors from the stitching process
 func (s *Server) handleStitchingError(w http.ResponseWriter, err error, requestID *string) {
 	// Check if it's a tile-related error
-	if stitchErr, ok := err.(*stitcher.TileError); ok {
+	if stitchErr, ok := err.(*stitch.TileError); ok {
 		// Convert to API tile error response
-		failedTiles := make([]struct {
-			Error      string `json:"error"`
-			StatusCode *int   `json:"status_code,omitempty"`
-			Url        string `json:"url"`
-		}, len(stitchErr.FailedTiles))
-
-		for i, ft := range stitchErr.FailedTiles {
-			failedTiles[i] = struct {
-				Error      string `json:"error"`
-				StatusCode *int   `json:"status_code,omitempty"`
-				Url        string `json:"url"`
-			}{
-				Error:      ft.Error,
-				StatusCode: ft.StatusCode,
-				Url:        ft.URL,
-			}
-		}
-
 		response := api.TileErrorResponse{
 			Error:           "TILE_SERVER_ERROR",
 			Message:         stitchErr.Message,
-			FailedTiles:     failedTiles,
+			FailedTiles:     apiFailedTiles(stitchErr.FailedTiles),
 			SuccessfulTiles: stitchErr.SuccessfulTiles,
 			TotalTiles:      stitchErr.TotalTiles,
 			RequestId:       requestID,
 		}
 
+		// Pass the tile server's rate limiting on instead of blaming it as
+		// broken, and tell a slow tile server apart from a failing one
+		status := http.StatusBadGateway
+		if stitchErr.TimedOut() {
+			status = http.StatusGatewayTimeout
+			response.Error = "TILE_SERVER_TIMEOUT"
+		} else if retryAfter, limited := stitchErr.RetryAfter(); limited {
+			status = http.StatusServiceUnavailable
+			response.Error = "TILE_SERVER_RATE_LIMITED"
+			seconds := int(math.Ceil(retryAfter.Seconds()))
+			if seconds < 1 {
+				seconds = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		}
+
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadGateway)
+		w.WriteHeader(status)
 		json.NewEncoder(w).Encode(response)
 		return
 	}
 
+	// Check if the request exceeds the configured limits
+	var limitErr *stitch.LimitError
+	if errors.As(err, &limitErr) {
+		s.writeErrorResponse(w, http.StatusBadRequest, "VALIDATION_ERROR",
+			limitErr.Message, requestID, map[string]interface{}{
+				"limit":     limitErr.Limit,
+				"requested": limitErr.Requested,
+				"max":       limitErr.Max,
+			})
+		return
+	}
+
+	// Check if the image would be larger than allowed
+	var sizeErr *stitch.SizeError
+	if errors.As(err, &sizeErr) {
+		s.writeErrorResponse(w, http.StatusRequestEntityTooLarge, "IMAGE_TOO_LARGE",
+			sizeErr.Error(), requestID, map[string]interface{}{
+				"width":      sizeErr.Width,
+				"height":     sizeErr.Height,
+				"pixels":     int64(sizeErr.Width) * int64(sizeErr.Height),
+				"max_pixels": sizeErr.MaxPixels,
+			})
+		return
+	}
+
+	// Check if the area is outside the source's declared coverage
+	var coverageErr *stitch.CoverageError
+	if errors.As(err, &coverageErr) {
+		s.writeErrorResponse(w, http.StatusBadRequest, "OUT_OF_COVERAGE",
+			coverageErr.Message, requestID, map[string]interface{}{
+				"coverage_percent": coverageErr.Percent,
+			})
+		return
+	}
+
+	// Check if a tile URL expanded to a host the server doesn't allow
+	var hostErr *tile.HostError
+	if errors.As(err, &hostErr) {
+		s.writeHostNotAllowed(w, fmt.Errorf("tile URL: %v", err), requestID)
+		return
+	}
+
+	// Check if the area had no data at all
+	if errors.Is(err, stitch.ErrEmptyResult) {
+		s.writeErrorResponse(w, http.StatusNotFound, "EMPTY_RESULT",
+			err.Error(), requestID, nil)
+		return
+	}
+
 	// Check if it's a timeout error
 	if err == context.DeadlineExceeded {
+		timeout := 30 * time.Second
+		if s.config.StitchTimeout > 0 {
+			timeout = s.config.StitchTimeout
+		}
 		s.writeErrorResponse(w, http.StatusGatewayTimeout, "TILE_SERVER_TIMEOUT",
 			"Tile server requests timed out", requestID, map[string]interface{}{
-				"timeout_seconds": 30,
+				"timeout_seconds": timeout.Seconds(),
 			})
 		return
 	}
@@ -282,6 +1243,12 @@ func (s *Server) writeErrorResponse(w http.ResponseWriter, statusCode int, error
 	json.NewEncoder(w).Encode(response)
 }
 
+// writeHostNotAllowed answers requests for tiles from a host the server
+// doesn't allow with 403 HOST_NOT_ALLOWED
+func (s *Server) writeHostNotAllowed(w http.ResponseWriter, err error, requestID *string) {
+	s.writeErrorResponse(w, http.StatusForbidden, "HOST_NOT_ALLOWED", err.Error(), requestID, nil)
+}
+
 // writeValidationErrorResponse writes a validation error response
 func (s *Server) writeValidationErrorResponse(w http.ResponseWriter, message string, requestID *string) {
 	response := api.ValidationErrorResponse{
@@ -309,3 +1276,86 @@ func (s *Server) writeValidationErrorResponse(w http.ResponseWriter, message str
 func generateRequestID() string {
 	return fmt.Sprintf("req_%d", time.Now().UnixNano())
 }
+
+// stitchCacheControl lets caches keep stitched images for a day; tiles can
+// change underneath them, so they shouldn't be kept forever
+const stitchCacheControl = "public, max-age=86400"
+
+// privateCacheControl is stitchCacheControl for images of sources that need
+// credentials, which shared caches must not hand out to other clients
+const privateCacheControl = "private, max-age=86400"
+
+// cacheControlFor returns the Cache-Control of the image stitched for req
+func cacheControlFor(req *api.StitchRequest) string {
+	if hasCredentials(req) {
+		return privateCacheControl
+	}
+	return stitchCacheControl
+}
+
+// hasCredentials reports whether req sends credentials with its tile
+// requests: basic auth, a bearer or {token} token, an Authorization or
+// Cookie header, or a query parameter like key or signature in a URL
+func hasCredentials(req *api.StitchRequest) bool {
+	src := req.TileSource
+	if src.BasicAuth != nil || (src.BearerToken != nil && *src.BearerToken != "") || (src.Token != nil && *src.Token != "") {
+		return true
+	}
+	if src.Headers != nil {
+		for name := range *src.Headers {
+			if strings.EqualFold(name, "Authorization") || strings.EqualFold(name, "Cookie") {
+				return true
+			}
+		}
+	}
+	urls := []string{src.Url}
+	if req.Layers != nil {
+		for _, layer := range *req.Layers {
+			urls = append(urls, layer.Url)
+		}
+	}
+	for _, url := range urls {
+		if tile.RedactURL(url) != url {
+			return true
+		}
+	}
+	return false
+}
+
+// stitchETag derives the entity tag of the image, or of the JSON answer
+// holding it, for req from its parameters and the server version, so upgrades
+// that change the output invalidate it
+func (s *Server) stitchETag(req *api.StitchRequest, answerJSON bool) string {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return ""
+	}
+	prefix := s.version + "\n"
+	if answerJSON {
+		prefix += "json\n"
+	}
+	sum := sha256.Sum256(append([]byte(prefix), data...))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// setCacheHeaders sets Cache-Control and, unless it's empty, the ETag
+func setCacheHeaders(h http.Header, etag, cacheControl string) {
+	if etag != "" {
+		h.Set("ETag", etag)
+	}
+	h.Set("Cache-Control", cacheControl)
+}
+
+// etagMatches reports whether the If-None-Match header value names etag
+func etagMatches(header, etag string) bool {
+	if header == "" || etag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
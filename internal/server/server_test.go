@@ -2,21 +2,38 @@ package server
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"image"
+	"image/png"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/kiesman99/stitch/internal/api"
+	"github.com/kiesman99/stitch/internal/stitcher"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Test server setup
 func setupTestServer() *httptest.Server {
+	return setupTestServerWithConfig(Config{})
+}
+
+func setupTestServerWithConfig(config Config) *httptest.Server {
 	r := chi.NewRouter()
 
 	// Add middleware
@@ -24,13 +41,15 @@ func setupTestServer() *httptest.Server {
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
+	// Compress JSON and text responses only; images are already compressed
+	r.Use(middleware.Compress(5, "application/json", "text/plain"))
 	r.Use(middleware.Timeout(30 * time.Second))
 
 	// CORS middleware
 	r.Use(func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, OPTIONS")
 			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key")
 
 			if r.Method == "OPTIONS" {
@@ -43,13 +62,14 @@ func setupTestServer() *httptest.Server {
 	})
 
 	// Create server implementation
-	apiServer := NewServer("2.0.0-test")
+	apiServer := NewServerWithConfig("2.0.0-test", config)
 
 	// Mount API routes at /api/v1
 	r.Route("/api/v1", func(r chi.Router) {
 		handler := api.HandlerWithOptions(apiServer, api.ChiServerOptions{
 			BaseRouter: r,
 		})
+		apiServer.RegisterStitchMethods(r)
 		r.Mount("/", handler)
 	})
 
@@ -102,6 +122,85 @@ func TestHealthEndpoint(t *testing.T) {
 	}
 }
 
+func TestHealthEndpoint_Deep(t *testing.T) {
+	up := pngTileServer(t)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	testCases := []struct {
+		name           string
+		probeURL       string
+		query          string
+		expectedStatus int
+		expectedHealth api.HealthResponseStatus
+		expectedCheck  api.HealthCheckStatus // empty when no check runs
+	}{
+		{
+			name:           "Probe reachable",
+			probeURL:       up.URL + "/{z}/{x}/{y}.png",
+			query:          "?deep=true",
+			expectedStatus: http.StatusOK,
+			expectedHealth: api.Healthy,
+			expectedCheck:  api.Ok,
+		},
+		{
+			name:           "Probe down",
+			probeURL:       down.URL + "/{z}/{x}/{y}.png",
+			query:          "?deep=true",
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedHealth: api.Degraded,
+			expectedCheck:  api.Failed,
+		},
+		{
+			name:           "Shallow check ignores the probe",
+			probeURL:       down.URL + "/{z}/{x}/{y}.png",
+			expectedStatus: http.StatusOK,
+			expectedHealth: api.Healthy,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := setupTestServerWithConfig(Config{HealthProbeURL: tc.probeURL})
+			defer server.Close()
+
+			resp, err := http.Get(server.URL + "/api/v1/health" + tc.query)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tc.expectedStatus, resp.StatusCode)
+			}
+			var healthResp api.HealthResponse
+			if err := json.NewDecoder(resp.Body).Decode(&healthResp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if healthResp.Status != tc.expectedHealth {
+				t.Errorf("Expected status %s, got %s", tc.expectedHealth, healthResp.Status)
+			}
+
+			if tc.expectedCheck == "" {
+				if healthResp.Checks != nil {
+					t.Errorf("Expected no checks, got %v", *healthResp.Checks)
+				}
+				return
+			}
+			if healthResp.Checks == nil || len(*healthResp.Checks) != 1 {
+				t.Fatalf("Expected one check, got %v", healthResp.Checks)
+			}
+			check := (*healthResp.Checks)[0]
+			if check.Status != tc.expectedCheck {
+				t.Errorf("Expected check status %s, got %s", tc.expectedCheck, check.Status)
+			}
+			if (check.Error != nil) != (tc.expectedCheck == api.Failed) {
+				t.Errorf("Expected an error only for failed checks, got %v", check.Error)
+			}
+		})
+	}
+}
+
 func TestStitchEndpoint_BoundingBox_Success(t *testing.T) {
 	server := setupTestServer()
 	defer server.Close()
@@ -185,8 +284,8 @@ func TestStitchEndpoint_Centered_Success(t *testing.T) {
 		Center: &api.CenterPoint{
 			Lat:    37.7749,
 			Lon:    -122.4194,
-			Width:  256,
-			Height: 256,
+			Width:  intPtr(256),
+			Height: intPtr(256),
 		},
 		Zoom: 10,
 		TileSource: api.TileSource{
@@ -236,6 +335,9 @@ func TestStitchEndpoint_ValidationErrors(t *testing.T) {
 	server := setupTestServer()
 	defer server.Close()
 
+	failureRatio := float32(1.5)
+	widthMeters := float32(5000)
+
 	testCases := []struct {
 		name           string
 		request        interface{}
@@ -272,6 +374,68 @@ func TestStitchEndpoint_ValidationErrors(t *testing.T) {
 			expectedStatus: http.StatusBadRequest,
 			expectedError:  "VALIDATION_ERROR",
 		},
+		{
+			name: "Latitude beyond Web Mercator range",
+			request: api.StitchRequest{
+				Mode: api.Bbox,
+				Bbox: &api.BoundingBox{
+					MinLat: 80,
+					MinLon: -10,
+					MaxLat: 89,
+					MaxLon: 10,
+				},
+				Zoom: 3,
+				TileSource: api.TileSource{
+					Url: "https://example.com/{z}/{x}/{y}.png",
+				},
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "VALIDATION_ERROR",
+		},
+		{
+			name: "Basic auth and bearer token",
+			request: api.StitchRequest{
+				Mode: api.Bbox,
+				Bbox: &api.BoundingBox{
+					MinLat: 37.7,
+					MinLon: -122.5,
+					MaxLat: 37.8,
+					MaxLon: -122.4,
+				},
+				Zoom: 10,
+				TileSource: api.TileSource{
+					Url:         "https://example.com/{z}/{x}/{y}.png",
+					BasicAuth:   &api.BasicAuth{Username: "alice", Password: "secret"},
+					BearerToken: stringPtr("xyz"),
+				},
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "VALIDATION_ERROR",
+		},
+		{
+			name: "Both bbox and center",
+			request: api.StitchRequest{
+				Mode: api.Bbox,
+				Bbox: &api.BoundingBox{
+					MinLat: 37.7,
+					MinLon: -122.5,
+					MaxLat: 37.8,
+					MaxLon: -122.4,
+				},
+				Center: &api.CenterPoint{
+					Lat:    37.75,
+					Lon:    -122.45,
+					Width:  intPtr(512),
+					Height: intPtr(512),
+				},
+				Zoom: 10,
+				TileSource: api.TileSource{
+					Url: "https://example.com/{z}/{x}/{y}.png",
+				},
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "VALIDATION_ERROR",
+		},
 		{
 			name: "Invalid zoom level",
 			request: api.StitchRequest{
@@ -308,6 +472,64 @@ func TestStitchEndpoint_ValidationErrors(t *testing.T) {
 			expectedStatus: http.StatusBadRequest,
 			expectedError:  "VALIDATION_ERROR",
 		},
+		{
+			name: "Conflicting Y placeholders",
+			request: api.StitchRequest{
+				Mode: api.Bbox,
+				Bbox: &api.BoundingBox{
+					MinLat: 37.7,
+					MinLon: -122.5,
+					MaxLat: 37.8,
+					MaxLon: -122.4,
+				},
+				Zoom: 10,
+				TileSource: api.TileSource{
+					Url: "https://example.com/{z}/{x}/{y}.png?row={-y}",
+				},
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "VALIDATION_ERROR",
+		},
+		{
+			name: "Token in the host",
+			request: api.StitchRequest{
+				Mode: api.Bbox,
+				Bbox: &api.BoundingBox{
+					MinLat: 37.7,
+					MinLon: -122.5,
+					MaxLat: 37.8,
+					MaxLon: -122.4,
+				},
+				Zoom: 10,
+				TileSource: api.TileSource{
+					Url:   "https://{token}.example.com/{z}/{x}/{y}.png",
+					Token: stringPtr("evil.com/"),
+				},
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "VALIDATION_ERROR",
+		},
+		{
+			name: "Failure ratio above 1",
+			request: api.StitchRequest{
+				Mode: api.Bbox,
+				Bbox: &api.BoundingBox{
+					MinLat: 37.7,
+					MinLon: -122.5,
+					MaxLat: 37.8,
+					MaxLon: -122.4,
+				},
+				Zoom: 10,
+				TileSource: api.TileSource{
+					Url: "https://example.com/{z}/{x}/{y}.png",
+				},
+				Output: &api.OutputOptions{
+					MaxFailureRatio: &failureRatio,
+				},
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "VALIDATION_ERROR",
+		},
 		{
 			name: "Invalid bounding box coordinates",
 			request: api.StitchRequest{
@@ -326,6 +548,24 @@ func TestStitchEndpoint_ValidationErrors(t *testing.T) {
 			expectedStatus: http.StatusBadRequest,
 			expectedError:  "VALIDATION_ERROR",
 		},
+		{
+			name: "Bounding box crossing the antimeridian",
+			request: api.StitchRequest{
+				Mode: api.Bbox,
+				Bbox: &api.BoundingBox{
+					MinLat: -20,
+					MinLon: 170, // West edge east of the east edge
+					MaxLat: -10,
+					MaxLon: -170,
+				},
+				Zoom: 10,
+				TileSource: api.TileSource{
+					Url: "https://example.com/{z}/{x}/{y}.png",
+				},
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "VALIDATION_ERROR",
+		},
 		{
 			name: "Invalid center dimensions",
 			request: api.StitchRequest{
@@ -333,13 +573,59 @@ func TestStitchEndpoint_ValidationErrors(t *testing.T) {
 				Center: &api.CenterPoint{
 					Lat:    37.7749,
 					Lon:    -122.4194,
-					Width:  0, // Invalid
-					Height: 256,
+					Width:  intPtr(0), // Invalid
+					Height: intPtr(256),
+				},
+				Zoom: 10,
+				TileSource: api.TileSource{
+					Url: "https://example.com/{z}/{x}/{y}.png",
+				},
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "VALIDATION_ERROR",
+		},
+		{
+			name: "Center size in pixels and meters",
+			request: api.StitchRequest{
+				Mode: api.Centered,
+				Center: &api.CenterPoint{
+					Lat:          37.7749,
+					Lon:          -122.4194,
+					Width:        intPtr(256),
+					Height:       intPtr(256),
+					WidthMeters:  &widthMeters,
+					HeightMeters: &widthMeters,
+				},
+				Zoom: 10,
+				TileSource: api.TileSource{
+					Url: "https://example.com/{z}/{x}/{y}.png",
+				},
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "VALIDATION_ERROR",
+		},
+		{
+			name: "Too many layers",
+			request: api.StitchRequest{
+				Mode: api.Bbox,
+				Bbox: &api.BoundingBox{
+					MinLat: 37.7,
+					MinLon: -122.5,
+					MaxLat: 37.8,
+					MaxLon: -122.4,
 				},
 				Zoom: 10,
 				TileSource: api.TileSource{
 					Url: "https://example.com/{z}/{x}/{y}.png",
 				},
+				Layers: &[]api.Layer{
+					{Url: "https://example.com/1/{z}/{x}/{y}.png"},
+					{Url: "https://example.com/2/{z}/{x}/{y}.png"},
+					{Url: "https://example.com/3/{z}/{x}/{y}.png"},
+					{Url: "https://example.com/4/{z}/{x}/{y}.png"},
+					{Url: "https://example.com/5/{z}/{x}/{y}.png"},
+					{Url: "https://example.com/6/{z}/{x}/{y}.png"},
+				},
 			},
 			expectedStatus: http.StatusBadRequest,
 			expectedError:  "VALIDATION_ERROR",
@@ -448,9 +734,53 @@ func TestStitchEndpoint_TileServerError(t *testing.T) {
 }
 
 func TestStitchEndpoint_Timeout(t *testing.T) {
-	// This test would require a mock server that delays responses
-	// For now, we'll skip it as it's complex to set up
-	t.Skip("Timeout test requires mock server setup")
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	server := setupTestServerWithConfig(Config{StitchTimeout: 100 * time.Millisecond})
+	defer server.Close()
+
+	request := api.StitchRequest{
+		Mode: api.Bbox,
+		Bbox: &api.BoundingBox{
+			MinLat: 37.7,
+			MinLon: -122.5,
+			MaxLat: 37.8,
+			MaxLon: -122.4,
+		},
+		Zoom: 8,
+		TileSource: api.TileSource{
+			Url: slow.URL + "/{z}/{x}/{y}.png",
+		},
+	}
+
+	start := time.Now()
+	resp := postStitchRequest(t, server, request)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Expected status 504, got %d. Body: %s", resp.StatusCode, string(body))
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the stitch to stop at its timeout, took %v", elapsed)
+	}
+
+	var errorResp api.ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&errorResp); err != nil {
+		t.Fatalf("Failed to decode error response: %v", err)
+	}
+	if errorResp.Error != "TILE_SERVER_TIMEOUT" {
+		t.Errorf("Expected error code TILE_SERVER_TIMEOUT, got %s", errorResp.Error)
+	}
+	if errorResp.Details == nil || (*errorResp.Details)["timeout_seconds"] != 0.1 {
+		t.Errorf("Expected timeout_seconds 0.1, got %v", errorResp.Details)
+	}
 }
 
 func TestCORSHeaders(t *testing.T) {
@@ -483,54 +813,1805 @@ func TestCORSHeaders(t *testing.T) {
 	}
 }
 
-func TestStitchEndpoint_WithCustomHeaders(t *testing.T) {
+func TestStitchEndpoint_MethodNotAllowed(t *testing.T) {
 	server := setupTestServer()
 	defer server.Close()
 
-	// Create request with custom headers
-	headers := map[string]string{
-		"User-Agent": "CustomAgent/1.0",
-		"Referer":    "https://example.com",
+	resp, err := http.Get(server.URL + "/api/v1/stitch")
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
 	}
+	defer resp.Body.Close()
 
-	request := api.StitchRequest{
-		Mode: api.Bbox,
-		Bbox: &api.BoundingBox{
-			MinLat: 37.7,
-			MinLon: -122.5,
-			MaxLat: 37.8,
-			MaxLon: -122.4,
-		},
-		Zoom: 8,
-		TileSource: api.TileSource{
-			Url:     "https://tile.opentopomap.org/{z}/{x}/{y}.png",
-			Headers: &headers,
-		},
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected status 405, got %d", resp.StatusCode)
 	}
-
-	jsonData, err := json.Marshal(request)
-	if err != nil {
-		t.Fatalf("Failed to marshal request: %v", err)
+	if got := resp.Header.Get("Allow"); got != "POST, HEAD, OPTIONS" {
+		t.Errorf("Expected Allow: POST, HEAD, OPTIONS, got %q", got)
+	}
+	var errorResp api.ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&errorResp); err != nil {
+		t.Fatalf("Failed to decode error response: %v", err)
 	}
+	if errorResp.Error != "METHOD_NOT_ALLOWED" {
+		t.Errorf("Expected error METHOD_NOT_ALLOWED, got %s", errorResp.Error)
+	}
+}
 
-	resp, err := http.Post(
-		server.URL+"/api/v1/stitch",
-		"application/json",
-		bytes.NewBuffer(jsonData),
-	)
-	if err != nil {
-		t.Fatalf("Failed to make request: %v", err)
+func TestStitchEndpoint_HostPolicy(t *testing.T) {
+	// Private addresses stay blocked even when they are allowed hosts
+	server := setupTestServerWithConfig(Config{
+		AllowedHosts:      []string{"*.tile.openstreetmap.org", "127.0.0.1", "169.254.169.254"},
+		BlockPrivateHosts: true,
+	})
+	defer server.Close()
+
+	request := func(url string) api.StitchRequest {
+		return api.StitchRequest{
+			Mode:       api.Bbox,
+			Bbox:       &api.BoundingBox{MinLat: 37.7, MinLon: -122.5, MaxLat: 38.2, MaxLon: -121.9},
+			Zoom:       10,
+			TileSource: api.TileSource{Url: url},
+		}
 	}
-	defer resp.Body.Close()
 
-	// Should succeed (headers are passed through to tile requests)
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		t.Errorf("Expected status 200, got %d. Body: %s", resp.StatusCode, string(body))
+	testCases := []struct {
+		name   string
+		url    string
+		status int
+	}{
+		{"loopback", "http://127.0.0.1:8080/{z}/{x}/{y}.png", http.StatusForbidden},
+		{"metadata endpoint", "http://169.254.169.254/latest/{z}/{x}/{y}", http.StatusForbidden},
+		{"ipv6 loopback", "http://[::1]/{z}/{x}/{y}.png", http.StatusForbidden},
+		{"localhost", "http://localhost/{z}/{x}/{y}.png", http.StatusForbidden},
+		{"not allowed", "https://tiles.example.com/{z}/{x}/{y}.png", http.StatusForbidden},
+		{"allowed", "https://{s}.tile.openstreetmap.org/{z}/{x}/{y}.png", http.StatusOK},
 	}
-}
 
-// Helper function
-func stringPtr(s string) *string {
-	return &s
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// The preview endpoint runs the same checks without downloading
+			body, err := json.Marshal(request(tc.url))
+			if err != nil {
+				t.Fatalf("Failed to marshal request: %v", err)
+			}
+			resp, err := http.Post(server.URL+"/api/v1/preview", "application/json", bytes.NewReader(body))
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tc.status {
+				t.Fatalf("Expected status %d, got %d", tc.status, resp.StatusCode)
+			}
+			if tc.status != http.StatusForbidden {
+				return
+			}
+			var errorResp api.ErrorResponse
+			if err := json.NewDecoder(resp.Body).Decode(&errorResp); err != nil {
+				t.Fatalf("Failed to decode error response: %v", err)
+			}
+			if errorResp.Error != "HOST_NOT_ALLOWED" {
+				t.Errorf("Expected error HOST_NOT_ALLOWED, got %s", errorResp.Error)
+			}
+		})
+	}
+
+	// The stitch endpoint rejects private hosts before downloading anything
+	resp := postStitchRequest(t, server, request("http://169.254.169.254/{z}/{x}/{y}"))
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status 403 from /stitch, got %d", resp.StatusCode)
+	}
+
+	// A placeholder in the host can't smuggle in another host
+	smuggled := request("http://{p}.tile.openstreetmap.org/{z}/{x}/{y}.png")
+	smuggled.TileSource.Params = &map[string]string{"p": "127.0.0.1:8080/"}
+	resp = postStitchRequest(t, server, smuggled)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a host from params, got %d", resp.StatusCode)
+	}
+
+	// Proxies are held to the same policy
+	proxied := request("https://{s}.tile.openstreetmap.org/{z}/{x}/{y}.png")
+	proxied.TileSource.ProxyUrl = stringPtr("http://proxy.example.com:3128")
+	resp = postStitchRequest(t, server, proxied)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a proxy outside the allowed hosts, got %d", resp.StatusCode)
+	}
+}
+
+func TestStitchEndpoint_Head(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+
+	// Nothing may be downloaded for a HEAD request
+	tiles := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unexpected tile request %s", r.URL.Path)
+	}))
+	defer tiles.Close()
+
+	head := func(request api.StitchRequest) *http.Response {
+		jsonData, err := json.Marshal(request)
+		if err != nil {
+			t.Fatalf("Failed to marshal request: %v", err)
+		}
+		req, err := http.NewRequest(http.MethodHead, server.URL+"/api/v1/stitch", bytes.NewReader(jsonData))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	request := api.StitchRequest{
+		Mode: api.Bbox,
+		Bbox: &api.BoundingBox{
+			MinLat: 37.7,
+			MinLon: -122.5,
+			MaxLat: 37.8,
+			MaxLon: -122.4,
+		},
+		Zoom: 8,
+		TileSource: api.TileSource{
+			Url: tiles.URL + "/{z}/{x}/{y}.png",
+		},
+	}
+
+	resp := head(request)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "image/png" {
+		t.Errorf("Expected Content-Type image/png, got %q", got)
+	}
+	if got := resp.Header.Get("X-Stitch-Tile-Count"); got != "2" {
+		t.Errorf("Expected X-Stitch-Tile-Count: 2, got %q", got)
+	}
+	if resp.Header.Get("X-Stitch-Dimensions") == "" {
+		t.Error("Expected an X-Stitch-Dimensions header")
+	}
+	if resp.Header.Get("ETag") == "" {
+		t.Error("Expected an ETag header")
+	}
+
+	request.Zoom = 25
+	if resp := head(request); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid request, got %d", resp.StatusCode)
+	}
+}
+
+func TestStitchEndpoint_HeadOverLimits(t *testing.T) {
+	request := api.StitchRequest{
+		Mode: api.Bbox,
+		Bbox: &api.BoundingBox{
+			MinLat: 37.0,
+			MinLon: -123.0,
+			MaxLat: 38.0,
+			MaxLon: -122.0,
+		},
+		Zoom: 12,
+		TileSource: api.TileSource{
+			Url: "https://example.com/{z}/{x}/{y}.png",
+		},
+	}
+
+	testCases := []struct {
+		name           string
+		config         Config
+		expectedStatus int
+	}{
+		{"Too many tiles", Config{MaxTiles: 1}, http.StatusBadRequest},
+		{"Too many pixels", Config{MaxPixels: 100000}, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := setupTestServerWithConfig(tc.config)
+			defer server.Close()
+
+			jsonData, err := json.Marshal(request)
+			if err != nil {
+				t.Fatalf("Failed to marshal request: %v", err)
+			}
+			req, err := http.NewRequest(http.MethodHead, server.URL+"/api/v1/stitch", bytes.NewReader(jsonData))
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+			resp.Body.Close()
+
+			// HEAD must fail like a POST of the same request
+			post := postStitchRequest(t, server, request)
+			post.Body.Close()
+			if post.StatusCode != tc.expectedStatus {
+				t.Fatalf("Expected POST status %d, got %d", tc.expectedStatus, post.StatusCode)
+			}
+			if resp.StatusCode != tc.expectedStatus {
+				t.Errorf("Expected HEAD status %d, got %d", tc.expectedStatus, resp.StatusCode)
+			}
+			if etag := resp.Header.Get("ETag"); etag != "" {
+				t.Errorf("Expected no ETag for a request over the limits, got %s", etag)
+			}
+		})
+	}
+}
+
+func TestStitchEndpoint_WithCustomHeaders(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+
+	// Create request with custom headers
+	headers := map[string]string{
+		"User-Agent": "CustomAgent/1.0",
+		"Referer":    "https://example.com",
+	}
+
+	request := api.StitchRequest{
+		Mode: api.Bbox,
+		Bbox: &api.BoundingBox{
+			MinLat: 37.7,
+			MinLon: -122.5,
+			MaxLat: 37.8,
+			MaxLon: -122.4,
+		},
+		Zoom: 8,
+		TileSource: api.TileSource{
+			Url:     "https://tile.opentopomap.org/{z}/{x}/{y}.png",
+			Headers: &headers,
+		},
+	}
+
+	jsonData, err := json.Marshal(request)
+	if err != nil {
+		t.Fatalf("Failed to marshal request: %v", err)
+	}
+
+	resp, err := http.Post(
+		server.URL+"/api/v1/stitch",
+		"application/json",
+		bytes.NewBuffer(jsonData),
+	)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Should succeed (headers are passed through to tile requests)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Errorf("Expected status 200, got %d. Body: %s", resp.StatusCode, string(body))
+	}
+}
+
+func TestStitchEndpoint_EmptyResult(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+
+	// Tile server reporting "no data" for every tile
+	tiles := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer tiles.Close()
+
+	request := api.StitchRequest{
+		Mode: api.Bbox,
+		Bbox: &api.BoundingBox{
+			MinLat: 37.7,
+			MinLon: -122.5,
+			MaxLat: 37.8,
+			MaxLon: -122.4,
+		},
+		Zoom: 8,
+		TileSource: api.TileSource{
+			Url: tiles.URL + "/{z}/{x}/{y}.png",
+		},
+	}
+
+	resp := postStitchRequest(t, server, request)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Expected status 404, got %d. Body: %s", resp.StatusCode, string(body))
+	}
+
+	var errorResp api.ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&errorResp); err != nil {
+		t.Fatalf("Failed to decode error response: %v", err)
+	}
+	if errorResp.Error != "EMPTY_RESULT" {
+		t.Errorf("Expected error code EMPTY_RESULT, got %s", errorResp.Error)
+	}
+
+	// Opting in returns the blank image instead
+	allowEmpty := true
+	request.Output = &api.OutputOptions{AllowEmpty: &allowEmpty}
+
+	resp = postStitchRequest(t, server, request)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Expected status 200, got %d. Body: %s", resp.StatusCode, string(body))
+	}
+	if resp.Header.Get("X-Empty") != "true" {
+		t.Errorf("Expected X-Empty: true, got %q", resp.Header.Get("X-Empty"))
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics()
+	if err := metrics.Register(reg); err != nil {
+		t.Fatalf("Failed to register metrics: %v", err)
+	}
+
+	server := setupTestServerWithConfig(Config{Metrics: metrics})
+	defer server.Close()
+
+	metricsServer := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	defer metricsServer.Close()
+
+	tiles := pngTileServer(t)
+
+	request := api.StitchRequest{
+		Mode: api.Bbox,
+		Bbox: &api.BoundingBox{
+			MinLat: 37.7,
+			MinLon: -122.5,
+			MaxLat: 37.8,
+			MaxLon: -122.4,
+		},
+		Zoom: 8,
+		TileSource: api.TileSource{
+			Url: tiles.URL + "/{z}/{x}/{y}.png",
+		},
+	}
+
+	resp := postStitchRequest(t, server, request)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	scrape, err := http.Get(metricsServer.URL)
+	if err != nil {
+		t.Fatalf("Failed to scrape metrics: %v", err)
+	}
+	defer scrape.Body.Close()
+
+	body, err := io.ReadAll(scrape.Body)
+	if err != nil {
+		t.Fatalf("Failed to read metrics: %v", err)
+	}
+
+	for _, want := range []string{
+		`stitch_requests_total{code="200"} 1`,
+		"stitch_tiles_downloaded_total 2",
+		"stitch_duration_seconds_count 1",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", want, body)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"/api/v1/health", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	// Setting Accept-Encoding explicitly disables the transport's transparent decompression
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected Content-Encoding gzip, got %q", resp.Header.Get("Content-Encoding"))
+	}
+
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to create gzip reader: %v", err)
+	}
+	var healthResp api.HealthResponse
+	if err := json.NewDecoder(gz).Decode(&healthResp); err != nil {
+		t.Fatalf("Failed to decode compressed response: %v", err)
+	}
+	if healthResp.Status != api.Healthy {
+		t.Errorf("Expected status 'healthy', got %s", healthResp.Status)
+	}
+
+	// Images must not be compressed a second time
+	tiles := pngTileServer(t)
+	jsonData, err := json.Marshal(api.StitchRequest{
+		Mode: api.Bbox,
+		Bbox: &api.BoundingBox{
+			MinLat: 37.7,
+			MinLon: -122.5,
+			MaxLat: 37.8,
+			MaxLon: -122.4,
+		},
+		Zoom: 8,
+		TileSource: api.TileSource{
+			Url: tiles.URL + "/{z}/{x}/{y}.png",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal request: %v", err)
+	}
+
+	req, err = http.NewRequest("POST", server.URL+"/api/v1/stitch", bytes.NewBuffer(jsonData))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	imageResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer imageResp.Body.Close()
+
+	if imageResp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", imageResp.StatusCode)
+	}
+	if enc := imageResp.Header.Get("Content-Encoding"); enc != "" {
+		t.Errorf("Expected uncompressed image, got Content-Encoding %q", enc)
+	}
+}
+
+func TestStitchEndpoint_PartialStitchHeaders(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+
+	// One of the two tiles is missing
+	tiles := pngTileServer(t)
+	partial := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/8/40/99.png" {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, tiles.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer partial.Close()
+
+	request := api.StitchRequest{
+		Mode: api.Bbox,
+		Bbox: &api.BoundingBox{
+			MinLat: 37.7,
+			MinLon: -122.5,
+			MaxLat: 37.8,
+			MaxLon: -122.4,
+		},
+		Zoom: 8,
+		TileSource: api.TileSource{
+			Url: partial.URL + "/{z}/{x}/{y}.png",
+		},
+	}
+
+	resp := postStitchRequest(t, server, request)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Expected status 200, got %d. Body: %s", resp.StatusCode, string(body))
+	}
+	if got := resp.Header.Get("X-Tiles-Failed"); got != "1" {
+		t.Errorf("Expected X-Tiles-Failed: 1, got %q", got)
+	}
+	if got := resp.Header.Get("X-Tiles-Total"); got != "2" {
+		t.Errorf("Expected X-Tiles-Total: 2, got %q", got)
+	}
+}
+
+func TestStitchEndpoint_ZeroFailureLimits(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+
+	// One of the two tiles is missing
+	tiles := pngTileServer(t)
+	partial := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/8/40/99.png" {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, tiles.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer partial.Close()
+
+	zeroRatio := float32(0)
+	testCases := []struct {
+		name   string
+		output api.OutputOptions
+	}{
+		{"Zero ratio", api.OutputOptions{MaxFailureRatio: &zeroRatio}},
+		{"Zero count", api.OutputOptions{MaxFailedTiles: intPtr(0)}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			request := api.StitchRequest{
+				Mode: api.Bbox,
+				Bbox: &api.BoundingBox{
+					MinLat: 37.7,
+					MinLon: -122.5,
+					MaxLat: 37.8,
+					MaxLon: -122.4,
+				},
+				Zoom: 8,
+				TileSource: api.TileSource{
+					Url: partial.URL + "/{z}/{x}/{y}.png",
+				},
+				Output: &tc.output,
+			}
+
+			resp := postStitchRequest(t, server, request)
+			defer resp.Body.Close()
+
+			// 0 allows no failed tile rather than lifting the limit
+			if resp.StatusCode != http.StatusBadGateway {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("Expected status 502, got %d. Body: %s", resp.StatusCode, string(body))
+			}
+			var errorResp api.TileErrorResponse
+			if err := json.NewDecoder(resp.Body).Decode(&errorResp); err != nil {
+				t.Fatalf("Failed to decode error response: %v", err)
+			}
+			if errorResp.Error != "TILE_SERVER_ERROR" {
+				t.Errorf("Expected error code TILE_SERVER_ERROR, got %s", errorResp.Error)
+			}
+			if len(errorResp.FailedTiles) != 1 || errorResp.TotalTiles != 2 {
+				t.Errorf("Expected 1 of 2 tiles failed, got %d of %d", len(errorResp.FailedTiles), errorResp.TotalTiles)
+			}
+		})
+	}
+}
+
+func TestStitchEndpoint_TileFailureLogRequestID(t *testing.T) {
+	var logs bytes.Buffer
+	server := setupTestServerWithConfig(Config{
+		Logger: slog.New(slog.NewTextHandler(&logs, nil)),
+	})
+	defer server.Close()
+
+	tiles := pngTileServer(t)
+	partial := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/8/40/99.png" {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, tiles.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer partial.Close()
+
+	request := api.StitchRequest{
+		Mode: api.Bbox,
+		Bbox: &api.BoundingBox{
+			MinLat: 37.7,
+			MinLon: -122.5,
+			MaxLat: 37.8,
+			MaxLon: -122.4,
+		},
+		Zoom: 8,
+		TileSource: api.TileSource{
+			Url: partial.URL + "/{z}/{x}/{y}.png",
+		},
+	}
+
+	resp := postStitchRequest(t, server, request)
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	requestID := resp.Header.Get("X-Request-ID")
+	if requestID == "" {
+		t.Fatal("Expected an X-Request-ID header")
+	}
+	// The tile failure must be logged with the same ID the client sees
+	if !strings.Contains(logs.String(), "msg=\"tile failed\" request_id="+requestID+" ") {
+		t.Errorf("Expected a tile failure logged with request_id=%s, got:\n%s", requestID, logs.String())
+	}
+}
+
+func TestStitchEndpoint_Referer(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+
+	tiles := pngTileServer(t)
+	var (
+		mu       sync.Mutex
+		referers []string
+	)
+	checked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		referers = append(referers, r.Header.Get("Referer"))
+		mu.Unlock()
+		http.Redirect(w, r, tiles.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer checked.Close()
+
+	request := api.StitchRequest{
+		Mode: api.Bbox,
+		Bbox: &api.BoundingBox{MinLat: 37.7, MinLon: -122.5, MaxLat: 37.8, MaxLon: -122.4},
+		Zoom: 8,
+		TileSource: api.TileSource{
+			Url:     checked.URL + "/{z}/{x}/{y}.png",
+			Referer: stringPtr("https://maps.example.com/"),
+		},
+	}
+
+	resp := postStitchRequest(t, server, request)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Expected status 200, got %d. Body: %s", resp.StatusCode, string(body))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(referers) == 0 {
+		t.Fatal("Expected tile requests")
+	}
+	for _, got := range referers {
+		if got != "https://maps.example.com/" {
+			t.Errorf("Expected Referer %q, got %q", "https://maps.example.com/", got)
+		}
+	}
+}
+
+func TestStitchEndpoint_JSONResponse(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+
+	// One of the two tiles is missing
+	tiles := pngTileServer(t)
+	partial := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/8/40/99.png" {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, tiles.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer partial.Close()
+
+	request := api.StitchRequest{
+		Mode:       api.Bbox,
+		Bbox:       &api.BoundingBox{MinLat: 37.7, MinLon: -122.5, MaxLat: 37.8, MaxLon: -122.4},
+		Zoom:       8,
+		TileSource: api.TileSource{Url: partial.URL + "/{z}/{x}/{y}.png"},
+	}
+	jsonData, err := json.Marshal(request)
+	if err != nil {
+		t.Fatalf("Failed to marshal request: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		accept string
+	}{
+		{name: "query parameter", query: "?format=json"},
+		{name: "accept header", accept: "application/json"},
+		{name: "image"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, server.URL+"/api/v1/stitch"+tt.query, bytes.NewReader(jsonData))
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("Expected status 200, got %d. Body: %s", resp.StatusCode, string(body))
+			}
+			// Partial images aren't cached
+			if cc := resp.Header.Get("Cache-Control"); cc != "no-store" {
+				t.Errorf("Expected Cache-Control no-store for a partial image, got %q", cc)
+			}
+			if etag := resp.Header.Get("ETag"); etag != "" {
+				t.Errorf("Expected no ETag for a partial image, got %s", etag)
+			}
+			if tt.name == "image" {
+				return
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Expected Content-Type application/json, got %q", ct)
+			}
+
+			var result api.StitchJSONResponse
+			if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if result.ContentType != "image/png" {
+				t.Errorf("Expected content_type image/png, got %q", result.ContentType)
+			}
+			img, err := png.Decode(bytes.NewReader(result.Image))
+			if err != nil {
+				t.Fatalf("Expected a base64 encoded PNG: %v", err)
+			}
+			if b := img.Bounds(); b.Dx() != result.Width || b.Dy() != result.Height {
+				t.Errorf("Expected a %dx%d image, got %dx%d", result.Width, result.Height, b.Dx(), b.Dy())
+			}
+			if result.SuccessfulTiles != 1 || result.TotalTiles != 2 {
+				t.Errorf("Expected 1 of 2 tiles, got %d of %d", result.SuccessfulTiles, result.TotalTiles)
+			}
+			if len(result.FailedTiles) != 1 {
+				t.Fatalf("Expected 1 failed tile, got %d", len(result.FailedTiles))
+			}
+			failed := result.FailedTiles[0]
+			if failed.Url != partial.URL+"/8/40/99.png" {
+				t.Errorf("Expected the missing tile's URL, got %q", failed.Url)
+			}
+			if failed.StatusCode == nil || *failed.StatusCode != http.StatusNotFound {
+				t.Errorf("Expected status code 404, got %v", failed.StatusCode)
+			}
+		})
+	}
+}
+
+func TestPrefersJSON(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{accept: "", want: false},
+		{accept: "*/*", want: false},
+		{accept: "image/png", want: false},
+		{accept: "application/json", want: true},
+		{accept: "Application/JSON; charset=utf-8", want: true},
+		{accept: "application/json, */*", want: false},
+		{accept: "application/json, image/*", want: false},
+		{accept: "application/json, */*;q=0.8", want: true},
+		{accept: "image/png;q=0.5, application/json", want: true},
+		{accept: "application/json;q=0.5, image/png", want: false},
+		{accept: "application/json;q=0", want: false},
+		{accept: "application/json;q=0, */*", want: false},
+		{accept: "image/*;q=0, application/json;q=0.1", want: true},
+	}
+	for _, tt := range tests {
+		if got := prefersJSON(tt.accept); got != tt.want {
+			t.Errorf("prefersJSON(%q) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestStitchEndpoint_GeoHeaders(t *testing.T) {
+	server := setupTestServerWithConfig(Config{GeoHeaders: true})
+	defer server.Close()
+
+	tiles := pngTileServer(t)
+	request := api.StitchRequest{
+		Mode:       api.Bbox,
+		Bbox:       &api.BoundingBox{MinLat: 37.7, MinLon: -122.5, MaxLat: 37.8, MaxLon: -122.4},
+		Zoom:       10,
+		TileSource: api.TileSource{Url: tiles.URL + "/{z}/{x}/{y}.png"},
+	}
+
+	// The stitcher computes the same georeferencing for the same request
+	opts, err := NewServer("test").convertToStitcherOptions(&request)
+	if err != nil {
+		t.Fatalf("Failed to convert request: %v", err)
+	}
+	result, err := stitcher.New().Stitch(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+
+	resp := postStitchRequest(t, server, request)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	for name, want := range map[string]float64{
+		"X-Min-X":        result.MinX,
+		"X-Max-Y":        result.MaxY,
+		"X-Pixel-Size-X": result.PixelSizeX,
+		"X-Pixel-Size-Y": result.PixelSizeY,
+	} {
+		got, err := strconv.ParseFloat(resp.Header.Get(name), 64)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if got != want {
+			t.Errorf("Expected %s %v, got %v", name, want, got)
+		}
+	}
+	if got := resp.Header.Get("X-CRS"); got != "EPSG:3857" {
+		t.Errorf("Expected X-CRS EPSG:3857, got %q", got)
+	}
+
+	// Without the setting the headers are left out
+	plain := setupTestServer()
+	defer plain.Close()
+	resp = postStitchRequest(t, plain, request)
+	defer resp.Body.Close()
+	if got := resp.Header.Get("X-Min-X"); got != "" {
+		t.Errorf("Expected no X-Min-X header by default, got %q", got)
+	}
+}
+
+func TestStitchEndpoint_ConditionalRequest(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+
+	tiles := pngTileServer(t)
+	var fetches atomic.Int32
+	counting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		http.Redirect(w, r, tiles.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer counting.Close()
+
+	request := api.StitchRequest{
+		Mode: api.Bbox,
+		Bbox: &api.BoundingBox{
+			MinLat: 37.7,
+			MinLon: -122.5,
+			MaxLat: 37.8,
+			MaxLon: -122.4,
+		},
+		Zoom: 8,
+		TileSource: api.TileSource{
+			Url: counting.URL + "/{z}/{x}/{y}.png",
+		},
+	}
+
+	resp := postStitchRequest(t, server, request)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("Expected an ETag header")
+	}
+	if resp.Header.Get("Cache-Control") == "" {
+		t.Error("Expected a Cache-Control header")
+	}
+	fetched := fetches.Load()
+
+	jsonData, err := json.Marshal(request)
+	if err != nil {
+		t.Fatalf("Failed to marshal request: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/api/v1/stitch", bytes.NewReader(jsonData))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("If-None-Match", etag)
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("Expected status 304, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("ETag"); got != etag {
+		t.Errorf("Expected ETag %s, got %s", etag, got)
+	}
+	if fetches.Load() != fetched {
+		t.Error("Expected no tiles to be fetched for a 304")
+	}
+	if vary := resp.Header.Get("Vary"); vary != "Accept" {
+		t.Errorf("Expected Vary: Accept, got %q", vary)
+	}
+
+	// The image's ETag doesn't stand for the JSON answer
+	req, err = http.NewRequest(http.MethodPost, server.URL+"/api/v1/stitch", bytes.NewReader(jsonData))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("If-None-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the JSON answer for the image's ETag, got status %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected Content-Type application/json, got %q", ct)
+	}
+	if got := resp.Header.Get("ETag"); got == "" || got == etag {
+		t.Errorf("Expected an ETag of its own for the JSON answer, got %q", got)
+	}
+
+	// Other parameters give another image
+	request.Zoom = 9
+	resp = postStitchRequest(t, server, request)
+	resp.Body.Close()
+	if got := resp.Header.Get("ETag"); got == etag {
+		t.Error("Expected a different ETag for a different request")
+	}
+}
+
+func TestStitchEndpoint_CredentialsCacheControl(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+
+	tiles := pngTileServer(t)
+	url := tiles.URL + "/{z}/{x}/{y}.png"
+
+	testCases := []struct {
+		name         string
+		source       api.TileSource
+		cacheControl string
+	}{
+		{"No credentials", api.TileSource{Url: url}, "public, max-age=86400"},
+		{"Basic auth", api.TileSource{Url: url, BasicAuth: &api.BasicAuth{Username: "user", Password: "secret"}}, "private, max-age=86400"},
+		{"Bearer token", api.TileSource{Url: url, BearerToken: stringPtr("secret")}, "private, max-age=86400"},
+		{"Token", api.TileSource{Url: url + "?access_token={token}", Token: stringPtr("secret")}, "private, max-age=86400"},
+		{"Authorization header", api.TileSource{Url: url, Headers: &map[string]string{"authorization": "Bearer secret"}}, "private, max-age=86400"},
+		{"Key in the URL", api.TileSource{Url: url + "?key={key}", Params: &map[string]string{"key": "secret"}}, "private, max-age=86400"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := postStitchRequest(t, server, api.StitchRequest{
+				Mode:       api.Bbox,
+				Bbox:       &api.BoundingBox{MinLat: 37.7, MinLon: -122.5, MaxLat: 37.8, MaxLon: -122.4},
+				Zoom:       8,
+				TileSource: tc.source,
+			})
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("Expected status 200, got %d. Body: %s", resp.StatusCode, string(body))
+			}
+			// Shared caches must not hand imagery of authenticated sources to others
+			if got := resp.Header.Get("Cache-Control"); got != tc.cacheControl {
+				t.Errorf("Expected Cache-Control %q, got %q", tc.cacheControl, got)
+			}
+		})
+	}
+}
+
+func TestStitchEndpoint_ReservedParams(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+
+	for _, name := range append(stitcher.ReservedPlaceholders(), "") {
+		t.Run("{"+name+"}", func(t *testing.T) {
+			request := api.StitchRequest{
+				Mode: api.Bbox,
+				Bbox: &api.BoundingBox{MinLat: 37.7, MinLon: -122.5, MaxLat: 37.8, MaxLon: -122.4},
+				Zoom: 8,
+				TileSource: api.TileSource{
+					Url:    "https://example.com/{z}/{x}/{y}.png",
+					Params: &map[string]string{name: "1"},
+				},
+			}
+			resp := postStitchRequest(t, server, request)
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("Expected status 400 for a {%s} param, got %d", name, resp.StatusCode)
+			}
+		})
+	}
+
+	// Every placeholder the stitcher fills in is reserved
+	for _, name := range []string{"z", "x", "y", "-y", "!y", "s", "bbox", "width", "height", "token"} {
+		if !slices.Contains(stitcher.ReservedPlaceholders(), name) {
+			t.Errorf("Expected {%s} to be reserved", name)
+		}
+	}
+}
+
+func TestStitchEndpoint_IfNoneMatchValidatesFirst(t *testing.T) {
+	server := setupTestServerWithConfig(Config{MaxTiles: 1})
+	defer server.Close()
+
+	tests := []struct {
+		name           string
+		request        api.StitchRequest
+		expectedStatus int
+	}{
+		{
+			name: "invalid template",
+			request: api.StitchRequest{
+				Mode:       api.Bbox,
+				Bbox:       &api.BoundingBox{MinLat: 37.7, MinLon: -122.5, MaxLat: 37.8, MaxLon: -122.4},
+				Zoom:       8,
+				TileSource: api.TileSource{Url: "https://example.com/tile.png"},
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "too many tiles",
+			request: api.StitchRequest{
+				Mode:       api.Bbox,
+				Bbox:       &api.BoundingBox{MinLat: 37.7, MinLon: -122.5, MaxLat: 37.8, MaxLon: -122.4},
+				Zoom:       8,
+				TileSource: api.TileSource{Url: "https://example.com/{z}/{x}/{y}.png"},
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jsonData, err := json.Marshal(tt.request)
+			if err != nil {
+				t.Fatalf("Failed to marshal request: %v", err)
+			}
+			req, err := http.NewRequest(http.MethodPost, server.URL+"/api/v1/stitch", bytes.NewReader(jsonData))
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("If-None-Match", "*")
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestStitchEndpoint_TileLimit(t *testing.T) {
+	server := setupTestServerWithConfig(Config{MaxTiles: 1})
+	defer server.Close()
+
+	request := api.StitchRequest{
+		Mode: api.Bbox,
+		Bbox: &api.BoundingBox{
+			MinLat: 37.7,
+			MinLon: -122.5,
+			MaxLat: 37.8,
+			MaxLon: -122.4,
+		},
+		Zoom: 8, // Two tiles
+		TileSource: api.TileSource{
+			Url: "https://example.com/{z}/{x}/{y}.png",
+		},
+	}
+
+	resp := postStitchRequest(t, server, request)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Expected status 400, got %d. Body: %s", resp.StatusCode, string(body))
+	}
+
+	var errorResp api.ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&errorResp); err != nil {
+		t.Fatalf("Failed to decode error response: %v", err)
+	}
+	if errorResp.Error != "VALIDATION_ERROR" {
+		t.Errorf("Expected error code VALIDATION_ERROR, got %s", errorResp.Error)
+	}
+	if errorResp.Details == nil {
+		t.Fatal("Expected details with the limits")
+	}
+	details := *errorResp.Details
+	if details["limit"] != "max_tiles" || details["requested"] != float64(2) || details["max"] != float64(1) {
+		t.Errorf("Unexpected details: %v", details)
+	}
+}
+
+func TestStitchEndpoint_ImageTooLarge(t *testing.T) {
+	server := setupTestServerWithConfig(Config{MaxPixels: 100000})
+	defer server.Close()
+
+	request := api.StitchRequest{
+		Mode: api.Bbox,
+		Bbox: &api.BoundingBox{
+			MinLat: 37.0,
+			MinLon: -123.0,
+			MaxLat: 38.0,
+			MaxLon: -122.0,
+		},
+		Zoom: 12,
+		TileSource: api.TileSource{
+			Url: "https://example.com/{z}/{x}/{y}.png",
+		},
+	}
+
+	resp := postStitchRequest(t, server, request)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Expected status 413, got %d. Body: %s", resp.StatusCode, string(body))
+	}
+
+	var errorResp api.ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&errorResp); err != nil {
+		t.Fatalf("Failed to decode error response: %v", err)
+	}
+	if errorResp.Error != "IMAGE_TOO_LARGE" {
+		t.Errorf("Expected error code IMAGE_TOO_LARGE, got %s", errorResp.Error)
+	}
+	if errorResp.Details == nil {
+		t.Fatal("Expected details with the size and limit")
+	}
+	details := *errorResp.Details
+	if details["max_pixels"] != float64(100000) {
+		t.Errorf("Expected max_pixels 100000, got %v", details["max_pixels"])
+	}
+	width, _ := details["width"].(float64)
+	height, _ := details["height"].(float64)
+	if width*height <= 100000 || details["pixels"] != width*height {
+		t.Errorf("Unexpected details: %v", details)
+	}
+}
+
+func TestStitchEndpoint_OutOfCoverage(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+
+	// Coverage is checked before downloading, so the tile host is never contacted
+	strict := true
+	request := api.StitchRequest{
+		Mode: api.Bbox,
+		Bbox: &api.BoundingBox{
+			MinLat: 37.7,
+			MinLon: -122.5,
+			MaxLat: 37.8,
+			MaxLon: -122.4,
+		},
+		Zoom: 8,
+		TileSource: api.TileSource{
+			Url:            "https://example.com/{z}/{x}/{y}.png",
+			Bounds:         &[]float64{5.87, 47.27, 15.04, 55.06},
+			StrictCoverage: &strict,
+		},
+	}
+
+	resp := postStitchRequest(t, server, request)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Expected status 400, got %d. Body: %s", resp.StatusCode, string(body))
+	}
+
+	var errorResp api.ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&errorResp); err != nil {
+		t.Fatalf("Failed to decode error response: %v", err)
+	}
+	if errorResp.Error != "OUT_OF_COVERAGE" {
+		t.Errorf("Expected error code OUT_OF_COVERAGE, got %s", errorResp.Error)
+	}
+	if errorResp.Details == nil || (*errorResp.Details)["coverage_percent"] != float64(0) {
+		t.Errorf("Expected coverage_percent 0 in details, got %v", errorResp.Details)
+	}
+}
+
+func TestPreviewEndpoint_MatchesStitch(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+
+	tiles := pngTileServer(t)
+	bbox := &api.BoundingBox{
+		MinLat: 37.7,
+		MinLon: -122.5,
+		MaxLat: 38.2,
+		MaxLon: -121.9,
+	}
+
+	testCases := []struct {
+		name      string
+		request   api.StitchRequest
+		positions bool // the tile count is one download per position
+	}{
+		{
+			name: "single source",
+			request: api.StitchRequest{
+				Mode:       api.Bbox,
+				Bbox:       bbox,
+				Zoom:       10,
+				TileSource: api.TileSource{Url: tiles.URL + "/{z}/{x}/{y}.png"},
+			},
+			positions: true,
+		},
+		{
+			name: "overlay layers",
+			request: api.StitchRequest{
+				Mode:       api.Bbox,
+				Bbox:       bbox,
+				Zoom:       10,
+				TileSource: api.TileSource{Url: tiles.URL + "/base/{z}/{x}/{y}.png"},
+				Layers:     &[]api.Layer{{Url: tiles.URL + "/overlay/{z}/{x}/{y}.png"}},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			request := tc.request
+			body, err := json.Marshal(request)
+			if err != nil {
+				t.Fatalf("Failed to marshal request: %v", err)
+			}
+			resp, err := http.Post(server.URL+"/api/v1/preview", "application/json", bytes.NewReader(body))
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("Expected status 200, got %d. Body: %s", resp.StatusCode, string(body))
+			}
+
+			var preview api.PreviewResponse
+			if err := json.NewDecoder(resp.Body).Decode(&preview); err != nil {
+				t.Fatalf("Failed to decode preview response: %v", err)
+			}
+
+			r := preview.TileRange
+			positions := (r.MaxX - r.MinX + 1) * (r.MaxY - r.MinY + 1)
+			if tc.positions && positions != preview.TileCount {
+				t.Errorf("Expected tile count %d to match the tile range, got %d", positions, preview.TileCount)
+			}
+			if preview.EstimatedBytes != int64(preview.OutputWidth)*int64(preview.OutputHeight)*4 {
+				t.Errorf("Unexpected estimated bytes %d for %dx%d", preview.EstimatedBytes, preview.OutputWidth, preview.OutputHeight)
+			}
+
+			// The real stitch must download exactly the previewed tiles
+			opts, err := NewServer("test").convertToStitcherOptions(&request)
+			if err != nil {
+				t.Fatalf("Failed to convert request: %v", err)
+			}
+			var downloads int64
+			opts.OnTile = func(url string, ok bool) { downloads++ }
+
+			result, err := stitcher.New().Stitch(context.Background(), opts)
+			if err != nil {
+				t.Fatalf("Stitch failed: %v", err)
+			}
+			if downloads != preview.TileCount {
+				t.Errorf("Expected %d downloads, got %d", preview.TileCount, downloads)
+			}
+			if result.Width != preview.OutputWidth || result.Height != preview.OutputHeight {
+				t.Errorf("Expected %dx%d image, got %dx%d", preview.OutputWidth, preview.OutputHeight, result.Width, result.Height)
+			}
+		})
+	}
+}
+
+func TestStitchEndpoint_TileCountExplosion(t *testing.T) {
+	server := setupTestServerWithConfig(Config{MaxTiles: 10000})
+	defer server.Close()
+
+	// Roughly continental Europe at zoom 18, which needs hundreds of millions of tiles
+	request := api.StitchRequest{
+		Mode: api.Bbox,
+		Bbox: &api.BoundingBox{
+			MinLat: 36,
+			MinLon: -10,
+			MaxLat: 60,
+			MaxLon: 30,
+		},
+		Zoom: 18,
+		TileSource: api.TileSource{
+			Url: "https://example.com/{z}/{x}/{y}.png",
+		},
+	}
+
+	resp := postStitchRequest(t, server, request)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Expected status 400, got %d. Body: %s", resp.StatusCode, string(body))
+	}
+
+	var errorResp api.ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&errorResp); err != nil {
+		t.Fatalf("Failed to decode error response: %v", err)
+	}
+	if errorResp.Error != "VALIDATION_ERROR" {
+		t.Errorf("Expected error code VALIDATION_ERROR, got %s", errorResp.Error)
+	}
+	if errorResp.Details == nil {
+		t.Fatal("Expected details with the tile count")
+	}
+	details := *errorResp.Details
+	if details["limit"] != "max_tiles" || details["max"] != float64(10000) {
+		t.Errorf("Unexpected details: %v", details)
+	}
+	if requested, _ := details["requested"].(float64); requested < 1e8 {
+		t.Errorf("Expected a tile count in the hundreds of millions, got %v", details["requested"])
+	}
+}
+
+func TestStitchEndpoint_TileServerRateLimited(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+
+	limited := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer limited.Close()
+
+	request := api.StitchRequest{
+		Mode: api.Bbox,
+		Bbox: &api.BoundingBox{
+			MinLat: 37.7,
+			MinLon: -122.5,
+			MaxLat: 37.8,
+			MaxLon: -122.4,
+		},
+		Zoom: 10,
+		TileSource: api.TileSource{
+			Url: limited.URL + "/{z}/{x}/{y}.png",
+		},
+	}
+
+	resp := postStitchRequest(t, server, request)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Expected status 503, got %d. Body: %s", resp.StatusCode, string(body))
+	}
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "7" {
+		t.Errorf("Expected Retry-After 7, got %q", retryAfter)
+	}
+
+	var errorResp api.TileErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&errorResp); err != nil {
+		t.Fatalf("Failed to decode error response: %v", err)
+	}
+	if errorResp.Error != "TILE_SERVER_RATE_LIMITED" {
+		t.Errorf("Expected error code TILE_SERVER_RATE_LIMITED, got %s", errorResp.Error)
+	}
+	for _, ft := range errorResp.FailedTiles {
+		if ft.StatusCode == nil || *ft.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("Expected status_code 429 for %s, got %v", ft.Url, ft.StatusCode)
+		}
+	}
+}
+
+func TestStitchEndpoint_TileServerTimeout(t *testing.T) {
+	server := setupTestServerWithConfig(Config{TileTimeout: 50 * time.Millisecond})
+	defer server.Close()
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer slow.Close()
+
+	request := api.StitchRequest{
+		Mode: api.Bbox,
+		Bbox: &api.BoundingBox{
+			MinLat: 37.7,
+			MinLon: -122.5,
+			MaxLat: 37.8,
+			MaxLon: -122.4,
+		},
+		Zoom: 10,
+		TileSource: api.TileSource{
+			Url: slow.URL + "/{z}/{x}/{y}.png",
+		},
+	}
+
+	resp := postStitchRequest(t, server, request)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Expected status 504, got %d. Body: %s", resp.StatusCode, string(body))
+	}
+
+	var errorResp api.TileErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&errorResp); err != nil {
+		t.Fatalf("Failed to decode error response: %v", err)
+	}
+	if errorResp.Error != "TILE_SERVER_TIMEOUT" {
+		t.Errorf("Expected error code TILE_SERVER_TIMEOUT, got %s", errorResp.Error)
+	}
+	if len(errorResp.FailedTiles) == 0 {
+		t.Fatal("Expected the failed tiles in the response")
+	}
+	for _, ft := range errorResp.FailedTiles {
+		if ft.Cause == nil || *ft.Cause != api.Timeout {
+			t.Errorf("Expected cause timeout for %s, got %v", ft.Url, ft.Cause)
+		}
+	}
+}
+
+func TestStitchEndpoint_UploadToS3(t *testing.T) {
+	tiles := pngTileServer(t)
+
+	var (
+		method, path, auth, contentHash string
+		uploaded                        []byte
+	)
+	s3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		auth = r.Header.Get("Authorization")
+		contentHash = r.Header.Get("X-Amz-Content-Sha256")
+		uploaded, _ = io.ReadAll(r.Body)
+	}))
+	defer s3.Close()
+
+	request := api.StitchRequest{
+		Mode: api.Bbox,
+		Bbox: &api.BoundingBox{
+			MinLat: 37.7,
+			MinLon: -122.5,
+			MaxLat: 37.8,
+			MaxLon: -122.4,
+		},
+		Zoom: 8,
+		TileSource: api.TileSource{
+			Url: tiles.URL + "/{z}/{x}/{y}.png",
+		},
+		Output: &api.OutputOptions{
+			Destination: stringPtr("s3://maps/exports/sf.png"),
+		},
+	}
+
+	t.Run("Not configured", func(t *testing.T) {
+		server := setupTestServer()
+		defer server.Close()
+
+		resp := postStitchRequest(t, server, request)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Destination not allowed", func(t *testing.T) {
+		server := setupTestServerWithConfig(Config{S3: &S3Config{
+			Endpoint:        s3.URL,
+			AccessKeyID:     "AKIDEXAMPLE",
+			SecretAccessKey: "secret",
+			Destinations:    []string{"maps/exports", "archive"},
+		}})
+		defer server.Close()
+
+		for _, destination := range []string{
+			"s3://other/exports/sf.png",
+			"s3://maps/exports-old/sf.png",
+			"s3://maps/sf.png",
+			"s3://maps/exports/../sf.png",
+			"s3://archive/../maps/sf.png",
+		} {
+			request := request
+			request.Output = &api.OutputOptions{Destination: stringPtr(destination)}
+			resp := postStitchRequest(t, server, request)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("Expected status 400 for %s, got %d", destination, resp.StatusCode)
+			}
+		}
+		if method != "" {
+			t.Errorf("Expected nothing uploaded, got %s %s", method, path)
+		}
+	})
+
+	t.Run("Uploaded", func(t *testing.T) {
+		server := setupTestServerWithConfig(Config{S3: &S3Config{
+			Endpoint:        s3.URL,
+			Region:          "eu-central-1",
+			AccessKeyID:     "AKIDEXAMPLE",
+			SecretAccessKey: "secret",
+			Destinations:    []string{"maps/exports"},
+		}})
+		defer server.Close()
+
+		resp := postStitchRequest(t, server, request)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			t.Fatalf("Expected status 200, got %d. Body: %s", resp.StatusCode, string(body))
+		}
+
+		var upload api.UploadResponse
+		if err := json.NewDecoder(resp.Body).Decode(&upload); err != nil {
+			t.Fatalf("Failed to decode upload response: %v", err)
+		}
+
+		if method != http.MethodPut || path != "/maps/exports/sf.png" {
+			t.Errorf("Expected PUT /maps/exports/sf.png, got %s %s", method, path)
+		}
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || !strings.Contains(auth, "/eu-central-1/s3/aws4_request") {
+			t.Errorf("Expected a SigV4 Authorization header, got %q", auth)
+		}
+		// Over plain HTTP every chunk of the body is signed
+		if contentHash != "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+			t.Errorf("Expected a signed streaming payload, got X-Amz-Content-Sha256 %q", contentHash)
+		}
+		uploaded = decodeAWSChunked(t, uploaded)
+
+		img, err := png.Decode(bytes.NewReader(uploaded))
+		if err != nil {
+			t.Fatalf("Failed to decode uploaded image: %v", err)
+		}
+		if upload.Url != s3.URL+"/maps/exports/sf.png" {
+			t.Errorf("Expected the object URL, got %s", upload.Url)
+		}
+		if upload.Bytes != int64(len(uploaded)) || upload.Width != img.Bounds().Dx() || upload.Height != img.Bounds().Dy() {
+			t.Errorf("Response %+v doesn't match the uploaded %d bytes, %v", upload, len(uploaded), img.Bounds())
+		}
+	})
+}
+
+// decodeAWSChunked returns the data of an aws-chunked body, whose chunks are
+// "<hex size>;chunk-signature=<signature>\r\n<data>\r\n"
+func decodeAWSChunked(t *testing.T, body []byte) []byte {
+	t.Helper()
+
+	var data []byte
+	for {
+		header, rest, ok := bytes.Cut(body, []byte("\r\n"))
+		if !ok {
+			t.Fatalf("Truncated aws-chunked body")
+		}
+		sizeHex, _, _ := bytes.Cut(header, []byte(";"))
+		size, err := strconv.ParseInt(string(sizeHex), 16, 64)
+		if err != nil || int64(len(rest)) < size+2 {
+			t.Fatalf("Invalid aws-chunked chunk header %q", header)
+		}
+		if size == 0 {
+			return data
+		}
+		data = append(data, rest[:size]...)
+		body = rest[size+2:]
+	}
+}
+
+func TestTileEndpoint(t *testing.T) {
+	// The tile isn't decoded, so any bytes pass through
+	body := []byte("RIFF\x1a\x00\x00\x00WEBPVP8L not really a webp tile")
+	var path string
+	tileServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.Header().Set("Content-Type", "image/webp")
+		w.Write(body)
+	}))
+	defer tileServer.Close()
+
+	server := setupTestServer()
+	defer server.Close()
+
+	query := url.Values{"url": {tileServer.URL + "/{z}/{x}/{y}.webp"}, "z": {"3"}, "x": {"4"}, "y": {"2"}}
+	resp, err := http.Get(server.URL + "/api/v1/tile?" + query.Encode())
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if path != "/3/4/2.webp" {
+		t.Errorf("Expected tile /3/4/2.webp to be requested, got %s", path)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "image/webp" {
+		t.Errorf("Expected Content-Type image/webp, got %s", ct)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if !bytes.Equal(data, body) {
+		t.Errorf("Expected the tile bytes unchanged, got %q", data)
+	}
+
+	t.Run("Validation", func(t *testing.T) {
+		testCases := []struct {
+			name  string
+			query url.Values
+		}{
+			{"Missing placeholders", url.Values{"url": {tileServer.URL + "/tile.png"}, "z": {"3"}, "x": {"4"}, "y": {"2"}}},
+			{"Zoom out of range", url.Values{"url": {tileServer.URL + "/{z}/{x}/{y}.png"}, "z": {"21"}, "x": {"0"}, "y": {"0"}}},
+			{"Column outside the grid", url.Values{"url": {tileServer.URL + "/{z}/{x}/{y}.png"}, "z": {"3"}, "x": {"8"}, "y": {"0"}}},
+			{"Negative row", url.Values{"url": {tileServer.URL + "/{z}/{x}/{y}.png"}, "z": {"3"}, "x": {"0"}, "y": {"-1"}}},
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				resp, err := http.Get(server.URL + "/api/v1/tile?" + tc.query.Encode())
+				if err != nil {
+					t.Fatalf("Failed to make request: %v", err)
+				}
+				defer resp.Body.Close()
+
+				if resp.StatusCode != http.StatusBadRequest {
+					t.Errorf("Expected status 400, got %d", resp.StatusCode)
+				}
+			})
+		}
+	})
+}
+
+func TestStitchEndpoint_ZoomOutsideSourceRange(t *testing.T) {
+	tiles := pngTileServer(t)
+	server := setupTestServerWithConfig(Config{Sources: map[string]NamedSource{
+		"limited": {URL: tiles.URL + "/{z}/{x}/{y}.png", MinZoom: 2, MaxZoom: 8},
+	}})
+	defer server.Close()
+
+	boolPtr := func(b bool) *bool { return &b }
+	testCases := []struct {
+		name    string
+		zoom    int
+		source  api.TileSource
+		layers  *[]api.Layer
+		status  int
+		message string
+	}{
+		{"above maxzoom", 10, api.TileSource{Url: tiles.URL + "/{z}/{x}/{y}.png", Maxzoom: intPtr(8)}, nil, http.StatusBadRequest, "zoom 10 is outside the range of the tile source, 0 to 8"},
+		{"below minzoom", 1, api.TileSource{Url: tiles.URL + "/{z}/{x}/{y}.png", Minzoom: intPtr(2)}, nil, http.StatusBadRequest, "zoom 1 is outside the range of the tile source, 2 to 30"},
+		{"named source", 10, api.TileSource{Name: stringPtr("limited")}, nil, http.StatusBadRequest, "zoom 10 is outside the range of the tile source, 2 to 8"},
+		{"with layers", 10, api.TileSource{Url: tiles.URL + "/{z}/{x}/{y}.png", Maxzoom: intPtr(8)}, &[]api.Layer{{Url: tiles.URL + "/{z}/{x}/{y}.png"}}, http.StatusBadRequest, "zoom 10 is outside the range of the tile source, 0 to 8"},
+		{"beyond fallback levels", 12, api.TileSource{Url: tiles.URL + "/{z}/{x}/{y}.png", Maxzoom: intPtr(8), FallbackZoom: boolPtr(true)}, nil, http.StatusBadRequest, "zoom 12 is outside the range of the tile source, 0 to 11"},
+		{"within range", 8, api.TileSource{Name: stringPtr("limited")}, nil, http.StatusOK, ""},
+		{"fallback zoom", 10, api.TileSource{Url: tiles.URL + "/{z}/{x}/{y}.png", Maxzoom: intPtr(8), FallbackZoom: boolPtr(true)}, nil, http.StatusOK, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := postStitchRequest(t, server, api.StitchRequest{
+				Mode:       api.Bbox,
+				Bbox:       &api.BoundingBox{MinLat: 37.7, MinLon: -122.5, MaxLat: 37.8, MaxLon: -122.4},
+				Zoom:       tc.zoom,
+				TileSource: tc.source,
+				Layers:     tc.layers,
+			})
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tc.status {
+				t.Fatalf("Expected status %d, got %d", tc.status, resp.StatusCode)
+			}
+			if tc.message == "" {
+				return
+			}
+			var errorResponse api.ValidationErrorResponse
+			if err := json.NewDecoder(resp.Body).Decode(&errorResponse); err != nil {
+				t.Fatalf("Failed to decode error response: %v", err)
+			}
+			if errorResponse.Error != api.VALIDATIONERROR || errorResponse.Message != tc.message {
+				t.Errorf("Expected %s %q, got %s %q", api.VALIDATIONERROR, tc.message, errorResponse.Error, errorResponse.Message)
+			}
+		})
+	}
+}
+
+// Helper functions
+func stringPtr(s string) *string {
+	return &s
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestStitchEndpoint_TileRange(t *testing.T) {
+	tiles := pngTileServer(t)
+	server := setupTestServer()
+	defer server.Close()
+
+	request := func(r api.TileRange) api.StitchRequest {
+		return api.StitchRequest{
+			Mode:       api.Tilerange,
+			TileRange:  &r,
+			Zoom:       3,
+			TileSource: api.TileSource{Url: tiles.URL + "/{z}/{x}/{y}.png"},
+		}
+	}
+
+	resp := postStitchRequest(t, server, request(api.TileRange{MinX: 4, MinY: 3, MaxX: 5, MaxY: 4}))
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	config, err := png.DecodeConfig(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to decode image: %v", err)
+	}
+	if config.Width != 512 || config.Height != 512 {
+		t.Errorf("Expected the 512x512 pixels of 2x2 tiles, got %dx%d", config.Width, config.Height)
+	}
+
+	// Zoom 3 has tiles 0 to 7
+	resp = postStitchRequest(t, server, request(api.TileRange{MinX: 4, MinY: 3, MaxX: 8, MaxY: 4}))
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status 400, got %d", resp.StatusCode)
+	}
+	var errorResponse api.ValidationErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&errorResponse); err != nil {
+		t.Fatalf("Failed to decode error response: %v", err)
+	}
+	if !strings.Contains(errorResponse.Message, "tile_range exceeds the 8x8 tiles of zoom 3") {
+		t.Errorf("Unexpected error message %q", errorResponse.Message)
+	}
+}
+
+func postStitchRequest(t *testing.T, server *httptest.Server, request api.StitchRequest) *http.Response {
+	t.Helper()
+
+	jsonData, err := json.Marshal(request)
+	if err != nil {
+		t.Fatalf("Failed to marshal request: %v", err)
+	}
+
+	resp, err := http.Post(
+		server.URL+"/api/v1/stitch",
+		"application/json",
+		bytes.NewBuffer(jsonData),
+	)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+
+	return resp
+}
+
+// pngTileServer serves opaque 256x256 PNG tiles
+func pngTileServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+
+	var tile bytes.Buffer
+	if err := png.Encode(&tile, img); err != nil {
+		t.Fatalf("Failed to encode tile: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(tile.Bytes())
+	}))
+	t.Cleanup(server.Close)
+
+	return server
 }
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/kiesman99/stitch/internal/api"
+)
+
+// NamedSource is a tile source configured on the server, which stitch
+// requests can refer to by name instead of sending its URL
+type NamedSource struct {
+	URL         string   `yaml:"url"`
+	Attribution string   `yaml:"attribution"`
+	MinZoom     int      `yaml:"min_zoom"`
+	MaxZoom     int      `yaml:"max_zoom"`   // 0 leaves the zoom unlimited
+	Subdomains  []string `yaml:"subdomains"` // values of {s}; empty uses a, b and c
+}
+
+// LoadSources reads named tile sources from a YAML (or JSON) file mapping
+// each name to its source:
+//
+//	osm:
+//	  url: https://{s}.tile.openstreetmap.org/{z}/{x}/{y}.png
+//	  attribution: © OpenStreetMap contributors
+//	  max_zoom: 19
+func LoadSources(path string) (map[string]NamedSource, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var sources map[string]NamedSource
+	if err := yaml.Unmarshal(data, &sources); err != nil {
+		return nil, fmt.Errorf("can't parse sources file %s: %v", path, err)
+	}
+	for name, source := range sources {
+		if err := validateTileTemplate("source "+name, source.URL); err != nil {
+			return nil, fmt.Errorf("sources file %s: %v", path, err)
+		}
+	}
+	return sources, nil
+}
+
+// ListSources lists the configured named tile sources, sorted by name
+func (s *Server) ListSources(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(s.config.Sources))
+	for name := range s.config.Sources {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	response := api.SourcesResponse{Sources: make([]api.NamedTileSource, 0, len(names))}
+	for _, name := range names {
+		source := s.config.Sources[name]
+		item := api.NamedTileSource{Name: name, Url: source.URL}
+		if source.Attribution != "" {
+			item.Attribution = &source.Attribution
+		}
+		if source.MinZoom > 0 {
+			item.MinZoom = &source.MinZoom
+		}
+		if source.MaxZoom > 0 {
+			item.MaxZoom = &source.MaxZoom
+		}
+		if len(source.Subdomains) > 0 {
+			item.Subdomains = &source.Subdomains
+		}
+		response.Sources = append(response.Sources, item)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		s.log.Error("encoding sources response failed", "error", err)
+	}
+}
+
+// resolveSource fills in the URL of a tile source given only by name from
+// the configured sources, along with its attribution and zoom range unless
+// the request sets them
+func (s *Server) resolveSource(req *api.StitchRequest) error {
+	src := &req.TileSource
+	if src.Url != "" || src.Name == nil || *src.Name == "" {
+		return nil
+	}
+
+	source, ok := s.config.Sources[*src.Name]
+	if !ok {
+		return fmt.Errorf("unknown tile source %q", *src.Name)
+	}
+	src.Url = source.URL
+	if src.Attribution == nil && source.Attribution != "" {
+		attribution := source.Attribution
+		src.Attribution = &attribution
+	}
+	if src.Minzoom == nil && source.MinZoom > 0 {
+		minZoom := source.MinZoom
+		src.Minzoom = &minZoom
+	}
+	if src.Maxzoom == nil && source.MaxZoom > 0 {
+		maxZoom := source.MaxZoom
+		src.Maxzoom = &maxZoom
+	}
+	return nil
+}
+
+// sourceSubdomains returns the {s} values of the named source a request
+// uses, or nil when it sends its own URL
+func (s *Server) sourceSubdomains(src api.TileSource) []string {
+	if src.Name == nil {
+		return nil
+	}
+	source, ok := s.config.Sources[*src.Name]
+	if !ok || source.URL != src.Url {
+		return nil
+	}
+	return source.Subdomains
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kiesman99/stitch/internal/api"
+)
+
+func TestLoadSources(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sources.yaml")
+	data := `
+osm:
+  url: "https://{s}.tile.openstreetmap.org/{z}/{x}/{y}.png"
+  attribution: "© OpenStreetMap contributors"
+  max_zoom: 19
+  subdomains: [a, b]
+`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sources, err := LoadSources(path)
+	if err != nil {
+		t.Fatalf("LoadSources failed: %v", err)
+	}
+	osm, ok := sources["osm"]
+	if !ok {
+		t.Fatalf("Expected source osm, got %v", sources)
+	}
+	if osm.URL != "https://{s}.tile.openstreetmap.org/{z}/{x}/{y}.png" || osm.MaxZoom != 19 || len(osm.Subdomains) != 2 {
+		t.Errorf("Unexpected source %+v", osm)
+	}
+
+	// Sources without placeholders are rejected when loading
+	if err := os.WriteFile(path, []byte("broken:\n  url: https://example.com/tile.png\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadSources(path); err == nil {
+		t.Error("Expected an error for a source without placeholders")
+	}
+}
+
+func TestSourcesEndpoint(t *testing.T) {
+	server := setupTestServerWithConfig(Config{Sources: map[string]NamedSource{
+		"topo": {URL: "https://tiles.example.com/topo/{z}/{x}/{y}.png"},
+		"osm": {
+			URL:         "https://{s}.tile.openstreetmap.org/{z}/{x}/{y}.png",
+			Attribution: "© OpenStreetMap contributors",
+			MaxZoom:     19,
+			Subdomains:  []string{"a", "b", "c"},
+		},
+	}})
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/v1/sources")
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	var response api.SourcesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(response.Sources) != 2 {
+		t.Fatalf("Expected 2 sources, got %d", len(response.Sources))
+	}
+
+	osm, topo := response.Sources[0], response.Sources[1]
+	if osm.Name != "osm" || topo.Name != "topo" {
+		t.Errorf("Expected sources sorted by name, got %s and %s", osm.Name, topo.Name)
+	}
+	if osm.MaxZoom == nil || *osm.MaxZoom != 19 {
+		t.Errorf("Expected max_zoom 19, got %v", osm.MaxZoom)
+	}
+	if osm.Attribution == nil || *osm.Attribution != "© OpenStreetMap contributors" {
+		t.Errorf("Unexpected attribution %v", osm.Attribution)
+	}
+	if osm.Subdomains == nil || len(*osm.Subdomains) != 3 {
+		t.Errorf("Unexpected subdomains %v", osm.Subdomains)
+	}
+	if topo.Attribution != nil || topo.MaxZoom != nil || topo.Subdomains != nil {
+		t.Errorf("Expected no optional fields for topo, got %+v", topo)
+	}
+}
+
+func TestStitchEndpoint_NamedSource(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	var tile bytes.Buffer
+	if err := png.Encode(&tile, img); err != nil {
+		t.Fatalf("Failed to encode tile: %v", err)
+	}
+
+	// Record the paths requested, whose first element is the subdomain
+	var mu sync.Mutex
+	var paths []string
+	tiles := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(tile.Bytes())
+	}))
+	defer tiles.Close()
+
+	server := setupTestServerWithConfig(Config{Sources: map[string]NamedSource{
+		"local": {
+			URL:        tiles.URL + "/{s}/{z}/{x}/{y}.png",
+			Subdomains: []string{"one", "two"},
+		},
+	}})
+	defer server.Close()
+
+	request := func(name string) api.StitchRequest {
+		return api.StitchRequest{
+			Mode:       api.Bbox,
+			Bbox:       &api.BoundingBox{MinLat: 37.7, MinLon: -122.5, MaxLat: 37.8, MaxLon: -122.4},
+			Zoom:       10,
+			TileSource: api.TileSource{Name: &name},
+		}
+	}
+
+	resp := postStitchRequest(t, server, request("local"))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if len(paths) == 0 {
+		t.Fatal("Expected the named source to be downloaded from")
+	}
+	for _, path := range paths {
+		if !strings.HasPrefix(path, "/one/10/") && !strings.HasPrefix(path, "/two/10/") {
+			t.Errorf("Expected a configured subdomain in %s", path)
+		}
+	}
+
+	// Unknown names are validation errors
+	resp = postStitchRequest(t, server, request("missing"))
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status 400, got %d", resp.StatusCode)
+	}
+	var errorResponse api.ValidationErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&errorResponse); err != nil {
+		t.Fatalf("Failed to decode error response: %v", err)
+	}
+	if !strings.Contains(errorResponse.Message, `unknown tile source "missing"`) {
+		t.Errorf("Unexpected error message %q", errorResponse.Message)
+	}
+}
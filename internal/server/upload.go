@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Config holds the object storage results are uploaded to for requests
+// with output.destination. Any S3-compatible service (AWS, MinIO, R2, ...)
+// works; objects are addressed path-style as Endpoint/bucket/key.
+type S3Config struct {
+	Endpoint        string // e.g. https://s3.eu-central-1.amazonaws.com or http://localhost:9000
+	Region          string // signing region; empty uses us-east-1
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string // for temporary credentials; optional
+
+	// Destinations are the buckets, as "bucket", and folders, as
+	// "bucket/prefix", requests may upload to. Empty rejects every upload.
+	Destinations []string
+
+	Client *http.Client // nil uses http.DefaultClient
+
+	once   sync.Once
+	client *minio.Client
+	err    error
+}
+
+// parseS3Destination splits an s3://bucket/key destination
+func parseS3Destination(destination string) (bucket, key string, err error) {
+	rest, ok := strings.CutPrefix(destination, "s3://")
+	if !ok {
+		return "", "", fmt.Errorf("destination must be an s3://bucket/key URL")
+	}
+	bucket, key, _ = strings.Cut(rest, "/")
+	if bucket == "" || key == "" {
+		return "", "", fmt.Errorf("destination must be an s3://bucket/key URL")
+	}
+	if strings.Contains(key, "..") {
+		return "", "", fmt.Errorf("destination key must not contain '..'")
+	}
+	return bucket, key, nil
+}
+
+// checkDestination returns an error unless Destinations allows the object
+// key in bucket
+func (c *S3Config) checkDestination(bucket, key string) error {
+	for _, allowed := range c.Destinations {
+		allowedBucket, prefix, _ := strings.Cut(strings.Trim(allowed, "/"), "/")
+		if allowedBucket != bucket {
+			continue
+		}
+		if prefix == "" || strings.HasPrefix(key, prefix+"/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("destination s3://%s/%s is not an allowed upload location", bucket, key)
+}
+
+// s3Client returns the client for Endpoint, created on first use
+func (c *S3Config) s3Client() (*minio.Client, error) {
+	c.once.Do(func() {
+		endpoint, err := url.Parse(c.Endpoint)
+		if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+			c.err = fmt.Errorf("S3 endpoint must be an http or https URL, got %q", c.Endpoint)
+			return
+		}
+		region := c.Region
+		if region == "" {
+			region = "us-east-1"
+		}
+		var transport http.RoundTripper
+		if c.Client != nil {
+			transport = c.Client.Transport
+		}
+		c.client, c.err = minio.New(endpoint.Host, &minio.Options{
+			Creds:        credentials.NewStaticV4(c.AccessKeyID, c.SecretAccessKey, c.SessionToken),
+			Secure:       endpoint.Scheme == "https",
+			Region:       region,
+			BucketLookup: minio.BucketLookupPath,
+			Transport:    transport,
+		})
+	})
+	return c.client, c.err
+}
+
+// upload stores data at an s3://bucket/key destination and returns the
+// object's URL
+func (c *S3Config) upload(ctx context.Context, destination, contentType string, data []byte) (string, error) {
+	bucket, key, err := parseS3Destination(destination)
+	if err != nil {
+		return "", err
+	}
+	if err := c.checkDestination(bucket, key); err != nil {
+		return "", err
+	}
+
+	client, err := c.s3Client()
+	if err != nil {
+		return "", err
+	}
+	_, err = client.PutObject(ctx, bucket, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType: contentType,
+	})
+	if err != nil {
+		return "", fmt.Errorf("upload to %s failed: %w", destination, err)
+	}
+	return strings.TrimRight(c.Endpoint, "/") + "/" + uriEncode(bucket) + "/" + uriEncode(key), nil
+}
+
+// uriEncode percent-encodes an object path for its URL: everything but
+// unreserved characters and slashes
+func uriEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
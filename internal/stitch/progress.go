@@ -0,0 +1,102 @@
+package stitch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Progress output modes
+const (
+	ProgressText = "text" // human-readable lines (default)
+	ProgressJSON = "json" // newline-delimited JSON events
+	ProgressNone = "none" // no per-tile progress
+)
+
+// progressEvent is one line of JSON progress output
+type progressEvent struct {
+	Event     string `json:"event"`
+	URL       string `json:"url,omitempty"`
+	OK        *bool  `json:"ok,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Completed int    `json:"completed"`
+	Total     int    `json:"total"`
+	Failed    *int   `json:"failed,omitempty"`
+	ElapsedMS *int64 `json:"elapsed_ms,omitempty"`
+}
+
+// progress reports the state of a stitch on stderr in the selected mode
+type progress struct {
+	mode      string
+	w         io.Writer
+	total     int
+	completed int
+	failed    int
+	start     time.Time
+}
+
+// newProgress returns a reporter for mode, which may be empty for text
+func newProgress(mode string, w io.Writer) (*progress, error) {
+	switch mode {
+	case "":
+		mode = ProgressText
+	case ProgressText, ProgressJSON, ProgressNone:
+	default:
+		return nil, fmt.Errorf("unknown progress mode: %s (use text, json or none)", mode)
+	}
+	return &progress{mode: mode, w: w, start: time.Now()}, nil
+}
+
+// percent returns the share of finished tiles
+func (p *progress) percent() float64 {
+	if p.total == 0 {
+		return 100
+	}
+	return float64(p.completed) / float64(p.total) * 100
+}
+
+// tile records the outcome of a tile; err is nil on success. Text mode
+// prints the tile with the progress including it, so the last line reads 100%.
+func (p *progress) tile(url string, err error) {
+	p.completed++
+	ok := err == nil
+	if !ok {
+		p.failed++
+	}
+	if p.mode == ProgressText {
+		fmt.Fprintf(p.w, "%.2f%%: %s\n", p.percent(), url)
+	}
+	if p.mode != ProgressJSON {
+		return
+	}
+
+	event := progressEvent{Event: "tile", URL: url, OK: &ok, Completed: p.completed, Total: p.total}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	p.emit(event)
+}
+
+// done emits the completion event with timing and failure counts
+func (p *progress) done() {
+	if p.mode != ProgressJSON {
+		return
+	}
+	elapsed := time.Since(p.start).Milliseconds()
+	p.emit(progressEvent{
+		Event:     "done",
+		Completed: p.completed,
+		Total:     p.total,
+		Failed:    &p.failed,
+		ElapsedMS: &elapsed,
+	})
+}
+
+func (p *progress) emit(event progressEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(p.w, "%s\n", line)
+}
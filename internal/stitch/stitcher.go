@@ -1,10 +1,16 @@
 package stitch
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"log/slog"
 	"math"
+	"net/http"
 	"os"
+	"strings"
 
+	"github.com/kiesman99/stitch/internal/stitcher"
 	"github.com/kiesman99/stitch/pkg/tile"
 )
 
@@ -12,32 +18,123 @@ import (
 type Stitcher struct {
 	processor *tile.Processor
 	options   *tile.StitchOptions
+	log       *slog.Logger
 }
 
 // NewStitcher creates a new stitcher instance
-func NewStitcher(opts *tile.StitchOptions) *Stitcher {
+func NewStitcher(opts *tile.StitchOptions) (*Stitcher, error) {
 	userAgent := opts.UserAgent
 	if userAgent == "" {
-		userAgent = "stitch/2.0.0"
+		userAgent = tile.DefaultUserAgent
+	}
+
+	processor := tile.NewProcessor(userAgent)
+	if opts.DebugDump {
+		processor.SetDebugDump(os.Stderr)
+	}
+	if opts.NoKeepAlive {
+		if err := processor.SetKeepAlive(false); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Timeout > 0 {
+		processor.SetTimeout(opts.Timeout)
+	} else if opts.Timeout < 0 {
+		processor.SetTimeout(0)
+	}
+	if opts.Retries > 0 {
+		processor.SetRetries(opts.Retries, tile.DefaultRetryBackoff)
+	}
+	if opts.Proxy != nil {
+		if err := processor.SetProxy(opts.Proxy); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Insecure {
+		if err := processor.SetInsecureSkipVerify(true); err != nil {
+			return nil, err
+		}
+	}
+	if opts.CacheDir != "" {
+		cache := tile.NewCache(opts.CacheDir)
+		cache.SetTTL(opts.CacheTTL)
+		processor.SetCache(cache)
+	}
+	if headers := requestHeaders(opts); len(headers) > 0 {
+		processor.SetHeaders(headers)
+	}
+
+	log := opts.Logger
+	if log == nil {
+		log = slog.New(slog.NewTextHandler(io.Discard, nil))
 	}
 
 	return &Stitcher{
-		processor: tile.NewProcessor(userAgent),
+		processor: processor,
 		options:   opts,
+		log:       log,
+	}, nil
+}
+
+// requestHeaders returns opts.Headers with the Authorization from BasicAuth
+// or BearerToken, the Referer and the Origin, which replace the same headers
+// in Headers, as the library sets them
+func requestHeaders(opts *tile.StitchOptions) map[string]string {
+	shared := &stitcher.Options{
+		Headers:     opts.Headers,
+		BearerToken: opts.BearerToken,
+		Referer:     opts.Referer,
+		Origin:      opts.Origin,
+	}
+	if opts.BasicAuth != "" {
+		username, password, _ := strings.Cut(opts.BasicAuth, ":")
+		shared.BasicAuth = &stitcher.BasicAuth{Username: username, Password: password}
+	}
+	return stitcher.RequestHeaders(shared)
+}
+
+// tileRequest returns the URL and request body for a tile; the body template
+// takes the same placeholders as the URL
+func (s *Stitcher) tileRequest(urlTemplate string, zoom int, x, y uint32) (string, string) {
+	var body string
+	if s.options.Body != "" {
+		body = tile.BuildURL(s.options.Body, zoom, x, y)
+	}
+	return tile.BuildURL(urlTemplate, zoom, x, y), body
+}
+
+// stdoutIsTerminal reports whether standard output is a terminal; tests replace it
+var stdoutIsTerminal = func() bool {
+	stat, err := os.Stdout.Stat()
+	return err == nil && (stat.Mode()&os.ModeCharDevice) != 0
+}
+
+// checkOutput refuses to write binary image data to a terminal unless forced
+func (s *Stitcher) checkOutput() error {
+	if s.options.Output == "" && !s.options.Force && stdoutIsTerminal() {
+		return fmt.Errorf("didn't specify output file and standard output is a terminal (use --force to write anyway)")
 	}
+	return nil
 }
 
 // StitchBoundingBox stitches tiles for a geographic bounding box
-func (s *Stitcher) StitchBoundingBox(bbox *tile.BoundingBox, zoom int, urls []string) error {
-	return s.stitch(bbox.MinLat, bbox.MinLon, bbox.MaxLat, bbox.MaxLon, zoom, urls, false, 0, 0)
+func (s *Stitcher) StitchBoundingBox(ctx context.Context, bbox *tile.BoundingBox, zoom int, urls []string) error {
+	return s.stitch(ctx, bbox.MinLat, bbox.MinLon, bbox.MaxLat, bbox.MaxLon, zoom, urls, false, 0, 0, nil)
 }
 
 // StitchCentered stitches tiles for a centered request
-func (s *Stitcher) StitchCentered(req *tile.CenteredRequest, zoom int, urls []string) error {
-	return s.stitch(req.Lat, req.Lon, 0, 0, zoom, urls, true, req.Width, req.Height)
+func (s *Stitcher) StitchCentered(ctx context.Context, req *tile.CenteredRequest, zoom int, urls []string) error {
+	return s.stitch(ctx, req.Lat, req.Lon, 0, 0, zoom, urls, true, req.Width, req.Height, nil)
 }
 
-func (s *Stitcher) stitch(minlat, minlon, maxlat, maxlon float64, zoom int, urls []string, centered bool, width, height int) error {
+// StitchTileRange stitches exactly the tiles of r, georeferenced by their extent
+func (s *Stitcher) StitchTileRange(ctx context.Context, r *tile.TileRange, urls []string) error {
+	return s.stitch(ctx, 0, 0, 0, 0, r.Zoom, urls, false, 0, 0, r)
+}
+
+// stitch stitches the bounding box, the centered area when centered, or
+// exactly the tiles of a non-nil tiles
+func (s *Stitcher) stitch(ctx context.Context, minlat, minlon, maxlat, maxlon float64, zoom int, urls []string, centered bool, width, height int, tiles *tile.TileRange) error {
 	if zoom < 0 {
 		return fmt.Errorf("zoom %d less than 0", zoom)
 	}
@@ -46,108 +143,176 @@ func (s *Stitcher) stitch(minlat, minlon, maxlat, maxlon float64, zoom int, urls
 		return fmt.Errorf("no tile URLs provided")
 	}
 
-	// Check if output is to terminal
-	if s.options.Output == "" {
-		if stat, _ := os.Stdout.Stat(); (stat.Mode() & os.ModeCharDevice) != 0 {
-			return fmt.Errorf("didn't specify output file and standard output is a terminal")
-		}
+	method := strings.ToUpper(s.options.Method)
+	switch method {
+	case "":
+		method = http.MethodGet
+	case http.MethodGet, http.MethodPost:
+	default:
+		return fmt.Errorf("unsupported request method: %s", s.options.Method)
+	}
+	if s.options.Body != "" && method == http.MethodGet {
+		return fmt.Errorf("a request body requires --method POST")
 	}
 
-	var x1, y1, x2, y2 uint32
-
-	if centered {
-		lat := minlat
-		lon := minlon
-
-		if width <= 0 || height <= 0 {
-			return fmt.Errorf("width/height less than 0: %d %d", width, height)
+	if !s.options.DryRun {
+		if err := s.checkOutput(); err != nil {
+			return err
 		}
+	}
+	if s.options.Metadata == tile.MetadataAuto && s.options.Output == "" {
+		return fmt.Errorf("writing to stdout; give --metadata a path for the metadata file")
+	}
 
-		// Calculate tile coordinates at high precision
-		cx, cy := tile.LatLonToTile(lat, lon, 32)
-
-		// Calculate bounds
-		x1 = cx - uint32((width<<(32-(zoom+8)))/2)
-		y1 = cy - uint32((height<<(32-(zoom+8)))/2)
-		x2 = cx + uint32((width<<(32-(zoom+8)))/2)
-		y2 = cy + uint32((height<<(32-(zoom+8)))/2)
+	report, err := newProgress(s.options.Progress, os.Stderr)
+	if err != nil {
+		return err
+	}
 
-		// Convert back to lat/lon
-		maxlat, minlon = tile.TileToLatLon(x1, y1, 32)
-		minlat, maxlon = tile.TileToLatLon(x2, y2, 32)
-	} else {
-		// Bounding box mode
-		x1, y1 = tile.LatLonToTile(maxlat, minlon, 32)
-		x2, y2 = tile.LatLonToTile(minlat, maxlon, 32)
+	if centered && (width <= 0 || height <= 0) {
+		return fmt.Errorf("width/height less than 0: %d %d", width, height)
 	}
 
-	// Convert to actual tile coordinates
-	tx1 := x1 >> (32 - zoom)
-	ty1 := y1 >> (32 - zoom)
-	tx2 := x2 >> (32 - zoom)
-	ty2 := y2 >> (32 - zoom)
+	// The tile range and pixel size come from the library, so both
+	// pipelines cut the same area. Latitudes beyond the Web Mercator range
+	// are clamped to it.
+	geometry := &stitcher.Options{
+		Mode:          stitcher.ModeBBox,
+		MinLat:        minlat,
+		MinLon:        minlon,
+		MaxLat:        maxlat,
+		MaxLon:        maxlon,
+		Zoom:          zoom,
+		TileSize:      s.options.TileSize,
+		ClampLatitude: true,
+	}
+	switch {
+	case tiles != nil:
+		geometry.Mode = stitcher.ModeTileRange
+		geometry.MinTileX, geometry.MinTileY = tiles.MinX, tiles.MinY
+		geometry.MaxTileX, geometry.MaxTileY = tiles.MaxX, tiles.MaxY
+	case centered:
+		geometry.Mode = stitcher.ModeCentered
+		geometry.CenterLat, geometry.CenterLon = minlat, minlon
+		geometry.Width, geometry.Height = width, height
+	}
+	if s.options.CropToTiles {
+		geometry.CropMode = stitcher.CropTiles
+	}
+	bounds, err := stitcher.ComputeBounds(geometry)
+	if err != nil {
+		return err
+	}
+	minlat, minlon, maxlat, maxlon = bounds.MinLat, bounds.MinLon, bounds.MaxLat, bounds.MaxLon
+	tx1, ty1, tx2, ty2 := bounds.MinTileX, bounds.MinTileY, bounds.MaxTileX, bounds.MaxTileY
+	xa, ya := bounds.OffsetX, bounds.OffsetY
+	outputWidth, outputHeight := bounds.Width, bounds.Height
 
 	// Project coordinates
 	minx, miny := tile.ProjectLatLon(minlat, minlon)
 	maxx, maxy := tile.ProjectLatLon(maxlat, maxlon)
 
-	fmt.Fprintf(os.Stderr, "==Geodetic Bounds  (EPSG:4236): %.17g,%.17g to %.17g,%.17g\n", minlat, minlon, maxlat, maxlon)
-	fmt.Fprintf(os.Stderr, "==Projected Bounds (EPSG:3785): %.17g,%.17g to %.17g,%.17g\n", miny, minx, maxy, maxx)
-	fmt.Fprintf(os.Stderr, "==Zoom Level: %d\n", zoom)
-	fmt.Fprintf(os.Stderr, "==Upper Left Tile: x:%d y:%d\n", tx1, ty2)
-	fmt.Fprintf(os.Stderr, "==Lower Right Tile: x:%d y:%d\n", tx2, ty1)
-
-	// Calculate pixel offsets and dimensions
-	xa := int(((x1 >> (32 - (zoom + 8))) & 0xFF) * uint32(s.options.TileSize) / 256)
-	ya := int(((y1 >> (32 - (zoom + 8))) & 0xFF) * uint32(s.options.TileSize) / 256)
-
-	outputWidth := int(((x2 >> (32 - (zoom + 8))) - (x1 >> (32 - (zoom + 8)))) * uint32(s.options.TileSize) / 256)
-	outputHeight := int(((y2 >> (32 - (zoom + 8))) - (y1 >> (32 - (zoom + 8)))) * uint32(s.options.TileSize) / 256)
-
-	fmt.Fprintf(os.Stderr, "==Raster Size: %dx%d\n", outputWidth, outputHeight)
-
 	px := (maxx - minx) / float64(outputWidth)
 	py := math.Abs(maxy-miny) / float64(outputHeight)
-	fmt.Fprintf(os.Stderr, "==Pixel Size: x:%.17g y:%.17g\n", px, py)
+
+	s.log.Info("stitching", "zoom", zoom, "width", outputWidth, "height", outputHeight,
+		"tiles", int((tx2-tx1+1)*(ty2-ty1+1))*len(urls))
+	s.log.Debug("stitch geometry",
+		slog.Group("bounds", "min_lat", minlat, "min_lon", minlon, "max_lat", maxlat, "max_lon", maxlon),
+		slog.Group("projected", "min_x", minx, "min_y", miny, "max_x", maxx, "max_y", maxy),
+		"zoom", zoom,
+		slog.Group("tiles", "min_x", tx1, "min_y", ty1, "max_x", tx2, "max_y", ty2),
+		"width", outputWidth,
+		"height", outputHeight,
+		slog.Group("pixel_size", "x", px, "y", py),
+	)
 
 	// Check size limits
+	maxPixels := s.options.MaxPixels
+	if maxPixels <= 0 {
+		maxPixels = 10000 * 10000
+	}
 	dim := int64(outputWidth) * int64(outputHeight)
-	if dim > 10000*10000 {
-		return fmt.Errorf("that's too big")
+	if dim > maxPixels {
+		return fmt.Errorf("that's too big: %dx%d exceeds %d pixels (see --max-pixels)", outputWidth, outputHeight, maxPixels)
+	}
+
+	// List the tile URLs instead of downloading them
+	if s.options.DryRun {
+		for ty := ty1; ty <= ty2; ty++ {
+			for tx := tx1; tx <= tx2; tx++ {
+				for _, urlTemplate := range urls {
+					fmt.Fprintln(os.Stdout, tile.BuildURL(urlTemplate, zoom, tx, ty))
+				}
+			}
+		}
+		return nil
 	}
 
 	// Allocate output buffer
 	buf := make([]byte, outputWidth*outputHeight*4)
 
+	// Count failed downloads for the summary
+	failed := 0
+	fail := func(url string, err error) {
+		s.log.Warn("tile failed", "url", url, "error", err)
+		report.tile(url, err)
+		failed++
+	}
+	total := int((tx2-tx1+1)*(ty2-ty1+1)) * len(urls)
+	report.total = total
+
+	// Report how much of an interrupted run can be reused from the cache
+	if s.options.CacheDir != "" {
+		cache := tile.NewCache(s.options.CacheDir)
+		cached := 0
+		for ty := ty1; ty <= ty2; ty++ {
+			for tx := tx1; tx <= tx2; tx++ {
+				for _, urlTemplate := range urls {
+					url, body := s.tileRequest(urlTemplate, zoom, tx, ty)
+					if cache.Has(tile.RequestKey(method, url, body)) {
+						cached++
+					}
+				}
+			}
+		}
+		s.log.Info("cached tiles", "cached", cached, "total", total)
+	}
+
 	// Download and stitch tiles
 	for ty := ty1; ty <= ty2; ty++ {
 		for tx := tx1; tx <= tx2; tx++ {
-			progress := (float64(ty-ty1)/float64((ty2+1)-ty1) +
-				float64(tx-tx1)/float64((ty2+1)-ty1)/float64((tx2+1)-tx1)) * 100
-
 			xoff := int(tx-tx1)*s.options.TileSize - int(xa)
 			yoff := int(ty-ty1)*s.options.TileSize - int(ya)
 
 			for _, urlTemplate := range urls {
-				url := tile.BuildURL(urlTemplate, zoom, tx, ty)
-				fmt.Fprintf(os.Stderr, "%.2f%%: %s\n", progress, url)
+				// Stop promptly once cancelled (e.g. Ctrl-C)
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+
+				url, body := s.tileRequest(urlTemplate, zoom, tx, ty)
 
-				data, err := s.processor.DownloadTile(url)
+				data, err := s.processor.DownloadTileRequest(ctx, method, url, body)
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					return ctxErr
+				}
 				if err != nil {
-					fmt.Fprintf(os.Stderr, "Can't retrieve %s: %v\n", url, err)
+					fail(url, err)
 					continue
 				}
 
 				img, err := s.processor.DecodeImage(data)
 				if err != nil {
-					fmt.Fprintf(os.Stderr, "Can't decode image from %s: %v\n", url, err)
+					fail(url, fmt.Errorf("decode error: %v", err))
 					continue
 				}
 
 				if img.Height != s.options.TileSize || img.Width != s.options.TileSize {
-					fmt.Fprintf(os.Stderr, "Got %dx%d tile, not %d\n", img.Width, img.Height, s.options.TileSize)
+					fail(url, fmt.Errorf("wrong tile size %dx%d, expected %d", img.Width, img.Height, s.options.TileSize))
 					continue
 				}
+				report.tile(url, nil)
 
 				// Copy tile data to output buffer
 				for y := 0; y < img.Height; y++ {
@@ -162,41 +327,87 @@ func (s *Stitcher) stitch(minlat, minlon, maxlat, maxlon float64, zoom int, urls
 						srcIdx := (y*img.Width + x) * 4
 						dstIdx := (yd*outputWidth + xd) * 4
 
-						if img.Depth == 4 {
-							// Alpha blending
-							src := [4]byte{img.Buf[srcIdx], img.Buf[srcIdx+1], img.Buf[srcIdx+2], img.Buf[srcIdx+3]}
-							dst := [4]byte{buf[dstIdx], buf[dstIdx+1], buf[dstIdx+2], buf[dstIdx+3]}
-							result := tile.AlphaBlend(src, dst)
-							copy(buf[dstIdx:dstIdx+4], result[:])
-						} else if img.Depth == 3 {
-							// RGB
-							buf[dstIdx] = img.Buf[srcIdx]
-							buf[dstIdx+1] = img.Buf[srcIdx+1]
-							buf[dstIdx+2] = img.Buf[srcIdx+2]
-							buf[dstIdx+3] = 255
-						} else {
-							// Grayscale
-							val := img.Buf[srcIdx]
-							buf[dstIdx] = val
-							buf[dstIdx+1] = val
-							buf[dstIdx+2] = val
-							buf[dstIdx+3] = 255
-						}
+						// Decoded tiles are RGBA whatever their format, opaque for
+						// JPEG and grayscale, so every tile blends the same way and
+						// never overwrites what an earlier URL drew
+						src := [4]byte{img.Buf[srcIdx], img.Buf[srcIdx+1], img.Buf[srcIdx+2], img.Buf[srcIdx+3]}
+						dst := [4]byte{buf[dstIdx], buf[dstIdx+1], buf[dstIdx+2], buf[dstIdx+3]}
+						result := tile.AlphaBlend(src, dst)
+						copy(buf[dstIdx:dstIdx+4], result[:])
 					}
 				}
 			}
 		}
 	}
 
+	// Summarize holes left by failed tiles
+	if failed > 0 {
+		s.log.Warn("tiles failed", "failed", failed, "total", total)
+	}
+	report.done()
+	if ratio := s.options.MaxFailureRatio; ratio != nil && float64(failed) > *ratio*float64(total) {
+		return fmt.Errorf("too many tile failures: %d/%d failed, more than %g%%", failed, total, *ratio*100)
+	}
+	if limit := s.options.MaxFailedTiles; limit != nil && failed > *limit {
+		return fmt.Errorf("too many tile failures: %d/%d failed, at most %d allowed", failed, total, *limit)
+	}
+
+	// Fill transparent areas; the alpha mask still shows the original coverage
+	out := buf
+	if s.options.Background.A > 0 {
+		out = tile.ApplyBackground(buf, s.options.Background)
+	}
+
+	// Draw the tile grid and map decorations on a copy so the alpha mask
+	// isn't affected
+	if (s.options.Grid || s.options.ScaleBar || s.options.NorthArrow) && s.options.Background.A == 0 {
+		out = append([]byte(nil), buf...)
+	}
+	if s.options.Grid {
+		tile.DrawGrid(out, outputWidth, outputHeight, tile.Grid{
+			TileSize: s.options.TileSize,
+			OffsetX:  int(xa),
+			OffsetY:  int(ya),
+			Zoom:     zoom,
+			MinTileX: tx1,
+			MinTileY: ty1,
+			Color:    s.options.GridColor,
+			Labels:   s.options.GridLabels,
+		})
+	}
+	if s.options.ScaleBar {
+		gt := &tile.Geotransform{MinX: minx, MaxY: maxy, PixelSizeX: px, PixelSizeY: py}
+		lat, _ := tile.PixelToLatLon(outputWidth/2, outputHeight/2, gt)
+		tile.DrawScaleBar(out, outputWidth, outputHeight, tile.GroundResolution(px, lat, false))
+	}
+	if s.options.NorthArrow {
+		tile.DrawNorthArrow(out, outputWidth, outputHeight)
+	}
+
 	// Write output
 	if s.options.Format == tile.OUTFMT_PNG {
-		if err := tile.WritePNG(s.options.Output, buf, outputWidth, outputHeight); err != nil {
+		pngOpts := tile.PNGOptions{Verify: s.options.VerifyOutput, DPI: s.options.DPI}
+		if err := tile.WritePNGWithOptions(s.options.Output, out, outputWidth, outputHeight, pngOpts); err != nil {
 			return fmt.Errorf("failed to write PNG: %v", err)
 		}
 	} else if s.options.Format == tile.OUTFMT_GEOTIFF {
 		return fmt.Errorf("GeoTIFF output not yet implemented")
 	}
 
+	// Write alpha mask if requested
+	if s.options.AlphaMask {
+		if err := tile.WriteAlphaMask(s.options.Output, buf, outputWidth, outputHeight); err != nil {
+			return fmt.Errorf("failed to write alpha mask: %v", err)
+		}
+	}
+
+	// Write image statistics if requested
+	if s.options.Stats {
+		if err := tile.WriteStats(s.options.Output, tile.ComputeStats(out)); err != nil {
+			return fmt.Errorf("failed to write statistics: %v", err)
+		}
+	}
+
 	// Write world file if requested
 	if s.options.WriteWorldFile {
 		if err := tile.WriteWorldFile(s.options.Output, px, py, minx, maxy, s.options.Format); err != nil {
@@ -204,5 +415,46 @@ func (s *Stitcher) stitch(minlat, minlon, maxlat, maxlon float64, zoom int, urls
 		}
 	}
 
+	// Write the VRT if requested
+	if s.options.WriteVRT {
+		if err := tile.WriteVRT(s.options.Output, outputWidth, outputHeight, px, py, minx, maxy); err != nil {
+			return fmt.Errorf("failed to write VRT: %v", err)
+		}
+	}
+
+	// Write metadata if requested
+	if s.options.Metadata != "" {
+		filename := s.options.Metadata
+		if filename == tile.MetadataAuto {
+			filename = tile.MetadataFilename(s.options.Output)
+		}
+		meta := &tile.Metadata{
+			BoundingBox: tile.MetadataBBox{MinLat: minlat, MinLon: minlon, MaxLat: maxlat, MaxLon: maxlon},
+			Zoom:        zoom,
+			CRS:         "EPSG:3857",
+			Width:       outputWidth,
+			Height:      outputHeight,
+			PixelSize:   [2]float64{px, py},
+			Origin:      [2]float64{minx, maxy},
+			Sources:     urls,
+			Tiles: tile.MetadataTiles{
+				Total:      total,
+				Successful: total - failed,
+				Failed:     failed,
+			},
+		}
+		if err := tile.WriteMetadata(filename, meta); err != nil {
+			return fmt.Errorf("failed to write metadata: %v", err)
+		}
+	}
+
+	// Write the footprint of what was rendered, as the API does, if requested
+	if s.options.GeoJSON != "" {
+		gt := &tile.Geotransform{MinX: minx, MaxY: maxy, PixelSizeX: px, PixelSizeY: py}
+		if err := tile.WriteFootprint(s.options.GeoJSON, gt, outputWidth, outputHeight); err != nil {
+			return fmt.Errorf("failed to write footprint: %v", err)
+		}
+	}
+
 	return nil
 }
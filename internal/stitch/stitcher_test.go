@@ -0,0 +1,622 @@
+package stitch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kiesman99/stitch/pkg/tile"
+)
+
+// newStitcher creates a stitcher for opts, failing the test on an error
+func newStitcher(t *testing.T, opts *tile.StitchOptions) *Stitcher {
+	t.Helper()
+
+	s, err := NewStitcher(opts)
+	if err != nil {
+		t.Fatalf("NewStitcher failed: %v", err)
+	}
+	return s
+}
+
+func TestCheckOutput_TerminalGuard(t *testing.T) {
+	original := stdoutIsTerminal
+	defer func() { stdoutIsTerminal = original }()
+
+	testCases := []struct {
+		name      string
+		terminal  bool
+		output    string
+		force     bool
+		expectErr bool
+	}{
+		{name: "Terminal is refused", terminal: true, expectErr: true},
+		{name: "Terminal with force", terminal: true, force: true},
+		{name: "Pipe", terminal: false},
+		{name: "Output file", terminal: true, output: "map.png"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stdoutIsTerminal = func() bool { return tc.terminal }
+
+			s := newStitcher(t, &tile.StitchOptions{Output: tc.output, Force: tc.force})
+			err := s.checkOutput()
+			if tc.expectErr && err == nil {
+				t.Error("Expected an error")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestStitch_Cancelled(t *testing.T) {
+	// Tiles never arrive; only cancellation can end the stitch
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	s := newStitcher(t, &tile.StitchOptions{
+		Output:   filepath.Join(t.TempDir(), "out.png"),
+		TileSize: 256,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	bbox := &tile.BoundingBox{MinLat: 10, MinLon: 10, MaxLat: 20, MaxLon: 20}
+	err := s.StitchBoundingBox(ctx, bbox, 6, []string{server.URL + "/{z}/{x}/{y}.png"})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected stitch to stop promptly, took %v", elapsed)
+	}
+}
+
+func TestStitch_ResumesFromCache(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 256, 256))); err != nil {
+		t.Fatalf("Failed to encode tile: %v", err)
+	}
+
+	var (
+		mu       sync.Mutex
+		requests []string
+		cancel   context.CancelFunc
+	)
+	// The fourth request of the first run interrupts it, after three tiles
+	// have been served and cached
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.URL.Path)
+		interrupt := cancel != nil && len(requests) == 4
+		mu.Unlock()
+		if interrupt {
+			cancel()
+			<-r.Context().Done()
+			return
+		}
+		w.Write(encoded.Bytes())
+	}))
+	defer server.Close()
+
+	opts := &tile.StitchOptions{
+		Output:   filepath.Join(t.TempDir(), "out.png"),
+		TileSize: 256,
+		CacheDir: t.TempDir(),
+	}
+	bbox := &tile.BoundingBox{MinLat: 10, MinLon: 10, MaxLat: 20, MaxLon: 20}
+	urls := []string{server.URL + "/{z}/{x}/{y}.png"}
+
+	var ctx context.Context
+	ctx, cancel = context.WithCancel(context.Background())
+	if err := newStitcher(t, opts).StitchBoundingBox(ctx, bbox, 6, urls); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	mu.Lock()
+	cached := append([]string(nil), requests[:3]...)
+	requests = nil
+	cancel = nil
+	mu.Unlock()
+
+	if err := newStitcher(t, opts).StitchBoundingBox(context.Background(), bbox, 6, urls); err != nil {
+		t.Fatalf("Failed to resume stitch: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, path := range requests {
+		for _, c := range cached {
+			if path == c {
+				t.Errorf("Expected %s to come from the cache", path)
+			}
+		}
+	}
+	if len(requests) == 0 {
+		t.Error("Expected the remaining tiles to be downloaded")
+	}
+}
+
+func TestStitch_DryRunListsURLs(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	s := newStitcher(t, &tile.StitchOptions{TileSize: 256, DryRun: true})
+	bbox := &tile.BoundingBox{MinLat: 10, MinLon: 10, MaxLat: 20, MaxLon: 20}
+	err = s.StitchBoundingBox(context.Background(), bbox, 5, []string{"https://{s}.tile.test/{z}/{x}/{-y}.png"})
+	w.Close()
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Failed to read stdout: %v", err)
+	}
+
+	// Tiles 16..17 x 14..15 at zoom 5, rows flipped to 17..16
+	expected := []string{
+		"https://a.tile.test/5/16/17.png",
+		"https://b.tile.test/5/17/17.png",
+		"https://b.tile.test/5/16/16.png",
+		"https://c.tile.test/5/17/16.png",
+	}
+	got := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestStitch_CenteredNearPole(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	// A window reaching past the top of the map is shifted down into it
+	s := newStitcher(t, &tile.StitchOptions{TileSize: 256, DryRun: true})
+	req := &tile.CenteredRequest{Lat: 85, Lon: 0, Width: 512, Height: 512}
+	err = s.StitchCentered(context.Background(), req, 3, []string{"https://tile.test/{z}/{x}/{y}.png"})
+	w.Close()
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Failed to read stdout: %v", err)
+	}
+	expected := []string{
+		"https://tile.test/3/3/0.png",
+		"https://tile.test/3/4/0.png",
+		"https://tile.test/3/3/1.png",
+		"https://tile.test/3/4/1.png",
+	}
+	got := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestStitch_JSONProgress(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 256, 256))); err != nil {
+		t.Fatalf("Failed to encode tile: %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/5/17/15.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(encoded.Bytes())
+	}))
+	defer server.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	defer func() { os.Stderr = stderr }()
+
+	// The CLI silences file status messages in JSON mode
+	log := tile.Log
+	tile.Log = io.Discard
+	defer func() { tile.Log = log }()
+
+	s := newStitcher(t, &tile.StitchOptions{
+		Output:   filepath.Join(t.TempDir(), "out.png"),
+		TileSize: 256,
+		Progress: ProgressJSON,
+	})
+	bbox := &tile.BoundingBox{MinLat: 10, MinLon: 10, MaxLat: 20, MaxLon: 20}
+	err = s.StitchBoundingBox(context.Background(), bbox, 5, []string{server.URL + "/{z}/{x}/{y}.png"})
+	w.Close()
+	os.Stderr = stderr
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Failed to read stderr: %v", err)
+	}
+
+	var events []progressEvent
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		var event progressEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("Failed to decode progress line %q: %v", line, err)
+		}
+		events = append(events, event)
+	}
+
+	// Four tiles at zoom 5, then the completion event
+	if len(events) != 5 {
+		t.Fatalf("Expected 5 events, got %d: %s", len(events), out)
+	}
+	for i, event := range events[:4] {
+		if event.Event != "tile" || event.Completed != i+1 || event.Total != 4 {
+			t.Errorf("Expected tile event %d/4, got %+v", i+1, event)
+		}
+		failedTile := strings.HasSuffix(event.URL, "/5/17/15.png")
+		if event.OK == nil || *event.OK == failedTile {
+			t.Errorf("Expected ok=%v for %s, got %+v", !failedTile, event.URL, event)
+		}
+	}
+
+	done := events[4]
+	if done.Event != "done" || done.Completed != 4 || done.Total != 4 {
+		t.Errorf("Expected done event for 4 tiles, got %+v", done)
+	}
+	if done.Failed == nil || *done.Failed != 1 {
+		t.Errorf("Expected 1 failed tile, got %+v", done.Failed)
+	}
+	if done.ElapsedMS == nil {
+		t.Error("Expected elapsed_ms in the done event")
+	}
+}
+
+func TestStitch_Metadata(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 256, 256))); err != nil {
+		t.Fatalf("Failed to encode tile: %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(encoded.Bytes())
+	}))
+	defer server.Close()
+
+	output := filepath.Join(t.TempDir(), "out.png")
+	s := newStitcher(t, &tile.StitchOptions{
+		Output:   output,
+		TileSize: 256,
+		Metadata: tile.MetadataAuto,
+	})
+	bbox := &tile.BoundingBox{MinLat: 10, MinLon: 10, MaxLat: 20, MaxLon: 20}
+	if err := s.StitchBoundingBox(context.Background(), bbox, 5, []string{server.URL + "/{z}/{x}/{y}.png"}); err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(output), "out.json"))
+	if err != nil {
+		t.Fatalf("Failed to read metadata: %v", err)
+	}
+	var meta tile.Metadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatalf("Failed to decode metadata: %v", err)
+	}
+
+	file, err := os.Open(output)
+	if err != nil {
+		t.Fatalf("Failed to open output: %v", err)
+	}
+	defer file.Close()
+	config, err := png.DecodeConfig(file)
+	if err != nil {
+		t.Fatalf("Failed to decode output: %v", err)
+	}
+
+	expectedBBox := tile.MetadataBBox{MinLat: 10, MinLon: 10, MaxLat: 20, MaxLon: 20}
+	if meta.BoundingBox != expectedBBox {
+		t.Errorf("Expected bbox %+v, got %+v", expectedBBox, meta.BoundingBox)
+	}
+	if meta.Width != config.Width || meta.Height != config.Height {
+		t.Errorf("Expected %dx%d, got %dx%d", config.Width, config.Height, meta.Width, meta.Height)
+	}
+	if meta.Zoom != 5 || meta.CRS != "EPSG:3857" {
+		t.Errorf("Expected zoom 5 in EPSG:3857, got zoom %d in %s", meta.Zoom, meta.CRS)
+	}
+	if meta.Tiles.Total != 4 || meta.Tiles.Successful != 4 || meta.Tiles.Failed != 0 {
+		t.Errorf("Expected 4 successful tiles, got %+v", meta.Tiles)
+	}
+
+	// Without an output file the metadata needs an explicit path
+	s = newStitcher(t, &tile.StitchOptions{TileSize: 256, Force: true, Metadata: tile.MetadataAuto})
+	if err := s.StitchBoundingBox(context.Background(), bbox, 5, []string{server.URL + "/{z}/{x}/{y}.png"}); err == nil {
+		t.Error("Expected an error for metadata next to stdout")
+	}
+}
+
+func TestStitch_Authorization(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 256, 256))); err != nil {
+		t.Fatalf("Failed to encode tile: %v", err)
+	}
+
+	var (
+		mu   sync.Mutex
+		auth []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		auth = append(auth, r.Header.Get("Authorization"))
+		mu.Unlock()
+		w.Write(encoded.Bytes())
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		name     string
+		opts     tile.StitchOptions
+		expected string
+	}{
+		{
+			name:     "Basic auth",
+			opts:     tile.StitchOptions{BasicAuth: "alice:secret"},
+			expected: "Basic YWxpY2U6c2VjcmV0",
+		},
+		{
+			name: "Bearer token overrides header",
+			opts: tile.StitchOptions{
+				Headers:     map[string]string{"Authorization": "Token abc", "X-Client": "test"},
+				BearerToken: "xyz",
+			},
+			expected: "Bearer xyz",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mu.Lock()
+			auth = nil
+			mu.Unlock()
+
+			opts := tc.opts
+			opts.Output = filepath.Join(t.TempDir(), "out.png")
+			opts.TileSize = 256
+			opts.Progress = ProgressNone
+			bbox := &tile.BoundingBox{MinLat: 10, MinLon: 10, MaxLat: 20, MaxLon: 20}
+			if err := newStitcher(t, &opts).StitchBoundingBox(context.Background(), bbox, 3, []string{server.URL + "/{z}/{x}/{y}.png"}); err != nil {
+				t.Fatalf("Failed to stitch: %v", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(auth) == 0 {
+				t.Fatal("Expected tile requests")
+			}
+			for _, got := range auth {
+				if got != tc.expected {
+					t.Errorf("Expected Authorization %q, got %q", tc.expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestStitch_TextProgress(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 256, 256))); err != nil {
+		t.Fatalf("Failed to encode tile: %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(encoded.Bytes())
+	}))
+	defer server.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	defer func() { os.Stderr = stderr }()
+
+	log := tile.Log
+	tile.Log = io.Discard
+	defer func() { tile.Log = log }()
+
+	s := newStitcher(t, &tile.StitchOptions{
+		Output:   filepath.Join(t.TempDir(), "out.png"),
+		TileSize: 256,
+	})
+	// A 3x2 grid at zoom 5: x 17..19, y 14..15
+	bbox := &tile.BoundingBox{MinLat: 10, MinLon: 12, MaxLat: 20, MaxLon: 40}
+	err = s.StitchBoundingBox(context.Background(), bbox, 5, []string{server.URL + "/{z}/{x}/{y}.png"})
+	w.Close()
+	os.Stderr = stderr
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Failed to read stderr: %v", err)
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.Contains(line, "%: ") {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) != 6 {
+		t.Fatalf("Expected 6 progress lines, got %d: %s", len(lines), out)
+	}
+	if !strings.HasPrefix(lines[2], "50.00%: ") {
+		t.Errorf("Expected the third tile at 50%%, got %q", lines[2])
+	}
+	if !strings.HasPrefix(lines[5], "100.00%: ") {
+		t.Errorf("Expected the last progress line at 100%%, got %q", lines[5])
+	}
+}
+
+func TestStitch_FailureThresholds(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 256, 256))); err != nil {
+		t.Fatalf("Failed to encode tile: %v", err)
+	}
+
+	testCases := []struct {
+		name           string
+		maxRatio       *float64
+		maxFailed      *int
+		expectedToFail bool
+	}{
+		{"No thresholds", nil, nil, false},
+		{"Ratio exceeded", float64Ptr(0.2), nil, true},
+		{"Ratio reached", float64Ptr(0.25), nil, false},
+		{"Zero ratio allows no failure", float64Ptr(0), nil, true},
+		{"Count reached", nil, intPtr(1), false},
+		{"Zero count allows no failure", nil, intPtr(0), true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// One of the 4 tiles fails
+			var mu sync.Mutex
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				requests++
+				fail := requests == 1
+				mu.Unlock()
+				if fail {
+					http.NotFound(w, r)
+					return
+				}
+				w.Write(encoded.Bytes())
+			}))
+			defer server.Close()
+
+			output := filepath.Join(t.TempDir(), "out.png")
+			s := newStitcher(t, &tile.StitchOptions{
+				Output:          output,
+				TileSize:        256,
+				Progress:        ProgressNone,
+				MaxFailureRatio: tc.maxRatio,
+				MaxFailedTiles:  tc.maxFailed,
+			})
+			bbox := &tile.BoundingBox{MinLat: 10, MinLon: 10, MaxLat: 20, MaxLon: 20}
+			err := s.StitchBoundingBox(context.Background(), bbox, 5, []string{server.URL + "/{z}/{x}/{y}.png"})
+
+			if !tc.expectedToFail {
+				if err != nil {
+					t.Fatalf("Stitch failed: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "too many tile failures: 1/4 failed") {
+				t.Fatalf("Expected a tile failure error, got %v", err)
+			}
+			if _, err := os.Stat(output); !os.IsNotExist(err) {
+				t.Errorf("Expected no output after a failed stitch, got %v", err)
+			}
+		})
+	}
+}
+
+func TestStitch_JPEGBlendsUnderEarlierTiles(t *testing.T) {
+	solid := func(c color.NRGBA) *image.NRGBA {
+		img := image.NewNRGBA(image.Rect(0, 0, 256, 256))
+		for i := 0; i < len(img.Pix); i += 4 {
+			img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+		}
+		return img
+	}
+	serve := func(data []byte) *httptest.Server {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(data)
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+
+	// Half-transparent blue from the first URL, opaque red JPEG from the second
+	var overlay, base bytes.Buffer
+	if err := png.Encode(&overlay, solid(color.NRGBA{B: 255, A: 128})); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+	if err := jpeg.Encode(&base, solid(color.NRGBA{R: 255, A: 255}), &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatalf("Failed to encode JPEG: %v", err)
+	}
+	urls := []string{
+		serve(overlay.Bytes()).URL + "/{z}/{x}/{y}.png",
+		serve(base.Bytes()).URL + "/{z}/{x}/{y}.jpg",
+	}
+
+	output := filepath.Join(t.TempDir(), "out.png")
+	s := newStitcher(t, &tile.StitchOptions{Output: output, TileSize: 256})
+	bbox := &tile.BoundingBox{MinLat: 10, MinLon: 10, MaxLat: 20, MaxLon: 20}
+	if err := s.StitchBoundingBox(context.Background(), bbox, 3, urls); err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+
+	f, err := os.Open(output)
+	if err != nil {
+		t.Fatalf("Failed to open output: %v", err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatalf("Failed to decode output: %v", err)
+	}
+
+	// The JPEG fills in under the blue instead of replacing it
+	got := color.NRGBAModel.Convert(img.At(0, 0)).(color.NRGBA)
+	near := func(a, b uint8) bool { return a >= b-3 && a <= b+3 }
+	if !near(got.R, 127) || got.G > 3 || !near(got.B, 128) || got.A != 255 {
+		t.Errorf("Expected blue blended over red (127, 0, 128, 255), got %v", got)
+	}
+}
+
+func float64Ptr(v float64) *float64 {
+	return &v
+}
+
+func intPtr(i int) *int {
+	return &i
+}
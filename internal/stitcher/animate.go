@@ -0,0 +1,98 @@
+package stitcher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"time"
+)
+
+// DefaultFrameDelay is the time each frame is shown when
+// AnimationOptions.FrameDelay is unset
+const DefaultFrameDelay = 500 * time.Millisecond
+
+// AnimationOptions selects the frames of a zoom animation
+type AnimationOptions struct {
+	ZoomFrom, ZoomTo int           // one frame per zoom level; ZoomFrom > ZoomTo zooms out
+	FrameDelay       time.Duration // how long each frame is shown; rounded to 10ms
+}
+
+// gifPalette is the web-safe palette plus a transparent entry for areas
+// without tile data
+var gifPalette = append(color.Palette{color.Transparent}, palette.WebSafe...)
+
+// AnimateCentered stitches the centered area of opts once per zoom level and
+// returns the frames as an animated GIF. opts.Zoom is ignored. Every frame
+// has the size of the first one; frames that come out differently are
+// scaled to it.
+func (s *Stitcher) AnimateCentered(ctx context.Context, opts *Options, anim AnimationOptions) ([]byte, error) {
+	if opts.Mode != ModeCentered {
+		return nil, fmt.Errorf("animations require centered mode")
+	}
+
+	step := 1
+	if anim.ZoomTo < anim.ZoomFrom {
+		step = -1
+	}
+	delay := anim.FrameDelay
+	if delay <= 0 {
+		delay = DefaultFrameDelay
+	}
+
+	var (
+		out    gif.GIF
+		canvas image.Rectangle
+	)
+	for zoom := anim.ZoomFrom; ; zoom += step {
+		frameOpts := *opts
+		frameOpts.Zoom = zoom
+		frameOpts.OutputFormat = FormatPNG
+		frameOpts.GenerateWorldFile = false
+
+		result, err := s.Stitch(ctx, &frameOpts)
+		if err != nil {
+			return nil, fmt.Errorf("zoom %d: %w", zoom, err)
+		}
+		frame, err := png.Decode(bytes.NewReader(result.ImageData))
+		if err != nil {
+			return nil, fmt.Errorf("zoom %d: %v", zoom, err)
+		}
+
+		if len(out.Image) == 0 {
+			canvas = frame.Bounds()
+		} else if frame.Bounds() != canvas {
+			frame = scaleImage(frame, canvas, opts.Resampling)
+		}
+
+		paletted := image.NewPaletted(canvas, gifPalette)
+		draw.FloydSteinberg.Draw(paletted, canvas, frame, canvas.Min)
+		out.Image = append(out.Image, paletted)
+		out.Delay = append(out.Delay, int(delay/(10*time.Millisecond)))
+
+		if zoom == anim.ZoomTo {
+			break
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, &out); err != nil {
+		return nil, fmt.Errorf("failed to encode animation: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// scaleImage resizes img to bounds with the given resampling method
+func scaleImage(img image.Image, bounds image.Rectangle, method int) image.Image {
+	src := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(src, src.Rect, img, img.Bounds().Min, draw.Src)
+
+	data := &ImageData{buf: src.Pix, width: src.Rect.Dx(), height: src.Rect.Dy(), depth: 4}
+	scaled := resample(data, src.Rect, bounds.Dx(), bounds.Dy(), method)
+	return &image.RGBA{Pix: scaled.buf, Stride: scaled.width * 4, Rect: bounds}
+}
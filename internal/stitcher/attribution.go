@@ -0,0 +1,128 @@
+package stitcher
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+	"unicode"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/text/unicode/norm"
+)
+
+// attributionPadding is the space around the attribution text in pixels
+const attributionPadding = 3
+
+// glyphSubstitutes spells out common attribution symbols for fonts that lack
+// them
+var glyphSubstitutes = map[rune]string{
+	'©':      "(c)",
+	'®':      "(R)",
+	'™':      "(TM)",
+	'–':      "-",
+	'—':      "-",
+	'‘':      "'",
+	'’':      "'",
+	'“':      "\"",
+	'”':      "\"",
+	'\u00a0': " ",
+}
+
+// combinedAttribution joins the unique attributions of the sources that
+// contributed tiles, base source first
+func combinedAttribution(opts *Options, contributed map[int]bool) string {
+	var sources []string
+	if opts.LayerMode == LayerModeOverlay {
+		for i, layer := range opts.overlayLayers() {
+			if contributed[i] {
+				sources = append(sources, layer.Attribution)
+			}
+		}
+	} else if len(contributed) > 0 {
+		sources = append(sources, opts.Attribution)
+	}
+
+	var parts []string
+	seen := make(map[string]bool)
+	for _, attribution := range sources {
+		attribution = strings.TrimSpace(attribution)
+		if attribution == "" || seen[attribution] {
+			continue
+		}
+		seen[attribution] = true
+		parts = append(parts, attribution)
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// drawAttribution renders text on a translucent white box in the bottom-right
+// corner of the RGBA buffer
+func drawAttribution(buf []byte, width, height int, text string) {
+	img := &image.RGBA{Pix: buf, Stride: width * 4, Rect: image.Rect(0, 0, width, height)}
+	face := basicfont.Face7x13
+	text = printableText(face, text)
+
+	d := &font.Drawer{Dst: img, Src: image.NewUniform(color.Black), Face: face}
+	textWidth := d.MeasureString(text).Ceil()
+	metrics := face.Metrics()
+	textHeight := (metrics.Ascent + metrics.Descent).Ceil()
+
+	box := image.Rect(
+		width-textWidth-2*attributionPadding, height-textHeight-2*attributionPadding,
+		width, height,
+	).Intersect(img.Rect)
+	draw.Draw(img, box, image.NewUniform(color.NRGBA{R: 255, G: 255, B: 255, A: 192}), image.Point{}, draw.Over)
+
+	d.Dot = fixed.P(box.Min.X+attributionPadding, height-attributionPadding-metrics.Descent.Ceil())
+	d.DrawString(text)
+}
+
+// printableText replaces the runes the face has no glyph for, so they aren't
+// drawn as replacement boxes. Known symbols are spelled out, accented letters
+// lose their accents and anything else becomes '?'
+func printableText(face font.Face, text string) string {
+	hasGlyph := func(r rune) bool {
+		_, ok := face.GlyphAdvance(r)
+		return ok
+	}
+
+	var b strings.Builder
+	for _, r := range text {
+		if hasGlyph(r) {
+			b.WriteRune(r)
+			continue
+		}
+		if substitute, ok := glyphSubstitutes[r]; ok {
+			b.WriteString(substitute)
+			continue
+		}
+
+		var base []rune
+		for _, d := range norm.NFD.String(string(r)) {
+			if unicode.Is(unicode.Mn, d) {
+				continue
+			}
+			base = append(base, d)
+		}
+		if len(base) > 0 && allRunes(base, hasGlyph) {
+			b.WriteString(string(base))
+		} else {
+			b.WriteRune('?')
+		}
+	}
+	return b.String()
+}
+
+// allRunes reports whether every rune satisfies f
+func allRunes(runes []rune, f func(rune) bool) bool {
+	for _, r := range runes {
+		if !f(r) {
+			return false
+		}
+	}
+	return true
+}
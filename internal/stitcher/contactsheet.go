@@ -0,0 +1,136 @@
+package stitcher
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Layout of a contact sheet cell: the tile inside a border, with its caption
+// below, separated from the neighboring cells by the margin
+const (
+	contactSheetMargin  = 4
+	contactSheetCaption = 16
+)
+
+var (
+	contactSheetBackground = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	contactSheetBorder     = color.RGBA{R: 128, G: 128, B: 128, A: 255}
+	contactSheetMissing    = color.RGBA{R: 220, G: 0, B: 0, A: 255}
+)
+
+// ContactSheet downloads the tiles covering the area of opts and lays them
+// out side by side in a grid instead of stitching them, each in a border and
+// captioned with its z/x/y, for checking what a tile source serves. Tiles
+// that failed are crossed out and captioned "missing", tiles the server had
+// no data for are left transparent and captioned "empty". The result is a
+// PNG without georeferencing; the failure limits of opts apply as usual.
+func (s *Stitcher) ContactSheet(ctx context.Context, opts *Options) (*Result, error) {
+	bounds, err := ComputeBounds(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckLimits(opts, bounds); err != nil {
+		return nil, err
+	}
+
+	cols := int(bounds.MaxTileX-bounds.MinTileX) + 1
+	rows := int(bounds.MaxTileY-bounds.MinTileY) + 1
+	cellWidth := opts.TileSize + 2*contactSheetMargin
+	cellHeight := opts.TileSize + contactSheetCaption + 2*contactSheetMargin
+	width, height := cols*cellWidth, rows*cellHeight
+
+	maxPixels := opts.MaxPixels
+	if maxPixels <= 0 {
+		maxPixels = DefaultMaxPixels
+	}
+	if int64(width)*int64(height) > maxPixels {
+		return nil, &SizeError{Width: width, Height: height, MaxPixels: maxPixels}
+	}
+
+	var positions []tilePosition
+	for ty := bounds.MinTileY; ty <= bounds.MaxTileY; ty++ {
+		for tx := bounds.MinTileX; tx <= bounds.MaxTileX; tx++ {
+			positions = append(positions, tilePosition{x: tx, y: ty})
+		}
+	}
+
+	// Each tile is drawn into its own cell, which no other worker touches
+	sheet := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(sheet, sheet.Rect, image.NewUniform(contactSheetBackground), image.Point{}, draw.Src)
+	cell := func(pos tilePosition) image.Rectangle {
+		x := int(pos.x-bounds.MinTileX)*cellWidth + contactSheetMargin
+		y := int(pos.y-bounds.MinTileY)*cellHeight + contactSheetMargin
+		return image.Rect(x, y, x+opts.TileSize, y+opts.TileSize)
+	}
+	for _, pos := range positions {
+		draw.Draw(sheet, cell(pos), image.Transparent, image.Point{}, draw.Src)
+	}
+
+	outcomes, err := s.downloadPositions(ctx, opts, positions, func(ctx context.Context, pos tilePosition) (positionOutcome, error) {
+		r := cell(pos)
+		return s.stitchPosition(ctx, opts, pos, sheet.Pix, r.Min.X, r.Min.Y, width, height)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{Width: width, Height: height, TotalTiles: len(positions) * opts.SourcesPerTile()}
+	for i, outcome := range outcomes {
+		result.FailedTiles = append(result.FailedTiles, outcome.failed...)
+		result.SuccessfulTiles += outcome.successful
+		result.FallbackTiles += outcome.fallback
+
+		caption, c := fmt.Sprintf("%d/%d/%d", opts.Zoom, positions[i].x, positions[i].y), color.RGBA{A: 255}
+		switch {
+		case outcome.successful == 0 && len(outcome.failed) > 0:
+			caption, c = caption+" missing", contactSheetMissing
+			drawCross(sheet, cell(positions[i]), c)
+		case len(outcome.contributed) == 0:
+			caption += " empty"
+		}
+		drawCell(sheet, cell(positions[i]), caption, c)
+	}
+
+	if err := checkTileFailures(opts, result.FailedTiles, result.SuccessfulTiles, result.TotalTiles); err != nil {
+		return nil, err
+	}
+
+	if result.ImageData, err = s.encodePNG(sheet.Pix, width, height); err != nil {
+		return nil, fmt.Errorf("failed to encode contact sheet: %v", err)
+	}
+	return result, nil
+}
+
+// drawCell draws a 1px border around the tile at r and the caption below it
+func drawCell(img *image.RGBA, r image.Rectangle, caption string, c color.RGBA) {
+	border := r.Inset(-1)
+	for x := border.Min.X; x < border.Max.X; x++ {
+		img.SetRGBA(x, border.Min.Y, contactSheetBorder)
+		img.SetRGBA(x, border.Max.Y-1, contactSheetBorder)
+	}
+	for y := border.Min.Y; y < border.Max.Y; y++ {
+		img.SetRGBA(border.Min.X, y, contactSheetBorder)
+		img.SetRGBA(border.Max.X-1, y, contactSheetBorder)
+	}
+
+	face := basicfont.Face7x13
+	d := &font.Drawer{Dst: img, Src: image.NewUniform(c), Face: face}
+	d.Dot = fixed.P(r.Min.X, r.Max.Y+2+face.Metrics().Ascent.Ceil())
+	d.DrawString(caption)
+}
+
+// drawCross draws both diagonals of r, marking a missing tile
+func drawCross(img *image.RGBA, r image.Rectangle, c color.RGBA) {
+	size := min(r.Dx(), r.Dy())
+	for i := 0; i < size; i++ {
+		img.SetRGBA(r.Min.X+i, r.Min.Y+i, c)
+		img.SetRGBA(r.Max.X-1-i, r.Min.Y+i, c)
+	}
+}
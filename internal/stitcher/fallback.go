@@ -0,0 +1,54 @@
+package stitcher
+
+import (
+	"context"
+	"image"
+)
+
+// DefaultMaxFallbackLevels is how many zoom levels below the requested one
+// Options.FallbackZoom searches when MaxFallbackLevels is unset
+const DefaultMaxFallbackLevels = 3
+
+// fallbackLevels returns how many zoom levels FallbackZoom goes down, or 0
+// without it
+func fallbackLevels(opts *Options) int {
+	switch {
+	case !opts.FallbackZoom:
+		return 0
+	case opts.MaxFallbackLevels <= 0:
+		return DefaultMaxFallbackLevels
+	}
+	return opts.MaxFallbackLevels
+}
+
+// fetchFallback looks for an ancestor of the tile at pos in the zoom levels
+// below opts.Zoom and returns the part of the first one found that covers
+// pos, upscaled to a full tile. It returns nil when no level has the tile.
+func (s *Stitcher) fetchFallback(ctx context.Context, opts *Options, template string, pos tilePosition) *ImageData {
+	levels := fallbackLevels(opts)
+
+	for level := 1; level <= levels && opts.Zoom-level >= 0; level++ {
+		// Each level down halves the part of the ancestor covering pos
+		size := opts.TileSize >> level
+		if size == 0 || ctx.Err() != nil {
+			return nil
+		}
+
+		parent := tilePosition{x: pos.x >> level, y: pos.y >> level}
+		req := s.newTileRequestAt(opts, template, opts.Zoom-level, parent)
+		img, failed := s.fetchTile(ctx, req, opts)
+		if opts.OnTile != nil {
+			opts.OnTile(req.displayURL(), failed == nil)
+		}
+		if failed != nil || img == nil {
+			continue
+		}
+
+		qx := int(pos.x-parent.x<<level) * size
+		qy := int(pos.y-parent.y<<level) * size
+		quadrant := image.Rect(qx, qy, qx+size, qy+size)
+		return resample(img, quadrant, opts.TileSize, opts.TileSize, opts.Resampling)
+	}
+
+	return nil
+}
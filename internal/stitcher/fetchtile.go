@@ -0,0 +1,50 @@
+package stitcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Tile is a single tile as the tile server sent it
+type Tile struct {
+	Data        []byte // empty when the server has no tile there (204)
+	ContentType string // as sent, or sniffed from Data when the server sent none
+}
+
+// FetchTile downloads the tile zoom/x/y of the first of opts.TileURLs with the
+// headers, credentials and rate limit retries of opts, without decoding it.
+// Concurrent downloads of the same tile, by stitches too, share one request,
+// so the returned data must not be modified.
+func (s *Stitcher) FetchTile(ctx context.Context, opts *Options, zoom int, x, y uint32) (*Tile, error) {
+	if len(opts.TileURLs) == 0 {
+		return nil, errors.New("no tile URL")
+	}
+	if zoom < 0 || zoom > 30 {
+		return nil, fmt.Errorf("zoom %d is outside 0 to 30", zoom)
+	}
+	// Geographic tile schemes are two tiles wide at zoom 0
+	columns, rows := uint64(1)<<zoom, uint64(1)<<zoom
+	if opts.OutputCRS == CRSWGS84 {
+		columns *= 2
+	}
+	if uint64(x) >= columns || uint64(y) >= rows {
+		return nil, fmt.Errorf("tile %d/%d/%d is outside the %dx%d tile grid of zoom %d", zoom, x, y, columns, rows, zoom)
+	}
+
+	req := s.newTileRequestAt(opts, opts.TileURLs[0], zoom, tilePosition{x: x, y: y})
+	resp, err := s.download(ctx, req)
+	if opts.OnTile != nil {
+		opts.OnTile(req.displayURL(), err == nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	contentType := resp.contentType
+	if contentType == "" && len(resp.data) > 0 {
+		contentType = http.DetectContentType(resp.data)
+	}
+	return &Tile{Data: resp.data, ContentType: contentType}, nil
+}
@@ -0,0 +1,45 @@
+package stitcher
+
+import (
+	"errors"
+	"math"
+)
+
+// earthCircumference is the equator length of the sphere Web Mercator and
+// the WGS84 tile scheme are drawn on, in meters
+const earthCircumference = 2 * math.Pi * 6378137
+
+// MetersToPixels returns the image size in pixels of tileSize pixel tiles at
+// zoom that covers widthMeters by heightMeters on the ground around lat, in
+// the tile scheme of crs. Web Mercator pixels shrink with the cosine of the
+// latitude in both directions; WGS84 pixels only from east to west.
+func MetersToPixels(widthMeters, heightMeters, lat float64, zoom, tileSize, crs int) (int, int) {
+	gz := zoom
+	if crs == CRSWGS84 {
+		gz++
+	}
+	atEquator := earthCircumference / (float64(tileSize) * math.Exp2(float64(gz)))
+	cosLat := math.Cos(lat * math.Pi / 180)
+
+	metersPerPixelX, metersPerPixelY := atEquator*cosLat, atEquator*cosLat
+	if crs == CRSWGS84 {
+		metersPerPixelY = atEquator
+	}
+	return int(math.Round(widthMeters / metersPerPixelX)), int(math.Round(heightMeters / metersPerPixelY))
+}
+
+// centeredSize returns the pixel size of a centered stitch around lat, from
+// Options.Width and Height or converted from WidthMeters and HeightMeters
+func centeredSize(opts *Options, lat float64, crs int) (int, int, error) {
+	if opts.WidthMeters == 0 && opts.HeightMeters == 0 {
+		return opts.Width, opts.Height, nil
+	}
+	if opts.Width != 0 || opts.Height != 0 {
+		return 0, 0, errors.New("give the centered size in pixels or in meters, not both")
+	}
+	if opts.WidthMeters <= 0 || opts.HeightMeters <= 0 {
+		return 0, 0, errors.New("width and height in meters must both be positive")
+	}
+	width, height := MetersToPixels(opts.WidthMeters, opts.HeightMeters, lat, opts.Zoom, opts.TileSize, crs)
+	return max(width, 1), max(height, 1), nil
+}
@@ -0,0 +1,174 @@
+package stitcher
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	_ "modernc.org/sqlite" // registers the "sqlite" database/sql driver
+)
+
+// mbtilesSchema creates the tables of the MBTiles 1.3 specification
+const mbtilesSchema = `
+CREATE TABLE metadata (name TEXT, value TEXT);
+CREATE TABLE tiles (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BLOB);
+CREATE UNIQUE INDEX tile_index ON tiles (zoom_level, tile_column, tile_row);
+`
+
+// exportMBTiles downloads the tiles tx1..tx2 × ty1..ty2 and stores them unmodified
+// in an MBTiles file at opts.Output. bounds is minLon, minLat, maxLon, maxLat.
+func (s *Stitcher) exportMBTiles(ctx context.Context, opts *Options, tx1, ty1, tx2, ty2 uint32, bounds [4]float64) (*Result, error) {
+	if opts.Output == "" {
+		return nil, fmt.Errorf("MBTiles output requires an output path")
+	}
+	if opts.LayerMode == LayerModeOverlay {
+		return nil, fmt.Errorf("MBTiles output doesn't support overlay layers")
+	}
+
+	var positions []tilePosition
+	for ty := ty1; ty <= ty2; ty++ {
+		for tx := tx1; tx <= tx2; tx++ {
+			positions = append(positions, tilePosition{x: tx, y: ty})
+		}
+	}
+
+	// Raw tile data by position index; nil for empty or failed tiles
+	columns := int(tx2 - tx1 + 1)
+	tiles := make([][]byte, len(positions))
+
+	outcomes, err := s.downloadPositions(ctx, opts, positions, func(ctx context.Context, pos tilePosition) (positionOutcome, error) {
+		data, outcome, err := s.fetchRawPosition(ctx, opts, pos)
+		tiles[int(pos.y-ty1)*columns+int(pos.x-tx1)] = data
+		return outcome, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var failedTiles []FailedTile
+	successfulTiles := 0
+	for _, outcome := range outcomes {
+		failedTiles = append(failedTiles, outcome.failed...)
+		successfulTiles += outcome.successful
+	}
+	totalTiles := len(positions) * len(opts.TileURLs)
+
+	if err := checkTileFailures(opts, failedTiles, successfulTiles, totalTiles); err != nil {
+		return nil, err
+	}
+
+	if err := s.writeMBTiles(opts.Output, opts.Zoom, positions, tiles, bounds); err != nil {
+		return nil, fmt.Errorf("failed to write MBTiles: %v", err)
+	}
+
+	return &Result{
+		FailedTiles:     failedTiles,
+		SuccessfulTiles: successfulTiles,
+		TotalTiles:      totalTiles,
+	}, nil
+}
+
+// fetchRawPosition downloads the first available tile for a position without
+// decoding it into a buffer. The tile is still decoded once to reject
+// responses that aren't images.
+func (s *Stitcher) fetchRawPosition(ctx context.Context, opts *Options, pos tilePosition) ([]byte, positionOutcome, error) {
+	var outcome positionOutcome
+
+	for _, urlTemplate := range opts.TileURLs {
+		if err := ctx.Err(); err != nil {
+			return nil, outcome, err
+		}
+
+		req := s.newTileRequest(opts, urlTemplate, pos)
+		data, err := s.downloadTile(ctx, req)
+		if err == nil && len(data) > 0 {
+			if _, decodeErr := s.decodeImage(data); decodeErr != nil {
+				err = fmt.Errorf("decode error: %v", decodeErr)
+			}
+		}
+		if opts.OnTile != nil {
+			opts.OnTile(req.displayURL(), err == nil)
+		}
+		if err != nil {
+			outcome.failed = append(outcome.failed, FailedTile{URL: req.displayURL(), Error: err.Error()})
+			continue
+		}
+
+		outcome.successful++
+		if len(data) == 0 {
+			return nil, outcome, nil
+		}
+		return data, outcome, nil
+	}
+
+	return nil, outcome, nil
+}
+
+// writeMBTiles creates a fresh MBTiles file holding the given tiles
+func (s *Stitcher) writeMBTiles(path string, zoom int, positions []tilePosition, tiles [][]byte, bounds [4]float64) (err error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if _, err = tx.Exec(mbtilesSchema); err != nil {
+		return err
+	}
+
+	format := "png"
+	for _, data := range tiles {
+		if len(data) >= 2 && data[0] == 0xFF && data[1] == 0xD8 {
+			format = "jpg"
+			break
+		} else if len(data) > 0 {
+			break
+		}
+	}
+
+	metadata := [][2]string{
+		{"name", "stitch"},
+		{"type", "baselayer"},
+		{"version", "1.0"},
+		{"format", format},
+		{"bounds", fmt.Sprintf("%f,%f,%f,%f", bounds[0], bounds[1], bounds[2], bounds[3])},
+		{"minzoom", strconv.Itoa(zoom)},
+		{"maxzoom", strconv.Itoa(zoom)},
+	}
+	for _, kv := range metadata {
+		if _, err = tx.Exec("INSERT INTO metadata (name, value) VALUES (?, ?)", kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+
+	// MBTiles rows use the TMS scheme, counting from the bottom
+	maxRow := uint32(1)<<uint(zoom) - 1
+	for i, pos := range positions {
+		if tiles[i] == nil {
+			continue
+		}
+		if _, err = tx.Exec("INSERT INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?)",
+			zoom, pos.x, maxRow-pos.y, tiles[i]); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
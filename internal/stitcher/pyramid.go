@@ -0,0 +1,129 @@
+package stitcher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// PyramidOptions selects the zoom levels and destination of a tile pyramid
+type PyramidOptions struct {
+	ZoomFrom, ZoomTo int    // inclusive zoom range; the order doesn't matter
+	Dir              string // root of the z/x/y tree, created if missing
+	Reencode         bool   // decode every tile and write it as PNG instead of as downloaded
+}
+
+// ExportPyramid downloads the tiles covering the area of opts at every zoom
+// level from ZoomFrom to ZoomTo and writes them to Dir/z/x/y.ext, on
+// opts.Concurrency workers. opts.Zoom is ignored. Tiles keep the format the
+// tile server sent unless Reencode is set; empty tiles aren't written. The
+// tile limit and failure limits of opts apply to the tiles of all levels
+// together.
+func (s *Stitcher) ExportPyramid(ctx context.Context, opts *Options, pyr PyramidOptions) (*Result, error) {
+	if pyr.Dir == "" {
+		return nil, fmt.Errorf("a pyramid requires an output directory")
+	}
+	if opts.LayerMode == LayerModeOverlay {
+		return nil, fmt.Errorf("pyramids don't support overlay layers")
+	}
+	zoomFrom, zoomTo := min(pyr.ZoomFrom, pyr.ZoomTo), max(pyr.ZoomFrom, pyr.ZoomTo)
+	if zoomFrom < 0 {
+		return nil, fmt.Errorf("zoom levels must not be negative")
+	}
+
+	// Every level quadruples the tiles, so check them all before downloading
+	levels := make([]*Bounds, 0, zoomTo-zoomFrom+1)
+	var tileCount int64
+	for zoom := zoomFrom; zoom <= zoomTo; zoom++ {
+		levelOpts := *opts
+		levelOpts.Zoom = zoom
+
+		bounds, err := ComputeBounds(&levelOpts)
+		if err != nil {
+			return nil, fmt.Errorf("zoom %d: %w", zoom, err)
+		}
+		levels = append(levels, bounds)
+		tileCount += bounds.TileCount() * int64(len(opts.TileURLs))
+	}
+	if opts.MaxTiles > 0 && tileCount > int64(opts.MaxTiles) {
+		return nil, &LimitError{
+			Limit:     "max_tiles",
+			Requested: tileCount,
+			Max:       int64(opts.MaxTiles),
+			Message:   fmt.Sprintf("pyramid of zoom %d to %d needs %d tiles, more than the limit of %d; use a smaller zoom range", zoomFrom, zoomTo, tileCount, opts.MaxTiles),
+		}
+	}
+
+	result := &Result{}
+	for i, bounds := range levels {
+		zoom := zoomFrom + i
+		levelOpts := *opts
+		levelOpts.Zoom = zoom
+
+		var positions []tilePosition
+		for ty := bounds.MinTileY; ty <= bounds.MaxTileY; ty++ {
+			for tx := bounds.MinTileX; tx <= bounds.MaxTileX; tx++ {
+				positions = append(positions, tilePosition{x: tx, y: ty})
+			}
+		}
+
+		outcomes, err := s.downloadPositions(ctx, &levelOpts, positions, func(ctx context.Context, pos tilePosition) (positionOutcome, error) {
+			data, outcome, err := s.fetchRawPosition(ctx, &levelOpts, pos)
+			if err != nil || data == nil {
+				return outcome, err
+			}
+			return outcome, s.writePyramidTile(pyr, zoom, pos, data)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, outcome := range outcomes {
+			result.FailedTiles = append(result.FailedTiles, outcome.failed...)
+			result.SuccessfulTiles += outcome.successful
+		}
+		result.TotalTiles += len(positions) * len(opts.TileURLs)
+	}
+
+	if err := checkTileFailures(opts, result.FailedTiles, result.SuccessfulTiles, result.TotalTiles); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// writePyramidTile writes the tile data at pos to its place in the pyramid
+func (s *Stitcher) writePyramidTile(pyr PyramidOptions, zoom int, pos tilePosition, data []byte) error {
+	if pyr.Reencode {
+		img, err := s.decodeImage(data)
+		if err != nil {
+			return fmt.Errorf("failed to decode tile %d/%d/%d: %v", zoom, pos.x, pos.y, err)
+		}
+		if data, err = s.encodePNG(img.buf, img.width, img.height); err != nil {
+			return fmt.Errorf("failed to encode tile %d/%d/%d: %v", zoom, pos.x, pos.y, err)
+		}
+	}
+
+	dir := filepath.Join(pyr.Dir, strconv.Itoa(zoom), strconv.FormatUint(uint64(pos.x), 10))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	name := strconv.FormatUint(uint64(pos.y), 10) + "." + tileExtension(data)
+	return os.WriteFile(filepath.Join(dir, name), data, 0644)
+}
+
+// tileExtension returns the file extension for the image format of data,
+// png for formats it doesn't recognize
+func tileExtension(data []byte) string {
+	switch http.DetectContentType(data) {
+	case "image/jpeg":
+		return "jpg"
+	case "image/webp":
+		return "webp"
+	case "image/gif":
+		return "gif"
+	}
+	return "png"
+}
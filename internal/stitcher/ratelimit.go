@@ -0,0 +1,82 @@
+package stitcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// MaxRateLimitWait is the longest Retry-After the stitcher waits out before
+// retrying a rate-limited tile; longer waits fail the tile instead
+const MaxRateLimitWait = time.Minute
+
+// RateLimitError is returned for tiles the tile server refused with
+// 429 Too Many Requests
+type RateLimitError struct {
+	StatusCode int
+	RetryAfter time.Duration // zero if the server didn't send Retry-After
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("HTTP %d: rate limited, retry after %v", e.StatusCode, e.RetryAfter)
+	}
+	return fmt.Sprintf("HTTP %d: rate limited", e.StatusCode)
+}
+
+// RetryAfter returns the longest Retry-After among the rate-limited tiles, and
+// whether any tile was rate limited at all
+func (e *TileError) RetryAfter() (time.Duration, bool) {
+	var wait time.Duration
+	limited := false
+	for _, ft := range e.FailedTiles {
+		if ft.RateLimited {
+			limited = true
+			wait = max(wait, ft.RetryAfter)
+		}
+	}
+	return wait, limited
+}
+
+// fetchWithRetry fetches a tile after its random jitter delay, waiting out
+// Retry-After and trying again up to tr.rateLimitRetries times while the
+// server rate limits it
+func (s *Stitcher) fetchWithRetry(ctx context.Context, tr tileRequest) (tileResponse, error) {
+	if tr.jitter > 0 {
+		if err := sleep(ctx, rand.N(tr.jitter+1)); err != nil {
+			return tileResponse{}, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := s.fetchURL(ctx, tr)
+
+		var rateErr *RateLimitError
+		if !errors.As(err, &rateErr) || attempt >= tr.rateLimitRetries || rateErr.RetryAfter > MaxRateLimitWait {
+			return resp, err
+		}
+
+		// Back off briefly when the server didn't say how long to wait
+		wait := rateErr.RetryAfter
+		if wait == 0 {
+			wait = time.Second
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return tileResponse{}, err
+		}
+	}
+}
+
+// sleep waits for d or until ctx is done, whichever comes first
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,92 @@
+package stitcher
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// reprojects reports whether the tiles of opts are in another scheme than
+// the output of crs and have to be reprojected
+func reprojects(opts *Options, crs int) bool {
+	return opts.SourceCRS != 0 && opts.SourceCRS != crs
+}
+
+// sourceGrid returns the options and bounds of stitching the tiles of
+// opts.SourceCRS that cover bounds, the output in another scheme, in their
+// own grid before they're reprojected into the output
+func sourceGrid(opts *Options, bounds *Bounds) (*Options, *Bounds, error) {
+	if opts.SourceCRS != CRSWebMercator && opts.SourceCRS != CRSWGS84 {
+		return nil, nil, fmt.Errorf("unsupported source CRS: EPSG:%d", opts.SourceCRS)
+	}
+	if opts.Mode == ModeTileRange {
+		return nil, nil, errors.New("a tile range addresses the tiles of the output CRS and can't be reprojected")
+	}
+	if opts.OutputFormat == FormatMBTiles {
+		return nil, nil, errors.New("MBTiles output stores the source tiles and can't reproject them")
+	}
+
+	// Both schemes are cylindrical, so the output's extent is a rectangle in
+	// the source too. Web Mercator tiles end at ±MaxMercatorLat; the output
+	// stays transparent beyond.
+	src := *opts
+	src.OutputCRS, src.SourceCRS = opts.SourceCRS, 0
+	src.Mode, src.CropMode = ModeBBox, CropExact
+	src.MinLat, src.MinLon, src.MaxLat, src.MaxLon = bounds.MinLat, bounds.MinLon, bounds.MaxLat, bounds.MaxLon
+	src.ClampLatitude = true
+
+	grid, err := ComputeBounds(&src)
+	if err != nil {
+		return nil, nil, err
+	}
+	if grid.Width <= 0 || grid.Height <= 0 {
+		return nil, nil, fmt.Errorf("the area has no pixels in the tiles of EPSG:%d", opts.SourceCRS)
+	}
+	if err := CheckLimits(&src, grid); err != nil {
+		return nil, nil, err
+	}
+	return &src, grid, nil
+}
+
+// reproject fills buf, the RGBA image of bounds, from img, the image of the
+// same area in the tile scheme of grid. Every output pixel center is
+// projected back to lat/lon and sampled from img with method. Pixels outside
+// img are left as they are.
+func reproject(img *ImageData, grid *Bounds, buf []byte, bounds *Bounds, method int) {
+	minX, maxY := bounds.project(bounds.MaxLat, bounds.MinLon)
+	maxX, minY := bounds.project(bounds.MinLat, bounds.MaxLon)
+	px := (maxX - minX) / float64(bounds.Width)
+	py := (maxY - minY) / float64(bounds.Height)
+
+	srcMinX, srcMaxY := grid.project(grid.MaxLat, grid.MinLon)
+	srcMaxX, srcMinY := grid.project(grid.MinLat, grid.MaxLon)
+	srcPx := (srcMaxX - srcMinX) / float64(img.width)
+	srcPy := (srcMaxY - srcMinY) / float64(img.height)
+
+	for y := 0; y < bounds.Height; y++ {
+		// Longitude is linear in both schemes, so only rows change latitude
+		lat, _ := unproject(bounds.CRS, minX, maxY-(float64(y)+0.5)*py)
+		for x := 0; x < bounds.Width; x++ {
+			_, lon := unproject(bounds.CRS, minX+(float64(x)+0.5)*px, 0)
+			sX, sY := grid.project(lat, lon)
+			sx := (sX-srcMinX)/srcPx - 0.5
+			sy := (srcMaxY-sY)/srcPy - 0.5
+			if sx < -0.5 || sy < -0.5 || sx > float64(img.width)-0.5 || sy > float64(img.height)-0.5 || math.IsNaN(sy) {
+				continue
+			}
+			sample(img, sx, sy, buf[(y*bounds.Width+x)*4:][:4], method)
+		}
+	}
+}
+
+// unproject converts XY in crs back to lat/lon, the inverse of
+// projectlatlon and projectlatlon4326
+func unproject(crs int, x, y float64) (float64, float64) {
+	if crs == CRSWGS84 {
+		return y, x
+	}
+	const originshift = 20037508.342789244
+	lon := x * 180 / originshift
+	lat := 360/math.Pi*math.Atan(math.Exp(y*math.Pi/originshift)) - 90
+	return lat, lon
+}
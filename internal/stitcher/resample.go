@@ -0,0 +1,203 @@
+package stitcher
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// Resampling methods for scaled tiles and frames
+const (
+	ResamplingBilinear = iota // smooth; the default, suited to imagery
+	ResamplingNearest         // keeps hard edges, e.g. of labels and lines
+	ResamplingBicubic         // sharper than bilinear, slower
+)
+
+// ParseResampling returns the resampling method for nearest, bilinear or
+// bicubic; an empty name is bilinear
+func ParseResampling(name string) (int, error) {
+	switch name {
+	case "", "bilinear":
+		return ResamplingBilinear, nil
+	case "nearest":
+		return ResamplingNearest, nil
+	case "bicubic":
+		return ResamplingBicubic, nil
+	default:
+		return 0, fmt.Errorf("unknown resampling method %q (use nearest, bilinear or bicubic)", name)
+	}
+}
+
+// resample scales the src region of img to a width x height image. Pixels
+// next to the region are sampled too, so neighboring regions join
+// seamlessly. Shrinking averages all pixels an output pixel covers instead,
+// unless method is ResamplingNearest, as interpolating between just a few of
+// them aliases. This and reproject are the only places the stitcher scales
+// images.
+func resample(img *ImageData, src image.Rectangle, width, height, method int) *ImageData {
+	out := &ImageData{
+		buf:    make([]byte, width*height*4),
+		width:  width,
+		height: height,
+		depth:  img.depth,
+	}
+	scaleX := float64(src.Dx()) / float64(width)
+	scaleY := float64(src.Dy()) / float64(height)
+
+	if method != ResamplingNearest && scaleX >= 1 && scaleY >= 1 && scaleX*scaleY > 1 {
+		areaAverage(img, src, out, scaleX, scaleY)
+		return out
+	}
+
+	for y := 0; y < height; y++ {
+		// Source coordinates of the pixel center
+		sy := float64(src.Min.Y) + (float64(y)+0.5)*scaleY - 0.5
+
+		for x := 0; x < width; x++ {
+			sx := float64(src.Min.X) + (float64(x)+0.5)*scaleX - 0.5
+			sample(img, sx, sy, out.buf[(y*width+x)*4:][:4], method)
+		}
+	}
+
+	return out
+}
+
+// areaWeight is the share of an output pixel covered by one source pixel
+type areaWeight struct {
+	index  int
+	weight float64
+}
+
+// areaWeights returns, for each of n output pixels along one axis, the
+// source pixels it covers from first on and how much of it each covers
+func areaWeights(first int, scale float64, n, limit int) [][]areaWeight {
+	weights := make([][]areaWeight, n)
+	for i := range weights {
+		start := float64(first) + float64(i)*scale
+		end := start + scale
+		for p := math.Floor(start); p < end; p++ {
+			w := (math.Min(end, p+1) - math.Max(start, p)) / scale
+			if w > 0 {
+				weights[i] = append(weights[i], areaWeight{index: clampIndex(int(p), limit), weight: w})
+			}
+		}
+	}
+	return weights
+}
+
+// areaAverage shrinks the src region of img into out, averaging the source
+// pixels under every output pixel weighted by how much of them it covers
+func areaAverage(img *ImageData, src image.Rectangle, out *ImageData, scaleX, scaleY float64) {
+	columns := areaWeights(src.Min.X, scaleX, out.width, img.width)
+	rows := areaWeights(src.Min.Y, scaleY, out.height, img.height)
+
+	for y, row := range rows {
+		for x, column := range columns {
+			var sum [4]float64
+			for _, ry := range row {
+				for _, cx := range column {
+					i := (ry.index*img.width + cx.index) * 4
+					w := ry.weight * cx.weight
+					for c := 0; c < 4; c++ {
+						sum[c] += float64(img.buf[i+c]) * w
+					}
+				}
+			}
+			dst := out.buf[(y*out.width+x)*4:][:4]
+			for c := 0; c < 4; c++ {
+				dst[c] = byte(math.Min(sum[c]+0.5, 255))
+			}
+		}
+	}
+}
+
+// sample writes the pixel of img at sx, sy, interpolated with method, to dst
+func sample(img *ImageData, sx, sy float64, dst []byte, method int) {
+	switch method {
+	case ResamplingNearest:
+		i := (clampIndex(int(math.Round(sy)), img.height)*img.width + clampIndex(int(math.Round(sx)), img.width)) * 4
+		copy(dst, img.buf[i:i+4])
+	case ResamplingBicubic:
+		sampleBicubic(img, sx, sy, dst)
+	default:
+		sampleBilinear(img, sx, sy, dst)
+	}
+}
+
+// sampleBilinear interpolates the 2x2 pixels around sx, sy
+func sampleBilinear(img *ImageData, sx, sy float64, dst []byte) {
+	x0, fx := splitCoordinate(sx, img.width)
+	y0, fy := splitCoordinate(sy, img.height)
+	x1 := min(x0+1, img.width-1)
+	y1 := min(y0+1, img.height-1)
+	i00 := (y0*img.width + x0) * 4
+	i10 := (y0*img.width + x1) * 4
+	i01 := (y1*img.width + x0) * 4
+	i11 := (y1*img.width + x1) * 4
+
+	for c := 0; c < 4; c++ {
+		top := float64(img.buf[i00+c])*(1-fx) + float64(img.buf[i10+c])*fx
+		bottom := float64(img.buf[i01+c])*(1-fx) + float64(img.buf[i11+c])*fx
+		dst[c] = byte(top*(1-fy) + bottom*fy + 0.5)
+	}
+}
+
+// sampleBicubic interpolates the 4x4 pixels around sx, sy with the
+// Catmull-Rom spline
+func sampleBicubic(img *ImageData, sx, sy float64, dst []byte) {
+	x0, y0 := math.Floor(sx), math.Floor(sy)
+	fx, fy := sx-x0, sy-y0
+
+	var wx, wy [4]float64
+	for k := 0; k < 4; k++ {
+		wx[k] = catmullRom(fx - float64(k-1))
+		wy[k] = catmullRom(fy - float64(k-1))
+	}
+
+	var sum [4]float64
+	for j := 0; j < 4; j++ {
+		row := clampIndex(int(y0)+j-1, img.height) * img.width
+		for k := 0; k < 4; k++ {
+			i := (row + clampIndex(int(x0)+k-1, img.width)) * 4
+			w := wx[k] * wy[j]
+			for c := 0; c < 4; c++ {
+				sum[c] += float64(img.buf[i+c]) * w
+			}
+		}
+	}
+	for c := 0; c < 4; c++ {
+		// The spline overshoots at edges
+		dst[c] = byte(math.Max(0, math.Min(255, sum[c]+0.5)))
+	}
+}
+
+// catmullRom is the Catmull-Rom cubic kernel
+func catmullRom(t float64) float64 {
+	t = math.Abs(t)
+	switch {
+	case t < 1:
+		return 1.5*t*t*t - 2.5*t*t + 1
+	case t < 2:
+		return -0.5*t*t*t + 2.5*t*t - 4*t + 2
+	default:
+		return 0
+	}
+}
+
+// clampIndex clamps i to [0, n-1]
+func clampIndex(i, n int) int {
+	return max(0, min(i, n-1))
+}
+
+// splitCoordinate returns the pixel index at or before v, clamped to
+// [0, n-1], and the fractional distance to the next pixel
+func splitCoordinate(v float64, n int) (int, float64) {
+	if v <= 0 {
+		return 0, 0
+	}
+	if v >= float64(n-1) {
+		return n - 1, 0
+	}
+	i := math.Floor(v)
+	return int(i), v - i
+}
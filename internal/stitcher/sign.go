@@ -0,0 +1,43 @@
+package stitcher
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// URLSigner returns url with the signature a tile server requires added,
+// computed for requests made at now. It's called once per tile request,
+// before any retry.
+type URLSigner func(url string, now time.Time) string
+
+// HMACSigner returns a URLSigner for servers that check time-limited HMAC
+// signatures. It appends expires, the Unix time ttl after now, to the query
+// and then signature, the hex HMAC-SHA256 with key of the path and query up
+// to and including expires. Keep ttl longer than a stitch with its retries.
+func HMACSigner(key []byte, ttl time.Duration) URLSigner {
+	return func(url string, now time.Time) string {
+		// Only the path and query are signed, so {s} subdomains share keys
+		rest := url
+		if i := strings.Index(rest, "://"); i >= 0 {
+			rest = rest[i+3:]
+			if j := strings.IndexAny(rest, "/?"); j >= 0 {
+				rest = rest[j:]
+			} else {
+				rest = ""
+			}
+		}
+
+		separator := "?"
+		if strings.Contains(url, "?") {
+			separator = "&"
+		}
+		expires := "expires=" + strconv.FormatInt(now.Add(ttl).Unix(), 10)
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(rest + separator + expires))
+		return url + separator + expires + "&signature=" + hex.EncodeToString(mac.Sum(nil))
+	}
+}
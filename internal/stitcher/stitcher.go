@@ -2,357 +2,1840 @@ package stitcher
 
 import (
 	"bytes"
+	"compress/gzip"
+	"container/list"
+	"crypto/tls"
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"image"
-	"image/jpeg"
+	"image/color"
 	"image/png"
 	"io"
+	"log/slog"
 	"math"
+	"net"
 	"net/http"
+	neturl "net/url"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	
+	"github.com/kiesman99/stitch/pkg/tile"
+	"golang.org/x/sync/singleflight"
 )
 
 // Output format constants
 const (
 	FormatPNG = iota
 	FormatGeoTIFF
+	FormatMBTiles // raw tiles in an SQLite file at Options.Output, not composited
 )
 
 // Mode constants
 const (
 	ModeBBox = iota
 	ModeCentered
+	ModeTileRange // exactly the tiles from MinTileX, MinTileY to MaxTileX, MaxTileY
+)
+
+// Crop mode constants
+const (
+	// CropExact cuts the image to the requested area (default)
+	CropExact = iota
+	// CropTiles keeps every tile the area reaches into whole, for
+	// tile-aligned mosaics; the image grows to the tiles' extent
+	CropTiles
+)
+
+// Output CRS constants (EPSG codes)
+const (
+	CRSWebMercator = 3857
+	CRSWGS84       = 4326
+)
+
+// Layer mode constants
+const (
+	// LayerModeFallback tries each tile URL in turn and uses the first success
+	LayerModeFallback = iota
+	// LayerModeOverlay composites every layer on top of the previous one
+	LayerModeOverlay
+)
+
+// Fetch order constants
+const (
+	// FetchOrderRaster downloads tiles row by row from the top left (default)
+	FetchOrderRaster = iota
+	// FetchOrderSpiral downloads the center tile first and works outward,
+	// so partial results show the middle of the area early
+	FetchOrderSpiral
 )
 
+// Layer is a single tile source composited in overlay mode
+type Layer struct {
+	URL         string
+	Opacity     float64 // 0..1, scales the tile's alpha before blending
+	Attribution string  // credit rendered when the layer contributes tiles
+
+	// Zoom range the layer has tiles for; it isn't requested at other zoom
+	// levels. MaxZoom 0 is unlimited.
+	MinZoom, MaxZoom int
+}
+
 // Options contains all stitching parameters
 type Options struct {
 	// Coordinates for bbox mode
 	MinLat, MinLon, MaxLat, MaxLon float64
 	
-	// Coordinates for centered mode
-	CenterLat, CenterLon float64
-	Width, Height        int
+	// Coordinates for centered mode; the size is either in pixels or on
+	// the ground in meters
+	CenterLat, CenterLon      float64
+	Width, Height             int
+	WidthMeters, HeightMeters float64
+	
+	// Inclusive tile coordinates at Zoom for tile range mode
+	MinTileX, MinTileY, MaxTileX, MaxTileY uint32
 	
 	// Common options
 	Zoom              int
 	TileURLs          []string
 	TileSize          int
 	OutputFormat      int
+	Output            string // destination file for FormatMBTiles
+	OutputCRS         int // CRSWebMercator (default) or CRSWGS84; selects the tile scheme and georeferencing
+	SourceCRS         int // tile scheme of the sources when it differs from OutputCRS; their tiles are reprojected. 0 uses OutputCRS
 	GenerateWorldFile bool
+	VRTImage          string // when set, Result.VRTData is a GDAL VRT referencing the image by this file name
 	Headers           map[string]string
+	BasicAuth         *BasicAuth // Authorization for tile requests; overrides one in Headers
+	BearerToken       string     // Authorization: Bearer for tile requests; overrides one in Headers
+	UserAgent         string     // User-Agent for tile requests; overrides one in Headers, defaults to tile.DefaultUserAgent
+	Referer           string     // Referer for tile requests, for providers that only serve their own sites; overrides one in Headers
+	Origin            string     // Origin for tile requests; overrides one in Headers
+	ProxyURL          string     // http, https or socks5 proxy for tile requests; empty uses HTTP_PROXY and HTTPS_PROXY
+	
+	// InsecureSkipVerify accepts any TLS certificate from the tile servers of
+	// this stitch, for internal servers with self-signed certificates. It
+	// makes the downloads open to interception; leave it off for others.
+	InsecureSkipVerify bool
+	
+	// HostPolicy limits the hosts of the expanded tile URLs and of the
+	// redirects they lead to; the zero value permits every host
+	HostPolicy tile.HostPolicy
+	
+	RequestMethod     string // GET (default) or POST
+	RequestBody       string // body template for POST, with the same placeholders as TileURLs; set Content-Type via Headers
+	URLParams         map[string]string // values for custom {name} placeholders in TileURLs
+	Token             string            // value of {token} in TileURLs and RequestBody, such as an access token; overrides URLParams["token"]
+	Signer            URLSigner         // signs every tile URL after the placeholders are filled in; nil leaves them unsigned
+	Subdomains        []string          // values of {s}, rotating with the tile position; empty uses a, b and c
 	Mode              int
+	CropMode          int  // CropExact (default) or CropTiles
+	AllowEmpty        bool // return a fully transparent image instead of ErrEmptyResult
+	ClampLatitude     bool // clamp Web Mercator latitudes to ±MaxMercatorLat instead of returning ErrLatitudeRange
+	FallbackZoom      bool // fill failed tiles with the upscaled part of a lower zoom tile
+	MaxFallbackLevels int  // zoom levels FallbackZoom goes down; 0 uses DefaultMaxFallbackLevels
+	AutoResample      bool // scale tiles that aren't TileSize pixels to it instead of failing them
+	UndersizedAsEmpty bool // treat tiles smaller than TileSize both ways, like 1x1 "no data" placeholders, as empty; before AutoResample
+	Resampling        int  // ResamplingBilinear (default), ResamplingNearest or ResamplingBicubic for all scaling
+	BackgroundColor   color.RGBA // fill for transparent areas; the zero value keeps them transparent
+	DrawTileGrid      bool       // draw tile boundaries over the image for debugging seams; always those of OutputCRS's scheme, also when SourceCRS tiles are reprojected
+	GridColor         color.RGBA // color of the tile grid; the zero value uses tile.DefaultGridColor
+	GridLabels        bool       // label every tile of the grid with z/x/y
+	DrawScaleBar      bool       // draw a scale bar for the center latitude in the bottom-left corner
+	DrawNorthArrow    bool       // draw a north arrow in the top-right corner
+	VerifyOutput      bool       // re-decode the encoded image and check its size before returning it
+	DPI               int        // resolution declared in a PNG pHYs chunk, for print; 0 leaves it out
+	MaxDimension      int        // downscale the image so neither side exceeds this, keeping the aspect ratio; 0 keeps its size
+	Attribution       string     // credit for TileURLs; overlay layers carry their own
+	
+	// Limits; MaxPixels defaults to DefaultMaxPixels, MaxTiles to unlimited
+	MaxPixels int64
+	MaxTiles  int
+	
+	// The stitch fails when more than MaxFailureRatio of the tiles fail
+	// or more than MaxFailedTiles do; 0 allows no failed tile at all. A nil
+	// MaxFailureRatio uses DefaultMaxFailureRatio, a nil MaxFailedTiles
+	// doesn't limit the count.
+	MaxFailureRatio *float64
+	MaxFailedTiles  *int
+	
+	// Download options
+	Concurrency int           // parallel tile downloads; values below 1 mean sequential
+	RampUp      time.Duration // spread worker start-up over this period (0 starts all at once)
+	FetchOrder  int           // FetchOrderRaster (default) or FetchOrderSpiral; doesn't change the image
+	
+	// RateLimitRetries is how often a tile answered with 429 is retried
+	// after waiting out its Retry-After (up to MaxRateLimitWait)
+	RateLimitRetries int
+	
+	// RequestJitter waits a random time up to this long before every tile
+	// request, so downloads don't arrive in regular bursts (0 doesn't wait)
+	RequestJitter time.Duration
+	
+	// TileTimeout limits each tile request, including reading the tile;
+	// 0 leaves only the client's 30 second timeout. Retries get their own.
+	TileTimeout time.Duration
+	
+	// OnTile is called after every tile download attempt, with the URL
+	// redacted as in FailedTile; it must be safe for concurrent use
+	OnTile func(url string, ok bool)
+	
+	// Logger receives a warning for every failed tile; nil discards them
+	Logger *slog.Logger
+	
+	// Layering options
+	LayerMode int
+	Layers    []Layer // used in overlay mode; falls back to TileURLs at full opacity
+	
+	// Coverage declared by the tile source; when set, the requested area is
+	// checked against it before downloading
+	Coverage       *SourceCoverage
+	StrictCoverage bool // fail with a CoverageError instead of only reporting the percentage
+}
+
+// SourceCoverage is the area and zoom range a tile source has data for,
+// as declared in TileJSON
+type SourceCoverage struct {
+	MinLon, MinLat, MaxLon, MaxLat float64
+	MinZoom, MaxZoom               int
+}
+
+// overlayLayers returns the layers to composite in overlay mode
+func (o *Options) overlayLayers() []Layer {
+	if len(o.Layers) > 0 {
+		return o.Layers
+	}
+	
+	layers := make([]Layer, len(o.TileURLs))
+	for i, url := range o.TileURLs {
+		layers[i] = Layer{URL: url, Opacity: 1, Attribution: o.Attribution}
+	}
+	return layers
+}
+
+// SourcesPerTile returns the number of tile downloads counted per position:
+// every layer that has tiles at Zoom in overlay mode, every fallback URL
+// otherwise
+func (o *Options) SourcesPerTile() int {
+	if o.LayerMode == LayerModeOverlay {
+		n := 0
+		for _, layer := range o.overlayLayers() {
+			if o.layerAtZoom(layer) {
+				n++
+			}
+		}
+		return n
+	}
+	return len(o.TileURLs)
+}
+
+// layerAtZoom reports whether layer is requested at Zoom: inside its zoom
+// range, or in the fallback levels above it, which are filled from its
+// highest level
+func (o *Options) layerAtZoom(layer Layer) bool {
+	if o.Zoom < layer.MinZoom {
+		return false
+	}
+	return layer.MaxZoom == 0 || o.Zoom <= layer.MaxZoom+fallbackLevels(o)
+}
+
+// Result contains the stitching result
+type Result struct {
+	ImageData     []byte
+	WorldFileData []byte
+	VRTData       []byte // GDAL Virtual Raster of the image, with Options.VRTImage
+	Width         int
+	Height        int
+	MinX, MaxY    float64 // For world file
+	PixelSizeX    float64
+	PixelSizeY    float64
+	CRS           int  // EPSG code of MinX/MaxY and the pixel sizes
+	Empty         bool // every pixel of the image is fully transparent
+	
+	// Attribution is the combined credit of all sources that contributed
+	// tiles, as rendered in the corner of the image
+	Attribution string
+	
+	// CoveragePercent is the share of the requested area inside the source's
+	// declared coverage; 100 when Options.Coverage is unset
+	CoveragePercent float64
+	
+	// LatitudeClamped is set when Options.ClampLatitude moved the area
+	// inside the Web Mercator latitude range
+	LatitudeClamped bool
+	
+	// Tile download statistics; FailedTiles is non-empty for partial stitches
+	FailedTiles     []FailedTile
+	SuccessfulTiles int
+	FallbackTiles   int // successful tiles upscaled from a lower zoom (Options.FallbackZoom)
+	TotalTiles      int
+}
+
+// Geotransform returns the georeferencing of the image, for converting
+// between pixels and lat/lon with tile.PixelToLatLon and tile.LatLonToPixel
+func (r *Result) Geotransform() *tile.Geotransform {
+	return &tile.Geotransform{
+		MinX:       r.MinX,
+		MaxY:       r.MaxY,
+		PixelSizeX: r.PixelSizeX,
+		PixelSizeY: r.PixelSizeY,
+		Geographic: r.CRS == CRSWGS84,
+	}
+}
+
+// Footprint returns the extent of the image as a GeoJSON Polygon in WGS84,
+// computed from its georeferencing rather than the requested area
+func (r *Result) Footprint() []byte {
+	return tile.ImageFootprint(r.Geotransform(), r.Width, r.Height)
+}
+
+// ErrEmptyResult is returned when the stitched image contains no data at all
+// and Options.AllowEmpty is not set
+var ErrEmptyResult = errors.New("stitched image is empty: no tile data for the requested area")
+
+// DefaultMaxPixels is the output size limit used when Options.MaxPixels is unset
+const DefaultMaxPixels = 10000 * 10000
+
+// DefaultMaxFailureRatio is the share of tiles that may fail when
+// Options.MaxFailureRatio is unset
+const DefaultMaxFailureRatio = 0.5
+
+// LimitError is returned when a request needs more tiles than allowed
+type LimitError struct {
+	Limit     string // "max_tiles"
+	Requested int64
+	Max       int64
+	Message   string
+}
+
+func (e *LimitError) Error() string {
+	return e.Message
+}
+
+// SizeError is returned when the output image would have more pixels than
+// allowed
+type SizeError struct {
+	Width, Height int
+	MaxPixels     int64
+}
+
+func (e *SizeError) Error() string {
+	return fmt.Sprintf("requested image size too large: %dx%d exceeds %d pixels", e.Width, e.Height, e.MaxPixels)
+}
+
+// CoverageError is returned in strict mode when the requested area isn't
+// fully covered by the tile source
+type CoverageError struct {
+	Percent float64
+	Message string
+}
+
+func (e *CoverageError) Error() string {
+	return e.Message
+}
+
+// ErrAntimeridian is returned when the requested area crosses the ±180° meridian
+var ErrAntimeridian = errors.New("bounding box crosses the antimeridian; split into two requests")
+
+// MaxMercatorLat is the latitude limit of Web Mercator (EPSG:3857); the
+// projection reaches infinity at the poles
+const MaxMercatorLat = 85.05112877980659
+
+// ErrLatitudeRange is returned for Web Mercator requests beyond ±MaxMercatorLat
+// unless Options.ClampLatitude is set
+var ErrLatitudeRange = errors.New("latitude outside the Web Mercator range of ±85.0511°")
+
+// TileError represents errors related to tile downloading
+type TileError struct {
+	Message         string
+	FailedTiles     []FailedTile
+	SuccessfulTiles int
+	TotalTiles      int
+}
+
+func (e *TileError) Error() string {
+	return e.Message
+}
+
+// Causes of tile failures, see FailedTile.Cause
+const (
+	CauseTimeout    = "timeout"     // the request didn't finish in time
+	CauseHTTPStatus = "http_status" // the tile server answered with an error status
+	CauseDecode     = "decode"      // the response isn't a usable image
+	CauseNetwork    = "network"     // the connection failed
+)
+
+// FailedTile represents a single failed tile download
+type FailedTile struct {
+	URL        string // with the token and query credentials such as signature replaced by REDACTED
+	StatusCode *int
+	Error      string
+	Cause      string // one of the Cause constants; empty when unknown
+	
+	// RateLimited is set when the tile server answered 429; RetryAfter is
+	// the wait it asked for, if any
+	RateLimited bool
+	RetryAfter  time.Duration
+}
+
+// StatusError is returned for tiles the tile server answered with an error
+// status other than 429 (see RateLimitError)
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.StatusCode, e.Status)
+}
+
+// TimedOut reports whether most failed tiles timed out, so the tile server is
+// slow rather than broken
+func (e *TileError) TimedOut() bool {
+	timeouts := 0
+	for _, ft := range e.FailedTiles {
+		if ft.Cause == CauseTimeout {
+			timeouts++
+		}
+	}
+	return timeouts > 0 && timeouts*2 > len(e.FailedTiles)
+}
+
+// failureCause classifies the error of a failed tile download
+func failureCause(err error) string {
+	var statusErr *StatusError
+	var rateErr *RateLimitError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return CauseTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return CauseTimeout
+	case errors.As(err, &statusErr), errors.As(err, &rateErr):
+		return CauseHTTPStatus
+	case errors.Is(err, errTileTooLarge):
+		return CauseDecode
+	}
+	return CauseNetwork
+}
+
+// ImageData holds decoded image information
+type ImageData struct {
+	buf    []byte
+	width  int
+	height int
+	depth  int // channels: 1=grayscale, 3=RGB, 4=RGBA
+}
+
+// Stitcher performs tile stitching operations
+type Stitcher struct {
+	client *http.Client
+	
+	// inflight coalesces concurrent downloads of the same tile URL; flights
+	// holds the context each shared download runs with, which is cancelled
+	// only when every caller waiting for it has given up
+	inflight singleflight.Group
+	flightMu sync.Mutex
+	flights  map[string]*flight
+	
+	// proxyClients share the connection pool settings of client but route
+	// through Options.ProxyURL or skip certificate verification, keyed by
+	// the proxy and " insecure" for Options.InsecureSkipVerify. The least
+	// recently used beyond maxProxyClients are dropped.
+	proxyMu      sync.Mutex
+	proxyClients map[string]*list.Element
+	proxyLRU     list.List // of *proxyClient, most recently used first
+}
+
+// maxProxyClients bounds the clients kept for proxies and skipped
+// certificate verification, as every one holds its own idle connections
+const maxProxyClients = 16
+
+// proxyClient is a cached client for the proxy and TLS settings of key
+type proxyClient struct {
+	key    string
+	client *http.Client
+}
+
+// New creates a new stitcher instance with the default connection pool
+func New() *Stitcher {
+	return NewWithTransport(tile.TransportOptions{})
+}
+
+// NewWithTransport creates a stitcher whose downloads use a connection pool
+// tuned by opts. Reuse the stitcher across stitches to keep connections to
+// the tile servers open.
+func NewWithTransport(opts tile.TransportOptions) *Stitcher {
+	return &Stitcher{
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: tile.NewTransport(opts),
+		},
+	}
+}
+
+// NewWithClient creates a stitcher that downloads tiles with client, for
+// callers that bring their own transport for mTLS, instrumentation or
+// recorded responses. The client's Timeout applies to every tile request.
+// Options.ProxyURL and Options.InsecureSkipVerify need its Transport to be
+// an *http.Transport or nil, which uses http.DefaultTransport; a nil client
+// gets the default connection pool of New.
+func NewWithClient(client *http.Client) *Stitcher {
+	if client == nil {
+		return New()
+	}
+	return &Stitcher{client: client}
+}
+
+// clientFor returns the client for requests through proxy, skipping TLS
+// certificate verification if insecure, which is s.client for an empty proxy
+// without insecure. Other clients are created once and kept.
+func (s *Stitcher) clientFor(proxy string, insecure bool) (*http.Client, error) {
+	if proxy == "" && !insecure {
+		return s.client, nil
+	}
+	key := proxy
+	if insecure {
+		key += " insecure"
+	}
+	
+	s.proxyMu.Lock()
+	defer s.proxyMu.Unlock()
+	if elem, ok := s.proxyClients[key]; ok {
+		s.proxyLRU.MoveToFront(elem)
+		return elem.Value.(*proxyClient).client, nil
+	}
+	
+	base := s.client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	transport, ok := base.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("a proxy or InsecureSkipVerify needs an *http.Transport, got %T", s.client.Transport)
+	}
+	transport = transport.Clone()
+	if proxy != "" {
+		proxyURL, err := tile.ParseProxy(proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	if insecure {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.InsecureSkipVerify = true
+	}
+	
+	// Keep the rest of a caller's client, such as its redirect policy
+	client := *s.client
+	client.Transport = transport
+	if s.proxyClients == nil {
+		s.proxyClients = make(map[string]*list.Element)
+	}
+	s.proxyClients[key] = s.proxyLRU.PushFront(&proxyClient{key: key, client: &client})
+	
+	// Requests still using an evicted client finish; only its idle
+	// connections are closed
+	for s.proxyLRU.Len() > maxProxyClients {
+		evicted := s.proxyLRU.Remove(s.proxyLRU.Back()).(*proxyClient)
+		delete(s.proxyClients, evicted.key)
+		evicted.client.CloseIdleConnections()
+	}
+	return &client, nil
+}
+
+// Bounds is the tile and pixel geometry of a stitch, computed without downloading
+type Bounds struct {
+	// Geographic bounds of the output image
+	MinLat, MinLon, MaxLat, MaxLon float64
+	
+	// Inclusive tile ranges at the requested zoom
+	MinTileX, MinTileY, MaxTileX, MaxTileY uint32
+	
+	// Pixel offset of the output's top-left corner into the first tile
+	OffsetX, OffsetY int
+	
+	// Output size in pixels
+	Width, Height int
+	
+	CRS     int
+	project func(lat, lon float64) (float64, float64)
+	
+	// LatitudeClamped is set when ClampLatitude moved the requested area
+	// inside the Web Mercator range
+	LatitudeClamped bool
+}
+
+// TileCount returns the number of tile positions in the stitched grid
+func (b *Bounds) TileCount() int64 {
+	return int64(b.MaxTileX-b.MinTileX+1) * int64(b.MaxTileY-b.MinTileY+1)
+}
+
+// ComputeBounds resolves the tile ranges and output size for opts
+func ComputeBounds(opts *Options) (*Bounds, error) {
+	if opts.TileSize <= 0 {
+		return nil, fmt.Errorf("tile size must be positive, got %d", opts.TileSize)
+	}
+	
+	// Calculate tile coordinates and bounds
+	var x1, y1, x2, y2 uint32
+	var minLat, minLon, maxLat, maxLon float64
+	
+	crs := opts.OutputCRS
+	if crs == 0 {
+		crs = CRSWebMercator
+	}
+	if crs != CRSWebMercator && crs != CRSWGS84 {
+		return nil, fmt.Errorf("unsupported output CRS: EPSG:%d", crs)
+	}
+	
+	// The WGS84 tile scheme is two tiles wide at zoom 0, which addresses like
+	// the Mercator grid one level deeper with only the top half in use
+	gz := opts.Zoom
+	toTile, fromTile, project := latlon2tile, tile2latlon, projectlatlon
+	if crs == CRSWGS84 {
+		gz++
+		toTile, fromTile, project = latlon2tile4326, tile2latlon4326, projectlatlon4326
+	}
+	
+	if opts.Mode == ModeTileRange {
+		return tileRangeBounds(opts, crs, gz, fromTile, project)
+	}
+	
+	// Web Mercator has no finite Y beyond ±MaxMercatorLat
+	clamped := false
+	centerLat, reqMinLat, reqMaxLat := opts.CenterLat, opts.MinLat, opts.MaxLat
+	if crs == CRSWebMercator {
+		lats := []*float64{&reqMinLat, &reqMaxLat}
+		if opts.Mode == ModeCentered {
+			lats = []*float64{&centerLat}
+		}
+		for _, lat := range lats {
+			if math.Abs(*lat) <= MaxMercatorLat {
+				continue
+			}
+			if !opts.ClampLatitude {
+				return nil, fmt.Errorf("%w: %g", ErrLatitudeRange, *lat)
+			}
+			*lat = math.Copysign(MaxMercatorLat, *lat)
+			clamped = true
+		}
+	}
+	
+	var sizeX, sizeY int
+	if opts.Mode == ModeCentered {
+		// Convert centered mode to bounding box
+		cx, cy := toTile(centerLat, opts.CenterLon, 32)
+		var err error
+		sizeX, sizeY, err = centeredSize(opts, centerLat, crs)
+		if err != nil {
+			return nil, err
+		}
+		
+		x1 = cx - pixelSpan(sizeX, opts.TileSize, gz)/2
+		x2 = cx + pixelSpan(sizeX, opts.TileSize, gz)/2
+		y1, y2, err = centeredRows(opts, cy, sizeY, gz, crs)
+		if err != nil {
+			return nil, err
+		}
+		
+		maxLat, minLon = fromTile(x1, y1, 32)
+		minLat, maxLon = fromTile(x2, y2, 32)
+	} else {
+		// Bounding box mode
+		minLat, minLon, maxLat, maxLon = reqMinLat, opts.MinLon, reqMaxLat, opts.MaxLon
+		x1, y1 = toTile(maxLat, minLon, 32)
+		x2, y2 = toTile(minLat, maxLon, 32)
+	}
+	
+	// A west edge east of the east edge means the area wraps around ±180°,
+	// which would otherwise produce a huge or negative-width buffer
+	if x1 > x2 {
+		return nil, ErrAntimeridian
+	}
+	
+	// Convert to actual tile coordinates
+	tx1 := x1 >> (32 - gz)
+	ty1 := y1 >> (32 - gz)
+	tx2 := x2 >> (32 - gz)
+	ty2 := y2 >> (32 - gz)
+	
+	// Calculate pixel offsets and dimensions in the grid of TileSize pixel tiles
+	xa := pixelAt(x1, opts.TileSize, gz) - int(tx1)*opts.TileSize
+	ya := pixelAt(y1, opts.TileSize, gz) - int(ty1)*opts.TileSize
+	
+	width := pixelAt(x2, opts.TileSize, gz) - pixelAt(x1, opts.TileSize, gz)
+	height := pixelAt(y2, opts.TileSize, gz) - pixelAt(y1, opts.TileSize, gz)
+	
+	// Centered output has exactly the requested size; the span rounded to
+	// tile coordinates can otherwise be a pixel short
+	if opts.Mode == ModeCentered && opts.CropMode != CropTiles {
+		width, height = sizeX, sizeY
+		tx2 = tx1 + uint32((xa+width-1)/opts.TileSize)
+		ty2 = ty1 + uint32((ya+height-1)/opts.TileSize)
+	}
+	
+	// Tile-aligned output covers its tiles from corner to corner. An area
+	// ending exactly on a tile edge doesn't reach into the next tile.
+	if opts.CropMode == CropTiles {
+		inTile := uint32(1)<<(32-gz) - 1 // bits of the position within a tile
+		if tx2 > tx1 && x2&inTile == 0 {
+			tx2--
+		}
+		if ty2 > ty1 && y2&inTile == 0 {
+			ty2--
+		}
+		xa, ya = 0, 0
+		width = int(tx2-tx1+1) * opts.TileSize
+		height = int(ty2-ty1+1) * opts.TileSize
+		maxLat, minLon = fromTile(tx1, ty1, gz)
+		minLat, maxLon = fromTile(tx2+1, ty2+1, gz)
+	}
+	
+	return &Bounds{
+		MinLat:   minLat,
+		MinLon:   minLon,
+		MaxLat:   maxLat,
+		MaxLon:   maxLon,
+		MinTileX: tx1,
+		MinTileY: ty1,
+		MaxTileX: tx2,
+		MaxTileY: ty2,
+		OffsetX:  xa,
+		OffsetY:  ya,
+		Width:    width,
+		Height:   height,
+		CRS:      crs,
+		project:  project,
+		
+		LatitudeClamped: clamped,
+	}, nil
+}
+
+// centeredRows returns the top and bottom edge of a window of height pixels
+// centered on cy. A window reaching past the top or bottom of the map is
+// shifted to end at that edge, so centers near the poles still give a valid
+// area.
+func centeredRows(opts *Options, cy uint32, height, gz, crs int) (uint32, uint32, error) {
+	// The WGS84 scheme only uses the top half of its grid
+	rows := int64(1) << 32
+	if crs == CRSWGS84 {
+		rows /= 2
+	}
+	
+	span := int64(uint64(height) << (32 - gz) / uint64(opts.TileSize))
+	if span > rows {
+		return 0, 0, fmt.Errorf("a %d pixel high image is taller than the whole map at zoom %d", height, opts.Zoom)
+	}
+	
+	top := int64(cy) - span/2
+	bottom := int64(cy) + span/2
+	if top < 0 {
+		bottom -= top
+		top = 0
+	}
+	if bottom > rows-1 {
+		top = max(top-(bottom-(rows-1)), 0)
+		bottom = rows - 1
+	}
+	return uint32(top), uint32(bottom), nil
+}
+
+// tileRangeBounds returns the bounds of exactly the tiles of a tile range
+// mode stitch, georeferenced by their extent
+func tileRangeBounds(opts *Options, crs, gz int, fromTile func(x, y uint32, zoom int) (float64, float64), project func(lat, lon float64) (float64, float64)) (*Bounds, error) {
+	if opts.Zoom < 0 || gz > 31 {
+		return nil, fmt.Errorf("zoom %d out of range for a tile range", opts.Zoom)
+	}
+	if opts.MinTileX > opts.MaxTileX || opts.MinTileY > opts.MaxTileY {
+		return nil, fmt.Errorf("tile range %d,%d to %d,%d is empty", opts.MinTileX, opts.MinTileY, opts.MaxTileX, opts.MaxTileY)
+	}
+	
+	// The WGS84 scheme only uses the top half of its grid
+	columns, rows := uint64(1)<<gz, uint64(1)<<gz
+	if crs == CRSWGS84 {
+		rows /= 2
+	}
+	if uint64(opts.MaxTileX) >= columns || uint64(opts.MaxTileY) >= rows {
+		return nil, fmt.Errorf("tile range %d,%d to %d,%d exceeds the %dx%d tiles of zoom %d",
+			opts.MinTileX, opts.MinTileY, opts.MaxTileX, opts.MaxTileY, columns, rows, opts.Zoom)
+	}
+	
+	maxLat, minLon := fromTile(opts.MinTileX, opts.MinTileY, gz)
+	minLat, maxLon := fromTile(opts.MaxTileX+1, opts.MaxTileY+1, gz)
+	return &Bounds{
+		MinLat:   minLat,
+		MinLon:   minLon,
+		MaxLat:   maxLat,
+		MaxLon:   maxLon,
+		MinTileX: opts.MinTileX,
+		MinTileY: opts.MinTileY,
+		MaxTileX: opts.MaxTileX,
+		MaxTileY: opts.MaxTileY,
+		Width:    int(opts.MaxTileX-opts.MinTileX+1) * opts.TileSize,
+		Height:   int(opts.MaxTileY-opts.MinTileY+1) * opts.TileSize,
+		CRS:      crs,
+		project:  project,
+	}, nil
+}
+
+// CheckLimits returns a LimitError when the stitch described by bounds needs
+// more tiles than opts allows, and a SizeError when it needs more pixels
+func CheckLimits(opts *Options, bounds *Bounds) error {
+	// Tile count first: it explodes fastest with zoom and tells users what to lower
+	tileCount := bounds.TileCount()
+	if opts.MaxTiles > 0 && tileCount > int64(opts.MaxTiles) {
+		return &LimitError{
+			Limit:     "max_tiles",
+			Requested: tileCount,
+			Max:       int64(opts.MaxTiles),
+			Message:   fmt.Sprintf("requested area needs %d tiles, more than the limit of %d; use a lower zoom", tileCount, opts.MaxTiles),
+		}
+	}
+	
+	maxPixels := opts.MaxPixels
+	if maxPixels <= 0 {
+		maxPixels = DefaultMaxPixels
+	}
+	if int64(bounds.Width)*int64(bounds.Height) > maxPixels {
+		return &SizeError{Width: bounds.Width, Height: bounds.Height, MaxPixels: maxPixels}
+	}
+	
+	return nil
+}
+
+// Stitch performs the tile stitching operation
+func (s *Stitcher) Stitch(ctx context.Context, opts *Options) (*Result, error) {
+	switch strings.ToUpper(opts.RequestMethod) {
+	case "", http.MethodGet, http.MethodPost:
+	default:
+		return nil, fmt.Errorf("unsupported request method: %s", opts.RequestMethod)
+	}
+	if opts.RequestBody != "" && !strings.EqualFold(opts.RequestMethod, http.MethodPost) {
+		return nil, fmt.Errorf("a request body requires method POST")
+	}
+	if opts.BasicAuth != nil && opts.BearerToken != "" {
+		return nil, fmt.Errorf("basic auth and a bearer token can't be combined")
+	}
+	if opts.ProxyURL != "" {
+		if _, err := tile.ParseProxy(opts.ProxyURL); err != nil {
+			return nil, err
+		}
+	}
+	if ratio := opts.MaxFailureRatio; ratio != nil && (*ratio < 0 || *ratio > 1) {
+		return nil, fmt.Errorf("max failure ratio %g is outside 0 to 1", *ratio)
+	}
+	if opts.MaxFailedTiles != nil && *opts.MaxFailedTiles < 0 {
+		return nil, fmt.Errorf("max failed tiles %d is negative", *opts.MaxFailedTiles)
+	}
+	for _, urlTemplate := range opts.TileURLs {
+		if err := tile.ValidateTemplate(urlTemplate); err != nil {
+			return nil, err
+		}
+	}
+	for _, layer := range opts.Layers {
+		if err := tile.ValidateTemplate(layer.URL); err != nil {
+			return nil, err
+		}
+	}
+	if err := CheckHosts(opts); err != nil {
+		return nil, err
+	}
+	
+	bounds, err := ComputeBounds(opts)
+	if err != nil {
+		return nil, err
+	}
+	
+	minLat, minLon, maxLat, maxLon := bounds.MinLat, bounds.MinLon, bounds.MaxLat, bounds.MaxLon
+	tx1, ty1, tx2, ty2 := bounds.MinTileX, bounds.MinTileY, bounds.MaxTileX, bounds.MaxTileY
+	xa, ya := bounds.OffsetX, bounds.OffsetY
+	width, height := bounds.Width, bounds.Height
+	crs, project := bounds.CRS, bounds.project
+	
+	// Check size limits before allocating or downloading anything
+	if err := CheckLimits(opts, bounds); err != nil {
+		return nil, err
+	}
+	tileCount := bounds.TileCount()
+	
+	// Tiles of another scheme are stitched in their own grid first and
+	// reprojected into the output below
+	grid, gridOpts := bounds, opts
+	if reprojects(opts, crs) {
+		if gridOpts, grid, err = sourceGrid(opts, bounds); err != nil {
+			return nil, err
+		}
+		tileCount = grid.TileCount()
+	}
+	
+	// Check the area against the source's declared coverage before downloading
+	coverage := 100.0
+	if opts.Coverage != nil {
+		coverage = coveragePercent(opts.Coverage, opts.Zoom, fallbackLevels(opts), minLat, minLon, maxLat, maxLon, project)
+		if coverage < 100 && opts.StrictCoverage {
+			return nil, &CoverageError{
+				Percent: coverage,
+				Message: fmt.Sprintf("tile source covers only %.1f%% of the requested area at zoom %d", coverage, opts.Zoom),
+			}
+		}
+	}
+	
+	// MBTiles stores the tiles themselves instead of one composited image
+	if opts.OutputFormat == FormatMBTiles {
+		if crs != CRSWebMercator {
+			return nil, fmt.Errorf("MBTiles output requires EPSG:%d", CRSWebMercator)
+		}
+		return s.exportMBTiles(ctx, opts, tx1, ty1, tx2, ty2, [4]float64{minLon, minLat, maxLon, maxLat})
+	}
+	
+	// Project coordinates for world file
+	minX, minY := project(minLat, minLon)
+	maxX, maxY := project(maxLat, maxLon)
+	
+	px := (maxX - minX) / float64(width)
+	py := math.Abs(maxY-minY) / float64(height)
+	
+	// Allocate output buffer
+	buf := make([]byte, width*height*4)
+	
+	// Track tile download statistics
+	var failedTiles []FailedTile
+	successfulTiles := 0
+	totalTiles := int(tileCount) * opts.SourcesPerTile()
+	
+	// Download and stitch tiles
+	positions := fetchOrder(grid.MinTileX, grid.MinTileY, grid.MaxTileX, grid.MaxTileY, opts.FetchOrder)
+	gridBuf := buf
+	if grid != bounds {
+		gridBuf = make([]byte, grid.Width*grid.Height*4)
+	}
+	
+	outcomes, err := s.downloadPositions(ctx, gridOpts, positions, func(ctx context.Context, pos tilePosition) (positionOutcome, error) {
+		xoff := int(pos.x-grid.MinTileX)*opts.TileSize - grid.OffsetX
+		yoff := int(pos.y-grid.MinTileY)*opts.TileSize - grid.OffsetY
+		return s.stitchPosition(ctx, gridOpts, pos, gridBuf, xoff, yoff, grid.Width, grid.Height)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if grid != bounds {
+		img := &ImageData{buf: gridBuf, width: grid.Width, height: grid.Height, depth: 4}
+		reproject(img, grid, buf, bounds, opts.Resampling)
+	}
+	
+	contributed := make(map[int]bool)
+	fallbackTiles := 0
+	for _, outcome := range outcomes {
+		failedTiles = append(failedTiles, outcome.failed...)
+		successfulTiles += outcome.successful
+		fallbackTiles += outcome.fallback
+		for _, layer := range outcome.contributed {
+			contributed[layer] = true
+		}
+	}
+	
+	if err := checkTileFailures(opts, failedTiles, successfulTiles, totalTiles); err != nil {
+		return nil, err
+	}
+	
+	// Distinguish "no data for this area" from a successful stitch
+	empty := isEmpty(buf)
+	if empty && !opts.AllowEmpty {
+		return nil, ErrEmptyResult
+	}
+	
+	// Compositing the finished image over the background is the same as
+	// starting from it, but leaves the emptiness check above meaningful
+	if opts.BackgroundColor.A > 0 {
+		s.applyBackground(buf, opts.BackgroundColor)
+	}
+	
+	if opts.DrawTileGrid {
+		tile.DrawGrid(buf, width, height, tile.Grid{
+			TileSize: opts.TileSize,
+			OffsetX:  xa,
+			OffsetY:  ya,
+			Zoom:     opts.Zoom,
+			MinTileX: tx1,
+			MinTileY: ty1,
+			Color:    opts.GridColor,
+			Labels:   opts.GridLabels,
+		})
+	}
+	
+	// Shrink oversized output, after the grid and before the attribution so
+	// the credit stays legible
+	if opts.MaxDimension > 0 && max(width, height) > opts.MaxDimension {
+		newWidth, newHeight := fitDimension(width, height, opts.MaxDimension)
+		img := &ImageData{buf: buf, width: width, height: height, depth: 4}
+		buf = resample(img, image.Rect(0, 0, width, height), newWidth, newHeight, opts.Resampling).buf
+		width, height = newWidth, newHeight
+		px = (maxX - minX) / float64(width)
+		py = math.Abs(maxY-minY) / float64(height)
+	}
+	
+	// Credit every source that ended up in the image
+	attribution := combinedAttribution(opts, contributed)
+	if attribution != "" {
+		drawAttribution(buf, width, height, attribution)
+	}
+	
+	// Map decorations go on last, at the final pixel size
+	if opts.DrawScaleBar {
+		gt := &tile.Geotransform{MinX: minX, MaxY: maxY, PixelSizeX: px, PixelSizeY: py, Geographic: crs == CRSWGS84}
+		lat, _ := tile.PixelToLatLon(width/2, height/2, gt)
+		tile.DrawScaleBar(buf, width, height, tile.GroundResolution(px, lat, gt.Geographic))
+	}
+	if opts.DrawNorthArrow {
+		tile.DrawNorthArrow(buf, width, height)
+	}
+	
+	// Encode output image
+	var imageData []byte
+	
+	switch opts.OutputFormat {
+	case FormatPNG:
+		imageData, err = s.encodePNG(buf, width, height)
+	case FormatGeoTIFF:
+		return nil, fmt.Errorf("GeoTIFF output not yet implemented")
+	default:
+		imageData, err = s.encodePNG(buf, width, height)
+	}
+	
+	if err == nil && opts.DPI > 0 {
+		imageData, err = tile.AddPNGResolution(imageData, opts.DPI)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode output image: %v", err)
+	}
+	
+	// Catch corrupt encodes before they reach the client
+	if opts.VerifyOutput {
+		if err := tile.VerifyImage(imageData, width, height); err != nil {
+			return nil, err
+		}
+	}
+	
+	result := &Result{
+		ImageData:  imageData,
+		Width:      width,
+		Height:     height,
+		MinX:       minX,
+		MaxY:       maxY,
+		PixelSizeX: px,
+		PixelSizeY: py,
+		CRS:        crs,
+		Empty:      empty,
+		
+		Attribution:     attribution,
+		CoveragePercent: coverage,
+		LatitudeClamped: bounds.LatitudeClamped,
+		
+		FailedTiles:     failedTiles,
+		SuccessfulTiles: successfulTiles,
+		FallbackTiles:   fallbackTiles,
+		TotalTiles:      totalTiles,
+	}
+	
+	// Generate world file if requested
+	if opts.GenerateWorldFile {
+		result.WorldFileData = s.generateWorldFile(px, py, minX, maxY)
+	}
+	if opts.VRTImage != "" {
+		result.VRTData = tile.VRT(opts.VRTImage, width, height, px, py, minX, maxY, crs)
+	}
+	
+	return result, nil
+}
+
+// fitDimension returns the size of a width x height image scaled down so its
+// longer side is limit pixels, keeping the aspect ratio
+func fitDimension(width, height, limit int) (int, int) {
+	scale := float64(limit) / float64(max(width, height))
+	return max(1, int(math.Round(float64(width)*scale))), max(1, int(math.Round(float64(height)*scale)))
+}
+
+// checkTileFailures returns a TileError when no tile could be downloaded or
+// more failed than opts.MaxFailureRatio or opts.MaxFailedTiles allow
+func checkTileFailures(opts *Options, failedTiles []FailedTile, successfulTiles, totalTiles int) error {
+	// Check if we have enough successful tiles
+	if successfulTiles == 0 {
+		return &TileError{
+			Message:         "No tiles could be downloaded successfully",
+			FailedTiles:     failedTiles,
+			SuccessfulTiles: successfulTiles,
+			TotalTiles:      totalTiles,
+		}
+	}
+	
+	// Fail when more than the allowed share of tiles failed
+	ratio := DefaultMaxFailureRatio
+	if opts.MaxFailureRatio != nil {
+		ratio = *opts.MaxFailureRatio
+	}
+	if float64(len(failedTiles)) > ratio*float64(totalTiles) {
+		return &TileError{
+			Message:         fmt.Sprintf("Too many tile download failures: %d/%d failed", len(failedTiles), totalTiles),
+			FailedTiles:     failedTiles,
+			SuccessfulTiles: successfulTiles,
+			TotalTiles:      totalTiles,
+		}
+	}
+	
+	// ... or more than the allowed number
+	if opts.MaxFailedTiles != nil && len(failedTiles) > *opts.MaxFailedTiles {
+		return &TileError{
+			Message:         fmt.Sprintf("Too many tile download failures: %d/%d failed, at most %d allowed", len(failedTiles), totalTiles, *opts.MaxFailedTiles),
+			FailedTiles:     failedTiles,
+			SuccessfulTiles: successfulTiles,
+			TotalTiles:      totalTiles,
+		}
+	}
+	
+	return nil
+}
+
+// coveragePercent returns the share of the area inside the source coverage,
+// measured in projected units. Zoom levels outside the source range have none,
+// except the fallback levels above it, which are filled from its highest one.
+func coveragePercent(c *SourceCoverage, zoom, fallback int, minLat, minLon, maxLat, maxLon float64, project func(lat, lon float64) (float64, float64)) float64 {
+	if zoom < c.MinZoom || zoom > c.MaxZoom+fallback {
+		return 0
+	}
+	
+	minX, minY := project(minLat, minLon)
+	maxX, maxY := project(maxLat, maxLon)
+	area := (maxX - minX) * (maxY - minY)
+	if area <= 0 {
+		return 100
+	}
+	
+	cMinX, cMinY := project(c.MinLat, c.MinLon)
+	cMaxX, cMaxY := project(c.MaxLat, c.MaxLon)
+	overlapX := math.Min(maxX, cMaxX) - math.Max(minX, cMinX)
+	overlapY := math.Min(maxY, cMaxY) - math.Max(minY, cMinY)
+	if overlapX <= 0 || overlapY <= 0 {
+		return 0
+	}
+	
+	return math.Min(100, overlapX*overlapY/area*100)
+}
+
+// tilePosition is a single tile address in the stitched grid
+type tilePosition struct {
+	x, y uint32
+}
+
+// fetchOrder returns the positions of the inclusive tile range in the order
+// they are downloaded. Spiral order sorts them by distance from the center of
+// the range, nearest first; equally distant tiles keep their raster order.
+func fetchOrder(tx1, ty1, tx2, ty2 uint32, order int) []tilePosition {
+	var positions []tilePosition
+	for ty := ty1; ty <= ty2; ty++ {
+		for tx := tx1; tx <= tx2; tx++ {
+			positions = append(positions, tilePosition{x: tx, y: ty})
+		}
+	}
+	if order != FetchOrderSpiral {
+		return positions
+	}
+	
+	cx := (float64(tx1) + float64(tx2)) / 2
+	cy := (float64(ty1) + float64(ty2)) / 2
+	distance := func(pos tilePosition) float64 {
+		return math.Hypot(float64(pos.x)-cx, float64(pos.y)-cy)
+	}
+	sort.SliceStable(positions, func(i, j int) bool {
+		return distance(positions[i]) < distance(positions[j])
+	})
+	return positions
+}
+
+// positionOutcome holds the download statistics for one tile position
+type positionOutcome struct {
+	failed      []FailedTile
+	successful  int
+	fallback    int   // tiles filled from a lower zoom level
+	contributed []int // indexes of the overlay layers (or TileURLs) that supplied a tile
+}
+
+// downloadPositions runs fn for every position on a pool of opts.Concurrency
+// workers. With opts.RampUp set, workers start one after another spread over
+// the ramp period instead of all at once, to avoid an initial burst against
+// the tile server. Outcomes are returned in position order.
+func (s *Stitcher) downloadPositions(parent context.Context, opts *Options, positions []tilePosition, fn func(context.Context, tilePosition) (positionOutcome, error)) ([]positionOutcome, error) {
+	workers := opts.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(positions) {
+		workers = len(positions)
+	}
+	
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	
+	outcomes := make([]positionOutcome, len(positions))
+	jobs := make(chan int)
+	errs := make(chan error, workers)
+	
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			
+			if delay := opts.RampUp * time.Duration(w) / time.Duration(workers); delay > 0 {
+				timer := time.NewTimer(delay)
+				defer timer.Stop()
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					return
+				}
+			}
+			
+			for i := range jobs {
+				outcome, err := fn(ctx, positions[i])
+				if err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+				outcomes[i] = outcome
+			}
+		}(w)
+	}
+	
+feed:
+	for i := range positions {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	
+	select {
+	case err := <-errs:
+		return nil, err
+	default:
+	}
+	if err := parent.Err(); err != nil {
+		return nil, err
+	}
+	
+	return outcomes, nil
+}
+
+// stitchPosition downloads the tile(s) for one position and draws them into buf.
+// It only returns an error when the context is cancelled.
+func (s *Stitcher) stitchPosition(ctx context.Context, opts *Options, pos tilePosition, buf []byte, xoff, yoff, width, height int) (positionOutcome, error) {
+	var outcome positionOutcome
+	
+	if opts.LayerMode == LayerModeOverlay {
+		// Composite every layer; a missing layer is skipped rather than failing the position
+		for i, layer := range opts.overlayLayers() {
+			if err := ctx.Err(); err != nil {
+				return outcome, err
+			}
+			if !opts.layerAtZoom(layer) {
+				continue
+			}
+			
+			req := s.newTileRequest(opts, layer.URL, pos)
+			img, failed := s.fetchTile(ctx, req, opts)
+			if opts.OnTile != nil {
+				opts.OnTile(req.displayURL(), failed == nil)
+			}
+			if failed != nil && opts.FallbackZoom {
+				if img = s.fetchFallback(ctx, opts, layer.URL, pos); img != nil {
+					failed = nil
+					outcome.fallback++
+				}
+			}
+			if failed != nil {
+				outcome.failed = append(outcome.failed, *failed)
+				continue
+			}
+			
+			if img != nil {
+				s.overlayTileOnBuffer(img, buf, xoff, yoff, width, height, layer.Opacity)
+				outcome.contributed = append(outcome.contributed, i)
+			}
+			outcome.successful++
+		}
+		return outcome, nil
+	}
+	
+	for i, urlTemplate := range opts.TileURLs {
+		req := s.newTileRequest(opts, urlTemplate, pos)
+		
+		// Check context cancellation
+		if err := ctx.Err(); err != nil {
+			return outcome, err
+		}
+		
+		img, failed := s.fetchTile(ctx, req, opts)
+		if opts.OnTile != nil {
+			opts.OnTile(req.displayURL(), failed == nil)
+		}
+		if failed != nil {
+			outcome.failed = append(outcome.failed, *failed)
+			continue
+		}
+		
+		// Copy tile data to output buffer
+		if img != nil {
+			s.copyTileToBuffer(img, buf, xoff, yoff, width, height)
+			outcome.contributed = append(outcome.contributed, i)
+		}
+		outcome.successful++
+		break // Successfully processed this tile position
+	}
+	
+	// Fill the hole from a lower zoom level of the first source that has one
+	if outcome.successful == 0 && opts.FallbackZoom {
+		for i, urlTemplate := range opts.TileURLs {
+			if img := s.fetchFallback(ctx, opts, urlTemplate, pos); img != nil {
+				s.copyTileToBuffer(img, buf, xoff, yoff, width, height)
+				outcome.failed = nil
+				outcome.contributed = append(outcome.contributed, i)
+				outcome.successful++
+				outcome.fallback++
+				break
+			}
+		}
+	}
+	
+	return outcome, nil
+}
+
+// fetchTile downloads and decodes a single tile, describing any failure as a FailedTile.
+// A nil image without failure means the server reported an empty tile.
+func (s *Stitcher) fetchTile(ctx context.Context, req tileRequest, opts *Options) (*ImageData, *FailedTile) {
+	img, failed := s.loadTile(ctx, req, opts)
+	if failed != nil && opts.Logger != nil {
+		attrs := []any{"url", failed.URL, "error", failed.Error}
+		if failed.StatusCode != nil {
+			attrs = append(attrs, "status", *failed.StatusCode)
+		}
+		if failed.RateLimited {
+			attrs = append(attrs, "rate_limited", true, "retry_after", failed.RetryAfter)
+		}
+		opts.Logger.WarnContext(ctx, "tile failed", attrs...)
+	}
+	return img, failed
+}
+
+// loadTile is fetchTile without logging
+func (s *Stitcher) loadTile(ctx context.Context, req tileRequest, opts *Options) (*ImageData, *FailedTile) {
+	url := req.displayURL()
+	data, err := s.downloadTile(ctx, req)
+	if err != nil {
+		failed := &FailedTile{
+			URL:   url,
+			Error: err.Error(),
+			Cause: failureCause(err),
+		}
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) {
+			failed.StatusCode = &statusErr.StatusCode
+		}
+		var rateErr *RateLimitError
+		if errors.As(err, &rateErr) {
+			failed.StatusCode = &rateErr.StatusCode
+			failed.RateLimited = true
+			failed.RetryAfter = rateErr.RetryAfter
+		}
+		return nil, failed
+	}
+	
+	if len(data) == 0 {
+		return nil, nil
+	}
+	
+	img, err := s.decodeImage(data)
+	if err != nil {
+		// Tell error pages and truncated bodies apart from broken images
+		if notImage := sniffNotImage(data); notImage != nil {
+			return nil, &FailedTile{URL: url, Error: notImage.Error(), Cause: CauseDecode}
+		}
+		return nil, &FailedTile{
+			URL:   url,
+			Error: fmt.Sprintf("decode error: %v", err),
+			Cause: CauseDecode,
+		}
+	}
+	
+	if img.height != opts.TileSize || img.width != opts.TileSize {
+		// Some servers answer 200 with a tiny placeholder where they have
+		// no data, instead of 204 or 404
+		if opts.UndersizedAsEmpty && img.width < opts.TileSize && img.height < opts.TileSize {
+			return nil, nil
+		}
+		if opts.AutoResample {
+			return resample(img, image.Rect(0, 0, img.width, img.height), opts.TileSize, opts.TileSize, opts.Resampling), nil
+		}
+		return nil, &FailedTile{
+			URL:   url,
+			Error: fmt.Sprintf("wrong tile size: got %dx%d, expected %dx%d", img.width, img.height, opts.TileSize, opts.TileSize),
+			Cause: CauseDecode,
+		}
+	}
+	
+	return img, nil
+}
+
+// BasicAuth holds HTTP Basic credentials for tile requests
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+// tileRequest is a single resolved tile request
+type tileRequest struct {
+	url      string
+	unsigned string // url before Options.Signer added the signature
+	token    string // Options.Token, kept out of URLs and errors shown outside the download
+	method   string // empty means GET
+	body     string
+	headers  map[string]string
+	proxy    string // empty uses the environment's proxy
+	insecure bool   // skip TLS certificate verification
+	hosts    tile.HostPolicy
+	
+	rateLimitRetries int
+	jitter           time.Duration
+	timeout          time.Duration
+}
+
+// key identifies requests that can share one download. Headers are part of
+// it, so requests with different credentials never share a response. It uses
+// the unsigned URL, as signatures differ with the time of each request.
+func (r tileRequest) key() string {
+	names := make([]string, 0, len(r.headers))
+	for name := range r.headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	
+	var key strings.Builder
+	key.WriteString(r.method + " " + r.unsigned + " " + r.proxy + " " + strconv.FormatBool(r.insecure) + " " + fmt.Sprint(r.hosts) + "\n" + r.body)
+	for _, name := range names {
+		key.WriteString("\n" + name + ": " + r.headers[name])
+	}
+	return key.String()
+}
+
+// displayURL returns url for logs, progress callbacks and FailedTile, without
+// the token or credentials such as the signature in its query
+func (r tileRequest) displayURL() string {
+	return r.redact(r.url)
 }
 
-// Result contains the stitching result
-type Result struct {
-	ImageData     []byte
-	WorldFileData []byte
-	Width         int
-	Height        int
-	MinX, MaxY    float64 // For world file
-	PixelSizeX    float64
-	PixelSizeY    float64
+// redact removes the token and the credentials in the query of url from s
+func (r tileRequest) redact(s string) string {
+	s = strings.ReplaceAll(s, r.url, tile.RedactURL(r.url))
+	if r.token != "" {
+		s = strings.NewReplacer(r.token, "REDACTED", neturl.QueryEscape(r.token), "REDACTED").Replace(s)
+	}
+	return s
 }
 
-// TileError represents errors related to tile downloading
-type TileError struct {
-	Message         string
-	FailedTiles     []FailedTile
-	SuccessfulTiles int
-	TotalTiles      int
+// redactError returns err with its message passed through redact. The
+// original error stays reachable through errors.As.
+func (r tileRequest) redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := r.redact(err.Error())
+	if msg == err.Error() {
+		return err
+	}
+	return &redactedError{err: err, msg: msg}
 }
 
-func (e *TileError) Error() string {
-	return e.Message
+// redactedError is an error with credentials removed from its message
+type redactedError struct {
+	err error
+	msg string
 }
 
-// FailedTile represents a single failed tile download
-type FailedTile struct {
-	URL        string
-	StatusCode *int
-	Error      string
+func (e *redactedError) Error() string {
+	return e.msg
 }
 
-// ImageData holds decoded image information
-type ImageData struct {
-	buf    []byte
-	width  int
-	height int
-	depth  int // channels: 1=grayscale, 3=RGB, 4=RGBA
+func (e *redactedError) Unwrap() error {
+	return e.err
 }
 
-// Stitcher performs tile stitching operations
-type Stitcher struct {
-	client *http.Client
+// newTileRequest resolves a URL template (and body template) for a tile position
+func (s *Stitcher) newTileRequest(opts *Options, template string, pos tilePosition) tileRequest {
+	return s.newTileRequestAt(opts, template, opts.Zoom, pos)
 }
 
-// New creates a new stitcher instance
-func New() *Stitcher {
-	return &Stitcher{
-		client: &http.Client{
-			Timeout: 30 * time.Second,
-		},
+// newTileRequestAt resolves a tile request at a zoom level other than opts.Zoom
+func (s *Stitcher) newTileRequestAt(opts *Options, template string, zoom int, pos tilePosition) tileRequest {
+	params := tileParams(opts)
+	url := tileURL(opts, template, zoom, pos)
+	req := tileRequest{
+		url:      url,
+		unsigned: url,
+		token:    opts.Token,
+		method:   strings.ToUpper(opts.RequestMethod),
+		headers:  RequestHeaders(opts),
+		proxy:    opts.ProxyURL,
+		insecure: opts.InsecureSkipVerify,
+		hosts:    opts.HostPolicy,
+		
+		rateLimitRetries: opts.RateLimitRetries,
+		jitter:           opts.RequestJitter,
+		timeout:          opts.TileTimeout,
+	}
+	if opts.Signer != nil {
+		req.url = opts.Signer(url, time.Now())
 	}
+	if opts.RequestBody != "" {
+		tokens := templateTokens(opts.OutputCRS, zoom, pos.x, pos.y, opts.TileSize, params)
+		req.body = strings.NewReplacer(tokens...).Replace(opts.RequestBody)
+	}
+	return req
 }
 
-// Stitch performs the tile stitching operation
-func (s *Stitcher) Stitch(ctx context.Context, opts *Options) (*Result, error) {
-	// Calculate tile coordinates and bounds
-	var x1, y1, x2, y2 uint32
-	var minLat, minLon, maxLat, maxLon float64
-	
-	if opts.Mode == ModeCentered {
-		// Convert centered mode to bounding box
-		cx, cy := latlon2tile(opts.CenterLat, opts.CenterLon, 32)
-		
-		x1 = cx - uint32((opts.Width<<(32-(opts.Zoom+8)))/2)
-		y1 = cy - uint32((opts.Height<<(32-(opts.Zoom+8)))/2)
-		x2 = cx + uint32((opts.Width<<(32-(opts.Zoom+8)))/2)
-		y2 = cy + uint32((opts.Height<<(32-(opts.Zoom+8)))/2)
-		
-		maxLat, minLon = tile2latlon(x1, y1, 32)
-		minLat, maxLon = tile2latlon(x2, y2, 32)
-	} else {
-		// Bounding box mode
-		minLat, minLon, maxLat, maxLon = opts.MinLat, opts.MinLon, opts.MaxLat, opts.MaxLon
-		x1, y1 = latlon2tile(maxLat, minLon, 32)
-		x2, y2 = latlon2tile(minLat, maxLon, 32)
+// tileParams returns the URL parameters of opts, with the Token as {token}
+func tileParams(opts *Options) map[string]string {
+	if opts.Token == "" {
+		return opts.URLParams
 	}
-	
-	// Convert to actual tile coordinates
-	tx1 := x1 >> (32 - opts.Zoom)
-	ty1 := y1 >> (32 - opts.Zoom)
-	tx2 := x2 >> (32 - opts.Zoom)
-	ty2 := y2 >> (32 - opts.Zoom)
-	
-	// Calculate pixel offsets and dimensions
-	xa := int(((x1 >> (32 - (opts.Zoom + 8))) & 0xFF) * uint32(opts.TileSize) / 256)
-	ya := int(((y1 >> (32 - (opts.Zoom + 8))) & 0xFF) * uint32(opts.TileSize) / 256)
-	
-	width := int(((x2 >> (32 - (opts.Zoom + 8))) - (x1 >> (32 - (opts.Zoom + 8)))) * uint32(opts.TileSize) / 256)
-	height := int(((y2 >> (32 - (opts.Zoom + 8))) - (y1 >> (32 - (opts.Zoom + 8)))) * uint32(opts.TileSize) / 256)
-	
-	// Check size limits
-	dim := int64(width) * int64(height)
-	if dim > 10000*10000 {
-		return nil, fmt.Errorf("requested image size too large: %dx%d", width, height)
+	params := make(map[string]string, len(opts.URLParams)+1)
+	for name, value := range opts.URLParams {
+		params[name] = value
+	}
+	params["token"] = opts.Token
+	return params
+}
+
+// tileURL expands a URL template for a tile position, before signing
+func tileURL(opts *Options, template string, zoom int, pos tilePosition) string {
+	if n := uint32(len(opts.Subdomains)); n > 0 {
+		template = strings.ReplaceAll(template, "{s}", opts.Subdomains[(pos.x+pos.y)%n])
+	}
+	return buildURL(template, opts.OutputCRS, zoom, pos.x, pos.y, opts.TileSize, tileParams(opts))
+}
+
+// RequestHeaders returns the headers for tile requests: opts.Headers with the
+// Authorization from BasicAuth or BearerToken, the UserAgent, Referer and
+// Origin, which replace the same headers in Headers
+func RequestHeaders(opts *Options) map[string]string {
+	overrides := make(map[string]string)
+	switch {
+	case opts.BasicAuth != nil:
+		credentials := opts.BasicAuth.Username + ":" + opts.BasicAuth.Password
+		overrides["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	case opts.BearerToken != "":
+		overrides["Authorization"] = "Bearer " + opts.BearerToken
+	}
+	if opts.UserAgent != "" {
+		overrides["User-Agent"] = opts.UserAgent
+	}
+	if opts.Referer != "" {
+		overrides["Referer"] = opts.Referer
+	}
+	if opts.Origin != "" {
+		overrides["Origin"] = opts.Origin
+	}
+	if len(overrides) == 0 {
+		return opts.Headers
 	}
 	
-	// Project coordinates for world file
-	minX, minY := projectlatlon(minLat, minLon)
-	maxX, maxY := projectlatlon(maxLat, maxLon)
-	
-	px := (maxX - minX) / float64(width)
-	py := math.Abs(maxY-minY) / float64(height)
+	headers := make(map[string]string, len(opts.Headers)+len(overrides))
+	for name, value := range opts.Headers {
+		if _, ok := overrides[http.CanonicalHeaderKey(name)]; !ok {
+			headers[name] = value
+		}
+	}
+	for name, value := range overrides {
+		headers[name] = value
+	}
+	return headers
+}
+
+// tileResponse is a downloaded tile body and the content type it was sent with
+type tileResponse struct {
+	data        []byte
+	contentType string
+}
+
+// downloadTile downloads a single tile. Concurrent calls for the same request
+// share one HTTP call; the returned data must not be modified.
+func (s *Stitcher) downloadTile(ctx context.Context, req tileRequest) ([]byte, error) {
+	resp, err := s.download(ctx, req)
+	return resp.data, err
+}
+
+// download is downloadTile keeping the content type
+func (s *Stitcher) download(ctx context.Context, req tileRequest) (tileResponse, error) {
+	if err := req.hosts.CheckURL(req.url); err != nil {
+		return tileResponse{}, err
+	}
 	
-	// Allocate output buffer
-	buf := make([]byte, width*height*4)
+	key := req.key()
+	f := s.joinFlight(ctx, key)
+	defer s.leaveFlight(key, f)
 	
-	// Track tile download statistics
-	var failedTiles []FailedTile
-	successfulTiles := 0
-	totalTiles := int((tx2-tx1+1) * (ty2-ty1+1) * uint32(len(opts.TileURLs)))
+	ch := s.inflight.DoChan(key, func() (interface{}, error) {
+		// Redacted here, as callers sharing the download have their own signature
+		resp, err := s.fetchWithRetry(f.ctx, req)
+		return resp, req.redactError(err)
+	})
 	
-	// Download and stitch tiles
-	for ty := ty1; ty <= ty2; ty++ {
-		for tx := tx1; tx <= tx2; tx++ {
-			xoff := int(tx-tx1)*opts.TileSize - xa
-			yoff := int(ty-ty1)*opts.TileSize - ya
-			
-			tileProcessed := false
-			for _, urlTemplate := range opts.TileURLs {
-				url := s.buildURL(urlTemplate, opts.Zoom, tx, ty)
-				
-				// Check context cancellation
-				select {
-				case <-ctx.Done():
-					return nil, ctx.Err()
-				default:
-				}
-				
-				data, err := s.downloadTile(ctx, url, opts.Headers)
-				if err != nil {
-					failedTiles = append(failedTiles, FailedTile{
-						URL:   url,
-						Error: err.Error(),
-					})
-					continue
-				}
-				
-				img, err := s.decodeImage(data)
-				if err != nil {
-					failedTiles = append(failedTiles, FailedTile{
-						URL:   url,
-						Error: fmt.Sprintf("decode error: %v", err),
-					})
-					continue
-				}
-				
-				if img.height != opts.TileSize || img.width != opts.TileSize {
-					failedTiles = append(failedTiles, FailedTile{
-						URL:   url,
-						Error: fmt.Sprintf("wrong tile size: got %dx%d, expected %dx%d", img.width, img.height, opts.TileSize, opts.TileSize),
-					})
-					continue
-				}
-				
-				// Copy tile data to output buffer
-				s.copyTileToBuffer(img, buf, xoff, yoff, width, height)
-				successfulTiles++
-				tileProcessed = true
-				break // Successfully processed this tile position
-			}
-			
-			if !tileProcessed {
-				// All URLs failed for this tile position
-				continue
-			}
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return tileResponse{}, res.Err
 		}
+		return res.Val.(tileResponse), nil
+	case <-ctx.Done():
+		return tileResponse{}, ctx.Err()
 	}
+}
+
+// flight is a download shared by the callers waiting for the same tile
+type flight struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int
+}
+
+// joinFlight registers a caller waiting for the download of key. The
+// download runs detached from the context of whichever caller started it, so
+// that caller giving up doesn't fail the others.
+func (s *Stitcher) joinFlight(ctx context.Context, key string) *flight {
+	s.flightMu.Lock()
+	defer s.flightMu.Unlock()
 	
-	// Check if we have enough successful tiles
-	if successfulTiles == 0 {
-		return nil, &TileError{
-			Message:         "No tiles could be downloaded successfully",
-			FailedTiles:     failedTiles,
-			SuccessfulTiles: successfulTiles,
-			TotalTiles:      totalTiles,
-		}
+	if s.flights == nil {
+		s.flights = make(map[string]*flight)
+	}
+	f := s.flights[key]
+	if f == nil {
+		f = &flight{}
+		f.ctx, f.cancel = context.WithCancel(context.WithoutCancel(ctx))
+		s.flights[key] = f
 	}
+	f.waiters++
+	return f
+}
+
+// leaveFlight unregisters a caller of joinFlight, stopping the download when
+// nobody waits for it anymore
+func (s *Stitcher) leaveFlight(key string, f *flight) {
+	s.flightMu.Lock()
+	defer s.flightMu.Unlock()
 	
-	// If more than 50% of tiles failed, return a tile error
-	if len(failedTiles) > totalTiles/2 {
-		return nil, &TileError{
-			Message:         fmt.Sprintf("Too many tile download failures: %d/%d failed", len(failedTiles), totalTiles),
-			FailedTiles:     failedTiles,
-			SuccessfulTiles: successfulTiles,
-			TotalTiles:      totalTiles,
+	f.waiters--
+	if f.waiters > 0 {
+		return
+	}
+	f.cancel()
+	if s.flights[key] == f {
+		delete(s.flights, key)
+		// Later callers start over instead of joining the stopped download
+		s.inflight.Forget(key)
+	}
+}
+
+// checkRedirectHosts returns a copy of client that applies hosts to every
+// redirect before following it
+func checkRedirectHosts(client *http.Client, hosts tile.HostPolicy) *http.Client {
+	next := client.CheckRedirect
+	checked := *client
+	checked.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if err := hosts.CheckURL(req.URL.String()); err != nil {
+			return err
+		}
+		if next != nil {
+			return next(req, via)
+		}
+		// The limit of http.Client's default policy
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
 		}
+		return nil
 	}
-	
-	// Encode output image
-	var imageData []byte
-	var err error
-	
-	switch opts.OutputFormat {
-	case FormatPNG:
-		imageData, err = s.encodePNG(buf, width, height)
-	case FormatGeoTIFF:
-		return nil, fmt.Errorf("GeoTIFF output not yet implemented")
-	default:
-		imageData, err = s.encodePNG(buf, width, height)
+	return &checked
+}
+
+// CheckHosts returns a tile.HostError when a tile URL or layer of opts
+// expands to a host opts.HostPolicy doesn't permit. Placeholders such as
+// {s} and URLParams can put any host into a URL whose template passes the
+// policy. Downloads check their URL as well; this catches it up front.
+func CheckHosts(opts *Options) error {
+	templates := slices.Clone(opts.TileURLs)
+	for _, layer := range opts.Layers {
+		templates = append(templates, layer.URL)
 	}
 	
-	if err != nil {
-		return nil, fmt.Errorf("failed to encode output image: %v", err)
+	// Every subdomain, including the default a, b and c of {s}
+	positions := max(len(opts.Subdomains), 3)
+	for _, template := range templates {
+		for i := 0; i < positions; i++ {
+			url := tileURL(opts, template, opts.Zoom, tilePosition{x: uint32(i)})
+			if err := opts.HostPolicy.CheckURL(url); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fetchURL performs the HTTP request for a single tile
+func (s *Stitcher) fetchURL(ctx context.Context, tr tileRequest) (tileResponse, error) {
+	method := tr.method
+	if method == "" {
+		method = http.MethodGet
 	}
 	
-	result := &Result{
-		ImageData:  imageData,
-		Width:      width,
-		Height:     height,
-		MinX:       minX,
-		MaxY:       maxY,
-		PixelSizeX: px,
-		PixelSizeY: py,
+	if tr.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, tr.timeout)
+		defer cancel()
 	}
 	
-	// Generate world file if requested
-	if opts.GenerateWorldFile {
-		result.WorldFileData = s.generateWorldFile(px, py, minX, maxY)
+	var body io.Reader
+	if tr.body != "" {
+		body = strings.NewReader(tr.body)
 	}
 	
-	return result, nil
-}
-
-// downloadTile downloads a single tile
-func (s *Stitcher) downloadTile(ctx context.Context, url string, headers map[string]string) ([]byte, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, method, tr.url, body)
 	if err != nil {
-		return nil, err
+		return tileResponse{}, err
 	}
 	
 	// Set User-Agent
-	req.Header.Set("User-Agent", "tile-stitch/2.0.0")
+	req.Header.Set("User-Agent", tile.DefaultUserAgent)
 	
 	// Set additional headers
-	for key, value := range headers {
+	for key, value := range tr.headers {
 		req.Header.Set(key, value)
 	}
 	
-	resp, err := s.client.Do(req)
+	client, err := s.clientFor(tr.proxy, tr.insecure)
 	if err != nil {
-		return nil, err
+		return tileResponse{}, err
+	}
+	client = checkRedirectHosts(client, tr.hosts)
+	resp, err := client.Do(req)
+	if err != nil {
+		return tileResponse{}, err
 	}
 	defer resp.Body.Close()
 	
+	// Some servers answer 204 for tiles without data (e.g. open ocean)
+	if resp.StatusCode == http.StatusNoContent {
+		return tileResponse{data: []byte{}}, nil
+	}
+	
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return tileResponse{}, &RateLimitError{
+			StatusCode: resp.StatusCode,
+			RetryAfter: tile.ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+	
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, resp.Status)
+		return tileResponse{}, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
 	}
 	
-	return io.ReadAll(resp.Body)
-}
-
-// decodeImage decodes an image from bytes
-func (s *Stitcher) decodeImage(data []byte) (*ImageData, error) {
-	if len(data) >= 4 && bytes.Equal(data[:4], []byte{0x89, 0x50, 0x4E, 0x47}) {
-		return s.readPNG(data)
-	} else if len(data) >= 2 && bytes.Equal(data[:2], []byte{0xFF, 0xD8}) {
-		return s.readJPEG(data)
+	// The transport inflates gzip bodies it asked for itself, so a small
+	// response can still grow without bound here
+	data, err := readTileBody(resp.Body)
+	if err != nil {
+		return tileResponse{}, err
+	}
+	if err := checkContentMD5(resp.Header, data); err != nil {
+		return tileResponse{}, err
 	}
 	
-	return nil, fmt.Errorf("unrecognized image format")
+	// The transport only decompresses bodies when it asked for gzip itself,
+	// not when Headers set Accept-Encoding
+	if !resp.Uncompressed {
+		if data, err = decodeContent(resp.Header.Get("Content-Encoding"), data); err != nil {
+			return tileResponse{}, err
+		}
+	}
+	if err := checkContentType(resp.Header, data); err != nil {
+		return tileResponse{}, err
+	}
+	return tileResponse{data: data, contentType: resp.Header.Get("Content-Type")}, nil
 }
 
-// readPNG decodes a PNG image
-func (s *Stitcher) readPNG(data []byte) (*ImageData, error) {
-	img, err := png.Decode(bytes.NewReader(data))
-	if err != nil {
-		return nil, err
+// decodeContent undoes a gzip Content-Encoding of a tile body; other
+// encodings are left to the decoder
+func decodeContent(encoding string, data []byte) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("gzip-encoded tile: %v", err)
+		}
+		defer zr.Close()
+		decoded, err := readTileBody(zr)
+		if err != nil {
+			return nil, fmt.Errorf("gzip-encoded tile: %w", err)
+		}
+		return decoded, nil
+	default:
+		return data, nil
 	}
-	
-	return s.imageToImageData(img), nil
 }
 
-// readJPEG decodes a JPEG image
-func (s *Stitcher) readJPEG(data []byte) (*ImageData, error) {
-	img, err := jpeg.Decode(bytes.NewReader(data))
+// maxTileBytes caps the size of a tile body after any gzip decoding, so a
+// small gzip bomb can't exhaust memory. Uncompressed 1024x1024 RGBA is 4 MiB.
+const maxTileBytes = 16 << 20
+
+// readTileBody reads r up to maxTileBytes; bodies beyond it fail as
+// CauseDecode
+func readTileBody(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxTileBytes+1))
 	if err != nil {
 		return nil, err
 	}
-	
-	return s.imageToImageData(img), nil
+	if len(data) > maxTileBytes {
+		return nil, errTileTooLarge
+	}
+	return data, nil
 }
 
-// imageToImageData converts a Go image to ImageData
-func (s *Stitcher) imageToImageData(img image.Image) *ImageData {
-	bounds := img.Bounds()
-	width := bounds.Dx()
-	height := bounds.Dy()
-	
-	// Convert to RGBA
-	buf := make([]byte, width*height*4)
-	
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			r, g, b, a := img.At(x, y).RGBA()
-			idx := (y*width + x) * 4
-			buf[idx] = byte(r >> 8)
-			buf[idx+1] = byte(g >> 8)
-			buf[idx+2] = byte(b >> 8)
-			buf[idx+3] = byte(a >> 8)
-		}
+// errTileTooLarge is returned for tile bodies over maxTileBytes
+var errTileTooLarge = fmt.Errorf("tile body is larger than %d MiB", maxTileBytes>>20)
+
+// decodeImage decodes a tile with the decoder registered for its format
+// (see tile.RegisterDecoder)
+func (s *Stitcher) decodeImage(data []byte) (*ImageData, error) {
+	img, err := tile.Decode(data)
+	if err != nil {
+		return nil, err
 	}
 	
 	return &ImageData{
-		buf:    buf,
-		width:  width,
-		height: height,
-		depth:  4,
-	}
+		buf:    img.Buf,
+		width:  img.Width,
+		height: img.Height,
+		depth:  img.Depth,
+	}, nil
 }
 
 // copyTileToBuffer copies tile data to the output buffer
@@ -378,6 +1861,32 @@ func (s *Stitcher) copyTileToBuffer(img *ImageData, buf []byte, xoff, yoff, widt
 	}
 }
 
+// overlayTileOnBuffer composites tile data on top of the output buffer,
+// scaling the tile's alpha by opacity first
+func (s *Stitcher) overlayTileOnBuffer(img *ImageData, buf []byte, xoff, yoff, width, height int, opacity float64) {
+	opacity = math.Max(0, math.Min(1, opacity))
+	
+	for y := 0; y < img.height; y++ {
+		for x := 0; x < img.width; x++ {
+			xd := x + xoff
+			yd := y + yoff
+			
+			if xd < 0 || yd < 0 || xd >= width || yd >= height {
+				continue
+			}
+			
+			srcIdx := (y*img.width + x) * 4
+			dstIdx := (yd*width + xd) * 4
+			
+			src := [4]byte{img.buf[srcIdx], img.buf[srcIdx+1], img.buf[srcIdx+2], byte(float64(img.buf[srcIdx+3])*opacity + 0.5)}
+			dst := [4]byte{buf[dstIdx], buf[dstIdx+1], buf[dstIdx+2], buf[dstIdx+3]}
+			// alphaBlend keeps its second argument on top, so pass the new tile second
+			result := s.alphaBlend(dst, src)
+			copy(buf[dstIdx:dstIdx+4], result[:])
+		}
+	}
+}
+
 // alphaBlend performs alpha blending of two pixels
 func (s *Stitcher) alphaBlend(src, dst [4]byte) [4]byte {
 	as := float64(src[3]) / 255.0
@@ -408,6 +1917,26 @@ func (s *Stitcher) alphaBlend(src, dst [4]byte) [4]byte {
 	return [4]byte{0, 0, 0, 0}
 }
 
+// applyBackground composites the buffer in place over a solid background color
+func (s *Stitcher) applyBackground(buf []byte, bg color.RGBA) {
+	under := [4]byte{bg.R, bg.G, bg.B, bg.A}
+	for i := 0; i+3 < len(buf); i += 4 {
+		// alphaBlend keeps its second argument on top
+		px := s.alphaBlend(under, [4]byte{buf[i], buf[i+1], buf[i+2], buf[i+3]})
+		copy(buf[i:i+4], px[:])
+	}
+}
+
+// isEmpty reports whether every pixel in the RGBA buffer is fully transparent
+func isEmpty(buf []byte) bool {
+	for i := 3; i < len(buf); i += 4 {
+		if buf[i] != 0 {
+			return false
+		}
+	}
+	return true
+}
+
 // encodePNG encodes the buffer as PNG
 func (s *Stitcher) encodePNG(buf []byte, width, height int) ([]byte, error) {
 	img := image.NewRGBA(image.Rect(0, 0, width, height))
@@ -433,31 +1962,106 @@ func (s *Stitcher) generateWorldFile(px, py, minx, maxy float64) []byte {
 	return buf.Bytes()
 }
 
-// buildURL replaces URL template tokens
-func (s *Stitcher) buildURL(template string, zoom int, x, y uint32) string {
-	url := template
-	url = strings.ReplaceAll(url, "{z}", strconv.Itoa(zoom))
-	url = strings.ReplaceAll(url, "{x}", strconv.FormatUint(uint64(x), 10))
-	url = strings.ReplaceAll(url, "{y}", strconv.FormatUint(uint64(y), 10))
-	// Handle {s} for subdomains (simple implementation)
-	if strings.Contains(url, "{s}") {
-		subdomain := string(rune('a' + (x+y)%3))
-		url = strings.ReplaceAll(url, "{s}", subdomain)
+// buildURL replaces URL template tokens for a tile of the scheme of crs,
+// including custom {name} placeholders from params. Values that land in the
+// query string are URL-encoded; the path is substituted verbatim.
+func buildURL(template string, crs, zoom int, x, y uint32, tileSize int, params map[string]string) string {
+	tokens := templateTokens(crs, zoom, x, y, tileSize, params)
+	
+	path, query, hasQuery := strings.Cut(template, "?")
+	url := strings.NewReplacer(tokens...).Replace(path)
+	if !hasQuery {
+		return url
+	}
+	
+	escaped := make([]string, len(tokens))
+	for i := range tokens {
+		escaped[i] = tokens[i]
+		if i%2 == 1 {
+			escaped[i] = neturl.QueryEscape(tokens[i])
+		}
+	}
+	return url + "?" + strings.NewReplacer(escaped...).Replace(query)
+}
+
+// ReservedPlaceholders returns the names of the placeholders the stitcher
+// fills in itself, such as z and bbox, and token, which URLParams shouldn't set
+func ReservedPlaceholders() []string {
+	tokens := templateTokens(0, 0, 0, 0, 0, nil)
+	names := make([]string, 0, len(tokens)/2+1)
+	for i := 0; i < len(tokens); i += 2 {
+		names = append(names, strings.Trim(tokens[i], "{}"))
+	}
+	return append(names, "token")
+}
+
+// templateTokens returns the placeholder/value pairs for a tile of the scheme
+// of crs (0 is CRSWebMercator), for use with strings.NewReplacer. {bbox} is the
+// tile's extent as minx,miny,maxx,maxy in crs, meters for EPSG:3857 and
+// degrees (lon,lat) for EPSG:4326, and {width} and {height} its size in pixels,
+// for WMS-like templates.
+func templateTokens(crs, zoom int, x, y uint32, tileSize int, params map[string]string) []string {
+	var minX, minY, maxX, maxY float64
+	if crs == CRSWGS84 {
+		// The WGS84 scheme addresses like the Mercator grid one level deeper
+		maxY, minX = tile2latlon4326(x, y, zoom+1)
+		minY, maxX = tile2latlon4326(x+1, y+1, zoom+1)
+	} else {
+		maxLat, minLon := tile2latlon(x, y, zoom)
+		minLat, maxLon := tile2latlon(x+1, y+1, zoom)
+		minX, minY = projectlatlon(minLat, minLon)
+		maxX, maxY = projectlatlon(maxLat, maxLon)
+	}
+	bbox := make([]string, 4)
+	for i, v := range []float64{minX, minY, maxX, maxY} {
+		bbox[i] = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	
+	tokens := []string{
+		"{z}", strconv.Itoa(zoom),
+		"{x}", strconv.FormatUint(uint64(x), 10),
+		"{y}", strconv.FormatUint(uint64(y), 10),
+		// Flipped (TMS) row as written in some provider templates
+		"{-y}", strconv.FormatUint(uint64(tile.FlipY(zoom, y)), 10),
+		"{!y}", strconv.FormatUint(uint64(tile.FlipY(zoom, y)), 10),
+		// Handle {s} for subdomains (simple implementation)
+		"{s}", string(rune('a' + (x+y)%3)),
+		"{bbox}", strings.Join(bbox, ","),
+		"{width}", strconv.Itoa(tileSize),
+		"{height}", strconv.Itoa(tileSize),
+	}
+	for name, value := range params {
+		tokens = append(tokens, "{"+name+"}", value)
 	}
-	return url
+	return tokens
 }
 
 // Coordinate conversion functions
 
+// pixelAt returns the pixel a 32-bit tile coordinate falls on in the grid of
+// tileSize pixel tiles at zoom
+func pixelAt(v uint32, tileSize, zoom int) int {
+	return int(uint64(v) * uint64(tileSize) >> (32 - zoom))
+}
+
+// pixelSpan returns how far n pixels of tileSize pixel tiles at zoom reach in
+// 32-bit tile coordinates
+func pixelSpan(n, tileSize, zoom int) uint32 {
+	return uint32(uint64(n) << (32 - zoom) / uint64(tileSize))
+}
+
 // latlon2tile converts lat/lon to tile coordinates at given zoom level
 func latlon2tile(lat, lon float64, zoom int) (uint32, uint32) {
+	lat = math.Max(-MaxMercatorLat, math.Min(MaxMercatorLat, lat))
 	latRad := lat * math.Pi / 180
 	n := uint64(1) << uint(zoom)
 	
-	x := uint32(float64(n) * ((lon + 180) / 360))
-	y := uint32(float64(n) * (1 - (math.Log(math.Tan(latRad)+1/math.Cos(latRad))/math.Pi)) / 2)
+	// Keep the far edges (lon 180, lat -MaxMercatorLat) inside the grid
+	// instead of overflowing uint32 at zoom 32
+	x := min(float64(n) * ((lon + 180) / 360), float64(n-1))
+	y := min(float64(n) * (1 - (math.Log(math.Tan(latRad)+1/math.Cos(latRad))/math.Pi)) / 2, float64(n-1))
 	
-	return x, y
+	return uint32(math.Max(x, 0)), uint32(math.Max(y, 0))
 }
 
 // tile2latlon converts tile coordinates to lat/lon
@@ -470,6 +2074,28 @@ func tile2latlon(x, y uint32, zoom int) (float64, float64) {
 	return lat, lon
 }
 
+// latlon2tile4326 converts lat/lon to tile coordinates in the WGS84 tile
+// scheme, scaled like latlon2tile so the same shift math applies at zoom+1
+func latlon2tile4326(lat, lon float64, zoom int) (uint32, uint32) {
+	n := float64(uint64(1) << uint(zoom))
+	
+	// Keep the far edges (lon 180, lat -90) inside the grid, whose rows
+	// are only the top half, instead of overflowing uint32 at zoom 32
+	x := min(n * ((lon + 180) / 360), n-1)
+	y := min(n * ((90 - lat) / 360), n/2-1)
+	
+	return uint32(math.Max(x, 0)), uint32(math.Max(y, 0))
+}
+
+// tile2latlon4326 converts WGS84 tile scheme coordinates to lat/lon
+func tile2latlon4326(x, y uint32, zoom int) (float64, float64) {
+	n := float64(uint64(1) << uint(zoom))
+	lon := 360.0*float64(x)/n - 180.0
+	lat := 90.0 - 360.0*float64(y)/n
+	
+	return lat, lon
+}
+
 // projectlatlon converts lat/lon in WGS84 to XY in Spherical Mercator (EPSG:900913/3857)
 func projectlatlon(lat, lon float64) (float64, float64) {
 	const originshift = 20037508.342789244 // 2 * pi * 6378137 / 2
@@ -478,4 +2104,9 @@ func projectlatlon(lat, lon float64) (float64, float64) {
 	y = y * originshift / 180.0
 	
 	return x, y
+}
+
+// projectlatlon4326 returns lat/lon as XY in plate carrée (EPSG:4326), in degrees
+func projectlatlon4326(lat, lon float64) (float64, float64) {
+	return lon, lat
 }
\ No newline at end of file
@@ -0,0 +1,3234 @@
+package stitcher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kiesman99/stitch/pkg/tile"
+	"golang.org/x/image/font/basicfont"
+)
+
+// solidTileServer serves 256x256 PNG tiles filled with a single color
+func solidTileServer(t *testing.T, c color.RGBA) *httptest.Server {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+
+	var tile bytes.Buffer
+	if err := png.Encode(&tile, img); err != nil {
+		t.Fatalf("Failed to encode tile: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(tile.Bytes())
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// decodeResult decodes the PNG image data of a stitch result
+func decodeResult(t *testing.T, result *Result) *image.RGBA {
+	t.Helper()
+
+	img, err := png.Decode(bytes.NewReader(result.ImageData))
+	if err != nil {
+		t.Fatalf("Failed to decode result: %v", err)
+	}
+
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		rgba = image.NewRGBA(img.Bounds())
+		for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
+			for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
+				rgba.Set(x, y, img.At(x, y))
+			}
+		}
+	}
+
+	return rgba
+}
+
+// absDiff returns the absolute difference of two channel values
+func absDiff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// bboxOptions returns options for a small bounding box stitch
+func bboxOptions(urls ...string) *Options {
+	return &Options{
+		Mode:     ModeBBox,
+		MinLat:   10,
+		MinLon:   10,
+		MaxLat:   20,
+		MaxLon:   20,
+		Zoom:     3,
+		TileURLs: urls,
+		TileSize: 256,
+	}
+}
+
+func TestStitch_OverlayLayers(t *testing.T) {
+	base := solidTileServer(t, color.RGBA{R: 255, A: 255})
+	overlay := solidTileServer(t, color.RGBA{B: 255, A: 255})
+
+	opts := bboxOptions()
+	opts.LayerMode = LayerModeOverlay
+	opts.Layers = []Layer{
+		{URL: base.URL + "/{z}/{x}/{y}.png", Opacity: 1},
+		{URL: overlay.URL + "/{z}/{x}/{y}.png", Opacity: 0.5},
+	}
+
+	result, err := New().Stitch(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+
+	img := decodeResult(t, result)
+	got := img.RGBAAt(0, 0)
+
+	// Half-opacity blue over opaque red gives an even purple
+	want := color.RGBA{R: 127, G: 0, B: 128, A: 255}
+	if absDiff(got.R, want.R) > 1 || got.G != want.G || absDiff(got.B, want.B) > 1 || got.A != want.A {
+		t.Errorf("Expected pixel %v, got %v", want, got)
+	}
+}
+
+func TestStitch_OverlayJPEGLayer(t *testing.T) {
+	base := solidTileServer(t, color.RGBA{R: 255, A: 255})
+
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i+2], img.Pix[i+3] = 255, 255
+	}
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatalf("Failed to encode JPEG: %v", err)
+	}
+	overlay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(encoded.Bytes())
+	}))
+	defer overlay.Close()
+
+	opts := bboxOptions()
+	opts.LayerMode = LayerModeOverlay
+	opts.Layers = []Layer{
+		{URL: base.URL + "/{z}/{x}/{y}.png", Opacity: 1},
+		{URL: overlay.URL + "/{z}/{x}/{y}.jpg", Opacity: 0.5},
+	}
+
+	result, err := New().Stitch(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+
+	// The opaque JPEG is blended at half opacity, not copied over the base
+	got := decodeResult(t, result).RGBAAt(0, 0)
+	want := color.RGBA{R: 127, G: 0, B: 128, A: 255}
+	if absDiff(got.R, want.R) > 3 || got.G > 3 || absDiff(got.B, want.B) > 3 || got.A != want.A {
+		t.Errorf("Expected pixel %v, got %v", want, got)
+	}
+}
+
+func TestStitch_OverlayMissingLayerIsSkipped(t *testing.T) {
+	base := solidTileServer(t, color.RGBA{R: 255, A: 255})
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+
+	opts := bboxOptions()
+	opts.LayerMode = LayerModeOverlay
+	opts.Layers = []Layer{
+		{URL: base.URL + "/{z}/{x}/{y}.png", Opacity: 1},
+		{URL: missing.URL + "/{z}/{x}/{y}.png", Opacity: 1},
+	}
+
+	result, err := New().Stitch(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+
+	img := decodeResult(t, result)
+	if got := img.RGBAAt(0, 0); got != (color.RGBA{R: 255, A: 255}) {
+		t.Errorf("Expected base layer pixel, got %v", got)
+	}
+}
+
+func TestStitch_OverlayLayerOutsideZoomRange(t *testing.T) {
+	base := solidTileServer(t, color.RGBA{R: 255, A: 255})
+	var requests atomic.Int32
+	detail := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer detail.Close()
+
+	opts := bboxOptions()
+	opts.LayerMode = LayerModeOverlay
+	opts.Layers = []Layer{
+		{URL: base.URL + "/{z}/{x}/{y}.png", Opacity: 1},
+		{URL: detail.URL + "/{z}/{x}/{y}.png", Opacity: 1, MinZoom: 5, MaxZoom: 12},
+	}
+
+	bounds, err := ComputeBounds(opts)
+	if err != nil {
+		t.Fatalf("ComputeBounds failed: %v", err)
+	}
+	if got := opts.SourcesPerTile(); got != 1 {
+		t.Errorf("Expected only the base layer to count at zoom 3, got %d sources", got)
+	}
+
+	result, err := New().Stitch(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("Expected no requests for the layer outside its zoom range, got %d", n)
+	}
+	if want := int(bounds.TileCount()) * opts.SourcesPerTile(); result.TotalTiles != want || len(result.FailedTiles) != 0 {
+		t.Errorf("Expected %d tiles without failures, got %d with %d failed", want, result.TotalTiles, len(result.FailedTiles))
+	}
+}
+
+func TestStitch_EmptyResult(t *testing.T) {
+	transparent := solidTileServer(t, color.RGBA{})
+
+	_, err := New().Stitch(context.Background(), bboxOptions(transparent.URL+"/{z}/{x}/{y}.png"))
+	if !errors.Is(err, ErrEmptyResult) {
+		t.Fatalf("Expected ErrEmptyResult, got %v", err)
+	}
+
+	opts := bboxOptions(transparent.URL + "/{z}/{x}/{y}.png")
+	opts.AllowEmpty = true
+
+	result, err := New().Stitch(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+	if !result.Empty {
+		t.Error("Expected result to be marked empty")
+	}
+	if len(result.ImageData) == 0 {
+		t.Error("Expected blank image data")
+	}
+}
+
+func TestStitch_AntimeridianRejected(t *testing.T) {
+	// The tile server must never be hit for a wrapped bounding box
+	tiles := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unexpected tile request: %s", r.URL.Path)
+	}))
+	defer tiles.Close()
+
+	opts := bboxOptions(tiles.URL + "/{z}/{x}/{y}.png")
+	opts.MinLon, opts.MaxLon = 170, -170
+
+	_, err := New().Stitch(context.Background(), opts)
+	if !errors.Is(err, ErrAntimeridian) {
+		t.Fatalf("Expected ErrAntimeridian, got %v", err)
+	}
+}
+
+func TestStitch_RampUpEnvelope(t *testing.T) {
+	const (
+		concurrency = 4
+		rampUp      = 400 * time.Millisecond
+		step        = rampUp / concurrency
+	)
+
+	tile := solidTileServer(t, color.RGBA{R: 255, A: 255})
+
+	var (
+		mu          sync.Mutex
+		inFlight    int
+		maxInFlight int
+		violations  []string
+	)
+	start := time.Now()
+
+	// Slow proxy in front of the tile server so workers overlap
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		elapsed := time.Since(start)
+		// Workers start at multiples of step, so at most 1+elapsed/step can be running
+		if allowed := 1 + int(elapsed/step); inFlight > allowed {
+			violations = append(violations, fmt.Sprintf("%d in flight after %v (allowed %d)", inFlight, elapsed, allowed))
+		}
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+
+		time.Sleep(50 * time.Millisecond)
+		resp, err := http.Get(tile.URL + r.URL.Path)
+		if err == nil {
+			io.Copy(w, resp.Body)
+			resp.Body.Close()
+		}
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}))
+	defer slow.Close()
+
+	opts := bboxOptions(slow.URL + "/{z}/{x}/{y}.png")
+	opts.Zoom = 6
+	opts.Concurrency = concurrency
+	opts.RampUp = rampUp
+
+	if _, err := New().Stitch(context.Background(), opts); err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+
+	for _, v := range violations {
+		t.Error(v)
+	}
+	if maxInFlight < 2 {
+		t.Errorf("Expected concurrent downloads after ramp-up, max in flight was %d", maxInFlight)
+	}
+}
+
+func TestStitch_RequestJitter(t *testing.T) {
+	const jitter = 40 * time.Millisecond
+
+	tiles := solidTileServer(t, color.RGBA{R: 255, A: 255})
+	opts := bboxOptions(tiles.URL + "/{z}/{x}/{y}.png")
+	opts.Zoom = 6
+	opts.RequestJitter = jitter
+
+	bounds, err := ComputeBounds(opts)
+	if err != nil {
+		t.Fatalf("ComputeBounds failed: %v", err)
+	}
+	n := time.Duration(bounds.TileCount())
+
+	// Sequential downloads each wait up to the jitter; a sum below a tenth
+	// of the maximum is vanishingly unlikely with several tiles
+	start := time.Now()
+	if _, err := New().Stitch(context.Background(), opts); err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+	elapsed := time.Since(start)
+	if low, high := n*jitter/10, n*jitter+500*time.Millisecond; elapsed < low || elapsed > high {
+		t.Errorf("Expected %d jittered tiles to take between %v and %v, took %v", n, low, high, elapsed)
+	}
+
+	// The wait ends with the context
+	opts.RequestJitter = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, err := New().Stitch(ctx, opts); err == nil {
+		t.Error("Expected the cancelled stitch to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the jitter to stop with the context, took %v", elapsed)
+	}
+}
+
+func TestBuildURL_EncodesQueryValues(t *testing.T) {
+	params := map[string]string{
+		"style": "dark matter",
+		"k":     "a&b=c",
+		"dir":   "base maps",
+	}
+
+	testCases := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{
+			name:     "Query placeholders are encoded",
+			template: "https://tiles.example.com/{z}/{x}/{y}.png?key={k}&style={style}",
+			expected: "https://tiles.example.com/3/4/5.png?key=a%26b%3Dc&style=dark+matter",
+		},
+		{
+			name:     "Path placeholders are left alone",
+			template: "https://tiles.example.com/{dir}/{z}/{x}/{y}.png",
+			expected: "https://tiles.example.com/base maps/3/4/5.png",
+		},
+		{
+			name:     "Tile coordinates in the query",
+			template: "https://tiles.example.com/tile?z={z}&x={x}&y={y}&s={s}",
+			expected: "https://tiles.example.com/tile?z=3&x=4&y=5&s=a",
+		},
+		{
+			name:     "Flipped Y placeholders",
+			template: "https://tiles.example.com/{z}/{x}/{-y}.png?row={!y}",
+			expected: "https://tiles.example.com/3/4/2.png?row=2",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := buildURL(tc.template, CRSWebMercator, 3, 4, 5, 256, params); got != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestBuildURL_BBoxPlaceholders(t *testing.T) {
+	const half = 20037508.342789244
+	testCases := []struct {
+		name     string
+		crs      int
+		expected []float64
+	}{
+		// Tile 1/1/0 is the north-east quarter of the Web Mercator square
+		{"Web Mercator", CRSWebMercator, []float64{0, 0, half, half}},
+		// and in the WGS84 scheme, 4x2 tiles of 90° at zoom 1, 90°W to 0° north of the equator
+		{"WGS84", CRSWGS84, []float64{-90, 0, 0, 90}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := buildURL("https://wms.example.com/{bbox}/{width}x{height}.png", tc.crs, 1, 1, 0, 512, nil)
+			path := strings.TrimPrefix(got, "https://wms.example.com/")
+			bboxPart, size, _ := strings.Cut(path, "/")
+			if size != "512x512.png" {
+				t.Errorf("Expected the tile size substituted, got %s", got)
+			}
+
+			parts := strings.Split(bboxPart, ",")
+			if len(parts) != 4 {
+				t.Fatalf("Expected four bbox values, got %s", got)
+			}
+			for i, part := range parts {
+				v, err := strconv.ParseFloat(part, 64)
+				if err != nil {
+					t.Fatalf("Invalid bbox value %q: %v", part, err)
+				}
+				if math.Abs(v-tc.expected[i]) > 1e-6 {
+					t.Errorf("Expected bbox value %d to be %f, got %f", i, tc.expected[i], v)
+				}
+			}
+		})
+	}
+}
+
+func TestStitch_WGS84WorldFile(t *testing.T) {
+	tile := solidTileServer(t, color.RGBA{R: 255, A: 255})
+
+	var (
+		mu    sync.Mutex
+		paths []string
+	)
+	recorder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		http.Redirect(w, r, tile.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer recorder.Close()
+
+	opts := bboxOptions(recorder.URL + "/{z}/{x}/{y}.png")
+	opts.OutputCRS = CRSWGS84
+	opts.GenerateWorldFile = true
+
+	result, err := New().Stitch(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+
+	// At zoom 3 the WGS84 scheme has 16x8 tiles of 22.5°, so 10..20°N/E is tile 8/3
+	if len(paths) != 1 || paths[0] != "/3/8/3.png" {
+		t.Errorf("Expected a single request for /3/8/3.png, got %v", paths)
+	}
+
+	var px, rotX, rotY, py, originX, originY float64
+	if _, err := fmt.Sscan(string(result.WorldFileData), &px, &rotX, &rotY, &py, &originX, &originY); err != nil {
+		t.Fatalf("Failed to parse world file: %v", err)
+	}
+
+	// The origin is the top-left corner in degrees, not Mercator meters
+	if math.Abs(originX-10) > 1e-9 || math.Abs(originY-20) > 1e-9 {
+		t.Errorf("Expected origin (10, 20), got (%v, %v)", originX, originY)
+	}
+	if want := 10.0 / float64(result.Width); math.Abs(px-want) > 1e-9 {
+		t.Errorf("Expected pixel width %v°, got %v", want, px)
+	}
+	if want := -10.0 / float64(result.Height); math.Abs(py-want) > 1e-9 {
+		t.Errorf("Expected pixel height %v°, got %v", want, py)
+	}
+}
+
+func TestComputeBounds_WGS84FarEdges(t *testing.T) {
+	opts := bboxOptions("http://127.0.0.1:0/{z}/{x}/{y}.png")
+	opts.OutputCRS = CRSWGS84
+	opts.Zoom = 1
+	opts.MinLat, opts.MinLon, opts.MaxLat, opts.MaxLon = -90, 100, -10, 180
+
+	bounds, err := ComputeBounds(opts)
+	if err != nil {
+		t.Fatalf("ComputeBounds failed: %v", err)
+	}
+
+	// At zoom 1 the WGS84 scheme has 4x2 tiles of 90°, so the south-east
+	// corner of the world is tile 3/1
+	if bounds.MinTileX != 3 || bounds.MaxTileX != 3 || bounds.MinTileY != 1 || bounds.MaxTileY != 1 {
+		t.Errorf("Expected tile 3/1, got %d..%d, %d..%d", bounds.MinTileX, bounds.MaxTileX, bounds.MinTileY, bounds.MaxTileY)
+	}
+	if bounds.Width <= 0 || bounds.Height <= 0 {
+		t.Errorf("Expected a positive size, got %dx%d", bounds.Width, bounds.Height)
+	}
+}
+
+func TestStitch_TileRange(t *testing.T) {
+	tile := solidTileServer(t, color.RGBA{G: 255, A: 255})
+
+	var (
+		mu    sync.Mutex
+		paths []string
+	)
+	recorder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		http.Redirect(w, r, tile.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer recorder.Close()
+
+	opts := &Options{
+		Mode:              ModeTileRange,
+		MinTileX:          4,
+		MinTileY:          3,
+		MaxTileX:          5,
+		MaxTileY:          4,
+		Zoom:              3,
+		TileURLs:          []string{recorder.URL + "/{z}/{x}/{y}.png"},
+		TileSize:          256,
+		GenerateWorldFile: true,
+	}
+
+	result, err := New().Stitch(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+
+	slices.Sort(paths)
+	want := []string{"/3/4/3.png", "/3/4/4.png", "/3/5/3.png", "/3/5/4.png"}
+	if !slices.Equal(paths, want) {
+		t.Errorf("Expected requests for %v, got %v", want, paths)
+	}
+	if result.Width != 512 || result.Height != 512 {
+		t.Errorf("Expected 512x512 pixels, got %dx%d", result.Width, result.Height)
+	}
+
+	var px, rotX, rotY, py, originX, originY float64
+	if _, err := fmt.Sscan(string(result.WorldFileData), &px, &rotX, &rotY, &py, &originX, &originY); err != nil {
+		t.Fatalf("Failed to parse world file: %v", err)
+	}
+
+	// Tile 4/3 of the 8x8 tiles at zoom 3 starts at the prime meridian, a
+	// quarter of the Mercator extent north of the equator
+	const extent = 20037508.342789244
+	if math.Abs(originX) > 1e-6 || math.Abs(originY-extent/4) > 1e-6 {
+		t.Errorf("Expected origin (0, %v), got (%v, %v)", extent/4, originX, originY)
+	}
+	if want := 2 * extent / (8 * 256); math.Abs(px-want) > 1e-6 || math.Abs(py+want) > 1e-6 {
+		t.Errorf("Expected pixel size %v, got %v by %v", want, px, py)
+	}
+
+	// Tiles beyond the edge of the zoom level don't exist
+	opts.MaxTileX = 8
+	if _, err := New().Stitch(context.Background(), opts); err == nil {
+		t.Error("Expected an error for a tile range beyond zoom 3")
+	}
+}
+
+func TestStitch_VRT(t *testing.T) {
+	tiles := solidTileServer(t, color.RGBA{G: 255, A: 255})
+
+	opts := bboxOptions(tiles.URL + "/{z}/{x}/{y}.png")
+	opts.VRTImage = "map.png"
+
+	result, err := New().Stitch(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+
+	var vrt struct {
+		XSize        int    `xml:"rasterXSize,attr"`
+		YSize        int    `xml:"rasterYSize,attr"`
+		SRS          string `xml:"SRS"`
+		GeoTransform string `xml:"GeoTransform"`
+		Bands        []struct {
+			Source string `xml:"SimpleSource>SourceFilename"`
+		} `xml:"VRTRasterBand"`
+	}
+	if err := xml.Unmarshal(result.VRTData, &vrt); err != nil {
+		t.Fatalf("Failed to parse VRT: %v\n%s", err, result.VRTData)
+	}
+
+	if vrt.XSize != result.Width || vrt.YSize != result.Height {
+		t.Errorf("Expected raster size %dx%d, got %dx%d", result.Width, result.Height, vrt.XSize, vrt.YSize)
+	}
+	if vrt.SRS != "EPSG:3857" {
+		t.Errorf("Expected SRS EPSG:3857, got %q", vrt.SRS)
+	}
+
+	var gt [6]float64
+	if _, err := fmt.Sscanf(vrt.GeoTransform, "%g, %g, %g, %g, %g, %g", &gt[0], &gt[1], &gt[2], &gt[3], &gt[4], &gt[5]); err != nil {
+		t.Fatalf("Failed to parse GeoTransform %q: %v", vrt.GeoTransform, err)
+	}
+	want := [6]float64{result.MinX, result.PixelSizeX, 0, result.MaxY, 0, -result.PixelSizeY}
+	for i := range want {
+		if math.Abs(gt[i]-want[i]) > 1e-6 {
+			t.Errorf("Expected GeoTransform %v, got %v", want, gt)
+			break
+		}
+	}
+
+	// One band per RGBA channel of the PNG, all read from the image
+	if len(vrt.Bands) != 4 {
+		t.Fatalf("Expected 4 bands, got %d", len(vrt.Bands))
+	}
+	for i, band := range vrt.Bands {
+		if band.Source != "map.png" {
+			t.Errorf("Expected band %d to read map.png, got %q", i+1, band.Source)
+		}
+	}
+
+	// Without a file name there's nothing to reference
+	opts.VRTImage = ""
+	result, err = New().Stitch(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+	if result.VRTData != nil {
+		t.Error("Expected no VRT without Options.VRTImage")
+	}
+}
+
+func TestContactSheet(t *testing.T) {
+	tiles := solidTileServer(t, color.RGBA{B: 255, A: 255})
+	missing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/3/5/4.png" {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, tiles.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer missing.Close()
+
+	// -10..10°N, 40..50°E reaches into tiles 4 and 5 on both axes at zoom 3
+	opts := bboxOptions(missing.URL + "/{z}/{x}/{y}.png")
+	opts.MinLat, opts.MaxLat, opts.MinLon, opts.MaxLon = -10, 10, 40, 50
+
+	result, err := New().ContactSheet(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("ContactSheet failed: %v", err)
+	}
+	if result.TotalTiles != 4 || result.SuccessfulTiles != 3 || len(result.FailedTiles) != 1 {
+		t.Errorf("Expected 3 of 4 tiles and 1 failure, got %d of %d and %d", result.SuccessfulTiles, result.TotalTiles, len(result.FailedTiles))
+	}
+
+	cellWidth := 256 + 2*contactSheetMargin
+	cellHeight := 256 + contactSheetCaption + 2*contactSheetMargin
+	img := decodeResult(t, result)
+	if b := img.Bounds(); b.Dx() != 2*cellWidth || b.Dy() != 2*cellHeight {
+		t.Fatalf("Expected a %dx%d sheet, got %dx%d", 2*cellWidth, 2*cellHeight, b.Dx(), b.Dy())
+	}
+
+	for row := 0; row < 2; row++ {
+		for col := 0; col < 2; col++ {
+			x0, y0 := col*cellWidth+contactSheetMargin, row*cellHeight+contactSheetMargin
+
+			// The caption below the tile has text in it
+			labeled := false
+			for y := y0 + 256 + 2; y < y0+256+contactSheetCaption && !labeled; y++ {
+				for x := x0; x < x0+256; x++ {
+					if c := img.RGBAAt(x, y); c.G < 64 && c.B < 64 {
+						labeled = true
+						break
+					}
+				}
+			}
+			if !labeled {
+				t.Errorf("Expected a caption below tile %d,%d", col, row)
+			}
+
+			// Tiles are drawn inside their border, the missing one crossed out
+			center := img.RGBAAt(x0+128, y0+128)
+			want := color.RGBA{B: 255, A: 255}
+			if col == 1 && row == 1 {
+				want = contactSheetMissing
+			}
+			if center != want {
+				t.Errorf("Expected %v in the center of tile %d,%d, got %v", want, col, row, center)
+			}
+			if border := img.RGBAAt(x0-1, y0+128); border != contactSheetBorder {
+				t.Errorf("Expected the border left of tile %d,%d, got %v", col, row, border)
+			}
+		}
+	}
+}
+
+func TestExportPyramid(t *testing.T) {
+	tiles := solidTileServer(t, color.RGBA{B: 255, A: 255})
+
+	opts := bboxOptions(tiles.URL + "/{z}/{x}/{y}.png")
+	opts.Concurrency = 2
+	dir := t.TempDir()
+
+	result, err := New().ExportPyramid(context.Background(), opts, PyramidOptions{ZoomFrom: 4, ZoomTo: 3, Dir: dir})
+	if err != nil {
+		t.Fatalf("ExportPyramid failed: %v", err)
+	}
+	if result.TotalTiles != 2 || result.SuccessfulTiles != 2 {
+		t.Errorf("Expected 2 of 2 tiles, got %d of %d", result.SuccessfulTiles, result.TotalTiles)
+	}
+
+	// 10..20°N/E is a single tile at both zoom levels
+	var files []string
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return err
+	})
+	want := []string{"3/4/3.png", "4/8/7.png"}
+	if !slices.Equal(files, want) {
+		t.Fatalf("Expected files %v, got %v", want, files)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "4", "8", "7.png"))
+	if err != nil {
+		t.Fatalf("Failed to read tile: %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to decode tile: %v", err)
+	}
+	if r, g, b, _ := img.At(0, 0).RGBA(); r != 0 || g != 0 || b != 0xffff {
+		t.Errorf("Expected a blue tile, got %v", img.At(0, 0))
+	}
+}
+
+func TestExportPyramid_TileLimit(t *testing.T) {
+	// The limit covers all levels together and is checked before any download
+	tiles := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unexpected tile request: %s", r.URL.Path)
+	}))
+	defer tiles.Close()
+
+	opts := bboxOptions(tiles.URL + "/{z}/{x}/{y}.png")
+	opts.MaxTiles = 10 // every level alone fits, zoom 3 to 6 needs 1+1+4+9 tiles
+	_, err := New().ExportPyramid(context.Background(), opts, PyramidOptions{ZoomFrom: 3, ZoomTo: 6, Dir: t.TempDir()})
+
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("Expected a LimitError, got %v", err)
+	}
+	if limitErr.Requested != 15 || limitErr.Max != 10 {
+		t.Errorf("Expected 15 tiles requested with a limit of 10, got %d and %d", limitErr.Requested, limitErr.Max)
+	}
+}
+
+func TestStitch_Limits(t *testing.T) {
+	// Limits must be enforced before any tile is requested
+	tiles := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unexpected tile request: %s", r.URL.Path)
+	}))
+	defer tiles.Close()
+
+	t.Run("Tile limit", func(t *testing.T) {
+		opts := bboxOptions(tiles.URL + "/{z}/{x}/{y}.png")
+		opts.Zoom = 6 // 3x3 tiles
+		opts.MaxTiles = 3
+
+		_, err := New().Stitch(context.Background(), opts)
+
+		var limitErr *LimitError
+		if !errors.As(err, &limitErr) {
+			t.Fatalf("Expected LimitError, got %v", err)
+		}
+		if limitErr.Limit != "max_tiles" {
+			t.Errorf("Expected limit max_tiles, got %s", limitErr.Limit)
+		}
+		if limitErr.Requested <= limitErr.Max {
+			t.Errorf("Expected requested %d to exceed max %d", limitErr.Requested, limitErr.Max)
+		}
+	})
+
+	t.Run("Pixel limit", func(t *testing.T) {
+		opts := bboxOptions(tiles.URL + "/{z}/{x}/{y}.png")
+		opts.Zoom = 6
+		opts.MaxPixels = 1000
+
+		_, err := New().Stitch(context.Background(), opts)
+
+		var sizeErr *SizeError
+		if !errors.As(err, &sizeErr) {
+			t.Fatalf("Expected SizeError, got %v", err)
+		}
+		if sizeErr.MaxPixels != 1000 {
+			t.Errorf("Expected max pixels 1000, got %d", sizeErr.MaxPixels)
+		}
+		if int64(sizeErr.Width)*int64(sizeErr.Height) <= sizeErr.MaxPixels {
+			t.Errorf("Expected %dx%d to exceed %d pixels", sizeErr.Width, sizeErr.Height, sizeErr.MaxPixels)
+		}
+	})
+}
+
+func TestStitch_MBTiles(t *testing.T) {
+	tiles := solidTileServer(t, color.RGBA{G: 255, A: 255})
+
+	resp, err := http.Get(tiles.URL + "/tile.png")
+	if err != nil {
+		t.Fatalf("Failed to fetch sample tile: %v", err)
+	}
+	sample, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	opts := bboxOptions(tiles.URL + "/{z}/{x}/{y}.png")
+	opts.Zoom = 6 // 3x3 tiles
+	opts.OutputFormat = FormatMBTiles
+	opts.Output = filepath.Join(t.TempDir(), "area.mbtiles")
+
+	result, err := New().Stitch(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+	if result.SuccessfulTiles != 9 {
+		t.Errorf("Expected 9 successful tiles, got %d", result.SuccessfulTiles)
+	}
+
+	db, err := sql.Open("sqlite", opts.Output)
+	if err != nil {
+		t.Fatalf("Failed to open MBTiles: %v", err)
+	}
+	defer db.Close()
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM tiles WHERE zoom_level = 6").Scan(&count); err != nil {
+		t.Fatalf("Failed to count tiles: %v", err)
+	}
+	if count != 9 {
+		t.Errorf("Expected 9 tiles, got %d", count)
+	}
+
+	// The north-west tile is stored at its flipped TMS row
+	tx, ty := latlon2tile(opts.MaxLat, opts.MinLon, opts.Zoom)
+	var blob []byte
+	if err := db.QueryRow("SELECT tile_data FROM tiles WHERE zoom_level = 6 AND tile_column = ? AND tile_row = ?",
+		tx, (1<<6)-1-ty).Scan(&blob); err != nil {
+		t.Fatalf("Failed to read tile %d/%d: %v", tx, ty, err)
+	}
+	if !bytes.Equal(blob, sample) {
+		t.Error("Expected stored tile to match the served tile")
+	}
+
+	var format string
+	if err := db.QueryRow("SELECT value FROM metadata WHERE name = 'format'").Scan(&format); err != nil {
+		t.Fatalf("Failed to read metadata: %v", err)
+	}
+	if format != "png" {
+		t.Errorf("Expected format png, got %s", format)
+	}
+}
+
+func TestStitch_Coverage(t *testing.T) {
+	tile := solidTileServer(t, color.RGBA{R: 255, A: 255})
+
+	testCases := []struct {
+		name      string
+		coverage  SourceCoverage
+		strict    bool
+		expectErr bool
+		minPct    float64
+		maxPct    float64
+	}{
+		{
+			name:     "Fully covered",
+			coverage: SourceCoverage{MinLon: 0, MinLat: 0, MaxLon: 30, MaxLat: 30, MaxZoom: 18},
+			minPct:   100,
+			maxPct:   100,
+		},
+		{
+			name:     "West half covered warns",
+			coverage: SourceCoverage{MinLon: 0, MinLat: 0, MaxLon: 15, MaxLat: 30, MaxZoom: 18},
+			minPct:   49.9,
+			maxPct:   50.1,
+		},
+		{
+			name:      "West half covered in strict mode",
+			coverage:  SourceCoverage{MinLon: 0, MinLat: 0, MaxLon: 15, MaxLat: 30, MaxZoom: 18},
+			strict:    true,
+			expectErr: true,
+		},
+		{
+			name:      "Zoom outside range",
+			coverage:  SourceCoverage{MinLon: -180, MinLat: -85, MaxLon: 180, MaxLat: 85, MinZoom: 5, MaxZoom: 18},
+			strict:    true,
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := bboxOptions(tile.URL + "/{z}/{x}/{y}.png")
+			opts.Coverage = &tc.coverage
+			opts.StrictCoverage = tc.strict
+
+			result, err := New().Stitch(context.Background(), opts)
+			if tc.expectErr {
+				var coverageErr *CoverageError
+				if !errors.As(err, &coverageErr) {
+					t.Fatalf("Expected CoverageError, got %v", err)
+				}
+				if coverageErr.Percent >= 100 {
+					t.Errorf("Expected coverage below 100%%, got %v", coverageErr.Percent)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Stitch failed: %v", err)
+			}
+			if result.CoveragePercent < tc.minPct || result.CoveragePercent > tc.maxPct {
+				t.Errorf("Expected coverage between %v and %v, got %v", tc.minPct, tc.maxPct, result.CoveragePercent)
+			}
+		})
+	}
+}
+
+func TestDownloadTile_CoalescesConcurrentRequests(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		hits int
+	)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits++
+		mu.Unlock()
+		<-release
+		w.Write([]byte("tile"))
+	}))
+	defer server.Close()
+
+	s := New()
+	url := server.URL + "/1/2/3.png"
+
+	var wg sync.WaitGroup
+	results := make([][]byte, 2)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data, err := s.downloadTile(context.Background(), tileRequest{url: url})
+			if err != nil {
+				t.Errorf("downloadTile failed: %v", err)
+			}
+			results[i] = data
+		}(i)
+	}
+
+	// Give both goroutines time to join the in-flight request
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if hits != 1 {
+		t.Errorf("Expected a single backend hit, got %d", hits)
+	}
+	for i, data := range results {
+		if string(data) != "tile" {
+			t.Errorf("Expected result %d to be the tile, got %q", i, data)
+		}
+	}
+}
+
+func TestDownloadTile_SharedDownloadOutlivesFirstCaller(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		select {
+		case <-release:
+			w.Write([]byte("tile"))
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	s := New()
+	req := tileRequest{url: server.URL + "/1/2/3.png"}
+
+	// The first caller starts the download, then gives up
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := s.downloadTile(ctx, req)
+		first <- err
+	}()
+	<-started
+
+	second := make(chan []byte, 1)
+	go func() {
+		data, err := s.downloadTile(context.Background(), req)
+		if err != nil {
+			t.Errorf("Expected the second caller to get the tile, got %v", err)
+		}
+		second <- data
+	}()
+
+	// Wait until the second caller shares the download
+	key := req.key()
+	for {
+		s.flightMu.Lock()
+		waiters := s.flights[key].waiters
+		s.flightMu.Unlock()
+		if waiters == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the first caller to be cancelled, got %v", err)
+	}
+	close(release)
+	if data := <-second; string(data) != "tile" {
+		t.Errorf("Expected the tile, got %q", data)
+	}
+}
+
+func TestFetchTile_HostPolicy(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("redirect") != "" {
+			// Same server, but by a host name the policy doesn't allow
+			http.Redirect(w, r, strings.Replace(server.URL, "127.0.0.1", "localhost", 1)+r.URL.Path, http.StatusFound)
+			return
+		}
+		w.Write([]byte("tile"))
+	}))
+	defer server.Close()
+
+	opts := &Options{HostPolicy: tile.HostPolicy{Allowed: []string{"127.0.0.1"}}}
+	fetch := func(template string, params map[string]string) error {
+		opts.TileURLs = []string{template}
+		opts.URLParams = params
+		_, err := New().FetchTile(context.Background(), opts, 1, 0, 0)
+		return err
+	}
+
+	if err := fetch(server.URL+"/{z}/{x}/{y}.png", nil); err != nil {
+		t.Fatalf("Expected an allowed host to be fetched, got %v", err)
+	}
+
+	var hostErr *tile.HostError
+	if err := fetch(server.URL+"/{z}/{x}/{y}.png?redirect=1", nil); !errors.As(err, &hostErr) {
+		t.Errorf("Expected a HostError for the redirect, got %v", err)
+	}
+	if err := fetch("http://{host}/{z}/{x}/{y}.png", map[string]string{"host": "localhost"}); !errors.As(err, &hostErr) {
+		t.Errorf("Expected a HostError for the expanded URL, got %v", err)
+	}
+}
+
+func TestStitch_TokenAndSigner(t *testing.T) {
+	tile := solidTileServer(t, color.RGBA{R: 255, A: 255})
+
+	var (
+		mu       sync.Mutex
+		requests []*url.URL
+	)
+	recorder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.URL)
+		mu.Unlock()
+		http.Redirect(w, r, tile.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer recorder.Close()
+
+	key := []byte("signing key")
+	opts := bboxOptions(recorder.URL + "/{z}/{x}/{y}.png?access_token={token}")
+	opts.Token = "pk.secret"
+	opts.Signer = HMACSigner(key, time.Hour)
+
+	before := time.Now()
+	if _, err := New().Stitch(context.Background(), opts); err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("Expected a single tile request, got %d", len(requests))
+	}
+
+	u := requests[0]
+	query := u.Query()
+	if token := query.Get("access_token"); token != "pk.secret" {
+		t.Errorf("Expected {token} to be replaced by pk.secret, got %q", token)
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || expires < before.Add(time.Hour).Unix() || expires > time.Now().Add(time.Hour).Unix() {
+		t.Errorf("Expected expires an hour from now, got %q", query.Get("expires"))
+	}
+
+	// The signature covers the path and the query up to expires
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(fmt.Sprintf("/3/4/3.png?access_token=pk.secret&expires=%d", expires)))
+	if want := hex.EncodeToString(mac.Sum(nil)); query.Get("signature") != want {
+		t.Errorf("Expected signature %s, got %s", want, query.Get("signature"))
+	}
+}
+
+func TestStitch_RedactsTokenAndSignature(t *testing.T) {
+	// A closed server makes the error quote the full URL
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	opts := bboxOptions(closed.URL + "/{token}/{z}/{x}/{y}.png?access_token={token}")
+	opts.Token = "pk.secret/+"
+	opts.Signer = HMACSigner([]byte("signing key"), time.Hour)
+	var logs bytes.Buffer
+	opts.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	var (
+		mu     sync.Mutex
+		onTile []string
+	)
+	opts.OnTile = func(url string, ok bool) {
+		mu.Lock()
+		onTile = append(onTile, url)
+		mu.Unlock()
+	}
+
+	_, err := New().Stitch(context.Background(), opts)
+	var tileErr *TileError
+	if !errors.As(err, &tileErr) || len(tileErr.FailedTiles) == 0 {
+		t.Fatalf("Expected failed tiles, got %v", err)
+	}
+
+	signature := regexp.MustCompile(`signature=[0-9a-f]`)
+	check := func(where, text string) {
+		t.Helper()
+		if strings.Contains(text, "pk.secret") || signature.MatchString(text) {
+			t.Errorf("Expected %s without the token and signature, got %s", where, text)
+		}
+	}
+	for _, ft := range tileErr.FailedTiles {
+		check("FailedTile.URL", ft.URL)
+		check("FailedTile.Error", ft.Error)
+		if !strings.Contains(ft.URL, "access_token=REDACTED") || !strings.Contains(ft.URL, "signature=REDACTED") {
+			t.Errorf("Expected the redacted parameters to stay in the URL, got %s", ft.URL)
+		}
+	}
+	check("the error", err.Error())
+	check("the log", logs.String())
+	for _, u := range onTile {
+		check("the OnTile URL", u)
+	}
+}
+
+func TestTileRequest_KeyIgnoresSignature(t *testing.T) {
+	signed := 0
+	opts := bboxOptions("https://tiles.example.com/{z}/{x}/{y}.png")
+	opts.Signer = func(url string, now time.Time) string {
+		signed++
+		return url + "?signature=" + strconv.Itoa(signed)
+	}
+
+	s := New()
+	first := s.newTileRequest(opts, opts.TileURLs[0], tilePosition{})
+	second := s.newTileRequest(opts, opts.TileURLs[0], tilePosition{})
+	if first.url == second.url {
+		t.Fatal("Expected two different signatures")
+	}
+	if first.key() != second.key() {
+		t.Error("Expected requests for the same tile to share a download despite different signatures")
+	}
+}
+
+func TestHMACSigner(t *testing.T) {
+	sign := HMACSigner([]byte("key"), 10*time.Minute)
+	now := time.Unix(1700000000, 0)
+
+	mac := hmac.New(sha256.New, []byte("key"))
+	mac.Write([]byte("/tiles/3/4/2.png?expires=1700000600"))
+	want := "https://a.example.com/tiles/3/4/2.png?expires=1700000600&signature=" + hex.EncodeToString(mac.Sum(nil))
+	if got := sign("https://a.example.com/tiles/3/4/2.png", now); got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	// The host isn't signed, so every subdomain gets the same signature
+	if got := sign("https://b.example.com/tiles/3/4/2.png", now); !strings.HasSuffix(got, want[strings.Index(want, "?"):]) {
+		t.Errorf("Expected the same signature on another subdomain, got %s", got)
+	}
+}
+
+func TestStitch_PostRequests(t *testing.T) {
+	tile := solidTileServer(t, color.RGBA{R: 255, A: 255})
+
+	var (
+		mu     sync.Mutex
+		bodies []string
+	)
+	wms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("Expected POST, got %s", r.Method)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/xml" {
+			t.Errorf("Expected Content-Type application/xml, got %s", ct)
+		}
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+
+		resp, err := http.Get(tile.URL)
+		if err == nil {
+			io.Copy(w, resp.Body)
+			resp.Body.Close()
+		}
+	}))
+	defer wms.Close()
+
+	opts := bboxOptions(wms.URL + "/wms?z={z}&x={x}&y={y}")
+	opts.RequestMethod = "post"
+	opts.RequestBody = "<GetMap layer=\"{layer}\" z=\"{z}\" x=\"{x}\" y=\"{y}\"/>"
+	opts.URLParams = map[string]string{"layer": "roads & rails"}
+	opts.Headers = map[string]string{"Content-Type": "application/xml"}
+
+	if _, err := New().Stitch(context.Background(), opts); err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+
+	// Bodies are substituted verbatim, without URL encoding
+	want := "<GetMap layer=\"roads & rails\" z=\"3\" x=\"4\" y=\"3\"/>"
+	if len(bodies) != 1 || bodies[0] != want {
+		t.Errorf("Expected body %q, got %v", want, bodies)
+	}
+
+	opts.RequestMethod = "DELETE"
+	if _, err := New().Stitch(context.Background(), opts); err == nil {
+		t.Error("Expected an error for an unsupported method")
+	}
+}
+
+func TestStitch_BackgroundColor(t *testing.T) {
+	tile := solidTileServer(t, color.RGBA{R: 255, A: 255})
+
+	opts := bboxOptions()
+	opts.Zoom = 6 // 3x3 tiles
+
+	// The top-left tile is missing, leaving a hole in the corner
+	tx, ty := latlon2tile(opts.MaxLat, opts.MinLon, opts.Zoom)
+	missing := fmt.Sprintf("/%d/%d/%d.png", opts.Zoom, tx, ty)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == missing {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, tile.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer server.Close()
+
+	opts.TileURLs = []string{server.URL + "/{z}/{x}/{y}.png"}
+	opts.BackgroundColor = color.RGBA{R: 10, G: 200, B: 30, A: 255}
+
+	result, err := New().Stitch(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+	if len(result.FailedTiles) != 1 {
+		t.Fatalf("Expected one failed tile, got %d", len(result.FailedTiles))
+	}
+
+	img := decodeResult(t, result)
+	if got := img.RGBAAt(0, 0); got != opts.BackgroundColor {
+		t.Errorf("Expected hole pixel %v, got %v", opts.BackgroundColor, got)
+	}
+	// Opaque tiles still cover the background
+	if got := img.RGBAAt(result.Width-1, result.Height-1); got != (color.RGBA{R: 255, A: 255}) {
+		t.Errorf("Expected tile pixel, got %v", got)
+	}
+}
+
+func TestStitch_ScaleBarAndNorthArrow(t *testing.T) {
+	server := solidTileServer(t, color.RGBA{R: 255, A: 255})
+
+	opts := bboxOptions(server.URL + "/{z}/{x}/{y}.png")
+	opts.MaxLat, opts.MaxLon = 45, 45
+	opts.DrawScaleBar = true
+	opts.DrawNorthArrow = true
+
+	result, err := New().Stitch(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+	img := decodeResult(t, result)
+
+	black := color.RGBA{A: 255}
+	bounds := img.Bounds()
+	// The left end of the bar, just above the padding of its box
+	if c := img.RGBAAt(12, bounds.Max.Y-13); c != black {
+		t.Errorf("Expected the scale bar in the bottom-left corner, got %v", c)
+	}
+	// The tip of the arrow head
+	if c := img.RGBAAt(bounds.Max.X-19, 12); c != black {
+		t.Errorf("Expected the north arrow in the top-right corner, got %v", c)
+	}
+	// The middle of the image is left alone
+	if c := img.RGBAAt(bounds.Dx()/2, bounds.Dy()/2); c != (color.RGBA{R: 255, A: 255}) {
+		t.Errorf("Expected tile pixels in the middle, got %v", c)
+	}
+}
+
+func TestStitch_UndersizedAsEmpty(t *testing.T) {
+	solid := solidTileServer(t, color.RGBA{R: 255, A: 255})
+	var placeholder bytes.Buffer
+	if err := png.Encode(&placeholder, image.NewRGBA(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatalf("Failed to encode placeholder: %v", err)
+	}
+
+	// The bottom-right tile of the area is outside the server's coverage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/3/5/3.png" {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(placeholder.Bytes())
+			return
+		}
+		http.Redirect(w, r, solid.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer server.Close()
+
+	opts := bboxOptions(server.URL + "/{z}/{x}/{y}.png")
+	opts.MaxLat, opts.MaxLon = 45, 50
+	opts.MaxFailedTiles = intPtr(0)
+
+	// By default the placeholder is a tile of the wrong size
+	_, err := New().Stitch(context.Background(), opts)
+	var tileErr *TileError
+	if !errors.As(err, &tileErr) || len(tileErr.FailedTiles) != 1 || !strings.Contains(tileErr.FailedTiles[0].Error, "wrong tile size") {
+		t.Fatalf("Expected a wrong tile size failure, got %v", err)
+	}
+
+	opts.UndersizedAsEmpty = true
+	opts.AutoResample = true
+	result, err := New().Stitch(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+	if len(result.FailedTiles) != 0 || result.SuccessfulTiles != 4 {
+		t.Errorf("Expected 4 successful tiles and no failures, got %d and %v", result.SuccessfulTiles, result.FailedTiles)
+	}
+
+	img := decodeResult(t, result)
+	bounds := img.Bounds()
+	if c := img.RGBAAt(bounds.Max.X-1, bounds.Max.Y-1); c.A != 0 {
+		t.Errorf("Expected the placeholder's position to stay transparent, got %v", c)
+	}
+	if c := img.RGBAAt(0, 0); c != (color.RGBA{R: 255, A: 255}) {
+		t.Errorf("Expected the other tiles to be stitched, got %v", c)
+	}
+}
+
+func TestStitch_Attribution(t *testing.T) {
+	base := solidTileServer(t, color.RGBA{R: 255, A: 255})
+	overlay := solidTileServer(t, color.RGBA{B: 255, A: 255})
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+
+	opts := bboxOptions()
+	opts.LayerMode = LayerModeOverlay
+	opts.Layers = []Layer{
+		{URL: base.URL + "/{z}/{x}/{y}.png", Opacity: 1, Attribution: "© OpenStreetMap contributors"},
+		{URL: overlay.URL + "/{z}/{x}/{y}.png", Opacity: 0, Attribution: "© OpenTopoMap"},
+		{URL: overlay.URL + "/{z}/{x}/{y}.png?labels", Opacity: 0, Attribution: "© OpenTopoMap"},
+		{URL: missing.URL + "/{z}/{x}/{y}.png", Opacity: 1, Attribution: "© Missing"},
+	}
+
+	result, err := New().Stitch(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+
+	// Duplicates are merged and layers without tiles aren't credited
+	want := "© OpenStreetMap contributors, © OpenTopoMap"
+	if result.Attribution != want {
+		t.Errorf("Expected attribution %q, got %q", want, result.Attribution)
+	}
+
+	img := decodeResult(t, result)
+	if got := img.RGBAAt(0, 0); got != (color.RGBA{R: 255, A: 255}) {
+		t.Errorf("Expected untouched pixel away from the attribution, got %v", got)
+	}
+	if got := img.RGBAAt(result.Width-1, result.Height-1); got == (color.RGBA{R: 255, A: 255}) {
+		t.Error("Expected the attribution box in the bottom-right corner")
+	}
+}
+
+func TestDrawAttribution_SubstitutesMissingGlyphs(t *testing.T) {
+	if got, want := printableText(basicfont.Face7x13, "© Géoportail – OSM™ 地图"), "(c) Geoportail - OSM(TM) ??"; got != want {
+		t.Errorf("Expected printable text %q, got %q", want, got)
+	}
+
+	render := func(text string) []byte {
+		buf := bytes.Repeat([]byte{255}, 200*20*4)
+		drawAttribution(buf, 200, 20, text)
+		return buf
+	}
+
+	// The symbol is drawn exactly like its spelled-out form, not as a box
+	if !bytes.Equal(render("© OpenStreetMap"), render("(c) OpenStreetMap")) {
+		t.Error("Expected © to be drawn as (c)")
+	}
+	if bytes.Equal(render("(c) OpenStreetMap"), render("(x) OpenStreetMap")) {
+		t.Error("Expected different text to draw different pixels")
+	}
+}
+
+func TestResult_PixelLatLonRoundTrip(t *testing.T) {
+	server := solidTileServer(t, color.RGBA{G: 255, A: 255})
+
+	for _, crs := range []int{CRSWebMercator, CRSWGS84} {
+		t.Run(fmt.Sprintf("EPSG:%d", crs), func(t *testing.T) {
+			opts := bboxOptions(server.URL + "/{z}/{x}/{y}.png")
+			opts.OutputCRS = crs
+
+			result, err := New().Stitch(context.Background(), opts)
+			if err != nil {
+				t.Fatalf("Stitch failed: %v", err)
+			}
+			gt := result.Geotransform()
+
+			corners := []struct {
+				px, py   int
+				lat, lon float64
+			}{
+				{px: 0, py: 0, lat: opts.MaxLat, lon: opts.MinLon},
+				{px: result.Width, py: 0, lat: opts.MaxLat, lon: opts.MaxLon},
+				{px: 0, py: result.Height, lat: opts.MinLat, lon: opts.MinLon},
+				{px: result.Width, py: result.Height, lat: opts.MinLat, lon: opts.MaxLon},
+			}
+			for _, c := range corners {
+				lat, lon := tile.PixelToLatLon(c.px, c.py, gt)
+				if math.Abs(lat-c.lat) > 1e-9 || math.Abs(lon-c.lon) > 1e-9 {
+					t.Errorf("Expected pixel (%d, %d) at (%v, %v), got (%v, %v)", c.px, c.py, c.lat, c.lon, lat, lon)
+				}
+
+				px, py := tile.LatLonToPixel(c.lat, c.lon, gt)
+				if math.Abs(px-float64(c.px)) > 1e-6 || math.Abs(py-float64(c.py)) > 1e-6 {
+					t.Errorf("Expected (%v, %v) at pixel (%d, %d), got (%v, %v)", c.lat, c.lon, c.px, c.py, px, py)
+				}
+			}
+		})
+	}
+}
+
+func TestStitch_FailureCauses(t *testing.T) {
+	testCases := []struct {
+		name     string
+		handler  http.HandlerFunc
+		cause    string
+		timedOut bool
+	}{
+		{"http status", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}, CauseHTTPStatus, false},
+		{"decode", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("\x89PNG broken"))
+		}, CauseDecode, false},
+		{"timeout", func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(2 * time.Second):
+			case <-r.Context().Done():
+			}
+		}, CauseTimeout, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(tc.handler)
+			defer server.Close()
+
+			opts := bboxOptions(server.URL + "/{z}/{x}/{y}.png")
+			opts.TileTimeout = 50 * time.Millisecond
+			_, err := New().Stitch(context.Background(), opts)
+
+			var tileErr *TileError
+			if !errors.As(err, &tileErr) {
+				t.Fatalf("Expected a TileError, got %v", err)
+			}
+			for _, ft := range tileErr.FailedTiles {
+				if ft.Cause != tc.cause {
+					t.Errorf("Expected cause %s for %s, got %q (%s)", tc.cause, ft.URL, ft.Cause, ft.Error)
+				}
+			}
+			if tileErr.TimedOut() != tc.timedOut {
+				t.Errorf("Expected TimedOut %v", tc.timedOut)
+			}
+		})
+	}
+}
+
+func TestStitch_RateLimited(t *testing.T) {
+	tiles := solidTileServer(t, color.RGBA{R: 255, A: 255})
+
+	var (
+		mu       sync.Mutex
+		requests int
+	)
+	// The first request is rate limited; later ones are served
+	limited := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		first := requests == 1
+		mu.Unlock()
+		if first {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		http.Redirect(w, r, tiles.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer limited.Close()
+
+	// Without retries the tile fails as rate limited
+	_, err := New().Stitch(context.Background(), bboxOptions(limited.URL+"/{z}/{x}/{y}.png"))
+	var tileErr *TileError
+	if !errors.As(err, &tileErr) {
+		t.Fatalf("Expected a TileError, got %v", err)
+	}
+	ft := tileErr.FailedTiles[0]
+	if !ft.RateLimited || ft.RetryAfter != time.Second || ft.StatusCode == nil || *ft.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected a rate-limited failure with Retry-After 1s, got %+v", ft)
+	}
+	if wait, limited := tileErr.RetryAfter(); !limited || wait != time.Second {
+		t.Errorf("Expected RetryAfter 1s, got %v (limited %v)", wait, limited)
+	}
+
+	// With a retry the stitcher waits out Retry-After and succeeds
+	mu.Lock()
+	requests = 0
+	mu.Unlock()
+
+	opts := bboxOptions(limited.URL + "/{z}/{x}/{y}.png")
+	opts.RateLimitRetries = 1
+	start := time.Now()
+	if _, err := New().Stitch(context.Background(), opts); err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Expected the retry to wait at least 1s, took %v", elapsed)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 2 {
+		t.Errorf("Expected 2 requests, got %d", requests)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{value: "", expected: 0},
+		{value: "30", expected: 30 * time.Second},
+		{value: "-5", expected: 0},
+		{value: "Mon, 01 Jan 2024 12:01:00 GMT", expected: time.Minute},
+		{value: "soon", expected: 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			if got := tile.ParseRetryAfter(tc.value, now); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestNewWithTransport_ReusesConnections(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		conns int
+	)
+	tiles := solidTileServer(t, color.RGBA{R: 255, A: 255})
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, err := http.Get(tiles.URL)
+		if err == nil {
+			io.Copy(w, resp.Body)
+			resp.Body.Close()
+		}
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	newConns := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		n := conns
+		conns = 0
+		return n
+	}
+
+	// 4x4 tiles at zoom 5
+	opts := bboxOptions(server.URL + "/{z}/{x}/{y}.png")
+	opts.Zoom = 5
+	opts.MaxLat, opts.MaxLon = 45, 45
+	opts.Concurrency = 4
+
+	t.Run("Pooled", func(t *testing.T) {
+		s := NewWithTransport(tile.TransportOptions{MaxIdleConnsPerHost: opts.Concurrency})
+
+		if _, err := s.Stitch(context.Background(), opts); err != nil {
+			t.Fatalf("Stitch failed: %v", err)
+		}
+		if n := newConns(); n > opts.Concurrency {
+			t.Errorf("Expected at most %d connections, got %d", opts.Concurrency, n)
+		}
+
+		// The idle pool holds every worker's connection for the next stitch
+		if _, err := s.Stitch(context.Background(), opts); err != nil {
+			t.Fatalf("Stitch failed: %v", err)
+		}
+		if n := newConns(); n != 0 {
+			t.Errorf("Expected no new connections, got %d", n)
+		}
+	})
+
+	t.Run("No keep-alive", func(t *testing.T) {
+		s := NewWithTransport(tile.TransportOptions{DisableKeepAlives: true})
+
+		result, err := s.Stitch(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("Stitch failed: %v", err)
+		}
+		if n := newConns(); n != result.TotalTiles {
+			t.Errorf("Expected a connection per tile (%d), got %d", result.TotalTiles, n)
+		}
+	})
+}
+
+// recordingTransport records the URL of every request before passing it on
+type recordingTransport struct {
+	mu   sync.Mutex
+	urls []string
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.mu.Lock()
+	rt.urls = append(rt.urls, req.URL.String())
+	rt.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestNewWithClient(t *testing.T) {
+	server := solidTileServer(t, color.RGBA{R: 255, A: 255})
+	transport := &recordingTransport{}
+	s := NewWithClient(&http.Client{Transport: transport})
+
+	opts := bboxOptions(server.URL + "/{z}/{x}/{y}.png")
+	opts.MaxLat, opts.MaxLon = 45, 45
+	result, err := s.Stitch(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+
+	slices.Sort(transport.urls)
+	want := []string{server.URL + "/3/4/2.png", server.URL + "/3/4/3.png", server.URL + "/3/5/2.png", server.URL + "/3/5/3.png"}
+	if !slices.Equal(transport.urls, want) {
+		t.Errorf("Expected the client to fetch %v, got %v", want, transport.urls)
+	}
+	if result.SuccessfulTiles != len(want) {
+		t.Errorf("Expected %d tiles, got %d", len(want), result.SuccessfulTiles)
+	}
+}
+
+func TestStitch_PolarLatitude(t *testing.T) {
+	server := solidTileServer(t, color.RGBA{0, 0, 255, 255})
+
+	opts := bboxOptions(server.URL + "/{z}/{x}/{y}.png")
+	opts.MinLat, opts.MaxLat = 80, 89
+
+	t.Run("Rejected", func(t *testing.T) {
+		_, err := New().Stitch(context.Background(), opts)
+		if !errors.Is(err, ErrLatitudeRange) {
+			t.Errorf("Expected ErrLatitudeRange, got %v", err)
+		}
+	})
+
+	t.Run("Clamped", func(t *testing.T) {
+		opts := *opts
+		opts.ClampLatitude = true
+
+		result, err := New().Stitch(context.Background(), &opts)
+		if err != nil {
+			t.Fatalf("Stitch failed: %v", err)
+		}
+		if !result.LatitudeClamped {
+			t.Error("Expected LatitudeClamped to be set")
+		}
+
+		gt := result.Geotransform()
+		for name, v := range map[string]float64{"MinX": gt.MinX, "MaxY": gt.MaxY, "PixelSizeX": gt.PixelSizeX, "PixelSizeY": gt.PixelSizeY} {
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				t.Errorf("Expected finite %s, got %v", name, v)
+			}
+		}
+		if result.Height == 0 {
+			t.Error("Expected a non-empty image")
+		}
+	})
+}
+
+func TestStitch_Authorization(t *testing.T) {
+	tile := solidTileServer(t, color.RGBA{G: 255, A: 255})
+
+	var (
+		mu   sync.Mutex
+		auth string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		auth = r.Header.Get("Authorization")
+		mu.Unlock()
+
+		if r.URL.Query().Get("deny") != "" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		resp, err := http.Get(tile.URL)
+		if err == nil {
+			io.Copy(w, resp.Body)
+			resp.Body.Close()
+		}
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		name        string
+		headers     map[string]string
+		basicAuth   *BasicAuth
+		bearerToken string
+		expected    string
+	}{
+		{
+			name:     "Header only",
+			headers:  map[string]string{"Authorization": "Token abc"},
+			expected: "Token abc",
+		},
+		{
+			name:      "Basic auth",
+			basicAuth: &BasicAuth{Username: "alice", Password: "secret"},
+			expected:  "Basic YWxpY2U6c2VjcmV0",
+		},
+		{
+			name:        "Bearer token overrides header",
+			headers:     map[string]string{"authorization": "Token abc"},
+			bearerToken: "xyz",
+			expected:    "Bearer xyz",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := bboxOptions(server.URL + "/{z}/{x}/{y}.png")
+			opts.Headers = tc.headers
+			opts.BasicAuth = tc.basicAuth
+			opts.BearerToken = tc.bearerToken
+
+			if _, err := New().Stitch(context.Background(), opts); err != nil {
+				t.Fatalf("Stitch failed: %v", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if auth != tc.expected {
+				t.Errorf("Expected Authorization %q, got %q", tc.expected, auth)
+			}
+		})
+	}
+
+	t.Run("Credentials not in errors", func(t *testing.T) {
+		opts := bboxOptions(server.URL + "/{z}/{x}/{y}.png?deny=1")
+		opts.BearerToken = "very-secret-token"
+
+		_, err := New().Stitch(context.Background(), opts)
+		if err == nil {
+			t.Fatal("Expected an error for rejected tiles")
+		}
+		if strings.Contains(err.Error(), opts.BearerToken) {
+			t.Errorf("Expected the error not to contain the token, got %v", err)
+		}
+	})
+
+	t.Run("Basic and bearer", func(t *testing.T) {
+		opts := bboxOptions(server.URL + "/{z}/{x}/{y}.png")
+		opts.BasicAuth = &BasicAuth{Username: "alice", Password: "secret"}
+		opts.BearerToken = "xyz"
+
+		if _, err := New().Stitch(context.Background(), opts); err == nil {
+			t.Error("Expected an error when combining basic auth and a bearer token")
+		}
+	})
+}
+
+func TestStitch_FallbackZoom(t *testing.T) {
+	red := color.RGBA{R: 255, A: 255}
+	quadrants := [2][2]color.RGBA{
+		{{G: 255, A: 255}, {B: 255, A: 255}},                 // top-left, top-right
+		{{R: 255, G: 255, A: 255}, {G: 255, B: 255, A: 255}}, // bottom-left, bottom-right
+	}
+
+	encode := func(fill func(x, y int) color.RGBA) []byte {
+		img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+		for y := 0; y < 256; y++ {
+			for x := 0; x < 256; x++ {
+				img.SetRGBA(x, y, fill(x, y))
+			}
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatalf("Failed to encode tile: %v", err)
+		}
+		return buf.Bytes()
+	}
+	solid := encode(func(x, y int) color.RGBA { return red })
+	parent := encode(func(x, y int) color.RGBA { return quadrants[y/128][x/128] })
+
+	opts := bboxOptions()
+	opts.MinLat, opts.MinLon, opts.MaxLat, opts.MaxLon = 10, 10, 10.5, 10.5
+	opts.Zoom = 10
+
+	// The z10 tile in the top-left corner is missing; its z9 parent exists
+	missingX, missingY := tile.LatLonToTile(opts.MaxLat, opts.MinLon, opts.Zoom)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var z, x, y uint32
+		fmt.Sscanf(r.URL.Path, "/%d/%d/%d.png", &z, &x, &y)
+		switch {
+		case z == 10 && x == missingX && y == missingY:
+			http.NotFound(w, r)
+		case z == 10:
+			w.Write(solid)
+		case z == 9 && x == missingX/2 && y == missingY/2:
+			w.Write(parent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	opts.TileURLs = []string{server.URL + "/{z}/{x}/{y}.png"}
+
+	t.Run("Without fallback", func(t *testing.T) {
+		result, err := New().Stitch(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("Stitch failed: %v", err)
+		}
+		if a := decodeResult(t, result).RGBAAt(0, 0).A; a != 0 {
+			t.Errorf("Expected a transparent hole, got alpha %d", a)
+		}
+	})
+
+	t.Run("With fallback", func(t *testing.T) {
+		opts := *opts
+		opts.FallbackZoom = true
+
+		result, err := New().Stitch(context.Background(), &opts)
+		if err != nil {
+			t.Fatalf("Stitch failed: %v", err)
+		}
+		if len(result.FailedTiles) != 0 {
+			t.Errorf("Expected no failed tiles, got %v", result.FailedTiles)
+		}
+		if result.FallbackTiles != 1 {
+			t.Errorf("Expected 1 fallback tile, got %d", result.FallbackTiles)
+		}
+
+		img := decodeResult(t, result)
+		for i := 3; i < len(img.Pix); i += 4 {
+			if img.Pix[i] != 255 {
+				t.Fatalf("Expected no transparent pixels, found one at offset %d", i/4)
+			}
+		}
+
+		// The missing tile is one quadrant of its parent, upscaled
+		want := quadrants[missingY%2][missingX%2]
+		if got := img.RGBAAt(0, 0); got != want {
+			t.Errorf("Expected the parent's quadrant color %v, got %v", want, got)
+		}
+	})
+}
+
+func TestAnimateCentered(t *testing.T) {
+	server := solidTileServer(t, color.RGBA{R: 255, A: 255})
+
+	opts := &Options{
+		Mode:      ModeCentered,
+		CenterLat: 15,
+		CenterLon: 15,
+		Width:     300,
+		Height:    200,
+		TileURLs:  []string{server.URL + "/{z}/{x}/{y}.png"},
+		TileSize:  256,
+	}
+
+	testCases := []struct {
+		name     string
+		anim     AnimationOptions
+		frames   int
+		expected int // frame delay in 1/100 s
+	}{
+		{name: "Zoom in", anim: AnimationOptions{ZoomFrom: 2, ZoomTo: 5, FrameDelay: 250 * time.Millisecond}, frames: 4, expected: 25},
+		{name: "Zoom out", anim: AnimationOptions{ZoomFrom: 4, ZoomTo: 3}, frames: 2, expected: 50},
+		{name: "Single frame", anim: AnimationOptions{ZoomFrom: 3, ZoomTo: 3}, frames: 1, expected: 50},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := New().AnimateCentered(context.Background(), opts, tc.anim)
+			if err != nil {
+				t.Fatalf("AnimateCentered failed: %v", err)
+			}
+
+			anim, err := gif.DecodeAll(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("Failed to decode GIF: %v", err)
+			}
+			if len(anim.Image) != tc.frames {
+				t.Fatalf("Expected %d frames, got %d", tc.frames, len(anim.Image))
+			}
+			for i, frame := range anim.Image {
+				if frame.Bounds().Dx() != 300 || frame.Bounds().Dy() != 200 {
+					t.Errorf("Expected frame %d to be 300x200, got %v", i, frame.Bounds())
+				}
+				if anim.Delay[i] != tc.expected {
+					t.Errorf("Expected delay %d for frame %d, got %d", tc.expected, i, anim.Delay[i])
+				}
+			}
+		})
+	}
+
+	t.Run("Bounding box", func(t *testing.T) {
+		if _, err := New().AnimateCentered(context.Background(), bboxOptions(server.URL+"/{z}/{x}/{y}.png"), AnimationOptions{ZoomFrom: 2, ZoomTo: 3}); err == nil {
+			t.Error("Expected an error for bounding box mode")
+		}
+	})
+}
+
+func TestStitch_RegisteredDecoder(t *testing.T) {
+	// A made-up format: a signature followed by one RGBA color for the whole tile
+	magic := []byte("SOLIDTILE")
+	tile.RegisterDecoder(magic, func(data []byte) (*tile.ImageData, error) {
+		if len(data) != len(magic)+4 {
+			return nil, fmt.Errorf("truncated tile")
+		}
+		c := data[len(magic):]
+		buf := make([]byte, 256*256*4)
+		for i := 0; i < len(buf); i += 4 {
+			copy(buf[i:i+4], c)
+		}
+		return &tile.ImageData{Buf: buf, Width: 256, Height: 256, Depth: 4}, nil
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(append(append([]byte(nil), magic...), 10, 20, 30, 255))
+	}))
+	defer server.Close()
+
+	result, err := New().Stitch(context.Background(), bboxOptions(server.URL+"/{z}/{x}/{y}.solid"))
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+
+	want := color.RGBA{10, 20, 30, 255}
+	if got := decodeResult(t, result).RGBAAt(0, 0); got != want {
+		t.Errorf("Expected pixel %v from the registered decoder, got %v", want, got)
+	}
+}
+
+func TestResult_Footprint(t *testing.T) {
+	server := solidTileServer(t, color.RGBA{B: 255, A: 255})
+
+	result, err := New().Stitch(context.Background(), bboxOptions(server.URL+"/{z}/{x}/{y}.png"))
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+
+	var polygon struct {
+		Type        string         `json:"type"`
+		Coordinates [][][2]float64 `json:"coordinates"`
+	}
+	if err := json.Unmarshal(result.Footprint(), &polygon); err != nil {
+		t.Fatalf("Failed to decode footprint: %v", err)
+	}
+	if polygon.Type != "Polygon" {
+		t.Errorf("Expected a Polygon, got %s", polygon.Type)
+	}
+	if len(polygon.Coordinates) != 1 {
+		t.Fatalf("Expected one ring, got %d", len(polygon.Coordinates))
+	}
+
+	// bboxOptions covers 10..20 in both directions
+	want := [][2]float64{{10, 10}, {20, 10}, {20, 20}, {10, 20}, {10, 10}}
+	ring := polygon.Coordinates[0]
+	if len(ring) != len(want) {
+		t.Fatalf("Expected %d positions, got %d", len(want), len(ring))
+	}
+	for i := range want {
+		if math.Abs(ring[i][0]-want[i][0]) > 1e-9 || math.Abs(ring[i][1]-want[i][1]) > 1e-9 {
+			t.Errorf("Expected position %d at %v, got %v", i, want[i], ring[i])
+		}
+	}
+}
+
+func TestStitch_UserAgent(t *testing.T) {
+	source := solidTileServer(t, color.RGBA{G: 255, A: 255})
+
+	var (
+		mu        sync.Mutex
+		userAgent string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		userAgent = r.Header.Get("User-Agent")
+		mu.Unlock()
+
+		resp, err := http.Get(source.URL)
+		if err == nil {
+			io.Copy(w, resp.Body)
+			resp.Body.Close()
+		}
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		name      string
+		headers   map[string]string
+		userAgent string
+		expected  string
+	}{
+		{
+			name:     "Default",
+			expected: tile.DefaultUserAgent,
+		},
+		{
+			name:      "Source override",
+			userAgent: "my-map-app/1.0 (maps@example.com)",
+			expected:  "my-map-app/1.0 (maps@example.com)",
+		},
+		{
+			name:      "Source override beats header",
+			headers:   map[string]string{"user-agent": "from-header/1.0"},
+			userAgent: "my-map-app/1.0 (maps@example.com)",
+			expected:  "my-map-app/1.0 (maps@example.com)",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := bboxOptions(server.URL + "/{z}/{x}/{y}.png")
+			opts.Headers = tc.headers
+			opts.UserAgent = tc.userAgent
+
+			if _, err := New().Stitch(context.Background(), opts); err != nil {
+				t.Fatalf("Stitch failed: %v", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if userAgent != tc.expected {
+				t.Errorf("Expected User-Agent %q, got %q", tc.expected, userAgent)
+			}
+		})
+	}
+}
+
+func TestStitch_RefererAndOrigin(t *testing.T) {
+	source := solidTileServer(t, color.RGBA{G: 255, A: 255})
+
+	var (
+		mu              sync.Mutex
+		referer, origin string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		referer, origin = r.Header.Get("Referer"), r.Header.Get("Origin")
+		mu.Unlock()
+
+		resp, err := http.Get(source.URL)
+		if err == nil {
+			io.Copy(w, resp.Body)
+			resp.Body.Close()
+		}
+	}))
+	defer server.Close()
+
+	opts := bboxOptions(server.URL + "/{z}/{x}/{y}.png")
+	opts.Headers = map[string]string{"referer": "https://other.example.com/", "X-Client": "test"}
+	opts.Referer = "https://maps.example.com/"
+	opts.Origin = "https://maps.example.com"
+
+	if _, err := New().Stitch(context.Background(), opts); err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if referer != "https://maps.example.com/" {
+		t.Errorf("Expected Referer %q to override the header, got %q", "https://maps.example.com/", referer)
+	}
+	if origin != "https://maps.example.com" {
+		t.Errorf("Expected Origin %q, got %q", "https://maps.example.com", origin)
+	}
+}
+
+func TestStitch_AutoResample(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 512, 512))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = 0, 0, 255, 255
+	}
+	var tile512 bytes.Buffer
+	if err := png.Encode(&tile512, img); err != nil {
+		t.Fatalf("Failed to encode tile: %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(tile512.Bytes())
+	}))
+	defer server.Close()
+
+	t.Run("Rejected without resampling", func(t *testing.T) {
+		opts := bboxOptions(server.URL + "/{z}/{x}/{y}.png")
+		if _, err := New().Stitch(context.Background(), opts); err == nil {
+			t.Error("Expected an error for 512px tiles")
+		}
+	})
+
+	t.Run("Resampled", func(t *testing.T) {
+		opts := bboxOptions(server.URL + "/{z}/{x}/{y}.png")
+		opts.AutoResample = true
+
+		result, err := New().Stitch(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("Stitch failed: %v", err)
+		}
+		if len(result.FailedTiles) != 0 {
+			t.Errorf("Expected no failed tiles, got %d", len(result.FailedTiles))
+		}
+
+		// The geometry stays at 256px tiles
+		reference, err := New().Stitch(context.Background(), bboxOptions(solidTileServer(t, color.RGBA{B: 255, A: 255}).URL+"/{z}/{x}/{y}.png"))
+		if err != nil {
+			t.Fatalf("Reference stitch failed: %v", err)
+		}
+		if result.Width != reference.Width || result.Height != reference.Height {
+			t.Errorf("Expected %dx%d, got %dx%d", reference.Width, reference.Height, result.Width, result.Height)
+		}
+
+		out := decodeResult(t, result)
+		if c := out.RGBAAt(result.Width/2, result.Height/2); c != (color.RGBA{B: 255, A: 255}) {
+			t.Errorf("Expected blue, got %v", c)
+		}
+	})
+}
+
+func TestStitch_TileGrid(t *testing.T) {
+	blue := color.RGBA{B: 255, A: 255}
+	red := color.RGBA{R: 255, A: 255}
+	opts := bboxOptions(solidTileServer(t, blue).URL + "/{z}/{x}/{y}.png")
+	opts.Zoom = 6 // 2x2 tiles
+	opts.DrawTileGrid = true
+	opts.GridColor = red
+
+	bounds, err := ComputeBounds(opts)
+	if err != nil {
+		t.Fatalf("Failed to compute bounds: %v", err)
+	}
+	result, err := New().Stitch(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+	img := decodeResult(t, result)
+
+	isBoundary := func(v, offset int) bool {
+		return (v+offset)%opts.TileSize == 0
+	}
+	boundaries := 0
+	for x := 0; x < result.Width; x++ {
+		if isBoundary(x, bounds.OffsetX) {
+			boundaries++
+		}
+		for y := 0; y < result.Height; y++ {
+			expected := blue
+			if isBoundary(x, bounds.OffsetX) || isBoundary(y, bounds.OffsetY) {
+				expected = red
+			}
+			if c := img.RGBAAt(x, y); c != expected {
+				t.Fatalf("Expected %v at %d,%d, got %v", expected, x, y, c)
+			}
+		}
+	}
+	if boundaries == 0 {
+		t.Fatal("Expected the area to cross a tile boundary")
+	}
+}
+
+func TestStitch_DPI(t *testing.T) {
+	opts := bboxOptions(solidTileServer(t, color.RGBA{G: 255, A: 255}).URL + "/{z}/{x}/{y}.png")
+	opts.DPI = 300
+
+	result, err := New().Stitch(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+
+	// Walk the chunks after the signature looking for pHYs
+	data := result.ImageData[8:]
+	var phys []byte
+	for len(data) >= 12 {
+		length := binary.BigEndian.Uint32(data)
+		kind := string(data[4:8])
+		if kind == "IDAT" && phys == nil {
+			t.Fatal("Expected pHYs before the image data")
+		}
+		if kind == "pHYs" {
+			phys = data[8 : 8+length]
+			if crc := binary.BigEndian.Uint32(data[8+length:]); crc != crc32.ChecksumIEEE(data[4:8+length]) {
+				t.Error("pHYs chunk has a bad CRC")
+			}
+		}
+		data = data[12+length:]
+	}
+	if len(phys) != 9 {
+		t.Fatalf("Expected a 9 byte pHYs chunk, got %v", phys)
+	}
+
+	// 300 DPI is 11811 pixels per meter
+	x, y := binary.BigEndian.Uint32(phys), binary.BigEndian.Uint32(phys[4:])
+	if x != 11811 || y != 11811 || phys[8] != 1 {
+		t.Errorf("Expected 11811x11811 pixels per meter, got %dx%d (unit %d)", x, y, phys[8])
+	}
+
+	// The image must still decode
+	decodeResult(t, result)
+}
+
+func TestResample(t *testing.T) {
+	// A black and a white pixel, upscaled to four
+	img := &ImageData{buf: []byte{0, 0, 0, 255, 255, 255, 255, 255}, width: 2, height: 1, depth: 4}
+
+	testCases := []struct {
+		name     string
+		method   int
+		expected []byte
+	}{
+		{"Nearest", ResamplingNearest, []byte{0, 0, 255, 255}},
+		{"Bilinear", ResamplingBilinear, []byte{0, 64, 191, 255}},
+		{"Bicubic", ResamplingBicubic, []byte{0, 52, 203, 255}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			out := resample(img, image.Rect(0, 0, 2, 1), 4, 1, tc.method)
+			for x, expected := range tc.expected {
+				if v := out.buf[x*4]; v != expected {
+					t.Errorf("Expected %d at x=%d, got %d", expected, x, v)
+				}
+				if a := out.buf[x*4+3]; a != 255 {
+					t.Errorf("Expected opaque pixel at x=%d, got alpha %d", x, a)
+				}
+			}
+		})
+	}
+}
+
+func TestStitch_NotImageTiles(t *testing.T) {
+	var valid bytes.Buffer
+	if err := png.Encode(&valid, image.NewRGBA(image.Rect(0, 0, 256, 256))); err != nil {
+		t.Fatalf("Failed to encode tile: %v", err)
+	}
+	errorPage := []byte("<html>\n<body><h1>Service Unavailable</h1></body>\n</html>")
+
+	testCases := []struct {
+		name        string
+		contentType string
+		contentMD5  string
+		body        []byte
+		expected    string
+	}{
+		{
+			name:        "HTML error page",
+			contentType: "text/html; charset=utf-8",
+			body:        errorPage,
+			expected:    `not an image: got text/html (56 bytes): "<html> <body><h1>Service Unavailable</h1></body> </html>"`,
+		},
+		{
+			name:        "HTML sent as PNG",
+			contentType: "image/png",
+			body:        errorPage,
+			expected:    `not an image: got text/html (56 bytes)`,
+		},
+		{
+			name:        "Truncated",
+			contentType: "image/png",
+			body:        valid.Bytes()[:12],
+			expected:    "not an image: 12 bytes is too small for a tile",
+		},
+		{
+			name:        "Content-MD5 mismatch",
+			contentType: "image/png",
+			contentMD5:  base64.StdEncoding.EncodeToString(make([]byte, 16)),
+			body:        valid.Bytes(),
+			expected:    "corrupt download:",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tc.contentType)
+				if tc.contentMD5 != "" {
+					w.Header().Set("Content-MD5", tc.contentMD5)
+				}
+				w.Write(tc.body)
+			}))
+			defer server.Close()
+
+			_, err := New().Stitch(context.Background(), bboxOptions(server.URL+"/{z}/{x}/{y}.png"))
+			var tileErr *TileError
+			if !errors.As(err, &tileErr) {
+				t.Fatalf("Expected a TileError, got %v", err)
+			}
+			if len(tileErr.FailedTiles) == 0 {
+				t.Fatal("Expected failed tiles")
+			}
+			if reason := tileErr.FailedTiles[0].Error; !strings.HasPrefix(reason, tc.expected) {
+				t.Errorf("Expected failure reason starting with %q, got %q", tc.expected, reason)
+			}
+		})
+	}
+
+	t.Run("Matching Content-MD5", func(t *testing.T) {
+		sum := md5.Sum(valid.Bytes())
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+			w.Write(valid.Bytes())
+		}))
+		defer server.Close()
+
+		opts := bboxOptions(server.URL + "/{z}/{x}/{y}.png")
+		opts.AllowEmpty = true
+		if _, err := New().Stitch(context.Background(), opts); err != nil {
+			t.Errorf("Stitch failed: %v", err)
+		}
+	})
+}
+
+func TestStitch_GzipEncodedTiles(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i+2], img.Pix[i+3] = 255, 255
+	}
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if err := png.Encode(zw, img); err != nil {
+		t.Fatalf("Failed to encode tile: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed to compress tile: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		name    string
+		headers map[string]string
+	}{
+		{"Transport decompresses", nil},
+		{"Custom Accept-Encoding", map[string]string{"Accept-Encoding": "gzip"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := bboxOptions(server.URL + "/{z}/{x}/{y}.png")
+			opts.Headers = tc.headers
+			result, err := New().Stitch(context.Background(), opts)
+			if err != nil {
+				t.Fatalf("Stitch failed: %v", err)
+			}
+
+			want := color.RGBA{B: 255, A: 255}
+			if got := decodeResult(t, result).RGBAAt(0, 0); got != want {
+				t.Errorf("Expected pixel %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestStitch_GzipBomb(t *testing.T) {
+	// Compresses to about 16 KiB but inflates past maxTileBytes
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(make([]byte, maxTileBytes+1)); err != nil {
+		t.Fatalf("Failed to compress tile: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed to compress tile: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		name    string
+		headers map[string]string
+	}{
+		{"Transport decompresses", nil},
+		{"Custom Accept-Encoding", map[string]string{"Accept-Encoding": "gzip"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := bboxOptions(server.URL + "/{z}/{x}/{y}.png")
+			opts.Headers = tc.headers
+			_, err := New().Stitch(context.Background(), opts)
+
+			var tileErr *TileError
+			if !errors.As(err, &tileErr) {
+				t.Fatalf("Expected a TileError, got %v", err)
+			}
+			for _, ft := range tileErr.FailedTiles {
+				if ft.Cause != CauseDecode || !strings.Contains(ft.Error, "larger than 16 MiB") {
+					t.Errorf("Expected a decode failure for the oversized body, got %s: %s", ft.Cause, ft.Error)
+				}
+			}
+		})
+	}
+}
+
+func TestStitch_CropMode(t *testing.T) {
+	server := solidTileServer(t, color.RGBA{G: 255, A: 255})
+
+	testCases := []struct {
+		name           string
+		cropMode       int
+		expectedWidth  int
+		expectedHeight int
+	}{
+		// The area starts 199px into its first tile column and 94px into its first row
+		{"Exact", CropExact, 455, 472},
+		{"Whole tiles", CropTiles, 768, 768},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := bboxOptions(server.URL + "/{z}/{x}/{y}.png")
+			opts.Zoom = 6
+			opts.CropMode = tc.cropMode
+
+			result, err := New().Stitch(context.Background(), opts)
+			if err != nil {
+				t.Fatalf("Stitch failed: %v", err)
+			}
+			if result.Width != tc.expectedWidth || result.Height != tc.expectedHeight {
+				t.Errorf("Expected %dx%d, got %dx%d", tc.expectedWidth, tc.expectedHeight, result.Width, result.Height)
+			}
+			if result.TotalTiles != 9 {
+				t.Errorf("Expected 9 tiles in both modes, got %d", result.TotalTiles)
+			}
+
+			// Whole tiles start at the tile grid: zoom 6 tiles are 1/64 of the world wide
+			if tc.cropMode == CropTiles {
+				tileWidth := 2 * 20037508.342789244 / 64
+				if offset := math.Mod(result.MinX+20037508.342789244, tileWidth); math.Abs(offset) > 1e-6 && math.Abs(offset-tileWidth) > 1e-6 {
+					t.Errorf("Expected the image to start on a tile edge, got MinX %f", result.MinX)
+				}
+				if math.Abs(result.PixelSizeX-tileWidth/256) > 1e-6 {
+					t.Errorf("Expected pixel size %f, got %f", tileWidth/256, result.PixelSizeX)
+				}
+			}
+		})
+	}
+
+	t.Run("Area ending on a tile edge", func(t *testing.T) {
+		// Zoom 1 tile 0/0 exactly; the area doesn't reach into the tiles east and south
+		opts := bboxOptions(server.URL + "/{z}/{x}/{y}.png")
+		opts.MinLat, opts.MinLon, opts.MaxLat, opts.MaxLon = 0, -180, 60, 0
+		opts.Zoom = 1
+		opts.CropMode = CropTiles
+
+		bounds, err := ComputeBounds(opts)
+		if err != nil {
+			t.Fatalf("ComputeBounds failed: %v", err)
+		}
+		if bounds.TileCount() != 1 || bounds.Width != 256 || bounds.Height != 256 {
+			t.Errorf("Expected one 256x256 tile, got %d tiles, %dx%d", bounds.TileCount(), bounds.Width, bounds.Height)
+		}
+	})
+}
+
+func TestStitch_LogsFailedTiles(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	var logs bytes.Buffer
+	opts := bboxOptions(server.URL + "/{z}/{x}/{y}.png")
+	opts.Logger = slog.New(slog.NewJSONHandler(&logs, nil))
+
+	// Every tile fails, so the stitch itself fails too
+	New().Stitch(context.Background(), opts)
+
+	var records []map[string]any
+	dec := json.NewDecoder(&logs)
+	for dec.More() {
+		var record map[string]any
+		if err := dec.Decode(&record); err != nil {
+			t.Fatalf("Failed to decode log record: %v", err)
+		}
+		records = append(records, record)
+	}
+	if len(records) == 0 {
+		t.Fatal("Expected a log record for the failed tile, got none")
+	}
+
+	record := records[0]
+	if record["msg"] != "tile failed" {
+		t.Errorf("Expected msg 'tile failed', got %v", record["msg"])
+	}
+	if record["level"] != "WARN" {
+		t.Errorf("Expected level WARN, got %v", record["level"])
+	}
+	if want := server.URL + "/3/4/3.png"; record["url"] != want {
+		t.Errorf("Expected url %s, got %v", want, record["url"])
+	}
+	if msg, _ := record["error"].(string); !strings.Contains(msg, "404") {
+		t.Errorf("Expected error mentioning 404, got %v", record["error"])
+	}
+}
+
+func TestStitch_FailureThresholds(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	var tileData bytes.Buffer
+	if err := png.Encode(&tileData, img); err != nil {
+		t.Fatalf("Failed to encode tile: %v", err)
+	}
+
+	testCases := []struct {
+		name           string
+		failed         int // of the 9 tiles
+		maxRatio       *float64
+		maxFailed      *int
+		expectedToFail bool
+	}{
+		{"Default ratio tolerates less than half", 4, nil, nil, false},
+		{"Default ratio fails more than half", 5, nil, nil, true},
+		{"Lower ratio", 2, float64Ptr(0.2), nil, true},
+		{"Lower ratio not reached", 1, float64Ptr(0.2), nil, false},
+		{"Ratio of 1 tolerates all but one", 8, float64Ptr(1), nil, false},
+		{"Zero ratio allows no failure", 1, float64Ptr(0), nil, true},
+		{"Zero ratio without failures", 0, float64Ptr(0), nil, false},
+		{"Count exceeded below the ratio", 3, nil, intPtr(2), true},
+		{"Count reached", 2, nil, intPtr(2), false},
+		{"Count exceeded above a ratio of 1", 8, float64Ptr(1), intPtr(7), true},
+		{"Zero count allows no failure", 1, nil, intPtr(0), true},
+		{"Zero count without failures", 0, nil, intPtr(0), false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Fail the first requests; which tiles fail doesn't matter
+			var mu sync.Mutex
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				requests++
+				fail := requests <= tc.failed
+				mu.Unlock()
+				if fail {
+					http.NotFound(w, r)
+					return
+				}
+				w.Header().Set("Content-Type", "image/png")
+				w.Write(tileData.Bytes())
+			}))
+			defer server.Close()
+
+			opts := bboxOptions(server.URL + "/{z}/{x}/{y}.png")
+			opts.Zoom = 6
+			opts.AllowEmpty = true
+			opts.MaxFailureRatio = tc.maxRatio
+			opts.MaxFailedTiles = tc.maxFailed
+
+			result, err := New().Stitch(context.Background(), opts)
+			if !tc.expectedToFail {
+				if err != nil {
+					t.Fatalf("Stitch failed: %v", err)
+				}
+				if len(result.FailedTiles) != tc.failed {
+					t.Errorf("Expected %d failed tiles, got %d", tc.failed, len(result.FailedTiles))
+				}
+				return
+			}
+
+			var tileErr *TileError
+			if !errors.As(err, &tileErr) {
+				t.Fatalf("Expected a TileError, got %v", err)
+			}
+			if len(tileErr.FailedTiles) != tc.failed || tileErr.TotalTiles != 9 {
+				t.Errorf("Expected %d/9 failed tiles, got %d/%d", tc.failed, len(tileErr.FailedTiles), tileErr.TotalTiles)
+			}
+		})
+	}
+
+	t.Run("Ratio outside 0 to 1", func(t *testing.T) {
+		opts := bboxOptions("http://127.0.0.1:0/{z}/{x}/{y}.png")
+		opts.MaxFailureRatio = float64Ptr(1.5)
+		if _, err := New().Stitch(context.Background(), opts); err == nil || !strings.Contains(err.Error(), "max failure ratio") {
+			t.Errorf("Expected a max failure ratio error, got %v", err)
+		}
+	})
+
+	t.Run("Negative count", func(t *testing.T) {
+		opts := bboxOptions("http://127.0.0.1:0/{z}/{x}/{y}.png")
+		opts.MaxFailedTiles = intPtr(-1)
+		if _, err := New().Stitch(context.Background(), opts); err == nil || !strings.Contains(err.Error(), "max failed tiles") {
+			t.Errorf("Expected a max failed tiles error, got %v", err)
+		}
+	})
+}
+
+func float64Ptr(v float64) *float64 {
+	return &v
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestStitch_512PixelTiles(t *testing.T) {
+	// Every tile is filled with a color encoding its column and row
+	tileColor := func(x, y int) color.RGBA {
+		return color.RGBA{R: uint8(x), G: uint8(y), B: 255, A: 255}
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var z, x, y int
+		fmt.Sscanf(r.URL.Path, "/%d/%d/%d.png", &z, &x, &y)
+		img := image.NewRGBA(image.Rect(0, 0, 512, 512))
+		c := tileColor(x, y)
+		for i := 0; i < len(img.Pix); i += 4 {
+			img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+		}
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, img)
+	}))
+	defer server.Close()
+
+	opts := bboxOptions(server.URL + "/{z}/{x}/{y}.png")
+	opts.Zoom = 5
+	opts.TileSize = 512
+
+	bounds, err := ComputeBounds(opts)
+	if err != nil {
+		t.Fatalf("Failed to compute bounds: %v", err)
+	}
+
+	// 512px tiles at zoom 5 have the pixel grid of 256px tiles at zoom 6
+	reference := bboxOptions()
+	reference.Zoom = 6
+	referenceBounds, err := ComputeBounds(reference)
+	if err != nil {
+		t.Fatalf("Failed to compute bounds: %v", err)
+	}
+	if bounds.Width != referenceBounds.Width || bounds.Height != referenceBounds.Height {
+		t.Errorf("Expected %dx%d like 256px tiles one zoom deeper, got %dx%d", referenceBounds.Width, referenceBounds.Height, bounds.Width, bounds.Height)
+	}
+	if expected := referenceBounds.OffsetX + int(referenceBounds.MinTileX%2)*256; bounds.OffsetX != expected {
+		t.Errorf("Expected x offset %d, got %d", expected, bounds.OffsetX)
+	}
+	if expected := referenceBounds.OffsetY + int(referenceBounds.MinTileY%2)*256; bounds.OffsetY != expected {
+		t.Errorf("Expected y offset %d, got %d", expected, bounds.OffsetY)
+	}
+
+	result, err := New().Stitch(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+	img := decodeResult(t, result)
+	if img.Bounds().Dx() != bounds.Width || img.Bounds().Dy() != bounds.Height {
+		t.Fatalf("Expected %dx%d, got %v", bounds.Width, bounds.Height, img.Bounds())
+	}
+
+	// Every pixel, including both sides of each seam, comes from the tile
+	// its position in the 512px grid falls into
+	for y := 0; y < bounds.Height; y++ {
+		for x := 0; x < bounds.Width; x++ {
+			tx := int(bounds.MinTileX) + (x+bounds.OffsetX)/512
+			ty := int(bounds.MinTileY) + (y+bounds.OffsetY)/512
+			if got := img.RGBAAt(x, y); got != tileColor(tx, ty) {
+				t.Fatalf("Expected pixel %d,%d from tile %d/%d, got %v", x, y, tx, ty, got)
+			}
+		}
+	}
+
+	// Centered sizes are pixels of the 512px tiles, not of 256px ones
+	centered := &Options{Mode: ModeCentered, CenterLat: 15, CenterLon: 15, Width: 400, Height: 300, Zoom: 5, TileSize: 512}
+	centeredBounds, err := ComputeBounds(centered)
+	if err != nil {
+		t.Fatalf("Failed to compute bounds: %v", err)
+	}
+	if centeredBounds.Width != 400 || centeredBounds.Height != 300 {
+		t.Errorf("Expected 400x300, got %dx%d", centeredBounds.Width, centeredBounds.Height)
+	}
+}
+
+func TestStitch_Proxy(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	var tileData bytes.Buffer
+	if err := png.Encode(&tileData, img); err != nil {
+		t.Fatalf("Failed to encode tile: %v", err)
+	}
+
+	// The proxy answers requests for the unresolvable tile host itself
+	var mu sync.Mutex
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		proxied = append(proxied, r.URL.String())
+		mu.Unlock()
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(tileData.Bytes())
+	}))
+	defer proxy.Close()
+
+	opts := bboxOptions("http://tiles.invalid/{z}/{x}/{y}.png")
+	opts.ProxyURL = proxy.URL
+
+	result, err := New().Stitch(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+	if result.SuccessfulTiles != result.TotalTiles {
+		t.Errorf("Expected all %d tiles, got %d", result.TotalTiles, result.SuccessfulTiles)
+	}
+	if len(proxied) != result.TotalTiles || proxied[0] != "http://tiles.invalid/3/4/3.png" {
+		t.Errorf("Expected the proxy to receive the %d tile requests, got %v", result.TotalTiles, proxied)
+	}
+
+	t.Run("Unsupported scheme", func(t *testing.T) {
+		opts := bboxOptions("http://tiles.invalid/{z}/{x}/{y}.png")
+		opts.ProxyURL = "ftp://proxy.example.com"
+		if _, err := New().Stitch(context.Background(), opts); err == nil || !strings.Contains(err.Error(), "scheme") {
+			t.Errorf("Expected a proxy scheme error, got %v", err)
+		}
+	})
+
+	t.Run("Bounded client cache", func(t *testing.T) {
+		s := New()
+		proxyURL := func(i int) string { return fmt.Sprintf("http://proxy%d.example.com", i) }
+		first, err := s.clientFor(proxyURL(0), false)
+		if err != nil {
+			t.Fatalf("clientFor failed: %v", err)
+		}
+		var last *http.Client
+		for i := 1; i <= maxProxyClients; i++ {
+			if last, err = s.clientFor(proxyURL(i), false); err != nil {
+				t.Fatalf("clientFor failed: %v", err)
+			}
+		}
+
+		if len(s.proxyClients) != maxProxyClients || s.proxyLRU.Len() != maxProxyClients {
+			t.Errorf("Expected %d cached clients, got %d", maxProxyClients, len(s.proxyClients))
+		}
+		if _, ok := s.proxyClients[proxyURL(0)]; ok {
+			t.Error("Expected the least recently used client to be evicted")
+		}
+		again, _ := s.clientFor(proxyURL(0), false)
+		if again == first {
+			t.Error("Expected a new client for the evicted proxy")
+		}
+		if client, _ := s.clientFor(proxyURL(maxProxyClients), false); client != last {
+			t.Error("Expected the cached client to be reused")
+		}
+	})
+}
+
+func TestStitch_InsecureSkipVerify(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	var tileData bytes.Buffer
+	if err := png.Encode(&tileData, img); err != nil {
+		t.Fatalf("Failed to encode tile: %v", err)
+	}
+
+	// The test server's certificate is self-signed
+	tiles := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(tileData.Bytes())
+	}))
+	defer tiles.Close()
+
+	stitcher := New()
+	_, err := stitcher.Stitch(context.Background(), bboxOptions(tiles.URL+"/{z}/{x}/{y}.png"))
+	var tileErr *TileError
+	if !errors.As(err, &tileErr) || !strings.Contains(tileErr.FailedTiles[0].Error, "certificate") {
+		t.Fatalf("Expected certificate failures, got %v", err)
+	}
+
+	// The same stitcher skips verification only for stitches asking for it
+	opts := bboxOptions(tiles.URL + "/{z}/{x}/{y}.png")
+	opts.InsecureSkipVerify = true
+	result, err := stitcher.Stitch(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+	if result.SuccessfulTiles != result.TotalTiles {
+		t.Errorf("Expected all %d tiles, got %d", result.TotalTiles, result.SuccessfulTiles)
+	}
+
+	if _, err := stitcher.Stitch(context.Background(), bboxOptions(tiles.URL+"/{z}/{x}/{y}.png")); err == nil {
+		t.Error("Expected verification to stay on for other stitches")
+	}
+}
+
+func TestComputeBounds_CenteredMeters(t *testing.T) {
+	// At zoom 10 a 256 pixel tile spans 152.87 m per pixel at the equator,
+	// half of that at 60 degrees north
+	width, height := MetersToPixels(10000, 5000, 60, 10, 256, CRSWebMercator)
+	if width != 131 || height != 65 {
+		t.Errorf("Expected 131x65 pixels, got %dx%d", width, height)
+	}
+
+	opts := &Options{
+		Mode:         ModeCentered,
+		CenterLat:    60,
+		CenterLon:    10,
+		WidthMeters:  10000,
+		HeightMeters: 5000,
+		Zoom:         10,
+		TileSize:     256,
+	}
+	bounds, err := ComputeBounds(opts)
+	if err != nil {
+		t.Fatalf("Failed to compute bounds: %v", err)
+	}
+	if bounds.Width != 131 || bounds.Height != 65 {
+		t.Errorf("Expected a 131x65 image, got %dx%d", bounds.Width, bounds.Height)
+	}
+
+	// WGS84 zoom 10 has the pixels of Web Mercator zoom 11 at the equator,
+	// which don't shrink from north to south
+	width, height = MetersToPixels(10000, 5000, 60, 10, 256, CRSWGS84)
+	if width != 262 || height != 65 {
+		t.Errorf("Expected 262x65 WGS84 pixels, got %dx%d", width, height)
+	}
+
+	invalid := []struct {
+		name                      string
+		width                     int
+		widthMeters, heightMeters float64
+	}{
+		{"pixels and meters", 640, 10000, 5000},
+		{"only width in meters", 0, 10000, 0},
+		{"negative meters", 0, -10000, 5000},
+	}
+	for _, tc := range invalid {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := &Options{
+				Mode:         ModeCentered,
+				CenterLat:    60,
+				CenterLon:    10,
+				Width:        tc.width,
+				WidthMeters:  tc.widthMeters,
+				HeightMeters: tc.heightMeters,
+				Zoom:         10,
+				TileSize:     256,
+			}
+			if _, err := ComputeBounds(opts); err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+}
+
+func TestComputeBounds_CenteredNearPole(t *testing.T) {
+	for _, crs := range []int{CRSWebMercator, CRSWGS84} {
+		for _, lat := range []float64{89.9, -89.9} {
+			t.Run(fmt.Sprintf("EPSG:%d/%g", crs, lat), func(t *testing.T) {
+				opts := &Options{
+					Mode:          ModeCentered,
+					CenterLat:     lat,
+					CenterLon:     10,
+					Width:         512,
+					Height:        512,
+					Zoom:          10,
+					TileSize:      256,
+					OutputCRS:     crs,
+					ClampLatitude: true,
+				}
+
+				bounds, err := ComputeBounds(opts)
+				if err != nil {
+					t.Fatalf("Failed to compute bounds: %v", err)
+				}
+				if bounds.MinLat >= bounds.MaxLat {
+					t.Errorf("Expected MinLat below MaxLat, got %g and %g", bounds.MinLat, bounds.MaxLat)
+				}
+				if bounds.Width != 512 || bounds.Height != 512 {
+					t.Errorf("Expected a 512x512 image, got %dx%d", bounds.Width, bounds.Height)
+				}
+
+				// The window is shifted to end at the edge of the map, which
+				// has 1024 rows of tiles at zoom 10 in both schemes
+				edge := bounds.MinTileY
+				if lat < 0 {
+					edge = 1023 - bounds.MaxTileY
+				}
+				if edge != 0 {
+					t.Errorf("Expected the window to touch the map edge, got tiles %d to %d", bounds.MinTileY, bounds.MaxTileY)
+				}
+			})
+		}
+	}
+
+	// A window taller than the map can't be shifted into it
+	opts := &Options{Mode: ModeCentered, CenterLat: 0, Width: 256, Height: 1024, Zoom: 1, TileSize: 256}
+	if _, err := ComputeBounds(opts); err == nil {
+		t.Error("Expected an error for an image taller than the map")
+	}
+}
+
+func TestFetchOrder(t *testing.T) {
+	raster := fetchOrder(10, 20, 12, 22, FetchOrderRaster)
+	if raster[0] != (tilePosition{x: 10, y: 20}) || raster[8] != (tilePosition{x: 12, y: 22}) {
+		t.Errorf("Expected raster order from the top left, got %v", raster)
+	}
+
+	spiral := fetchOrder(10, 20, 12, 22, FetchOrderSpiral)
+	if len(spiral) != 9 {
+		t.Fatalf("Expected 9 positions, got %d", len(spiral))
+	}
+	if spiral[0] != (tilePosition{x: 11, y: 21}) {
+		t.Errorf("Expected the center tile first, got %v", spiral[0])
+	}
+	// The four edge neighbours come before the corners
+	for i, pos := range spiral[1:5] {
+		if pos.x != 11 && pos.y != 21 {
+			t.Errorf("Expected an edge neighbour at %d, got %v", i+1, pos)
+		}
+	}
+	seen := make(map[tilePosition]bool)
+	for _, pos := range spiral {
+		seen[pos] = true
+	}
+	if len(seen) != 9 {
+		t.Errorf("Expected every position exactly once, got %v", spiral)
+	}
+}
+
+func TestStitch_CenteredExactSize(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 300, 300))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	var tile300 bytes.Buffer
+	if err := png.Encode(&tile300, img); err != nil {
+		t.Fatalf("Failed to encode tile: %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(tile300.Bytes())
+	}))
+	defer server.Close()
+
+	// The span of 640 pixels of 300 pixel tiles isn't a whole number of
+	// tile coordinates, which used to cost a pixel
+	for _, tileSize := range []int{256, 300} {
+		t.Run(strconv.Itoa(tileSize), func(t *testing.T) {
+			opts := &Options{
+				Mode:         ModeCentered,
+				CenterLat:    -60,
+				CenterLon:    -146.261,
+				Width:        640,
+				Height:       480,
+				Zoom:         22,
+				TileSize:     tileSize,
+				TileURLs:     []string{server.URL + "/{z}/{x}/{y}.png"},
+				AutoResample: true,
+			}
+			result, err := New().Stitch(context.Background(), opts)
+			if err != nil {
+				t.Fatalf("Stitch failed: %v", err)
+			}
+			if result.Width != 640 || result.Height != 480 {
+				t.Errorf("Expected a 640x480 image, got %dx%d", result.Width, result.Height)
+			}
+			decoded, err := png.Decode(bytes.NewReader(result.ImageData))
+			if err != nil {
+				t.Fatalf("Failed to decode result: %v", err)
+			}
+			if b := decoded.Bounds(); b.Dx() != 640 || b.Dy() != 480 {
+				t.Errorf("Expected a 640x480 PNG, got %dx%d", b.Dx(), b.Dy())
+			}
+		})
+	}
+}
+
+func TestStitch_MaxDimension(t *testing.T) {
+	server := solidTileServer(t, color.RGBA{G: 255, A: 255})
+
+	opts := &Options{
+		Mode:      ModeCentered,
+		CenterLat: 37.8,
+		CenterLon: -122.4,
+		Width:     640,
+		Height:    480,
+		Zoom:      10,
+		TileSize:  256,
+		TileURLs:  []string{server.URL + "/{z}/{x}/{y}.png"},
+	}
+	full, err := New().Stitch(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+
+	opts.MaxDimension = 200
+	opts.GenerateWorldFile = true
+	result, err := New().Stitch(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+	if result.Width != 200 || result.Height != 150 {
+		t.Errorf("Expected a 200x150 image, got %dx%d", result.Width, result.Height)
+	}
+	decoded, err := png.Decode(bytes.NewReader(result.ImageData))
+	if err != nil {
+		t.Fatalf("Failed to decode result: %v", err)
+	}
+	if b := decoded.Bounds(); b.Dx() != result.Width || b.Dy() != result.Height {
+		t.Errorf("Expected a %dx%d PNG, got %dx%d", result.Width, result.Height, b.Dx(), b.Dy())
+	}
+	if got := decoded.At(100, 75); got != (color.RGBA{G: 255, A: 255}) && got != (color.NRGBA{G: 255, A: 255}) {
+		t.Errorf("Expected the tile color to survive scaling, got %v", got)
+	}
+
+	// The pixels cover the same area, so they're 3.2 times as large
+	if math.Abs(result.PixelSizeX-full.PixelSizeX*3.2) > 1e-6 || math.Abs(result.PixelSizeY-full.PixelSizeY*3.2) > 1e-6 {
+		t.Errorf("Expected pixel sizes %g x %g, got %g x %g",
+			full.PixelSizeX*3.2, full.PixelSizeY*3.2, result.PixelSizeX, result.PixelSizeY)
+	}
+	if !bytes.Contains(result.WorldFileData, []byte(fmt.Sprintf("%24.10f", result.PixelSizeX))) {
+		t.Errorf("Expected the world file to have the scaled pixel size, got %s", result.WorldFileData)
+	}
+
+	// Images within the limit keep their size
+	opts.MaxDimension = 1000
+	if result, err := New().Stitch(context.Background(), opts); err != nil || result.Width != 640 {
+		t.Errorf("Expected the 640 pixel image unchanged, got %v", err)
+	}
+}
+
+func TestStitch_MaxDimensionAveragesStripes(t *testing.T) {
+	// One white column in every four, which point sampling at 4:1 either
+	// always hits or always misses
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for y := 0; y < 256; y++ {
+		for x := 0; x < 256; x++ {
+			img.Set(x, y, color.RGBA{A: 255})
+			if x%4 == 0 {
+				img.Set(x, y, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+			}
+		}
+	}
+	var tileData bytes.Buffer
+	if err := png.Encode(&tileData, img); err != nil {
+		t.Fatalf("Failed to encode tile: %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(tileData.Bytes())
+	}))
+	defer server.Close()
+
+	opts := &Options{
+		Mode:         ModeCentered,
+		CenterLat:    37.8,
+		CenterLon:    -122.4,
+		Width:        640,
+		Height:       640,
+		Zoom:         10,
+		TileSize:     256,
+		TileURLs:     []string{server.URL + "/{z}/{x}/{y}.png"},
+		MaxDimension: 160,
+	}
+	for _, method := range []int{ResamplingBilinear, ResamplingBicubic} {
+		opts.Resampling = method
+		result, err := New().Stitch(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("Stitch failed: %v", err)
+		}
+		decoded := decodeResult(t, result)
+		for x := 40; x < 120; x++ {
+			if got := decoded.RGBAAt(x, 80); got.R < 63 || got.R > 65 {
+				t.Fatalf("Resampling %d: expected the stripes averaged to gray 64 at x %d, got %v", method, x, got)
+			}
+		}
+	}
+}
+
+func TestStitch_ReprojectWGS84Source(t *testing.T) {
+	// WGS84 scheme tiles that record where every pixel came from: R is the
+	// row and G the column within the tile, B the tile's row
+	var (
+		mu    sync.Mutex
+		paths []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var z, x, y int
+		if _, err := fmt.Sscanf(r.URL.Path, "/%d/%d/%d.png", &z, &x, &y); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+
+		img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+		for py := 0; py < 256; py++ {
+			for px := 0; px < 256; px++ {
+				img.SetRGBA(px, py, color.RGBA{R: uint8(py), G: uint8(px), B: uint8(y), A: 255})
+			}
+		}
+		png.Encode(w, img)
+	}))
+	defer server.Close()
+
+	opts := &Options{
+		Mode:     ModeBBox,
+		MinLat:   40,
+		MinLon:   0,
+		MaxLat:   60,
+		MaxLon:   10,
+		Zoom:     3,
+		TileURLs: []string{server.URL + "/{z}/{x}/{y}.png"},
+		TileSize: 256,
+
+		SourceCRS: CRSWGS84,
+	}
+	result, err := New().Stitch(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+	if result.CRS != CRSWebMercator {
+		t.Errorf("Expected a Web Mercator image, got EPSG:%d", result.CRS)
+	}
+
+	// At zoom 3 the WGS84 scheme has 22.5° tiles, so the area needs column 8
+	// of rows 1 and 2
+	mu.Lock()
+	slices.Sort(paths)
+	if want := []string{"/3/8/1.png", "/3/8/2.png"}; !slices.Equal(paths, want) {
+		t.Errorf("Expected tiles %v, got %v", want, paths)
+	}
+	mu.Unlock()
+
+	// The center pixel of the Mercator image lies at lon 5 and a latitude
+	// north of the middle of 40 and 60, where the WGS84 grid has 4096
+	// pixels per 360°
+	img := decodeResult(t, result)
+	x, y := result.Width/2, result.Height/2
+	centerY := result.MaxY - (float64(y)+0.5)*result.PixelSizeY
+	lat := 360/math.Pi*math.Atan(math.Exp(centerY*math.Pi/20037508.342789244)) - 90
+	lon := (result.MinX + (float64(x)+0.5)*result.PixelSizeX) * 180 / 20037508.342789244
+	if lat < 50 || lat > 52 {
+		t.Fatalf("Expected the center pixel around 51°N, got %g", lat)
+	}
+
+	row := (90-lat)/360*4096 - 0.5
+	col := (lon+180)/360*4096 - 0.5
+	got := img.RGBAAt(x, y)
+	if got.B != uint8(row/256) {
+		t.Errorf("Expected the center pixel from tile row %d, got %d", int(row/256), got.B)
+	}
+	if want := math.Mod(row, 256); math.Abs(float64(got.R)-want) > 1 {
+		t.Errorf("Expected the center pixel from row %.1f of its tile, got %d", want, got.R)
+	}
+	if want := math.Mod(col, 256); math.Abs(float64(got.G)-want) > 1 {
+		t.Errorf("Expected the center pixel from column %.1f of its tile, got %d", want, got.G)
+	}
+
+	// Without reprojection, the same pixel comes from a different row of the
+	// tiles taken as Web Mercator ones
+	opts.SourceCRS = 0
+	plain, err := New().Stitch(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Stitch failed: %v", err)
+	}
+	if naive := decodeResult(t, plain).RGBAAt(x, y); naive == got {
+		t.Errorf("Expected reprojection to change the center pixel, both are %v", got)
+	}
+}
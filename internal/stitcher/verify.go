@@ -0,0 +1,83 @@
+package stitcher
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// minImageBytes is less than any real PNG, JPEG, GIF or WebP tile; bodies
+// this small that don't decode were cut off or never were images
+const minImageBytes = 26
+
+// maxSnippetBytes is how much of a text body NotImageError quotes
+const maxSnippetBytes = 80
+
+// NotImageError is returned for tiles the server answered 200 with
+// something other than an image, like an HTML error page or a truncated body
+type NotImageError struct {
+	ContentType string // text/html as sent or sniffed; empty for truncated bodies
+	Size        int
+	Snippet     string // start of a text body, with whitespace collapsed
+}
+
+func (e *NotImageError) Error() string {
+	switch {
+	case e.ContentType == "":
+		return fmt.Sprintf("not an image: %d bytes is too small for a tile, the download may be truncated", e.Size)
+	case e.Snippet != "":
+		return fmt.Sprintf("not an image: got %s (%d bytes): %q", e.ContentType, e.Size, e.Snippet)
+	default:
+		return fmt.Sprintf("not an image: got %s (%d bytes)", e.ContentType, e.Size)
+	}
+}
+
+// checkContentType rejects tile bodies the server declared as HTML
+func checkContentType(header http.Header, data []byte) error {
+	if mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil && mediaType == "text/html" {
+		return newNotImageError(mediaType, data)
+	}
+	return nil
+}
+
+// checkContentMD5 rejects a body that doesn't match the Content-MD5 header.
+// The header is rare but settles whether the body arrived intact; it covers
+// the body as sent, before any Content-Encoding is undone. Malformed values
+// are ignored.
+func checkContentMD5(header http.Header, data []byte) error {
+	value := header.Get("Content-MD5")
+	if value == "" {
+		return nil
+	}
+	want, err := base64.StdEncoding.DecodeString(value)
+	sum := md5.Sum(data)
+	if err == nil && len(want) == md5.Size && !bytes.Equal(want, sum[:]) {
+		return fmt.Errorf("corrupt download: body of %d bytes doesn't match Content-MD5 %s", len(data), value)
+	}
+	return nil
+}
+
+// sniffNotImage explains why a tile body that failed to decode isn't an
+// image, or returns nil when it looks like a damaged or unsupported image
+func sniffNotImage(data []byte) *NotImageError {
+	if strings.HasPrefix(http.DetectContentType(data), "text/html") {
+		return newNotImageError("text/html", data)
+	}
+	if len(data) < minImageBytes {
+		return &NotImageError{Size: len(data)}
+	}
+	return nil
+}
+
+func newNotImageError(contentType string, data []byte) *NotImageError {
+	snippet := data[:min(len(data), maxSnippetBytes)]
+	return &NotImageError{
+		ContentType: contentType,
+		Size:        len(data),
+		Snippet:     strings.Join(strings.Fields(strings.ToValidUTF8(string(snippet), "")), " "),
+	}
+}
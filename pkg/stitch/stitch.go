@@ -0,0 +1,198 @@
+// Package stitch downloads map tiles for an area and stitches them into a
+// single georeferenced image. It is the implementation behind the stitch
+// server, for use from other Go programs: it returns the encoded image
+// instead of writing files and never prints anything.
+//
+//	result, err := stitch.Stitch(ctx, stitch.Options{
+//		Mode:     stitch.ModeBBox,
+//		MinLat:   37.37, MinLon: -122.92, MaxLat: 38.23, MaxLon: -121.56,
+//		Zoom:     10,
+//		TileURLs: []string{"https://tile.example.com/{z}/{x}/{y}.png"},
+//		TileSize: 256,
+//	})
+package stitch
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/kiesman99/stitch/internal/stitcher"
+	"github.com/kiesman99/stitch/pkg/tile"
+)
+
+type (
+	// Options contains all stitching parameters
+	Options = stitcher.Options
+	// Result is a stitched image and its georeferencing
+	Result = stitcher.Result
+	// Layer is an overlay tile source for LayerModeOverlay
+	Layer = stitcher.Layer
+	// BasicAuth holds HTTP Basic credentials for tile requests
+	BasicAuth = stitcher.BasicAuth
+	// SourceCoverage is the area and zoom range a tile source has data for
+	SourceCoverage = stitcher.SourceCoverage
+	// Bounds is the tile and pixel geometry of a stitch
+	Bounds = stitcher.Bounds
+	// FailedTile describes a tile that couldn't be used
+	FailedTile = stitcher.FailedTile
+	// AnimationOptions selects the frames of a zoom animation
+	AnimationOptions = stitcher.AnimationOptions
+	// PyramidOptions selects the zoom levels and directory of a tile pyramid
+	PyramidOptions = stitcher.PyramidOptions
+	// Tile is a single tile as the tile server sent it, see Stitcher.FetchTile
+	Tile = stitcher.Tile
+
+	// TileError is returned when too many tiles failed
+	TileError = stitcher.TileError
+	// LimitError is returned when a request needs more tiles than allowed
+	LimitError = stitcher.LimitError
+	// SizeError is returned when the image would have more pixels than allowed
+	SizeError = stitcher.SizeError
+	// CoverageError is returned when the area is outside the source's
+	// declared coverage and Options.StrictCoverage is set
+	CoverageError = stitcher.CoverageError
+	// RateLimitError is returned for tiles the tile server rate limited
+	RateLimitError = stitcher.RateLimitError
+	// StatusError is returned for tiles answered with another error status
+	StatusError = stitcher.StatusError
+	// NotImageError describes tiles the server answered with an HTML page
+	// or a truncated body instead of an image
+	NotImageError = stitcher.NotImageError
+
+	// Stitcher stitches tiles with a connection pool shared by all calls
+	Stitcher = stitcher.Stitcher
+
+	// URLSigner adds the signature a tile server requires to tile URLs
+	URLSigner = stitcher.URLSigner
+)
+
+// Modes select how Options describe the area
+const (
+	ModeBBox      = stitcher.ModeBBox
+	ModeCentered  = stitcher.ModeCentered
+	ModeTileRange = stitcher.ModeTileRange
+)
+
+// Output formats
+const (
+	FormatPNG     = stitcher.FormatPNG
+	FormatGeoTIFF = stitcher.FormatGeoTIFF
+	FormatMBTiles = stitcher.FormatMBTiles
+)
+
+// Crop modes
+const (
+	CropExact = stitcher.CropExact
+	CropTiles = stitcher.CropTiles
+)
+
+// Output projections as EPSG codes
+const (
+	CRSWebMercator = stitcher.CRSWebMercator
+	CRSWGS84       = stitcher.CRSWGS84
+)
+
+// Layer modes
+const (
+	LayerModeFallback = stitcher.LayerModeFallback
+	LayerModeOverlay  = stitcher.LayerModeOverlay
+)
+
+// Resampling methods for scaled tiles and frames
+const (
+	ResamplingBilinear = stitcher.ResamplingBilinear
+	ResamplingNearest  = stitcher.ResamplingNearest
+	ResamplingBicubic  = stitcher.ResamplingBicubic
+)
+
+// Causes of tile failures, see FailedTile.Cause
+const (
+	CauseTimeout    = stitcher.CauseTimeout
+	CauseHTTPStatus = stitcher.CauseHTTPStatus
+	CauseDecode     = stitcher.CauseDecode
+	CauseNetwork    = stitcher.CauseNetwork
+)
+
+// Limits and defaults
+const (
+	DefaultMaxPixels         = stitcher.DefaultMaxPixels
+	DefaultMaxFallbackLevels = stitcher.DefaultMaxFallbackLevels
+	DefaultMaxFailureRatio   = stitcher.DefaultMaxFailureRatio
+	MaxMercatorLat           = stitcher.MaxMercatorLat
+)
+
+// Errors for requests that can't be stitched
+var (
+	ErrEmptyResult   = stitcher.ErrEmptyResult
+	ErrAntimeridian  = stitcher.ErrAntimeridian
+	ErrLatitudeRange = stitcher.ErrLatitudeRange
+)
+
+// defaultStitcher serves Stitch, so repeated calls reuse tile connections
+var defaultStitcher = stitcher.New()
+
+// Stitch downloads the tiles for the area of opts and returns the stitched
+// image. Cancelling ctx aborts the downloads.
+func Stitch(ctx context.Context, opts Options) (*Result, error) {
+	return defaultStitcher.Stitch(ctx, &opts)
+}
+
+// New returns a Stitcher with default connection settings
+func New() *Stitcher {
+	return stitcher.New()
+}
+
+// NewWithTransport returns a Stitcher whose connection pool is tuned by opts
+func NewWithTransport(opts tile.TransportOptions) *Stitcher {
+	return stitcher.NewWithTransport(opts)
+}
+
+// NewWithClient returns a Stitcher that downloads tiles with client, for
+// custom transports, TLS client certificates or tracing
+func NewWithClient(client *http.Client) *Stitcher {
+	return stitcher.NewWithClient(client)
+}
+
+// ParseResampling returns the resampling method for nearest, bilinear or
+// bicubic; an empty name is bilinear
+func ParseResampling(name string) (int, error) {
+	return stitcher.ParseResampling(name)
+}
+
+// HMACSigner returns a URLSigner appending an expiry ttl from the request
+// and the hex HMAC-SHA256 with key of the path and query up to it, as the
+// expires and signature query parameters
+func HMACSigner(key []byte, ttl time.Duration) URLSigner {
+	return stitcher.HMACSigner(key, ttl)
+}
+
+// MetersToPixels returns the image size in pixels of tileSize pixel tiles at
+// zoom that covers widthMeters by heightMeters on the ground around lat
+func MetersToPixels(widthMeters, heightMeters, lat float64, zoom, tileSize, crs int) (int, int) {
+	return stitcher.MetersToPixels(widthMeters, heightMeters, lat, zoom, tileSize, crs)
+}
+
+// ComputeBounds returns the tile range and image size for opts without
+// downloading anything
+func ComputeBounds(opts *Options) (*Bounds, error) {
+	return stitcher.ComputeBounds(opts)
+}
+
+// CheckLimits returns a LimitError when the stitch described by bounds needs
+// more tiles than opts allows, and a SizeError when it needs more pixels
+func CheckLimits(opts *Options, bounds *Bounds) error {
+	return stitcher.CheckLimits(opts, bounds)
+}
+
+// CheckHosts returns a tile.HostError when a tile URL or layer of opts
+// expands to a host opts.HostPolicy doesn't permit
+func CheckHosts(opts *Options) error {
+	return stitcher.CheckHosts(opts)
+}
+
+// ReservedPlaceholders returns the names of the placeholders the stitcher
+// fills in itself, such as z and bbox, and token, which URLParams shouldn't set
+func ReservedPlaceholders() []string {
+	return stitcher.ReservedPlaceholders()
+}
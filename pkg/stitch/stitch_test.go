@@ -0,0 +1,116 @@
+package stitch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// tileServer serves solid green 256px tiles
+func tileServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i+1], img.Pix[i+3] = 255, 255
+	}
+	var tile bytes.Buffer
+	if err := png.Encode(&tile, img); err != nil {
+		t.Fatalf("Failed to encode tile: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(tile.Bytes())
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestStitch(t *testing.T) {
+	url := tileServer(t).URL + "/{z}/{x}/{y}.png"
+
+	testCases := []struct {
+		name           string
+		opts           Options
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{
+			name: "Bounding box",
+			opts: Options{
+				Mode:     ModeBBox,
+				MinLat:   10,
+				MinLon:   10,
+				MaxLat:   20,
+				MaxLon:   20,
+				Zoom:     6,
+				TileURLs: []string{url},
+				TileSize: 256,
+			},
+			expectedWidth:  455,
+			expectedHeight: 472,
+		},
+		{
+			name: "Centered",
+			opts: Options{
+				Mode:      ModeCentered,
+				CenterLat: 37.7749,
+				CenterLon: -122.4194,
+				Width:     300,
+				Height:    200,
+				Zoom:      12,
+				TileURLs:  []string{url},
+				TileSize:  256,
+			},
+			expectedWidth:  300,
+			expectedHeight: 200,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := Stitch(context.Background(), tc.opts)
+			if err != nil {
+				t.Fatalf("Stitch failed: %v", err)
+			}
+			if result.Width != tc.expectedWidth || result.Height != tc.expectedHeight {
+				t.Errorf("Expected %dx%d, got %dx%d", tc.expectedWidth, tc.expectedHeight, result.Width, result.Height)
+			}
+
+			img, err := png.Decode(bytes.NewReader(result.ImageData))
+			if err != nil {
+				t.Fatalf("Failed to decode result: %v", err)
+			}
+			if img.Bounds().Dx() != result.Width || img.Bounds().Dy() != result.Height {
+				t.Errorf("Expected a %dx%d image, got %v", result.Width, result.Height, img.Bounds())
+			}
+			if c := color.RGBAModel.Convert(img.At(result.Width/2, result.Height/2)); c != (color.RGBA{G: 255, A: 255}) {
+				t.Errorf("Expected green, got %v", c)
+			}
+		})
+	}
+}
+
+func TestStitch_Errors(t *testing.T) {
+	_, err := Stitch(context.Background(), Options{
+		Mode:     ModeBBox,
+		MinLat:   10,
+		MinLon:   170,
+		MaxLat:   20,
+		MaxLon:   -170,
+		Zoom:     3,
+		TileURLs: []string{tileServer(t).URL + "/{z}/{x}/{y}.png"},
+		TileSize: 256,
+	})
+	if !errors.Is(err, ErrAntimeridian) {
+		t.Errorf("Expected ErrAntimeridian, got %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+package tile
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Cache stores downloaded tiles on disk so an interrupted stitch can be
+// resumed: tiles that are already cached aren't downloaded again. Entries
+// are keyed on the request (see RequestKey), which is the same from run to
+// run for the same parameters.
+//
+// With a TTL, entries older than it are revalidated with the tile server
+// using the ETag and Last-Modified of the response they came from.
+type Cache struct {
+	dir string
+	ttl time.Duration
+}
+
+// CacheEntry is a cached tile and the validators of its response
+type CacheEntry struct {
+	Data         []byte    `json:"-"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Stored       time.Time `json:"-"` // when the tile was stored or last revalidated
+}
+
+// NewCache returns a cache that stores tiles below dir. The directory is
+// created on the first write.
+func NewCache(dir string) *Cache {
+	return &Cache{dir: dir}
+}
+
+// SetTTL makes entries older than ttl stale, so they're revalidated or
+// downloaded again; 0 (the default) keeps entries fresh forever
+func (c *Cache) SetTTL(ttl time.Duration) {
+	c.ttl = ttl
+}
+
+// Fresh reports whether an entry can be used without asking the tile server
+func (c *Cache) Fresh(e *CacheEntry) bool {
+	return c.ttl <= 0 || time.Since(e.Stored) < c.ttl
+}
+
+// RequestKey returns the cache key of a tile request. Plain GET requests are
+// keyed on the URL alone.
+func RequestKey(method, url, body string) string {
+	if method == http.MethodGet && body == "" {
+		return url
+	}
+	return method + " " + url + "\n" + body
+}
+
+// cacheable reports whether a response body is worth caching: the server
+// labels it as an image or it decodes as one. Some tile servers answer errors
+// with 200 and an HTML or JSON page, which must not be served from the cache.
+func cacheable(contentType string, data []byte) bool {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && strings.HasPrefix(mediaType, "image/") {
+		return true
+	}
+	_, err := Decode(data)
+	return err == nil
+}
+
+// path returns the file for a key, spread over 256 subdirectories
+func (c *Cache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(c.dir, name[:2], name)
+}
+
+// Get returns the cached tile for key, if any
+func (c *Cache) Get(key string) ([]byte, bool) {
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// Entry returns the cached tile for key with its validators, if any
+func (c *Cache) Entry(key string) (*CacheEntry, bool) {
+	path := c.path(key)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+
+	entry := &CacheEntry{Data: data, Stored: info.ModTime()}
+	// Validators are optional; a missing or broken file just means the
+	// entry can't be revalidated
+	if meta, err := os.ReadFile(path + ".validators"); err == nil {
+		json.Unmarshal(meta, entry)
+	}
+	return entry, true
+}
+
+// Touch marks the entry for key as fresh again after the tile server
+// confirmed it's unchanged
+func (c *Cache) Touch(key string) error {
+	now := time.Now()
+	return os.Chtimes(c.path(key), now, now)
+}
+
+// Has reports whether key is cached
+func (c *Cache) Has(key string) bool {
+	_, err := os.Stat(c.path(key))
+	return err == nil
+}
+
+// Put stores a tile without validators
+func (c *Cache) Put(key string, data []byte) error {
+	return c.PutEntry(key, &CacheEntry{Data: data})
+}
+
+// PutEntry stores a tile and its validators. Files are written under a
+// temporary name and renamed into place, so an interrupted write never
+// leaves a truncated tile behind.
+func (c *Cache) PutEntry(key string, e *CacheEntry) error {
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// The tile goes first: if writing the validators is interrupted, the old
+	// ones no longer match and the next revalidation downloads the tile again
+	if err := writeFileAtomic(path, e.Data); err != nil {
+		return err
+	}
+	if e.ETag == "" && e.LastModified == "" {
+		if err := os.Remove(path + ".validators"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	meta, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path+".validators", meta)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it into place
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tile-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
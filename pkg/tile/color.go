@@ -0,0 +1,39 @@
+package tile
+
+import (
+	"fmt"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+// ParseColor parses a #RRGGBB or #RRGGBBAA hex color; the # is optional
+func ParseColor(s string) (color.RGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) != 6 && len(hex) != 8 {
+		return color.RGBA{}, fmt.Errorf("invalid color %q: expected #RRGGBB or #RRGGBBAA", s)
+	}
+
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid color %q: %v", s, err)
+	}
+	if len(hex) == 6 {
+		v = v<<8 | 0xFF
+	}
+
+	return color.RGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, nil
+}
+
+// ApplyBackground returns a copy of an RGBA buffer composited over bg, so
+// transparent areas take the background color
+func ApplyBackground(buf []byte, bg color.RGBA) []byte {
+	out := make([]byte, len(buf))
+	under := [4]byte{bg.R, bg.G, bg.B, bg.A}
+	for i := 0; i+3 < len(buf); i += 4 {
+		// AlphaBlend keeps its second argument on top
+		px := AlphaBlend(under, [4]byte{buf[i], buf[i+1], buf[i+2], buf[i+3]})
+		copy(out[i:i+4], px[:])
+	}
+	return out
+}
@@ -0,0 +1,126 @@
+package tile
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"sync"
+)
+
+// DecoderFunc decodes tile data. The returned ImageData holds 4 bytes (RGBA)
+// per pixel; Depth records the channels of the source format.
+type DecoderFunc func(data []byte) (*ImageData, error)
+
+// decoder is a registered tile format
+type decoder struct {
+	magic  []byte
+	decode DecoderFunc
+}
+
+var (
+	decodersMu sync.RWMutex
+	decoders   []decoder
+)
+
+// RegisterDecoder adds a decoder for tiles that start with magic, e.g. for
+// WebP or a provider's own format. Decoders registered later are tried
+// first, so a built-in PNG or JPEG decoder can be replaced.
+func RegisterDecoder(magic []byte, fn DecoderFunc) {
+	decodersMu.Lock()
+	defer decodersMu.Unlock()
+	decoders = append(decoders, decoder{magic: append([]byte(nil), magic...), decode: fn})
+}
+
+// Decode decodes tile data with the decoder registered for its signature
+func Decode(data []byte) (*ImageData, error) {
+	decodersMu.RLock()
+	var fn DecoderFunc
+	for i := len(decoders) - 1; i >= 0; i-- {
+		if bytes.HasPrefix(data, decoders[i].magic) {
+			fn = decoders[i].decode
+			break
+		}
+	}
+	decodersMu.RUnlock()
+
+	if fn == nil {
+		return nil, fmt.Errorf("unrecognized image format")
+	}
+	return fn(data)
+}
+
+func init() {
+	RegisterDecoder([]byte{0x89, 0x50, 0x4E, 0x47}, decodePNG)
+	RegisterDecoder([]byte{0xFF, 0xD8}, decodeJPEG)
+}
+
+// ImageDataFromImage converts a decoded image to RGBA ImageData with the
+// given source depth, for DecoderFuncs built on image.Decode-style decoders.
+// The color channels are not premultiplied by alpha, as AlphaBlend expects.
+func ImageDataFromImage(img image.Image, depth int) *ImageData {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	buf := make([]byte, width*height*4)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+			idx := (y*width + x) * 4
+			buf[idx] = c.R
+			buf[idx+1] = c.G
+			buf[idx+2] = c.B
+			buf[idx+3] = c.A
+		}
+	}
+
+	return &ImageData{
+		Buf:    buf,
+		Width:  width,
+		Height: height,
+		Depth:  depth,
+	}
+}
+
+// decodePNG decodes a PNG tile
+func decodePNG(data []byte) (*ImageData, error) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ImageDataFromImage(img, pngDepth(img)), nil
+}
+
+// pngDepth returns the channels of a decoded PNG: 1 for grayscale, 3 for
+// opaque color and 4 when it has transparency. The png package decodes
+// images with a tRNS chunk or an alpha channel to NRGBA, except paletted
+// ones, whose palette tells.
+func pngDepth(img image.Image) int {
+	switch img := img.(type) {
+	case *image.Gray, *image.Gray16:
+		return 1
+	case *image.RGBA, *image.RGBA64:
+		return 3
+	case *image.Paletted:
+		for _, c := range img.Palette {
+			if _, _, _, a := c.RGBA(); a != 0xffff {
+				return 4
+			}
+		}
+		return 3
+	default:
+		return 4
+	}
+}
+
+// decodeJPEG decodes a JPEG tile; JPEG has no alpha, so every pixel is opaque
+func decodeJPEG(data []byte) (*ImageData, error) {
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ImageDataFromImage(img, 3), nil
+}
@@ -0,0 +1,51 @@
+package tile
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// geoJSONPolygon is a GeoJSON Polygon geometry
+type geoJSONPolygon struct {
+	Type        string         `json:"type"`
+	Coordinates [][][2]float64 `json:"coordinates"`
+}
+
+// Footprint returns the area as a GeoJSON Polygon in WGS84. The ring runs
+// counterclockwise from the south-west corner, as RFC 7946 requires.
+func Footprint(minLat, minLon, maxLat, maxLon float64) []byte {
+	polygon := geoJSONPolygon{
+		Type: "Polygon",
+		Coordinates: [][][2]float64{{
+			{minLon, minLat},
+			{maxLon, minLat},
+			{maxLon, maxLat},
+			{minLon, maxLat},
+			{minLon, minLat},
+		}},
+	}
+	data, _ := json.Marshal(polygon)
+	return data
+}
+
+// ImageFootprint returns the extent of a width x height image georeferenced
+// by gt as a GeoJSON Polygon in WGS84, so it matches what the world file or
+// VRT of the image claims rather than the requested area
+func ImageFootprint(gt *Geotransform, width, height int) []byte {
+	maxLat, minLon := PixelToLatLon(0, 0, gt)
+	minLat, maxLon := PixelToLatLon(width, height, gt)
+	return Footprint(minLat, minLon, maxLat, maxLon)
+}
+
+// WriteFootprint writes the GeoJSON footprint of a width x height image
+// georeferenced by gt to filename
+func WriteFootprint(filename string, gt *Geotransform, width, height int) error {
+	data := append(ImageFootprint(gt, width, height), '\n')
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(Log, "Footprint written to '%s'.\n", filename)
+	return nil
+}
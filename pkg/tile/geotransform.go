@@ -0,0 +1,47 @@
+package tile
+
+import "math"
+
+// Geotransform georeferences a stitched image: the upper-left corner of
+// pixel (0, 0) is at (MinX, MaxY), and every pixel spans PixelSizeX by
+// PixelSizeY. These are the values written to world files.
+type Geotransform struct {
+	MinX, MaxY float64
+	PixelSizeX float64
+	PixelSizeY float64
+
+	// Geographic is set when the coordinates are WGS84 degrees (EPSG:4326)
+	// rather than Spherical Mercator meters (EPSG:3857)
+	Geographic bool
+}
+
+// UnprojectXY converts Spherical Mercator XY back to WGS84 lat/lon; it is
+// the inverse of ProjectLatLon
+func UnprojectXY(x, y float64) (float64, float64) {
+	const originshift = 20037508.342789244 // 2 * pi * 6378137 / 2
+	lon := x * 180.0 / originshift
+	lat := math.Atan(math.Exp(y*math.Pi/originshift))*360.0/math.Pi - 90
+
+	return lat, lon
+}
+
+// PixelToLatLon returns the lat/lon of the upper-left corner of pixel
+// (px, py). Passing the image width and height gives the lower-right corner.
+func PixelToLatLon(px, py int, gt *Geotransform) (float64, float64) {
+	x := gt.MinX + float64(px)*gt.PixelSizeX
+	y := gt.MaxY - float64(py)*gt.PixelSizeY
+	if gt.Geographic {
+		return y, x
+	}
+	return UnprojectXY(x, y)
+}
+
+// LatLonToPixel returns the fractional pixel position of lat/lon in the
+// image; truncate it to get the pixel that contains the point
+func LatLonToPixel(lat, lon float64, gt *Geotransform) (float64, float64) {
+	x, y := lon, lat
+	if !gt.Geographic {
+		x, y = ProjectLatLon(lat, lon)
+	}
+	return (x - gt.MinX) / gt.PixelSizeX, (gt.MaxY - y) / gt.PixelSizeY
+}
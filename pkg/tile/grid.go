@@ -0,0 +1,79 @@
+package tile
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// DefaultGridColor is the color of tile grid lines when none is configured
+var DefaultGridColor = color.RGBA{R: 255, A: 255}
+
+// Grid describes the tile layout of a stitched image for DrawGrid
+type Grid struct {
+	TileSize           int
+	OffsetX, OffsetY   int    // position of the image's top-left pixel in its tile
+	Zoom               int    // for labels
+	MinTileX, MinTileY uint32 // tile of the image's top-left pixel, for labels
+	Color              color.RGBA
+	Labels             bool // write z/x/y in the top-left corner of every tile
+}
+
+// DrawGrid draws a 1px line along the first row and column of every tile
+// in the RGBA buffer, so tiles that are copied off by a pixel stand out
+func DrawGrid(buf []byte, width, height int, g Grid) {
+	if g.TileSize <= 0 {
+		return
+	}
+	c := g.Color
+	if c.A == 0 {
+		c = DefaultGridColor
+	}
+	// Lines go over the image; translucent colors let it show through
+	a := float64(c.A) / 255
+	set := func(x, y int) {
+		i := (y*width + x) * 4
+		buf[i] = byte(float64(c.R)*a + float64(buf[i])*(1-a) + 0.5)
+		buf[i+1] = byte(float64(c.G)*a + float64(buf[i+1])*(1-a) + 0.5)
+		buf[i+2] = byte(float64(c.B)*a + float64(buf[i+2])*(1-a) + 0.5)
+		buf[i+3] = byte(float64(c.A) + float64(buf[i+3])*(1-a) + 0.5)
+	}
+
+	// A tile starts where the offset from the first tile's origin is a
+	// multiple of the tile size
+	firstX := (g.TileSize - g.OffsetX%g.TileSize) % g.TileSize
+	firstY := (g.TileSize - g.OffsetY%g.TileSize) % g.TileSize
+	for x := firstX; x < width; x += g.TileSize {
+		for y := 0; y < height; y++ {
+			set(x, y)
+		}
+	}
+	for y := firstY; y < height; y += g.TileSize {
+		for x := 0; x < width; x++ {
+			// Crossings are already drawn; blending twice would darken them
+			if x < firstX || (x-firstX)%g.TileSize != 0 {
+				set(x, y)
+			}
+		}
+	}
+
+	if !g.Labels {
+		return
+	}
+	img := &image.RGBA{Pix: buf, Stride: width * 4, Rect: image.Rect(0, 0, width, height)}
+	face := basicfont.Face7x13
+	d := &font.Drawer{Dst: img, Src: image.NewUniform(c), Face: face}
+	for row := 0; row*g.TileSize-g.OffsetY < height; row++ {
+		for col := 0; col*g.TileSize-g.OffsetX < width; col++ {
+			// Labels of tiles cut off at the top or left go into the visible part
+			x := max(col*g.TileSize-g.OffsetX, 0)
+			y := max(row*g.TileSize-g.OffsetY, 0)
+			d.Dot = fixed.P(x+3, y+3+face.Metrics().Ascent.Ceil())
+			d.DrawString(fmt.Sprintf("%d/%d/%d", g.Zoom, g.MinTileX+uint32(col), g.MinTileY+uint32(row)))
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package tile
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// ErrPrivateAddress is returned when a transport with BlockPrivateAddresses
+// is asked to connect to a loopback, private or link-local address
+var ErrPrivateAddress = errors.New("connecting to private addresses is not allowed")
+
+// HostPolicy restricts the hosts tile URLs may point at, so a public server
+// can't be used to reach internal services
+type HostPolicy struct {
+	// Allowed lists the permitted hosts; "*.example.com" permits the
+	// subdomains of example.com. Empty permits every host.
+	Allowed []string
+
+	// BlockPrivate rejects loopback, private and link-local IP addresses
+	// and localhost. Host names that resolve to such addresses are only
+	// caught when connecting, by TransportOptions.BlockPrivateAddresses.
+	BlockPrivate bool
+}
+
+// HostError is returned for a URL whose host a HostPolicy doesn't permit
+type HostError struct {
+	Host   string
+	Reason string // e.g. "is a private address"
+}
+
+func (e *HostError) Error() string {
+	return "host " + e.Host + " " + e.Reason
+}
+
+// Check returns an error when the host of the URL template is not permitted
+// by the policy. Placeholders in the host can still expand to any host, so
+// check the expanded URLs with CheckURL as well.
+func (p HostPolicy) Check(template string) error {
+	return p.checkHost(templateHost(template))
+}
+
+// CheckURL returns an error when the host of a URL, such as an expanded tile
+// URL or a redirect target, is not permitted by the policy
+func (p HostPolicy) CheckURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %v", err)
+	}
+	return p.checkHost(strings.ToLower(u.Hostname()))
+}
+
+// checkHost applies the policy to a lowercase host name or IP address
+func (p HostPolicy) checkHost(host string) error {
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	if host == "" {
+		return fmt.Errorf("URL has no host")
+	}
+
+	if p.BlockPrivate {
+		if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+			return &HostError{Host: host, Reason: "is not allowed"}
+		}
+		if ip := net.ParseIP(host); ip != nil && PrivateAddress(ip) {
+			return &HostError{Host: host, Reason: "is a private address"}
+		}
+	}
+
+	if len(p.Allowed) == 0 {
+		return nil
+	}
+	for _, allowed := range p.Allowed {
+		allowed = strings.ToLower(allowed)
+		if suffix, ok := strings.CutPrefix(allowed, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return nil
+			}
+		} else if host == allowed {
+			return nil
+		}
+	}
+	return &HostError{Host: host, Reason: "is not in the allowed hosts"}
+}
+
+// PrivateAddress reports whether ip is an unspecified, loopback, private
+// (RFC 1918 and RFC 4193) or link-local address, which covers cloud
+// metadata endpoints like 169.254.169.254
+func PrivateAddress(ip net.IP) bool {
+	return ip.IsUnspecified() ||
+		ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast()
+}
+
+// refusePrivateAddresses is a net.Dialer Control function that fails
+// connections to private addresses after host names are resolved
+func refusePrivateAddresses(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || PrivateAddress(ip) {
+		return fmt.Errorf("%s: %w", host, ErrPrivateAddress)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package tile
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// MetadataAuto as StitchOptions.Metadata writes the metadata next to the
+// output image (see MetadataFilename)
+const MetadataAuto = "auto"
+
+// Metadata is a machine-readable record of a stitched image
+type Metadata struct {
+	BoundingBox MetadataBBox  `json:"bbox"`
+	Zoom        int           `json:"zoom"`
+	CRS         string        `json:"crs"`
+	Width       int           `json:"width"`
+	Height      int           `json:"height"`
+	PixelSize   [2]float64    `json:"pixel_size"` // x, y in CRS units
+	Origin      [2]float64    `json:"origin"`     // upper-left corner in CRS units
+	Sources     []string      `json:"sources"`    // tile URL templates
+	Tiles       MetadataTiles `json:"tiles"`
+}
+
+// MetadataBBox is the geographic extent of the image in degrees
+type MetadataBBox struct {
+	MinLat float64 `json:"min_lat"`
+	MinLon float64 `json:"min_lon"`
+	MaxLat float64 `json:"max_lat"`
+	MaxLon float64 `json:"max_lon"`
+}
+
+// MetadataTiles counts the tile downloads of a stitch
+type MetadataTiles struct {
+	Total      int `json:"total"`
+	Successful int `json:"successful"`
+	Failed     int `json:"failed"`
+}
+
+// MetadataFilename returns the sidecar path for an output image, the image
+// name with its extension replaced by .json
+func MetadataFilename(output string) string {
+	name := output
+	if idx := strings.LastIndex(name, "."); idx != -1 && !strings.ContainsAny(name[idx:], `/\`) {
+		name = name[:idx]
+	}
+	return name + ".json"
+}
+
+// WriteMetadata writes the metadata as JSON to filename
+func WriteMetadata(filename string, meta *Metadata) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(filename, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(Log, "Metadata written to '%s'.\n", filename)
+	return nil
+}
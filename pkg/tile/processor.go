@@ -2,30 +2,151 @@ package tile
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"image"
-	"image/jpeg"
 	"image/png"
 	"io"
 	"math"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// Log receives the status messages of the Write functions, such as the name
+// of each file written. Set it to io.Discard to silence them.
+var Log io.Writer = os.Stderr
+
+// DefaultTimeout bounds a single tile request, including reading the body
+const DefaultTimeout = 30 * time.Second
+
+// DefaultRetryBackoff is the wait before the first retry of a failed tile;
+// it doubles with every further attempt
+const DefaultRetryBackoff = time.Second
+
+// MaxRetryWait is the longest Retry-After a processor waits out before
+// retrying; longer waits fail the tile instead
+const MaxRetryWait = time.Minute
+
 // Processor handles tile downloading and processing
 type Processor struct {
 	client    *http.Client
 	userAgent string
+	debugDump io.Writer
+	dumpOnce  sync.Once
+	cache     *Cache
+	headers   map[string]string
+	retries   int
+	backoff   time.Duration
 }
 
-// NewProcessor creates a new tile processor
+// NewProcessor creates a new tile processor with a DefaultTimeout per request
+// and no retries
 func NewProcessor(userAgent string) *Processor {
 	return &Processor{
-		client:    &http.Client{},
+		client: &http.Client{
+			Timeout:   DefaultTimeout,
+			Transport: NewTransport(TransportOptions{}),
+		},
 		userAgent: userAgent,
+		backoff:   DefaultRetryBackoff,
+	}
+}
+
+// SetTimeout bounds every tile request to d; 0 leaves only the context
+func (p *Processor) SetTimeout(d time.Duration) {
+	p.client.Timeout = d
+}
+
+// SetRetries makes the processor try a tile up to retries more times after a
+// transient failure: a network error or timeout, 429 Too Many Requests or a
+// 5xx other than 501. It waits backoff before the first retry and doubles
+// that for each further one, up to MaxRetryWait, unless the server sends a
+// Retry-After.
+func (p *Processor) SetRetries(retries int, backoff time.Duration) {
+	p.retries = retries
+	p.backoff = backoff
+}
+
+// SetDebugDump makes the processor write the full request and response
+// headers of the first downloaded tile to w, with secrets redacted
+func (p *Processor) SetDebugDump(w io.Writer) {
+	p.debugDump = w
+}
+
+// SetKeepAlive enables or disables connection reuse between tile requests.
+// Disabling it opens a new connection (and TLS handshake) for every tile,
+// which is much slower but helps when debugging proxies that corrupt reused
+// connections.
+func (p *Processor) SetKeepAlive(enabled bool) error {
+	transport, err := p.cloneTransport()
+	if err != nil {
+		return err
+	}
+	transport.DisableKeepAlives = !enabled
+	p.client.Transport = transport
+	return nil
+}
+
+// SetProxy routes tile requests through proxy instead of the one configured
+// by HTTP_PROXY and HTTPS_PROXY
+func (p *Processor) SetProxy(proxy *url.URL) error {
+	transport, err := p.cloneTransport()
+	if err != nil {
+		return err
+	}
+	transport.Proxy = http.ProxyURL(proxy)
+	p.client.Transport = transport
+	return nil
+}
+
+// SetInsecureSkipVerify makes the processor accept any TLS certificate, for
+// internal tile servers with self-signed ones. Only use it on trusted networks.
+func (p *Processor) SetInsecureSkipVerify(insecure bool) error {
+	transport, err := p.cloneTransport()
+	if err != nil {
+		return err
+	}
+	if insecure {
+		skipVerify(transport)
+	} else if transport.TLSClientConfig != nil {
+		transport.TLSClientConfig.InsecureSkipVerify = false
 	}
+	p.client.Transport = transport
+	return nil
+}
+
+// cloneTransport returns a copy of the processor's transport to change; only
+// an *http.Transport has the settings to change
+func (p *Processor) cloneTransport() (*http.Transport, error) {
+	transport, ok := p.client.Transport.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("changing the connection settings needs an *http.Transport, got %T", p.client.Transport)
+	}
+	return transport.Clone(), nil
+}
+
+// SetTransport replaces the connection pool settings for tile downloads
+func (p *Processor) SetTransport(opts TransportOptions) {
+	p.client.Transport = NewTransport(opts)
+}
+
+// SetHeaders adds headers, e.g. API keys, to every tile request. They take
+// precedence over the User-Agent and the guessed body Content-Type.
+func (p *Processor) SetHeaders(headers map[string]string) {
+	p.headers = headers
+}
+
+// SetCache makes the processor serve tiles from c when present and store
+// every successfully downloaded tile in it
+func (p *Processor) SetCache(c *Cache) {
+	p.cache = c
 }
 
 // LatLonToTile converts lat/lon to tile coordinates at given zoom level
@@ -60,111 +181,308 @@ func ProjectLatLon(lat, lon float64) (float64, float64) {
 	return x, y
 }
 
-// DownloadTile downloads a tile from the given URL
-func (p *Processor) DownloadTile(url string) ([]byte, error) {
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
+// DownloadTile downloads a tile from the given URL; cancelling ctx aborts the request
+func (p *Processor) DownloadTile(ctx context.Context, url string) ([]byte, error) {
+	return p.DownloadTileRequest(ctx, http.MethodGet, url, "")
+}
+
+// DownloadTileRequest downloads a tile with the given method and request
+// body, for tile APIs that expect the coordinates in e.g. a POSTed JSON body.
+// A body is only allowed with non-GET methods.
+func (p *Processor) DownloadTileRequest(ctx context.Context, method, url, body string) ([]byte, error) {
+	if body != "" && method == http.MethodGet {
+		return nil, fmt.Errorf("a request body requires a method other than GET")
 	}
 	
-	req.Header.Set("User-Agent", p.userAgent)
+	key := RequestKey(method, url, body)
+	var cached *CacheEntry
+	if p.cache != nil {
+		if entry, ok := p.cache.Entry(key); ok {
+			if p.cache.Fresh(entry) {
+				return entry.Data, nil
+			}
+			cached = entry
+		}
+	}
 	
-	resp, err := p.client.Do(req)
+	resp, data, err := p.fetchWithRetry(ctx, method, url, body, cached)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	
+	// The tile server confirmed the stale entry is still current
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		if err := p.cache.Touch(key); err != nil {
+			return nil, fmt.Errorf("failed to cache tile: %v", err)
+		}
+		return cached.Data, nil
+	}
 	
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, resp.Status)
 	}
 	
-	return io.ReadAll(resp.Body)
+	if p.cache != nil && cacheable(resp.Header.Get("Content-Type"), data) {
+		entry := &CacheEntry{
+			Data:         data,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+		}
+		if err := p.cache.PutEntry(key, entry); err != nil {
+			return nil, fmt.Errorf("failed to cache tile: %v", err)
+		}
+	}
+	return data, nil
 }
 
-// DecodeImage detects image format and decodes
-func (p *Processor) DecodeImage(data []byte) (*ImageData, error) {
-	if len(data) >= 4 && bytes.Equal(data[:4], []byte{0x89, 0x50, 0x4E, 0x47}) {
-		return p.readPNG(data)
-	} else if len(data) >= 2 && bytes.Equal(data[:2], []byte{0xFF, 0xD8}) {
-		return p.readJPEG(data)
+// ProbeResult describes a single tile fetched by Probe
+type ProbeResult struct {
+	URL         string
+	Status      int
+	StatusText  string
+	ContentType string
+	Bytes       int
+	Image       *ImageData // nil if the response couldn't be decoded
+	DecodeError error
+}
+
+// Probe fetches a single tile, bypassing the cache, and reports the response
+// and the decoded image for diagnosing a tile source. Only transport errors
+// are returned; HTTP and decode failures are part of the result.
+func (p *Processor) Probe(ctx context.Context, url string) (*ProbeResult, error) {
+	resp, data, err := p.fetch(ctx, http.MethodGet, url, "", nil)
+	if err != nil {
+		return nil, err
 	}
 	
-	return nil, fmt.Errorf("unrecognized image format")
+	result := &ProbeResult{
+		URL:         url,
+		Status:      resp.StatusCode,
+		StatusText:  resp.Status,
+		ContentType: resp.Header.Get("Content-Type"),
+		Bytes:       len(data),
+	}
+	result.Image, result.DecodeError = p.DecodeImage(data)
+	return result, nil
+}
+
+// fetchWithRetry fetches a tile, trying again after transient failures as
+// configured by SetRetries
+func (p *Processor) fetchWithRetry(ctx context.Context, method, url, body string, cached *CacheEntry) (*http.Response, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		resp, data, err := p.fetch(ctx, method, url, body, cached)
+		if attempt >= p.retries || ctx.Err() != nil {
+			return resp, data, err
+		}
+		
+		wait := retryBackoff(p.backoff, attempt)
+		switch {
+		case err != nil:
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented:
+			if after := ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); after > 0 {
+				wait = after
+			}
+		default:
+			return resp, data, err
+		}
+		if wait > MaxRetryWait {
+			return resp, data, err
+		}
+		
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil, ctx.Err()
+		}
+	}
 }
 
-// readJPEG decodes JPEG image
-func (p *Processor) readJPEG(data []byte) (*ImageData, error) {
-	img, err := jpeg.Decode(bytes.NewReader(data))
+// retryBackoff doubles backoff for every earlier attempt, capped at
+// MaxRetryWait so large retry counts neither overflow nor give up early
+func retryBackoff(backoff time.Duration, attempt int) time.Duration {
+	for i := 0; i < attempt && backoff < MaxRetryWait; i++ {
+		backoff *= 2
+	}
+	return min(backoff, MaxRetryWait)
+}
+
+// ParseRetryAfter reads a Retry-After header given in seconds or as an HTTP
+// date; it returns zero for a missing or malformed value
+func ParseRetryAfter(value string, now time.Time) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// fetch performs a tile request and reads the whole response body. With a
+// cached entry, the request is conditional on the entry's validators.
+func (p *Processor) fetch(ctx context.Context, method, url, body string, cached *CacheEntry) (*http.Response, []byte, error) {
+	var reqBody io.Reader
+	if body != "" {
+		reqBody = strings.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	
-	bounds := img.Bounds()
-	width := bounds.Dx()
-	height := bounds.Dy()
+	req.Header.Set("User-Agent", p.userAgent)
+	if body != "" {
+		req.Header.Set("Content-Type", bodyContentType(body))
+	}
+	for name, value := range p.headers {
+		req.Header.Set(name, value)
+	}
+	// Ask for the tile only if it changed since it was cached
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
 	
-	// Convert to RGBA - JPEG doesn't have alpha, so we'll use RGB with full alpha
-	buf := make([]byte, width*height*4)
+	dump := false
+	if p.debugDump != nil {
+		p.dumpOnce.Do(func() { dump = true })
+	}
+	if dump {
+		p.dumpRequest(req)
+	}
 	
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			r, g, b, _ := img.At(x, y).RGBA()
-			idx := (y*width + x) * 4
-			buf[idx] = byte(r >> 8)     // R
-			buf[idx+1] = byte(g >> 8)   // G
-			buf[idx+2] = byte(b >> 8)   // B
-			buf[idx+3] = 255            // A (full opacity for JPEG)
-		}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	
+	if dump {
+		defer p.dumpResponse(resp)
 	}
 	
-	return &ImageData{
-		Buf:    buf,
-		Width:  width,
-		Height: height,
-		Depth:  3, // JPEG is RGB, not RGBA
-	}, nil
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, data, nil
 }
 
-// readPNG decodes PNG image
-func (p *Processor) readPNG(data []byte) (*ImageData, error) {
-	img, err := png.Decode(bytes.NewReader(data))
-	if err != nil {
-		return nil, err
+// bodyContentType guesses the Content-Type of a request body
+func bodyContentType(body string) string {
+	trimmed := strings.TrimSpace(body)
+	switch {
+	case json.Valid([]byte(trimmed)):
+		return "application/json"
+	case strings.HasPrefix(trimmed, "<"):
+		return "application/xml"
+	default:
+		return "application/x-www-form-urlencoded"
+	}
+}
+
+// sensitiveHeaders are redacted in debug dumps
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+// sensitiveParams are query parameters redacted in debug dumps
+var sensitiveParams = []string{"key", "apikey", "api_key", "token", "access_token", "signature", "sig"}
+
+// RedactURL returns rawURL with the values of query parameters that commonly
+// carry credentials, such as token and signature, replaced by REDACTED. The
+// rest of the URL is left as it is.
+func RedactURL(rawURL string) string {
+	base, query, ok := strings.Cut(rawURL, "?")
+	if !ok {
+		return rawURL
+	}
+	query, fragment, hasFragment := strings.Cut(query, "#")
+	redacted := base + "?" + redactQuery(query)
+	if hasFragment {
+		redacted += "#" + fragment
 	}
+	return redacted
+}
+
+// redactQuery replaces the values of sensitiveParams in a raw query string,
+// keeping the order and encoding of the other parameters
+func redactQuery(rawQuery string) string {
+	params := strings.Split(rawQuery, "&")
+	for i, param := range params {
+		rawName, _, _ := strings.Cut(param, "=")
+		name := rawName
+		if unescaped, err := url.QueryUnescape(rawName); err == nil {
+			name = unescaped
+		}
+		for _, sensitive := range sensitiveParams {
+			if strings.EqualFold(name, sensitive) {
+				params[i] = rawName + "=REDACTED"
+				break
+			}
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// dumpRequest writes the outgoing request headers with secrets redacted
+func (p *Processor) dumpRequest(req *http.Request) {
+	redacted := req.Clone(req.Context())
+	redactHeaders(redacted.Header)
 	
-	bounds := img.Bounds()
-	width := bounds.Dx()
-	height := bounds.Dy()
+	redacted.URL.RawQuery = redactQuery(redacted.URL.RawQuery)
 	
-	// Convert to RGBA
-	buf := make([]byte, width*height*4)
+	out, err := httputil.DumpRequestOut(redacted, false)
+	if err != nil {
+		fmt.Fprintf(p.debugDump, "Can't dump request: %v\n", err)
+		return
+	}
+	fmt.Fprintf(p.debugDump, "==Request\n%s", out)
+}
+
+// dumpResponse writes the response status and headers with secrets redacted
+func (p *Processor) dumpResponse(resp *http.Response) {
+	redacted := *resp
+	redacted.Header = resp.Header.Clone()
+	redactHeaders(redacted.Header)
 	
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			r, g, b, a := img.At(x, y).RGBA()
-			idx := (y*width + x) * 4
-			buf[idx] = byte(r >> 8)
-			buf[idx+1] = byte(g >> 8)
-			buf[idx+2] = byte(b >> 8)
-			buf[idx+3] = byte(a >> 8)
+	out, err := httputil.DumpResponse(&redacted, false)
+	if err != nil {
+		fmt.Fprintf(p.debugDump, "Can't dump response: %v\n", err)
+		return
+	}
+	fmt.Fprintf(p.debugDump, "==Response\n%s[body not shown]\n", out)
+}
+
+// redactHeaders replaces the values of sensitive headers
+func redactHeaders(header http.Header) {
+	for _, name := range sensitiveHeaders {
+		if header.Get(name) != "" {
+			header.Set(name, "REDACTED")
 		}
 	}
-	
-	return &ImageData{
-		Buf:    buf,
-		Width:  width,
-		Height: height,
-		Depth:  4,
-	}, nil
 }
 
-// BuildURL replaces URL template tokens
+// DecodeImage decodes a tile with the decoder registered for its format
+// (see RegisterDecoder)
+func (p *Processor) DecodeImage(data []byte) (*ImageData, error) {
+	return Decode(data)
+}
+
+// BuildURL replaces URL template tokens. {-y} and {!y} take the flipped
+// (TMS) row, 2^zoom - 1 - y.
 func BuildURL(template string, zoom int, x, y uint32) string {
 	url := template
 	url = strings.ReplaceAll(url, "{z}", strconv.Itoa(zoom))
 	url = strings.ReplaceAll(url, "{x}", strconv.FormatUint(uint64(x), 10))
 	url = strings.ReplaceAll(url, "{y}", strconv.FormatUint(uint64(y), 10))
+	flipped := strconv.FormatUint(uint64(FlipY(zoom, y)), 10)
+	url = strings.ReplaceAll(url, "{-y}", flipped)
+	url = strings.ReplaceAll(url, "{!y}", flipped)
 	// Handle {s} for subdomains (simple implementation)
 	if strings.Contains(url, "{s}") {
 		subdomain := string(rune('a' + (x+y)%3))
@@ -173,6 +491,39 @@ func BuildURL(template string, zoom int, x, y uint32) string {
 	return url
 }
 
+// FlipY converts a tile row between the XYZ and TMS schemes
+func FlipY(zoom int, y uint32) uint32 {
+	return uint32(uint64(1)<<uint(zoom) - 1 - uint64(y))
+}
+
+// HasYPlaceholder reports whether a URL template contains {y}, {-y} or {!y}
+func HasYPlaceholder(template string) bool {
+	return strings.Contains(template, "{y}") ||
+		strings.Contains(template, "{-y}") ||
+		strings.Contains(template, "{!y}")
+}
+
+// ValidateTemplate rejects URL templates that mix the {y} placeholder with
+// its flipped {-y}/{!y} form, which would request rows from two schemes, and
+// templates with {token} before the path, where the token could pick the host.
+func ValidateTemplate(template string) error {
+	if strings.Contains(template, "{y}") &&
+		(strings.Contains(template, "{-y}") || strings.Contains(template, "{!y}")) {
+		return fmt.Errorf("URL template can't combine {y} with {-y} or {!y}: %s", template)
+	}
+	authority := template
+	if i := strings.Index(authority, "://"); i != -1 {
+		authority = authority[i+3:]
+	}
+	if i := strings.IndexAny(authority, "/?#"); i != -1 {
+		authority = authority[:i]
+	}
+	if strings.Contains(authority, "{token}") {
+		return fmt.Errorf("URL template can't have {token} in the host: %s", template)
+	}
+	return nil
+}
+
 // AlphaBlend blends two pixels with alpha compositing
 func AlphaBlend(src, dst [4]byte) [4]byte {
 	as := float64(src[3]) / 255.0
@@ -203,15 +554,32 @@ func AlphaBlend(src, dst [4]byte) [4]byte {
 	return [4]byte{0, 0, 0, 0}
 }
 
+// PNGOptions tunes how WritePNGWithOptions encodes an image
+type PNGOptions struct {
+	Verify bool // re-decode the encoded image before writing it
+	DPI    int  // declare this resolution in a pHYs chunk; 0 leaves it out
+}
+
 // WritePNG writes PNG output
 func WritePNG(filename string, buf []byte, width, height int) error {
+	return WritePNGWithOptions(filename, buf, width, height, PNGOptions{})
+}
+
+// WriteVerifiedPNG encodes the PNG in memory and re-decodes it before writing,
+// so a corrupt encode fails instead of producing a broken file
+func WriteVerifiedPNG(filename string, buf []byte, width, height int) error {
+	return WritePNGWithOptions(filename, buf, width, height, PNGOptions{Verify: true})
+}
+
+// WritePNGWithOptions writes PNG output to filename, or stdout if it's empty
+func WritePNGWithOptions(filename string, buf []byte, width, height int, opts PNGOptions) error {
 	var output io.Writer
 	
 	if filename == "" {
 		output = os.Stdout
-		fmt.Fprintf(os.Stderr, "Output PNG: stdout\n")
+		fmt.Fprintf(Log, "Output PNG: stdout\n")
 	} else {
-		fmt.Fprintf(os.Stderr, "Output PNG: %s\n", filename)
+		fmt.Fprintf(Log, "Output PNG: %s\n", filename)
 		file, err := os.Create(filename)
 		if err != nil {
 			return err
@@ -220,10 +588,92 @@ func WritePNG(filename string, buf []byte, width, height int) error {
 		output = file
 	}
 	
+	return WritePNGToWithOptions(output, buf, width, height, opts)
+}
+
+// WritePNGTo encodes the RGBA buffer as PNG to w without logging anything
+func WritePNGTo(w io.Writer, buf []byte, width, height int) error {
+	return WritePNGToWithOptions(w, buf, width, height, PNGOptions{})
+}
+
+// WritePNGToWithOptions encodes the RGBA buffer as PNG to w without logging
+// anything
+func WritePNGToWithOptions(w io.Writer, buf []byte, width, height int, opts PNGOptions) error {
 	img := image.NewRGBA(image.Rect(0, 0, width, height))
 	copy(img.Pix, buf)
 	
-	return png.Encode(output, img)
+	if !opts.Verify && opts.DPI == 0 {
+		return png.Encode(w, img)
+	}
+	
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		return err
+	}
+	data := encoded.Bytes()
+	if opts.DPI > 0 {
+		var err error
+		if data, err = AddPNGResolution(data, opts.DPI); err != nil {
+			return err
+		}
+	}
+	if opts.Verify {
+		if err := VerifyImage(data, width, height); err != nil {
+			return err
+		}
+	}
+	
+	_, err := w.Write(data)
+	return err
+}
+
+// VerifyImage fully decodes encoded PNG or JPEG data and checks its dimensions
+func VerifyImage(data []byte, width, height int) error {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("output verification failed: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != width || b.Dy() != height {
+		return fmt.Errorf("output verification failed: image is %dx%d, expected %dx%d", b.Dx(), b.Dy(), width, height)
+	}
+	return nil
+}
+
+// AlphaMask extracts the alpha channel of an RGBA buffer as a grayscale image
+func AlphaMask(buf []byte, width, height int) *image.Gray {
+	mask := image.NewGray(image.Rect(0, 0, width, height))
+	for i := range mask.Pix {
+		mask.Pix[i] = buf[i*4+3]
+	}
+	return mask
+}
+
+// WriteAlphaMask writes the alpha channel as a grayscale PNG next to the output file
+func WriteAlphaMask(filename string, buf []byte, width, height int) error {
+	if filename == "" {
+		return fmt.Errorf("can't write an alpha mask when writing to stdout")
+	}
+	
+	// Insert suffix before the extension
+	maskFilename := filename
+	if idx := strings.LastIndex(maskFilename, "."); idx != -1 {
+		maskFilename = maskFilename[:idx] + "_mask.png"
+	} else {
+		maskFilename += "_mask.png"
+	}
+	
+	file, err := os.Create(maskFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	
+	if err := png.Encode(file, AlphaMask(buf, width, height)); err != nil {
+		return err
+	}
+	
+	fmt.Fprintf(Log, "Alpha mask written to '%s'.\n", maskFilename)
+	return nil
 }
 
 // WriteWorldFile writes world file
@@ -261,6 +711,6 @@ func WriteWorldFile(filename string, px, py, minx, maxy float64, outfmt int) err
 	fmt.Fprintf(file, "%24.10f\n", minx)
 	fmt.Fprintf(file, "%24.10f\n", maxy)
 	
-	fmt.Fprintf(os.Stderr, "World file written to '%s'.\n", worldFilename)
+	fmt.Fprintf(Log, "World file written to '%s'.\n", worldFilename)
 	return nil
 }
\ No newline at end of file
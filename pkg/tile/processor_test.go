@@ -0,0 +1,806 @@
+package tile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDownloadTile_DebugDump(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=secret-cookie")
+		w.Header().Set("X-Tile-Server", "test")
+		w.Write([]byte("tile"))
+	}))
+	defer server.Close()
+
+	var dump bytes.Buffer
+	p := NewProcessor("stitch-test/1.0")
+	p.SetDebugDump(&dump)
+
+	if _, err := p.DownloadTile(context.Background(), server.URL+"/1/2/3.png?access_token=secret-token&style=dark"); err != nil {
+		t.Fatalf("DownloadTile failed: %v", err)
+	}
+	first := dump.String()
+
+	for _, want := range []string{"GET /1/2/3.png", "User-Agent: stitch-test/1.0", "style=dark", "200 OK", "X-Tile-Server: test"} {
+		if !strings.Contains(first, want) {
+			t.Errorf("Expected dump to contain %q, got:\n%s", want, first)
+		}
+	}
+	for _, secret := range []string{"secret-token", "secret-cookie"} {
+		if strings.Contains(first, secret) {
+			t.Errorf("Expected %q to be redacted, got:\n%s", secret, first)
+		}
+	}
+
+	// Only the first tile is dumped
+	if _, err := p.DownloadTile(context.Background(), server.URL+"/1/2/4.png"); err != nil {
+		t.Fatalf("DownloadTile failed: %v", err)
+	}
+	if dump.String() != first {
+		t.Error("Expected only the first tile to be dumped")
+	}
+}
+
+func TestComputeStats(t *testing.T) {
+	// Two opaque red pixels, one half-transparent blue and one fully transparent
+	buf := []byte{
+		255, 0, 0, 255,
+		255, 0, 0, 255,
+		0, 0, 200, 128,
+		0, 0, 0, 0,
+	}
+
+	stats := ComputeStats(buf)
+
+	if stats.Pixels != 4 || stats.TransparentPixels != 1 {
+		t.Errorf("Expected 4 pixels with 1 transparent, got %d with %d", stats.Pixels, stats.TransparentPixels)
+	}
+	if stats.Red.Min != 0 || stats.Red.Max != 255 || stats.Red.Mean != 127.5 {
+		t.Errorf("Unexpected red stats: min %d max %d mean %v", stats.Red.Min, stats.Red.Max, stats.Red.Mean)
+	}
+	if stats.Green.Max != 0 || stats.Green.Mean != 0 {
+		t.Errorf("Unexpected green stats: max %d mean %v", stats.Green.Max, stats.Green.Mean)
+	}
+	if stats.Blue.Histogram[200] != 1 || stats.Blue.Histogram[0] != 3 {
+		t.Errorf("Unexpected blue histogram: [0]=%d [200]=%d", stats.Blue.Histogram[0], stats.Blue.Histogram[200])
+	}
+	if stats.Alpha.Histogram[255] != 2 || stats.Alpha.Histogram[128] != 1 || stats.Alpha.Mean != 159.5 {
+		t.Errorf("Unexpected alpha stats: [255]=%d [128]=%d mean %v", stats.Alpha.Histogram[255], stats.Alpha.Histogram[128], stats.Alpha.Mean)
+	}
+}
+
+func TestWriteAlphaMask(t *testing.T) {
+	buf := []byte{
+		255, 0, 0, 255, 0, 255, 0, 128,
+		0, 0, 255, 0, 10, 20, 30, 64,
+	}
+
+	filename := filepath.Join(t.TempDir(), "out.png")
+	if err := WriteAlphaMask(filename, buf, 2, 2); err != nil {
+		t.Fatalf("Failed to write alpha mask: %v", err)
+	}
+
+	file, err := os.Open(filepath.Join(filepath.Dir(filename), "out_mask.png"))
+	if err != nil {
+		t.Fatalf("Failed to open alpha mask: %v", err)
+	}
+	defer file.Close()
+
+	img, err := png.Decode(file)
+	if err != nil {
+		t.Fatalf("Failed to decode alpha mask: %v", err)
+	}
+
+	gray, ok := img.(*image.Gray)
+	if !ok {
+		t.Fatalf("Expected grayscale mask, got %T", img)
+	}
+	for i, want := range []uint8{255, 128, 0, 64} {
+		if got := gray.Pix[i]; got != want {
+			t.Errorf("Expected mask pixel %d to be %d, got %d", i, want, got)
+		}
+	}
+}
+
+func TestSetKeepAlive(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		conns int
+	)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tile"))
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	for _, tc := range []struct {
+		name      string
+		keepAlive bool
+		expected  int
+	}{
+		{name: "Reused connection", keepAlive: true, expected: 1},
+		{name: "Connection per tile", keepAlive: false, expected: 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mu.Lock()
+			conns = 0
+			mu.Unlock()
+
+			p := NewProcessor("stitch-test/1.0")
+			if err := p.SetKeepAlive(tc.keepAlive); err != nil {
+				t.Fatalf("SetKeepAlive failed: %v", err)
+			}
+			for i := 0; i < 3; i++ {
+				if _, err := p.DownloadTile(context.Background(), server.URL+"/1/2/3.png"); err != nil {
+					t.Fatalf("DownloadTile failed: %v", err)
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if conns != tc.expected {
+				t.Errorf("Expected %d connections, got %d", tc.expected, conns)
+			}
+		})
+	}
+}
+
+func TestParseColor(t *testing.T) {
+	testCases := []struct {
+		input     string
+		expected  color.RGBA
+		expectErr bool
+	}{
+		{input: "#ffffff", expected: color.RGBA{R: 255, G: 255, B: 255, A: 255}},
+		{input: "#10203040", expected: color.RGBA{R: 0x10, G: 0x20, B: 0x30, A: 0x40}},
+		{input: "00ff00", expected: color.RGBA{G: 255, A: 255}},
+		{input: "#fff", expectErr: true},
+		{input: "#gggggg", expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			got, err := ParseColor(tc.input)
+			if tc.expectErr {
+				if err == nil {
+					t.Error("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseColor failed: %v", err)
+			}
+			if got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestWritePNGTo(t *testing.T) {
+	var logged bytes.Buffer
+	oldLog := Log
+	Log = &logged
+	defer func() { Log = oldLog }()
+
+	buf := make([]byte, 5*3*4)
+	for i := range buf {
+		buf[i] = 255
+	}
+
+	var encoded bytes.Buffer
+	if err := WritePNGTo(&encoded, buf, 5, 3); err != nil {
+		t.Fatalf("Failed to write PNG: %v", err)
+	}
+
+	img, err := png.Decode(&encoded)
+	if err != nil {
+		t.Fatalf("Failed to decode PNG: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 5 || b.Dy() != 3 {
+		t.Errorf("Expected a 5x3 image, got %dx%d", b.Dx(), b.Dy())
+	}
+	if logged.Len() != 0 {
+		t.Errorf("Expected nothing to be logged, got %q", logged.String())
+	}
+}
+
+func TestVerifyImage(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		t.Fatalf("Failed to encode image: %v", err)
+	}
+	data := encoded.Bytes()
+
+	testCases := []struct {
+		name          string
+		data          []byte
+		width, height int
+		expectErr     bool
+	}{
+		{name: "Valid image", data: data, width: 4, height: 3},
+		{name: "Truncated encode", data: data[:len(data)/2], width: 4, height: 3, expectErr: true},
+		{name: "Wrong dimensions", data: data, width: 3, height: 4, expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := VerifyImage(tc.data, tc.width, tc.height)
+			if tc.expectErr && err == nil {
+				t.Error("Expected verification to fail")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestBuildURL_FlippedY(t *testing.T) {
+	testCases := []struct {
+		template string
+		zoom     int
+		x, y     uint32
+		expected string
+	}{
+		{template: "https://t/{z}/{x}/{-y}.png", zoom: 0, x: 0, y: 0, expected: "https://t/0/0/0.png"},
+		{template: "https://t/{z}/{x}/{-y}.png", zoom: 1, x: 1, y: 0, expected: "https://t/1/1/1.png"},
+		{template: "https://t/{z}/{x}/{!y}.png", zoom: 3, x: 4, y: 2, expected: "https://t/3/4/5.png"},
+		{template: "https://t/{z}/{x}/{-y}.png", zoom: 10, x: 163, y: 395, expected: "https://t/10/163/628.png"},
+		{template: "https://t/{z}/{x}/{y}.png", zoom: 10, x: 163, y: 395, expected: "https://t/10/163/395.png"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.expected, func(t *testing.T) {
+			if got := BuildURL(tc.template, tc.zoom, tc.x, tc.y); got != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestValidateTemplate(t *testing.T) {
+	testCases := []struct {
+		template  string
+		expectErr bool
+	}{
+		{template: "https://t/{z}/{x}/{y}.png"},
+		{template: "https://t/{z}/{x}/{-y}.png"},
+		{template: "https://t/{z}/{x}/{!y}.png"},
+		{template: "https://t/{z}/{x}/{y}.png?tms={-y}", expectErr: true},
+		{template: "https://t/{z}/{x}/{!y}/{y}.png", expectErr: true},
+		{template: "https://t/{z}/{x}/{y}.png?access_token={token}"},
+		{template: "https://t/{token}/{z}/{x}/{y}.png"},
+		{template: "https://{token}.t/{z}/{x}/{y}.png", expectErr: true},
+		{template: "https://{token}@t/{z}/{x}/{y}.png", expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.template, func(t *testing.T) {
+			err := ValidateTemplate(tc.template)
+			if tc.expectErr && err == nil {
+				t.Error("Expected an error")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDownloadTileRequest_PostBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPost || string(body) != `{"z":3,"x":4,"y":5}` {
+			http.Error(w, "unknown tile", http.StatusBadRequest)
+			return
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Expected Content-Type application/json, got %s", ct)
+		}
+		w.Write([]byte("tile"))
+	}))
+	defer server.Close()
+
+	p := NewProcessor("stitch-test/1.0")
+	template := `{"z":{z},"x":{x},"y":{y}}`
+
+	data, err := p.DownloadTileRequest(context.Background(), http.MethodPost, server.URL, BuildURL(template, 3, 4, 5))
+	if err != nil {
+		t.Fatalf("DownloadTileRequest failed: %v", err)
+	}
+	if string(data) != "tile" {
+		t.Errorf("Expected tile data, got %q", data)
+	}
+
+	// Other coordinates in the body don't match
+	if _, err := p.DownloadTileRequest(context.Background(), http.MethodPost, server.URL, BuildURL(template, 3, 4, 6)); err == nil {
+		t.Error("Expected an error for a mismatched body")
+	}
+
+	// GET can't carry a body
+	if _, err := p.DownloadTileRequest(context.Background(), http.MethodGet, server.URL, "{}"); err == nil {
+		t.Error("Expected an error for a GET request with a body")
+	}
+}
+
+func TestUserAgentWarning(t *testing.T) {
+	testCases := []struct {
+		name      string
+		template  string
+		userAgent string
+		warn      bool
+	}{
+		{"OSM with default", "https://tile.openstreetmap.org/{z}/{x}/{y}.png", DefaultUserAgent, true},
+		{"OSM subdomain with empty", "https://{s}.tile.openstreetmap.org/{z}/{x}/{y}.png", "", true},
+		{"OSM with custom", "https://tile.openstreetmap.org/{z}/{x}/{y}.png", "my-map-app/1.0 (maps@example.com)", false},
+		{"Other host with default", "https://tiles.example.com/{z}/{x}/{y}.png", DefaultUserAgent, false},
+		{"Lookalike host", "https://tile.openstreetmap.org.example.com/{z}/{x}/{y}.png", DefaultUserAgent, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			warning := UserAgentWarning(tc.template, tc.userAgent)
+			if (warning != "") != tc.warn {
+				t.Errorf("Expected warning %v, got %q", tc.warn, warning)
+			}
+		})
+	}
+}
+
+func TestDownloadTile_RevalidatesCache(t *testing.T) {
+	var (
+		mu                     sync.Mutex
+		downloads, notModified int
+		ifNoneMatch            string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		ifNoneMatch = r.Header.Get("If-None-Match")
+		if ifNoneMatch == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Write([]byte("tile data"))
+	}))
+	defer server.Close()
+
+	cache := NewCache(t.TempDir())
+	cache.SetTTL(time.Hour)
+	p := NewProcessor("test")
+	p.SetCache(cache)
+	url := server.URL + "/1/0/0.png"
+
+	if _, err := p.DownloadTile(context.Background(), url); err != nil {
+		t.Fatalf("Failed to download tile: %v", err)
+	}
+
+	// Fresh entries are served without asking the server
+	if _, err := p.DownloadTile(context.Background(), url); err != nil {
+		t.Fatalf("Failed to download tile: %v", err)
+	}
+	if downloads != 1 || notModified != 0 {
+		t.Fatalf("Expected 1 download and no revalidation, got %d and %d", downloads, notModified)
+	}
+
+	// Stale entries are revalidated, and a 304 makes them fresh again
+	stale := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(cache.path(url), stale, stale); err != nil {
+		t.Fatalf("Failed to age cache entry: %v", err)
+	}
+	data, err := p.DownloadTile(context.Background(), url)
+	if err != nil {
+		t.Fatalf("Failed to revalidate tile: %v", err)
+	}
+	if string(data) != "tile data" {
+		t.Errorf("Expected the cached bytes, got %q", data)
+	}
+	if downloads != 1 || notModified != 1 {
+		t.Errorf("Expected 1 download and 1 revalidation, got %d and %d", downloads, notModified)
+	}
+
+	entry, ok := cache.Entry(url)
+	if !ok {
+		t.Fatal("Expected the tile to stay cached")
+	}
+	if !cache.Fresh(entry) {
+		t.Error("Expected the 304 to refresh the entry")
+	}
+	if entry.ETag != `"v1"` || entry.LastModified != "Mon, 02 Jan 2006 15:04:05 GMT" {
+		t.Errorf("Expected the stored validators, got %q and %q", entry.ETag, entry.LastModified)
+	}
+}
+
+func TestDownloadTile_CachesOnlyImages(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		t.Fatalf("Failed to encode tile: %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/error.png":
+			// An error page some servers send with 200
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html>quota exceeded</html>"))
+		case "/json.png":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"error":"invalid key"}`))
+		case "/unlabeled.png":
+			// Decodes as an image despite the wrong Content-Type
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(encoded.Bytes())
+		default:
+			w.Header().Set("Content-Type", "image/webp")
+			w.Write([]byte("webp data"))
+		}
+	}))
+	defer server.Close()
+
+	cache := NewCache(t.TempDir())
+	p := NewProcessor("test")
+	p.SetCache(cache)
+
+	testCases := []struct {
+		path   string
+		cached bool
+	}{
+		{"/error.png", false},
+		{"/json.png", false},
+		{"/unlabeled.png", true},
+		{"/tile.webp", true},
+	}
+	for _, tc := range testCases {
+		url := server.URL + tc.path
+		if _, err := p.DownloadTile(context.Background(), url); err != nil {
+			t.Fatalf("Failed to download %s: %v", tc.path, err)
+		}
+		if cache.Has(url) != tc.cached {
+			t.Errorf("Expected %s cached %v, got %v", tc.path, tc.cached, !tc.cached)
+		}
+	}
+}
+
+func TestDecode_GrayscaleAndPaletted(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 2, 1))
+	gray.Pix = []byte{0x40, 0xc0}
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, gray); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+	img, err := Decode(encoded.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to decode grayscale PNG: %v", err)
+	}
+	if img.Depth != 1 {
+		t.Errorf("Expected depth 1 for grayscale, got %d", img.Depth)
+	}
+	if expected := []byte{0x40, 0x40, 0x40, 255, 0xc0, 0xc0, 0xc0, 255}; !bytes.Equal(img.Buf, expected) {
+		t.Errorf("Expected pixels %v, got %v", expected, img.Buf)
+	}
+
+	// Paletted with a half transparent entry; the colors must not come out
+	// premultiplied, or blending darkens them a second time
+	paletted := image.NewPaletted(image.Rect(0, 0, 2, 1), color.Palette{
+		color.NRGBA{R: 255, A: 255},
+		color.NRGBA{B: 255, A: 128},
+	})
+	paletted.Pix = []byte{0, 1}
+	encoded.Reset()
+	if err := png.Encode(&encoded, paletted); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+	img, err = Decode(encoded.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to decode paletted PNG: %v", err)
+	}
+	if img.Depth != 4 {
+		t.Errorf("Expected depth 4 for a paletted PNG with transparency, got %d", img.Depth)
+	}
+	if expected := []byte{255, 0, 0, 255, 0, 0, 255, 128}; !bytes.Equal(img.Buf, expected) {
+		t.Errorf("Expected pixels %v, got %v", expected, img.Buf)
+	}
+
+	// Over white the half transparent blue becomes light blue
+	var src [4]byte
+	copy(src[:], img.Buf[4:8])
+	blended := AlphaBlend([4]byte{255, 255, 255, 255}, src)
+	if blended[2] != 255 || blended[0] < 120 || blended[0] > 135 || blended[3] != 255 {
+		t.Errorf("Expected light blue over white, got %v", blended)
+	}
+}
+
+func TestDownloadTile_Timeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	p := NewProcessor(DefaultUserAgent)
+	p.SetTimeout(50 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := p.DownloadTile(context.Background(), server.URL+"/1/0/0.png"); err == nil {
+		t.Fatal("Expected a timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the request to time out quickly, took %v", elapsed)
+	}
+}
+
+func TestDownloadTile_Retries(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		n := requests
+		mu.Unlock()
+
+		switch {
+		case r.URL.Path == "/missing.png":
+			http.NotFound(w, r)
+		case n == 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case n == 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.Write([]byte("tile"))
+		}
+	}))
+	defer server.Close()
+
+	reset := func() {
+		mu.Lock()
+		requests = 0
+		mu.Unlock()
+	}
+
+	t.Run("Too few retries", func(t *testing.T) {
+		reset()
+		p := NewProcessor(DefaultUserAgent)
+		p.SetRetries(1, time.Millisecond)
+		if _, err := p.DownloadTile(context.Background(), server.URL+"/tile.png"); err == nil {
+			t.Error("Expected the 429 of the second attempt to fail the tile")
+		}
+	})
+
+	t.Run("Succeeds after transient failures", func(t *testing.T) {
+		reset()
+		p := NewProcessor(DefaultUserAgent)
+		p.SetRetries(2, time.Millisecond)
+		data, err := p.DownloadTile(context.Background(), server.URL+"/tile.png")
+		if err != nil {
+			t.Fatalf("Expected the third attempt to succeed, got %v", err)
+		}
+		if string(data) != "tile" {
+			t.Errorf("Expected the tile, got %q", data)
+		}
+		if requests != 3 {
+			t.Errorf("Expected 3 requests, got %d", requests)
+		}
+	})
+
+	t.Run("Permanent failures aren't retried", func(t *testing.T) {
+		reset()
+		p := NewProcessor(DefaultUserAgent)
+		p.SetRetries(3, time.Millisecond)
+		if _, err := p.DownloadTile(context.Background(), server.URL+"/missing.png"); err == nil {
+			t.Error("Expected a 404 error")
+		}
+		if requests != 1 {
+			t.Errorf("Expected a single request for a 404, got %d", requests)
+		}
+	})
+}
+
+func TestSetProxy_CustomTransport(t *testing.T) {
+	p := NewProcessor(DefaultUserAgent)
+	p.client.Transport = http.NewFileTransport(http.Dir(t.TempDir()))
+
+	proxy, _ := url.Parse("http://proxy.example.com:3128")
+	if err := p.SetProxy(proxy); err == nil {
+		t.Error("Expected an error for a transport without proxy settings")
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{0, time.Second},
+		{3, 8 * time.Second},
+		{6, MaxRetryWait},
+		{100, MaxRetryWait},
+	}
+	for _, tc := range tests {
+		if got := retryBackoff(time.Second, tc.attempt); got != tc.expected {
+			t.Errorf("retryBackoff(1s, %d) = %v, want %v", tc.attempt, got, tc.expected)
+		}
+	}
+}
+
+func TestNewTransport_BlockPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unexpected request %s", r.URL.Path)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: NewTransport(TransportOptions{BlockPrivateAddresses: true})}
+	resp, err := client.Get(server.URL)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("expected the connection to the loopback server to be refused")
+	}
+	if !errors.Is(err, ErrPrivateAddress) {
+		t.Errorf("expected ErrPrivateAddress, got %v", err)
+	}
+}
+
+func TestBlockPrivateAddresses_ConfiguredProxy(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tile"))
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	// The operator's proxy on a private address still works
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxyURL)
+	blockPrivateAddresses(transport)
+	resp, err := (&http.Client{Transport: transport}).Get("http://tiles.example.com/1/2/3.png")
+	if err != nil {
+		t.Fatalf("expected the configured proxy to be reachable, got %v", err)
+	}
+	resp.Body.Close()
+
+	// A proxy set later, e.g. from a request, is not exempt
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unexpected request through the unconfigured proxy")
+	}))
+	defer other.Close()
+	otherURL, _ := url.Parse(other.URL)
+	clone := transport.Clone()
+	clone.Proxy = http.ProxyURL(otherURL)
+	_, err = (&http.Client{Transport: clone}).Get("http://tiles.example.org/1/2/3.png")
+	if err == nil || !errors.Is(err, ErrPrivateAddress) {
+		t.Errorf("expected ErrPrivateAddress for a proxy that isn't configured, got %v", err)
+	}
+}
+
+func TestHostPolicy_CheckURL(t *testing.T) {
+	policy := HostPolicy{Allowed: []string{"*.example.com"}, BlockPrivate: true}
+
+	// The template passes, but its expansion points somewhere else
+	template := "http://{p}.example.com/{z}/{x}/{y}.png"
+	if err := policy.Check(template); err != nil {
+		t.Fatalf("expected the template to pass, got %v", err)
+	}
+	var hostErr *HostError
+	if err := policy.CheckURL("http://127.0.0.1:8080/.example.com/1/2/3.png"); !errors.As(err, &hostErr) {
+		t.Errorf("expected a HostError for the expanded URL, got %v", err)
+	}
+	if err := policy.CheckURL("http://a.example.com/1/2/3.png"); err != nil {
+		t.Errorf("expected an allowed host to pass, got %v", err)
+	}
+	if err := policy.CheckURL("http://evil.test/?.example.com"); err == nil {
+		t.Error("expected a host outside the allowed hosts to fail")
+	}
+}
+
+func TestNewTransport_TLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	// The test server's certificate is self-signed
+	client := &http.Client{Transport: NewTransport(TransportOptions{})}
+	if resp, err := client.Get(server.URL); err == nil {
+		resp.Body.Close()
+		t.Fatal("expected the self-signed certificate to be rejected")
+	}
+
+	client = &http.Client{Transport: NewTransport(TransportOptions{InsecureSkipVerify: true})}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("expected the insecure transport to connect, got %v", err)
+	}
+	resp.Body.Close()
+	if proto := resp.Header.Get("X-Proto"); proto != "HTTP/2.0" {
+		t.Errorf("expected HTTP/2.0, got %s", proto)
+	}
+}
+
+func TestScaleBar(t *testing.T) {
+	// Pixel size of 256 pixel Web Mercator tiles at zoom
+	pixelSize := func(zoom int) float64 {
+		return 2 * 20037508.342789244 / (256 * float64(uint(1)<<zoom))
+	}
+
+	testCases := []struct {
+		zoom   int
+		lat    float64
+		label  string
+		pixels int
+	}{
+		// 152.9 m per pixel, so 256 pixels are 39.1 km
+		{zoom: 10, lat: 0, label: "20 km", pixels: 131},
+		// Half as much ground per pixel at 60°
+		{zoom: 10, lat: 60, label: "10 km", pixels: 131},
+		{zoom: 10, lat: 45, label: "20 km", pixels: 185},
+		{zoom: 16, lat: 0, label: "500 m", pixels: 209},
+	}
+	for _, tc := range testCases {
+		meters, pixels := ScaleBar(GroundResolution(pixelSize(tc.zoom), tc.lat, false), 256)
+		if label := FormatDistance(meters); label != tc.label || pixels != tc.pixels {
+			t.Errorf("Zoom %d at %g°: expected %s over %d pixels, got %s over %d", tc.zoom, tc.lat, tc.label, tc.pixels, label, pixels)
+		}
+	}
+
+	// The WGS84 scheme measures pixels in degrees
+	if meters, _ := ScaleBar(GroundResolution(360.0/(512*1024), 0, true), 256); FormatDistance(meters) != "10 km" {
+		t.Errorf("Expected 10 km for WGS84 zoom 10, got %s", FormatDistance(meters))
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	testCases := []struct {
+		url      string
+		expected string
+	}{
+		{url: "https://t/1/2/3.png", expected: "https://t/1/2/3.png"},
+		{url: "https://t/1/2/3.png?style=dark", expected: "https://t/1/2/3.png?style=dark"},
+		{
+			url:      "https://t/1/2/3.png?access_token=pk.1%2B2&style=dark&expires=9&Signature=ab12",
+			expected: "https://t/1/2/3.png?access_token=REDACTED&style=dark&expires=9&Signature=REDACTED",
+		},
+		{url: "https://t/1/2/3.png?key#top", expected: "https://t/1/2/3.png?key=REDACTED#top"},
+		{url: "https://t/1/2/3.png?api%5Fkey=x", expected: "https://t/1/2/3.png?api%5Fkey=REDACTED"},
+	}
+
+	for _, tc := range testCases {
+		if got := RedactURL(tc.url); got != tc.expected {
+			t.Errorf("RedactURL(%s): expected %s, got %s", tc.url, tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package tile
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Layout of the scale bar and north arrow, in pixels
+const (
+	decorationMargin  = 8  // from the image edge to the box
+	decorationPadding = 4  // from the box edge to its contents
+	scaleBarTick      = 6  // height of the ticks at the ends of the bar
+	northArrowWidth   = 14 // base of the arrow head
+	northArrowHeight  = 16
+)
+
+// decorationBox is the translucent white behind the scale bar and north
+// arrow, as behind the attribution
+var decorationBox = color.NRGBA{R: 255, G: 255, B: 255, A: 192}
+
+// GroundResolution returns the meters on the ground per pixel from west to
+// east at lat, for pixels spanning pixelSizeX Spherical Mercator meters, or
+// degrees when geographic
+func GroundResolution(pixelSizeX, lat float64, geographic bool) float64 {
+	const earthCircumference = 2 * math.Pi * 6378137
+	if geographic {
+		pixelSizeX *= earthCircumference / 360
+	}
+	return pixelSizeX * math.Cos(lat*math.Pi/180)
+}
+
+// ScaleBar returns the longest round distance of 1, 2 or 5 times a power of
+// ten that fits into maxPixels at metersPerPixel, with its length in pixels.
+// It returns 0, 0 when not even a meter fits.
+func ScaleBar(metersPerPixel float64, maxPixels int) (float64, int) {
+	limit := metersPerPixel * float64(maxPixels)
+	if metersPerPixel <= 0 || limit < 1 {
+		return 0, 0
+	}
+	power := math.Pow(10, math.Floor(math.Log10(limit)))
+	meters := power
+	for _, step := range []float64{5, 2} {
+		if step*power <= limit {
+			meters = step * power
+			break
+		}
+	}
+	return meters, int(math.Round(meters / metersPerPixel))
+}
+
+// FormatDistance formats a scale bar distance in meters below a kilometer
+// and in kilometers from there on
+func FormatDistance(meters float64) string {
+	if meters >= 1000 {
+		return fmt.Sprintf("%g km", meters/1000)
+	}
+	return fmt.Sprintf("%g m", meters)
+}
+
+// DrawScaleBar draws a scale bar for metersPerPixel in the bottom-left
+// corner of the RGBA buffer, at most a quarter of the image wide and
+// labeled with its distance. Images too small for one are left unchanged.
+func DrawScaleBar(buf []byte, width, height int, metersPerPixel float64) {
+	meters, length := ScaleBar(metersPerPixel, width/4)
+	if length < 2 {
+		return
+	}
+	img := &image.RGBA{Pix: buf, Stride: width * 4, Rect: image.Rect(0, 0, width, height)}
+	face := basicfont.Face7x13
+	label := FormatDistance(meters)
+
+	d := &font.Drawer{Dst: img, Src: image.NewUniform(color.Black), Face: face}
+	metrics := face.Metrics()
+	textHeight := (metrics.Ascent + metrics.Descent).Ceil()
+	boxWidth := max(length, d.MeasureString(label).Ceil()) + 2*decorationPadding
+	boxHeight := textHeight + 2 + scaleBarTick + 2*decorationPadding
+
+	box := image.Rect(decorationMargin, height-decorationMargin-boxHeight, decorationMargin+boxWidth, height-decorationMargin)
+	draw.Draw(img, box.Intersect(img.Rect), image.NewUniform(decorationBox), image.Point{}, draw.Over)
+
+	d.Dot = fixed.P(box.Min.X+decorationPadding, box.Min.Y+decorationPadding+metrics.Ascent.Ceil())
+	d.DrawString(label)
+
+	// A 2px bar along the bottom with ticks rising at both ends
+	left, bottom := box.Min.X+decorationPadding, box.Max.Y-decorationPadding
+	bar := image.Rect(left, bottom-2, left+length, bottom)
+	draw.Draw(img, bar.Intersect(img.Rect), image.Black, image.Point{}, draw.Src)
+	for _, x := range []int{left, left + length - 2} {
+		tick := image.Rect(x, bottom-scaleBarTick, x+2, bottom)
+		draw.Draw(img, tick.Intersect(img.Rect), image.Black, image.Point{}, draw.Src)
+	}
+}
+
+// DrawNorthArrow draws an arrow pointing up with an N below it in the
+// top-right corner of the RGBA buffer. Both tile schemes have north up.
+func DrawNorthArrow(buf []byte, width, height int) {
+	img := &image.RGBA{Pix: buf, Stride: width * 4, Rect: image.Rect(0, 0, width, height)}
+	face := basicfont.Face7x13
+	metrics := face.Metrics()
+	textHeight := (metrics.Ascent + metrics.Descent).Ceil()
+
+	boxWidth := northArrowWidth + 2*decorationPadding
+	boxHeight := northArrowHeight + 2 + textHeight + 2*decorationPadding
+	box := image.Rect(width-decorationMargin-boxWidth, decorationMargin, width-decorationMargin, decorationMargin+boxHeight)
+	if !box.In(img.Rect) {
+		return
+	}
+	draw.Draw(img, box, image.NewUniform(decorationBox), image.Point{}, draw.Over)
+
+	// Each row of the arrow head is wider than the one above it
+	center := box.Min.X + boxWidth/2
+	top := box.Min.Y + decorationPadding
+	for row := 0; row < northArrowHeight; row++ {
+		half := (row*northArrowWidth/northArrowHeight + 1) / 2
+		line := image.Rect(center-half, top+row, center+half+1, top+row+1)
+		draw.Draw(img, line, image.Black, image.Point{}, draw.Src)
+	}
+
+	d := &font.Drawer{Dst: img, Src: image.Black, Face: face}
+	d.Dot = fixed.P(center-d.MeasureString("N").Ceil()/2, top+northArrowHeight+2+metrics.Ascent.Ceil())
+	d.DrawString("N")
+}
@@ -0,0 +1,93 @@
+package tile
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ChannelStats holds statistics for a single color channel
+type ChannelStats struct {
+	Min       uint8      `json:"min"`
+	Max       uint8      `json:"max"`
+	Mean      float64    `json:"mean"`
+	Histogram [256]int64 `json:"histogram"`
+}
+
+// ImageStats holds statistics of an RGBA image
+type ImageStats struct {
+	Pixels            int64        `json:"pixels"`
+	TransparentPixels int64        `json:"transparent_pixels"`
+	Red               ChannelStats `json:"red"`
+	Green             ChannelStats `json:"green"`
+	Blue              ChannelStats `json:"blue"`
+	Alpha             ChannelStats `json:"alpha"`
+}
+
+// ComputeStats computes per-channel min/max/mean and histograms of an RGBA
+// buffer in a single pass
+func ComputeStats(buf []byte) *ImageStats {
+	stats := &ImageStats{Pixels: int64(len(buf) / 4)}
+	channels := [4]*ChannelStats{&stats.Red, &stats.Green, &stats.Blue, &stats.Alpha}
+
+	var sums [4]int64
+	for c := range channels {
+		channels[c].Min = 255
+	}
+
+	for i := 0; i+3 < len(buf); i += 4 {
+		for c, ch := range channels {
+			v := buf[i+c]
+			ch.Histogram[v]++
+			sums[c] += int64(v)
+			if v < ch.Min {
+				ch.Min = v
+			}
+			if v > ch.Max {
+				ch.Max = v
+			}
+		}
+		if buf[i+3] == 0 {
+			stats.TransparentPixels++
+		}
+	}
+
+	for c, ch := range channels {
+		if stats.Pixels == 0 {
+			ch.Min = 0
+			continue
+		}
+		ch.Mean = float64(sums[c]) / float64(stats.Pixels)
+	}
+
+	return stats
+}
+
+// WriteStats writes image statistics as JSON next to the output file, or to
+// stderr when writing the image to stdout
+func WriteStats(filename string, stats *ImageStats) error {
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if filename == "" {
+		fmt.Fprintf(os.Stderr, "%s\n", data)
+		return nil
+	}
+
+	// Replace extension
+	statsFilename := filename
+	if idx := strings.LastIndex(statsFilename, "."); idx != -1 {
+		statsFilename = statsFilename[:idx]
+	}
+	statsFilename += ".stats.json"
+
+	if err := os.WriteFile(statsFilename, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(Log, "Statistics written to '%s'.\n", statsFilename)
+	return nil
+}
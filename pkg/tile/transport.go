@@ -0,0 +1,144 @@
+package tile
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// DefaultMaxIdleConnsPerHost is the number of idle connections kept open per
+// tile host when TransportOptions doesn't set one. http.DefaultTransport
+// keeps only two, which makes parallel downloads from one provider reconnect
+// constantly.
+const DefaultMaxIdleConnsPerHost = 8
+
+// TransportOptions tunes the connection pool used for tile downloads
+type TransportOptions struct {
+	MaxIdleConnsPerHost int           // idle connections kept per host; 0 uses DefaultMaxIdleConnsPerHost
+	MaxConnsPerHost     int           // connections per host including active ones; 0 is unlimited
+	IdleConnTimeout     time.Duration // how long idle connections are kept; 0 uses the http.DefaultTransport value
+	DisableKeepAlives   bool          // open a new connection for every request
+
+	// BlockPrivateAddresses refuses connections to loopback, private and
+	// link-local addresses, including host names and redirects that lead
+	// there. The proxy from HTTP_PROXY and HTTPS_PROXY is exempt.
+	BlockPrivateAddresses bool
+
+	// InsecureSkipVerify accepts any TLS certificate, such as the self-signed
+	// ones of internal tile servers. It makes connections open to
+	// interception, so only set it for hosts on a trusted network.
+	InsecureSkipVerify bool
+}
+
+// ParseProxy parses a proxy URL with the scheme http, https, socks5 or
+// socks5h (which resolves host names on the proxy)
+func ParseProxy(raw string) (*url.URL, error) {
+	proxy, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %v", err)
+	}
+	switch proxy.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("invalid proxy URL %q: scheme must be http, https, socks5 or socks5h", raw)
+	}
+	if proxy.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q: missing host", raw)
+	}
+	return proxy, nil
+}
+
+// NewTransport returns a transport with the proxy, dialing and TLS settings of
+// http.DefaultTransport and the connection pool tuned by opts. It
+// negotiates HTTP/2 with servers that support it.
+func NewTransport(opts TransportOptions) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	transport.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+	if transport.MaxIdleConnsPerHost <= 0 {
+		transport.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	}
+	if transport.MaxIdleConns < transport.MaxIdleConnsPerHost {
+		transport.MaxIdleConns = transport.MaxIdleConnsPerHost
+	}
+	transport.MaxConnsPerHost = opts.MaxConnsPerHost
+	if opts.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = opts.IdleConnTimeout
+	}
+	transport.DisableKeepAlives = opts.DisableKeepAlives
+	// A custom dialer or TLS config turns off HTTP/2 unless it is forced
+	transport.ForceAttemptHTTP2 = true
+	if opts.BlockPrivateAddresses {
+		blockPrivateAddresses(transport)
+	}
+	if opts.InsecureSkipVerify {
+		skipVerify(transport)
+	}
+
+	return transport
+}
+
+// blockPrivateAddresses makes transport refuse connections to private
+// addresses. The proxies transport.Proxy picks, which the operator
+// configured, are exempt, as they are often on the internal network; a proxy
+// set on a clone of transport is not.
+func blockPrivateAddresses(transport *http.Transport) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   refusePrivateAddresses,
+	}
+	proxyDialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	// The dialer only sees addresses, so remember which are proxies
+	var proxies sync.Map
+	if configured := transport.Proxy; configured != nil {
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			proxy, err := configured(req)
+			if proxy != nil {
+				proxies.Store(proxyAddress(proxy), true)
+			}
+			return proxy, err
+		}
+	}
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if _, ok := proxies.Load(address); ok {
+			return proxyDialer.DialContext(ctx, network, address)
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+}
+
+// proxyAddress returns the host and port the transport dials for proxy
+func proxyAddress(proxy *url.URL) string {
+	port := proxy.Port()
+	if port == "" {
+		switch proxy.Scheme {
+		case "https":
+			port = "443"
+		case "socks5", "socks5h":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(proxy.Hostname(), port)
+}
+
+// skipVerify makes transport accept any TLS certificate
+func skipVerify(transport *http.Transport) {
+	config := &tls.Config{}
+	if transport.TLSClientConfig != nil {
+		config = transport.TLSClientConfig.Clone()
+	}
+	config.InsecureSkipVerify = true
+	transport.TLSClientConfig = config
+}
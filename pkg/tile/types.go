@@ -1,5 +1,12 @@
 package tile
 
+import (
+	"image/color"
+	"log/slog"
+	"net/url"
+	"time"
+)
+
 // Output format constants
 const (
 	OUTFMT_PNG = iota
@@ -21,7 +28,47 @@ type StitchOptions struct {
 	Centered       bool
 	Format         int
 	WriteWorldFile bool
+	WriteVRT       bool // write a GDAL VRT referencing Output next to it
 	UserAgent      string
+	DebugDump      bool  // dump request/response headers of the first tile
+	NoKeepAlive    bool  // open a new connection for every tile request
+	Timeout        time.Duration // per tile request; 0 uses DefaultTimeout, negative disables it
+	Retries        int           // retries of tiles that failed transiently (network errors, 429, 5xx)
+	Force          bool  // write to stdout even when it's a terminal
+	MaxPixels      int64 // output size limit; 0 uses the default of 10000x10000
+	Stats          bool  // write per-channel statistics and histograms as JSON
+	AlphaMask      bool  // write the alpha channel as a separate grayscale PNG
+	Background     color.RGBA // fill for transparent areas; the zero value keeps them transparent
+	VerifyOutput   bool       // re-decode the encoded image before writing it
+	CacheDir       string     // reuse tiles downloaded by an earlier, interrupted run
+	CacheTTL       time.Duration // revalidate cached tiles older than this; 0 never does
+	DryRun         bool       // print the tile URLs to stdout instead of stitching
+	Progress       string     // progress output on stderr: text (default), json or none
+	Method         string     // tile request method: GET (default) or POST
+	Body           string     // request body template with the same placeholders as the URL; requires POST
+	Metadata       string     // write JSON metadata to this path; MetadataAuto puts it next to Output
+	Headers        map[string]string // extra HTTP headers for every tile request
+	BasicAuth      string            // "user:password" sent as Basic Authorization; overrides one in Headers
+	BearerToken    string            // sent as Bearer Authorization; overrides one in Headers
+	Referer        string            // Referer for tile requests; overrides one in Headers
+	Origin         string            // Origin for tile requests; overrides one in Headers
+	Proxy          *url.URL          // route tile requests through this proxy; nil uses HTTP_PROXY and HTTPS_PROXY
+	Insecure       bool              // accept any TLS certificate of tile servers
+	GeoJSON        string            // write the GeoJSON footprint of the image to this path
+	Grid           bool              // draw tile boundaries over the image for debugging seams
+	GridColor      color.RGBA        // color of the tile grid; the zero value uses DefaultGridColor
+	GridLabels     bool              // label every tile of the grid with z/x/y
+	ScaleBar       bool              // draw a scale bar for the center latitude in the bottom-left corner
+	NorthArrow     bool              // draw a north arrow in the top-right corner
+	DPI            int               // resolution declared in the PNG; 0 leaves it out
+	CropToTiles    bool              // keep every tile the area reaches into whole instead of cropping to the area
+	Logger         *slog.Logger      // receives the stitch parameters and tile failures; nil discards them
+
+	// The stitch fails when more than MaxFailureRatio of the tiles fail
+	// or more than MaxFailedTiles do; 0 allows no failed tile at all and
+	// nil doesn't limit failures
+	MaxFailureRatio *float64
+	MaxFailedTiles  *int
 }
 
 // BoundingBox represents geographic bounds
@@ -29,6 +76,12 @@ type BoundingBox struct {
 	MinLat, MinLon, MaxLat, MaxLon float64
 }
 
+// TileRange is an inclusive range of tile coordinates at one zoom level
+type TileRange struct {
+	Zoom                   int
+	MinX, MinY, MaxX, MaxY uint32
+}
+
 // CenteredRequest represents a centered tile request
 type CenteredRequest struct {
 	Lat, Lon          float64
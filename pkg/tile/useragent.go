@@ -0,0 +1,48 @@
+package tile
+
+import "strings"
+
+// DefaultUserAgent is sent with tile requests when no User-Agent is
+// configured. It names the software but not who runs it, which some tile
+// providers require (see UserAgentWarning).
+const DefaultUserAgent = "stitch/2.0.0 (+https://github.com/kiesman99/stitch)"
+
+// descriptiveUserAgentHosts are tile hosts whose usage policy bans generic
+// User-Agents; subdomains are included
+var descriptiveUserAgentHosts = []string{"tile.openstreetmap.org"}
+
+// UserAgentWarning returns a warning when a URL template targets a host that
+// requires a descriptive User-Agent while userAgent is empty or the default,
+// and an empty string otherwise
+func UserAgentWarning(template, userAgent string) string {
+	if userAgent != "" && userAgent != DefaultUserAgent {
+		return ""
+	}
+
+	host := templateHost(template)
+	for _, h := range descriptiveUserAgentHosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return host + " requires a User-Agent identifying your application and a contact; set one instead of the default"
+		}
+	}
+	return ""
+}
+
+// templateHost returns the lowercased host of a URL template without port.
+// url.Parse rejects placeholders like {s} in the host, so it isn't used.
+func templateHost(template string) string {
+	host := template
+	if i := strings.Index(host, "://"); i != -1 {
+		host = host[i+3:]
+	}
+	if i := strings.IndexAny(host, "/?#"); i != -1 {
+		host = host[:i]
+	}
+	if i := strings.LastIndex(host, "@"); i != -1 {
+		host = host[i+1:]
+	}
+	if i := strings.LastIndex(host, ":"); i != -1 && !strings.Contains(host[i:], "]") {
+		host = host[:i]
+	}
+	return strings.ToLower(host)
+}
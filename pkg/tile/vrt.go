@@ -0,0 +1,72 @@
+package tile
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// vrtBands are the color interpretations of the RGBA bands of a stitched PNG
+var vrtBands = []string{"Red", "Green", "Blue", "Alpha"}
+
+// VRT returns a GDAL Virtual Raster describing the width x height RGBA image
+// at source, georeferenced by the pixel size and upper-left corner in the
+// coordinate system with EPSG code crs. A relative source is resolved
+// against the directory of the VRT file.
+func VRT(source string, width, height int, px, py, minx, maxy float64, crs int) []byte {
+	relative := 1
+	if filepath.IsAbs(source) {
+		relative = 0
+	}
+
+	var escaped bytes.Buffer
+	xml.EscapeText(&escaped, []byte(source))
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<VRTDataset rasterXSize=\"%d\" rasterYSize=\"%d\">\n", width, height)
+	fmt.Fprintf(&buf, "  <SRS dataAxisToSRSAxisMapping=\"1,2\">EPSG:%d</SRS>\n", crs)
+	fmt.Fprintf(&buf, "  <GeoTransform>%.10f, %.10f, %.10f, %.10f, %.10f, %.10f</GeoTransform>\n", minx, px, 0.0, maxy, 0.0, -py)
+	for i, color := range vrtBands {
+		fmt.Fprintf(&buf, "  <VRTRasterBand dataType=\"Byte\" band=\"%d\">\n", i+1)
+		fmt.Fprintf(&buf, "    <ColorInterp>%s</ColorInterp>\n", color)
+		fmt.Fprintf(&buf, "    <SimpleSource>\n")
+		fmt.Fprintf(&buf, "      <SourceFilename relativeToVRT=\"%d\">%s</SourceFilename>\n", relative, escaped.String())
+		fmt.Fprintf(&buf, "      <SourceBand>%d</SourceBand>\n", i+1)
+		fmt.Fprintf(&buf, "      <SrcRect xOff=\"0\" yOff=\"0\" xSize=\"%d\" ySize=\"%d\" />\n", width, height)
+		fmt.Fprintf(&buf, "      <DstRect xOff=\"0\" yOff=\"0\" xSize=\"%d\" ySize=\"%d\" />\n", width, height)
+		fmt.Fprintf(&buf, "    </SimpleSource>\n")
+		fmt.Fprintf(&buf, "  </VRTRasterBand>\n")
+	}
+	fmt.Fprintf(&buf, "</VRTDataset>\n")
+	return buf.Bytes()
+}
+
+// VRTFilename returns the VRT path for an output image, the image name with
+// its extension replaced by .vrt
+func VRTFilename(output string) string {
+	name := output
+	if idx := strings.LastIndex(name, "."); idx != -1 && !strings.ContainsAny(name[idx:], `/\`) {
+		name = name[:idx]
+	}
+	return name + ".vrt"
+}
+
+// WriteVRT writes a VRT referencing the Web Mercator image at output next to
+// it (see VRTFilename)
+func WriteVRT(output string, width, height int, px, py, minx, maxy float64) error {
+	if output == "" {
+		return fmt.Errorf("can't write a VRT when writing to stdout")
+	}
+
+	filename := VRTFilename(output)
+	data := VRT(filepath.Base(output), width, height, px, py, minx, maxy, 3857)
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(Log, "VRT written to '%s'.\n", filename)
+	return nil
+}